@@ -0,0 +1,249 @@
+package extract
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+var arMagic = []byte("!<arch>\n")
+
+// arHeader is the header of a member of an ar archive
+type arHeader struct {
+	Name    string
+	Mode    os.FileMode
+	Size    int64
+	ModTime time.Time
+}
+
+// arReader reads the members of an ar archive, in both the GNU and the BSD
+// variants. It works like tar.Reader: Next advances to the next member and
+// Read reads its content.
+type arReader struct {
+	r         io.Reader
+	remaining int64
+	padding   int64
+	longNames []byte
+}
+
+func newArReader(r io.Reader) (*arReader, error) {
+	magic := make([]byte, len(arMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return nil, errors.Annotatef(err, "Read ar magic")
+	}
+	if !bytes.Equal(magic, arMagic) {
+		return nil, errors.New("Not an ar archive")
+	}
+	return &arReader{r: r}, nil
+}
+
+// Next advances to the next member of the archive, skipping symbol tables.
+// It returns io.EOF at the end of the archive.
+func (ar *arReader) Next() (*arHeader, error) {
+	for {
+		// Skip the unread part of the current member and the padding
+		if _, err := io.CopyN(io.Discard, ar.r, ar.remaining+ar.padding); err != nil {
+			return nil, errors.Annotatef(err, "Skip ar member")
+		}
+		ar.remaining, ar.padding = 0, 0
+
+		var raw [60]byte
+		if n, err := io.ReadFull(ar.r, raw[:]); err == io.EOF || (err == io.ErrUnexpectedEOF && n == 1 && raw[0] == '\n') {
+			// Some writers leave a stray padding byte at the end of the archive
+			return nil, io.EOF
+		} else if err != nil {
+			return nil, errors.Annotatef(err, "Read ar header")
+		}
+		if raw[58] != '`' || raw[59] != '\n' {
+			return nil, errors.New("Invalid ar header")
+		}
+
+		name := strings.TrimRight(string(raw[0:16]), " ")
+		size, err := strconv.ParseInt(strings.TrimSpace(string(raw[48:58])), 10, 64)
+		if err != nil || size < 0 {
+			return nil, errors.Errorf("Invalid size in ar header: %q", raw[48:58])
+		}
+		mode, err := strconv.ParseUint(strings.TrimSpace(string(raw[40:48])), 8, 32)
+		if err != nil {
+			mode = 0644
+		}
+		// Some writers leave the modification time empty
+		mtime, _ := strconv.ParseInt(strings.TrimSpace(string(raw[16:28])), 10, 64)
+		ar.remaining = size
+		ar.padding = size % 2
+
+		switch {
+		case name == "/" || name == "/SYM64/" || strings.HasPrefix(name, "__.SYMDEF"):
+			// GNU and BSD symbol tables
+			continue
+		case name == "//":
+			// GNU long names table
+			ar.longNames = make([]byte, size)
+			if _, err := io.ReadFull(ar, ar.longNames); err != nil {
+				return nil, errors.Annotatef(err, "Read ar long names table")
+			}
+			continue
+		case strings.HasPrefix(name, "#1/"):
+			// BSD long name, stored at the beginning of the data
+			n, err := strconv.ParseInt(name[3:], 10, 64)
+			if err != nil || n < 0 || n > size {
+				return nil, errors.Errorf("Invalid BSD long name in ar header: %q", name)
+			}
+			buf := make([]byte, n)
+			if _, err := io.ReadFull(ar, buf); err != nil {
+				return nil, errors.Annotatef(err, "Read ar long name")
+			}
+			name = string(bytes.TrimRight(buf, "\x00"))
+		case len(name) > 1 && name[0] == '/':
+			// GNU long name, stored in the long names table
+			offset, err := strconv.Atoi(name[1:])
+			if err != nil || offset < 0 || offset >= len(ar.longNames) {
+				return nil, errors.Errorf("Invalid GNU long name in ar header: %q", name)
+			}
+			name = string(ar.longNames[offset:])
+			if end := strings.Index(name, "\n"); end != -1 {
+				name = name[:end]
+			}
+			name = strings.TrimSuffix(name, "/")
+		default:
+			// GNU terminates short names with a slash
+			name = strings.TrimSuffix(name, "/")
+		}
+
+		return &arHeader{
+			Name:    name,
+			Mode:    unixMode(uint32(mode)) & (os.ModePerm | modeSpecial),
+			Size:    ar.remaining,
+			ModTime: time.Unix(mtime, 0),
+		}, nil
+	}
+}
+
+// Read reads from the current member of the archive.
+func (ar *arReader) Read(p []byte) (int, error) {
+	if ar.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > ar.remaining {
+		p = p[:ar.remaining]
+	}
+	n, err := ar.r.Read(p)
+	ar.remaining -= int64(n)
+	if err == io.EOF && ar.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// Ar extracts a .a or .ar archived stream of data in the specified location.
+// It accepts a rename function to handle the names of the files (see the example)
+func (e *Extractor) Ar(ctx context.Context, body io.Reader, location string, rename Renamer) error {
+	ar, err := newArReader(body)
+	if err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return errors.New("interrupted")
+		default:
+		}
+
+		header, err := ar.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Annotatef(err, "Read ar stream")
+		}
+
+		path := header.Name
+		if rename != nil {
+			path = rename(path)
+		}
+
+		if path == "" {
+			continue
+		}
+
+		if path, err = safeJoin(location, path); err != nil {
+			continue
+		}
+
+		e.modTime(path, header.ModTime)
+		e.fileSize(path, header.Size)
+		if err := e.copy(ctx, path, e.Modes.perm(header.Mode), ar); err != nil {
+			return errors.Annotatef(err, "Create file %s", path)
+		}
+	}
+
+	return nil
+}
+
+// Deb extracts a .deb package in the specified location, with the same layout of
+// `dpkg-deb --raw-extract`: the data files are extracted in the location and the
+// control files in the DEBIAN folder inside it.
+// It accepts a rename function to handle the names of the files (see the example)
+func (e *Extractor) Deb(ctx context.Context, body io.Reader, location string, rename Renamer) error {
+	return e.DebSplit(ctx, body, filepath.Join(location, "DEBIAN"), location, rename)
+}
+
+// DebSplit extracts the control files of a .deb package in the control location
+// and the data files in the data location. If one of the locations is empty the
+// corresponding part of the package is skipped.
+// The tarballs inside the package may be compressed with any of the supported formats.
+// It accepts a rename function to handle the names of the files (see the example)
+func (e *Extractor) DebSplit(ctx context.Context, body io.Reader, control, data string, rename Renamer) error {
+	ar, err := newArReader(body)
+	if err != nil {
+		return err
+	}
+
+	header, err := ar.Next()
+	if err != nil {
+		return errors.Annotatef(err, "Read deb package")
+	}
+	if header.Name != "debian-binary" {
+		return errors.New("Not a deb package: missing debian-binary")
+	}
+	version, err := io.ReadAll(ar)
+	if err != nil {
+		return errors.Annotatef(err, "Read deb package version")
+	}
+	if !bytes.HasPrefix(version, []byte("2.")) {
+		return errors.Errorf("Unsupported deb package version %q", bytes.TrimSpace(version))
+	}
+
+	for {
+		header, err := ar.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Annotatef(err, "Read deb package")
+		}
+
+		var location string
+		switch {
+		case strings.HasPrefix(header.Name, "control.tar"):
+			location = control
+		case strings.HasPrefix(header.Name, "data.tar"):
+			location = data
+		}
+		if location == "" {
+			continue
+		}
+
+		if err := e.Archive(ctx, ar, location, rename); err != nil {
+			return errors.Annotatef(err, "Extract %s", header.Name)
+		}
+	}
+}
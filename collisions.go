@@ -0,0 +1,163 @@
+package extract
+
+import (
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/juju/errors"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Folding is the set of the ways in which different paths can name the same
+// file on a volume.
+type Folding int
+
+const (
+	// FoldCase makes the paths differing only in case collide, as on the
+	// case-insensitive volumes of Windows and macOS.
+	FoldCase Folding = 1 << iota
+
+	// FoldUnicode makes the paths with the same Unicode normalization collide,
+	// such as the NFC and the NFD forms of the same name, as on macOS.
+	FoldUnicode
+)
+
+// CollisionAction is what an Extractor does with an entry whose path collides
+// with the one of a previous entry.
+type CollisionAction int
+
+const (
+	// CollisionError fails with an error caused by ErrCollision.
+	CollisionError CollisionAction = iota
+
+	// CollisionSkip skips the entry, and the ones inside it if it's a
+	// directory.
+	CollisionSkip
+
+	// CollisionRename extracts the entry with a number added to its name,
+	// like readme~1.txt, and the ones inside it if it's a directory in the
+	// renamed directory.
+	CollisionRename
+)
+
+// ErrCollision is the cause of the error returned when the path of an entry
+// collides with the one of a previous entry and the Extractor has
+// CollisionError as OnCollision.
+var ErrCollision = errors.New("Path collision")
+
+// collisions keeps track of the paths extracted from an archive to find the
+// colliding ones. A nil collisions finds none.
+type collisions struct {
+	location string
+	folding  Folding
+	action   CollisionAction
+	caser    cases.Caser
+
+	// seen has the paths extracted, relative to location, by their key
+	seen map[string]string
+	// renamed has the paths of the archive renamed or skipped ("") because of
+	// a collision
+	renamed map[string]string
+}
+
+// newCollisions returns the collisions of an extraction in location, or nil if
+// they aren't detected
+func (e *Extractor) newCollisions(location string) *collisions {
+	if e.Collisions == 0 {
+		return nil
+	}
+	return &collisions{
+		location: location,
+		folding:  e.Collisions,
+		action:   e.OnCollision,
+		caser:    cases.Fold(),
+		seen:     map[string]string{},
+		renamed:  map[string]string{},
+	}
+}
+
+// key returns the path that all the paths colliding with path have in common
+func (c *collisions) key(path string) string {
+	if c.folding&FoldUnicode != 0 {
+		path = norm.NFC.String(path)
+	}
+	if c.folding&FoldCase != 0 {
+		path = c.caser.String(path)
+	}
+	return path
+}
+
+// add returns where the entry at path is extracted, or false if it's skipped.
+func (c *collisions) add(path string) (string, bool, error) {
+	return c.resolve(path, true)
+}
+
+// lookup returns where the entry at path, such as the target of a hard link,
+// was extracted, or false if it was skipped.
+func (c *collisions) lookup(path string) (string, bool) {
+	path, ok, _ := c.resolve(path, false)
+	return path, ok
+}
+
+func (c *collisions) resolve(path string, add bool) (string, bool, error) {
+	if c == nil {
+		return path, true, nil
+	}
+	rel, err := filepath.Rel(c.location, path)
+	if err != nil || rel == "." {
+		return path, true, nil
+	}
+
+	// The parents can collide too, so the path is checked one name at a time
+	names := strings.Split(rel, string(filepath.Separator))
+	extracted := ""
+	for i, name := range names {
+		original := strings.Join(names[:i+1], string(filepath.Separator))
+		if renamed, ok := c.renamed[original]; ok {
+			if renamed == "" {
+				return "", false, nil
+			}
+			extracted = renamed
+			continue
+		}
+
+		candidate := filepath.Join(extracted, name)
+		key := c.key(candidate)
+		previous, ok := c.seen[key]
+		switch {
+		case ok && previous == candidate:
+		case !add:
+		case !ok:
+			c.seen[key] = candidate
+		case c.action == CollisionError:
+			return "", false, errors.Annotatef(ErrCollision, "Extract %s over %s", path, filepath.Join(c.location, previous))
+		case c.action == CollisionSkip:
+			c.renamed[original] = ""
+			return "", false, nil
+		default:
+			candidate = c.rename(candidate)
+			c.seen[c.key(candidate)] = candidate
+			c.renamed[original] = candidate
+		}
+		extracted = candidate
+	}
+	return filepath.Join(c.location, extracted), true, nil
+}
+
+// rename returns path with the first number that makes it not collide
+func (c *collisions) rename(path string) string {
+	dir, base := filepath.Split(path)
+	ext := filepath.Ext(base)
+	if ext == base {
+		ext = ""
+	}
+	base = strings.TrimSuffix(base, ext)
+	for i := 1; ; i++ {
+		candidate := dir + base + "~" + strconv.Itoa(i) + ext
+		if _, ok := c.seen[c.key(candidate)]; !ok {
+			return candidate
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package extract_test
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/codeclysm/extract/v5"
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCollisions(t *testing.T) {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	addFile := func(name, content string) {
+		tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))})
+		tw.Write([]byte(content))
+	}
+	addFile("README", "upper")
+	addFile("readme", "lower")
+	addFile("README", "upper again")
+	tw.WriteHeader(&tar.Header{Name: "link", Typeflag: tar.TypeLink, Linkname: "readme"})
+	tw.WriteHeader(&tar.Header{Name: "Dir/", Typeflag: tar.TypeDir, Mode: 0755})
+	addFile("Dir/a", "a")
+	addFile("dir/b", "b")
+	addFile("café", "nfc")
+	addFile("café", "nfd")
+	tw.Close()
+
+	extractWith := func(t *testing.T, folding extract.Folding, action extract.CollisionAction) (*extract.MemFS, error) {
+		mem := &extract.MemFS{}
+		extractor := extract.Extractor{FS: mem, Collisions: folding, OnCollision: action}
+		return mem, extractor.Tar(context.Background(), bytes.NewReader(buf.Bytes()), "/out", nil)
+	}
+	requireFile := func(t *testing.T, mem *extract.MemFS, path, content string) {
+		data, err := mem.ReadFile(path)
+		require.NoError(t, err)
+		require.Equal(t, content, string(data))
+	}
+	requireMissing := func(t *testing.T, mem *extract.MemFS, path string) {
+		_, err := mem.Lstat(path)
+		require.Error(t, err)
+	}
+
+	t.Run("Disabled", func(t *testing.T) {
+		mem, err := extractWith(t, 0, extract.CollisionError)
+		require.NoError(t, err)
+		requireFile(t, mem, "/out/readme", "lower")
+		requireFile(t, mem, "/out/dir/b", "b")
+	})
+
+	t.Run("Error", func(t *testing.T) {
+		_, err := extractWith(t, extract.FoldCase, extract.CollisionError)
+		require.Equal(t, extract.ErrCollision, errors.Cause(err))
+		require.ErrorContains(t, err, "/out/readme over /out/README")
+	})
+
+	t.Run("Skip", func(t *testing.T) {
+		mem, err := extractWith(t, extract.FoldCase, extract.CollisionSkip)
+		require.NoError(t, err)
+		requireFile(t, mem, "/out/README", "upper again")
+		requireMissing(t, mem, "/out/readme")
+		requireMissing(t, mem, "/out/link")
+		requireFile(t, mem, "/out/Dir/a", "a")
+		requireMissing(t, mem, "/out/dir")
+		requireFile(t, mem, "/out/café", "nfd")
+	})
+
+	t.Run("Rename", func(t *testing.T) {
+		mem, err := extractWith(t, extract.FoldCase|extract.FoldUnicode, extract.CollisionRename)
+		require.NoError(t, err)
+		requireFile(t, mem, "/out/README", "upper again")
+		requireFile(t, mem, "/out/readme~1", "lower")
+		requireFile(t, mem, "/out/link", "lower")
+		requireFile(t, mem, "/out/Dir/a", "a")
+		requireFile(t, mem, "/out/dir~1/b", "b")
+		requireFile(t, mem, "/out/café", "nfc")
+		requireFile(t, mem, "/out/café~1", "nfd")
+	})
+
+	t.Run("Zip", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		zw := zip.NewWriter(buf)
+		f, _ := zw.Create("docs/README.txt")
+		f.Write([]byte("upper"))
+		f, _ = zw.Create("Docs/readme.txt")
+		f.Write([]byte("lower"))
+		zw.Close()
+
+		for _, stream := range []bool{false, true} {
+			mem := &extract.MemFS{}
+			extractor := extract.Extractor{FS: mem, Collisions: extract.FoldCase, OnCollision: extract.CollisionRename, StreamZip: stream}
+			body := io.Reader(bytes.NewReader(buf.Bytes()))
+			if stream {
+				body = io.MultiReader(body)
+			}
+			require.NoError(t, extractor.Zip(context.Background(), body, "/out", nil))
+			requireFile(t, mem, "/out/docs/README.txt", "upper")
+			requireFile(t, mem, "/out/Docs~1/readme.txt", "lower")
+		}
+	})
+}
@@ -0,0 +1,442 @@
+package extract
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"context"
+	"io"
+	iofs "io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// Entry is an entry of the archive written by Convert.
+type Entry struct {
+	// Name is the slash separated path of the entry, without a leading slash.
+	Name string
+
+	// Mode is the type and the permissions of the entry, which is a directory,
+	// a symlink or a regular file.
+	Mode os.FileMode
+
+	// ModTime is the modification time, zero if the format doesn't store it.
+	ModTime time.Time
+
+	// Linkname is the target of a symlink, or the Name of the file a hard link
+	// refers to.
+	Linkname string
+
+	// HardLink tells that the entry is a hard link to the Linkname file. Its
+	// Mode is the one of a regular file.
+	HardLink bool
+
+	// Size is the size of the data of a regular file, or -1 if it's not known
+	// before the data is written.
+	Size int64
+}
+
+// ArchiveWriter writes the archive produced by Convert.
+type ArchiveWriter interface {
+	// Create adds an entry to the archive, returning the writer of its data if
+	// it's a regular file. Exactly Size bytes are written, if it's known.
+	Create(entry *Entry) (io.Writer, error)
+}
+
+// TarWriter is an ArchiveWriter writing a tar archive. Tar stores the size of the
+// files before their data, so a file whose size isn't known in advance is kept
+// in memory until it's complete.
+type TarWriter struct {
+	tw      *tar.Writer
+	pending *tar.Header
+	data    bytes.Buffer
+}
+
+// NewTarWriter returns a TarWriter writing on w.
+func NewTarWriter(w io.Writer) *TarWriter {
+	return &TarWriter{tw: tar.NewWriter(w)}
+}
+
+// Create adds an entry to the archive.
+func (t *TarWriter) Create(entry *Entry) (io.Writer, error) {
+	if err := t.flush(); err != nil {
+		return nil, err
+	}
+	header := &tar.Header{
+		Name:    entry.Name,
+		Mode:    int64(entry.Mode.Perm()),
+		ModTime: entry.ModTime,
+	}
+	if entry.ModTime.IsZero() {
+		header.ModTime = time.Unix(0, 0)
+	}
+	for _, bit := range []struct {
+		mode os.FileMode
+		tar  int64
+	}{{os.ModeSetuid, 04000}, {os.ModeSetgid, 02000}, {os.ModeSticky, 01000}} {
+		if entry.Mode&bit.mode != 0 {
+			header.Mode |= bit.tar
+		}
+	}
+
+	switch {
+	case entry.HardLink:
+		header.Typeflag, header.Linkname = tar.TypeLink, entry.Linkname
+	case entry.Mode&os.ModeSymlink != 0:
+		header.Typeflag, header.Linkname = tar.TypeSymlink, entry.Linkname
+	case entry.Mode.IsDir():
+		header.Typeflag, header.Name = tar.TypeDir, entry.Name+"/"
+	case entry.Size >= 0:
+		header.Typeflag, header.Size = tar.TypeReg, entry.Size
+		if err := t.tw.WriteHeader(header); err != nil {
+			return nil, err
+		}
+		return t.tw, nil
+	default:
+		header.Typeflag = tar.TypeReg
+		t.pending = header
+		return &t.data, nil
+	}
+	return nil, t.tw.WriteHeader(header)
+}
+
+// flush writes the file being created, if any
+func (t *TarWriter) flush() error {
+	if t.pending == nil {
+		return nil
+	}
+	header := t.pending
+	t.pending = nil
+	header.Size = int64(t.data.Len())
+	if err := t.tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := t.tw.Write(t.data.Bytes())
+	t.data.Reset()
+	return err
+}
+
+// Close writes the end of the archive, without closing the underlying writer.
+func (t *TarWriter) Close() error {
+	if err := t.flush(); err != nil {
+		return err
+	}
+	return t.tw.Close()
+}
+
+// ZipWriter is an ArchiveWriter writing a zip archive, with the files deflated.
+// Zip doesn't support hard links, so they're stored as symlinks.
+type ZipWriter struct {
+	zw *zip.Writer
+}
+
+// NewZipWriter returns a ZipWriter writing on w.
+func NewZipWriter(w io.Writer) *ZipWriter {
+	return &ZipWriter{zw: zip.NewWriter(w)}
+}
+
+// Create adds an entry to the archive.
+func (z *ZipWriter) Create(entry *Entry) (io.Writer, error) {
+	header := &zip.FileHeader{Name: entry.Name, Method: zip.Deflate, Modified: entry.ModTime}
+	header.SetMode(entry.Mode)
+
+	switch {
+	case entry.HardLink:
+		target, err := filepath.Rel(path.Dir(entry.Name), entry.Linkname)
+		if err != nil {
+			return nil, err
+		}
+		header.SetMode(os.ModeSymlink | 0777)
+		w, err := z.zw.CreateHeader(header)
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.WriteString(w, filepath.ToSlash(target))
+		return nil, err
+	case entry.Mode&os.ModeSymlink != 0:
+		w, err := z.zw.CreateHeader(header)
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.WriteString(w, entry.Linkname)
+		return nil, err
+	case entry.Mode.IsDir():
+		header.Name, header.Method = entry.Name+"/", zip.Store
+		_, err := z.zw.CreateHeader(header)
+		return nil, err
+	default:
+		return z.zw.CreateHeader(header)
+	}
+}
+
+// Close writes the central directory, without closing the underlying writer.
+func (z *ZipWriter) Close() error {
+	return z.zw.Close()
+}
+
+// Convert reads an archive in any of the formats supported by Archive and writes
+// its entries in w as they're read, without writing anything on the FS. The
+// modes, the symlinks, the hard links and, when the format stores them, the
+// modification times are preserved. A compressed file that isn't an archive is
+// written with its original name, like with KeepOriginalName.
+// The files are written one at a time, and the nested archives aren't extracted.
+// It accepts a rename function to handle the names of the files (see the example)
+func (e *Extractor) Convert(ctx context.Context, body io.Reader, w ArchiveWriter, rename Renamer) error {
+	fs := &convertFS{w: w, entries: map[string]os.FileMode{}, times: map[string]time.Time{}, sizes: map[string]int64{}}
+	converter := *e
+	converter.FS = fs
+	converter.Writers = 0
+	converter.StreamZip = false
+	converter.MaxDepth = 0
+	converter.KeepOriginalName = true
+	if err := converter.Archive(ctx, body, convertRoot, rename); err != nil {
+		return err
+	}
+	return fs.close()
+}
+
+// convertRoot is the location where the entries are extracted by Convert
+var convertRoot = string(filepath.Separator)
+
+// modTimeFS is implemented by the FS that need the modification times of the
+// entries before they're created, such as the one of Convert
+type modTimeFS interface {
+	setModTime(path string, mtime time.Time)
+}
+
+// modTime tells the FS the modification time of the entry that is going to be
+// created at path, if it needs it
+func (e *Extractor) modTime(path string, mtime time.Time) {
+	if fs, ok := e.FS.(modTimeFS); ok {
+		fs.setModTime(path, mtime)
+	}
+}
+
+// sizeFS is implemented by the FS that need the sizes of the files before
+// they're written, such as the one of Convert
+type sizeFS interface {
+	setSize(path string, size int64)
+}
+
+// fileSize tells the FS the size of the file that is going to be written at
+// path, if it needs it
+func (e *Extractor) fileSize(path string, size int64) {
+	if fs, ok := e.FS.(sizeFS); ok {
+		fs.setSize(path, size)
+	}
+}
+
+// convertFS is the FS of Convert, which writes the entries in an ArchiveWriter
+type convertFS struct {
+	w ArchiveWriter
+
+	mu      sync.Mutex
+	entries map[string]os.FileMode
+	times   map[string]time.Time
+	sizes   map[string]int64
+	// empty are the empty files, written at the end because they may be the
+	// placeholders of links
+	empty []*Entry
+}
+
+// name returns the name of the entry at path, empty for the root
+func (f *convertFS) name(path string) string {
+	return filepath.ToSlash(strings.TrimPrefix(strings.TrimPrefix(path, convertRoot), "/"))
+}
+
+func (f *convertFS) setModTime(path string, mtime time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.times[f.name(path)] = mtime
+}
+
+func (f *convertFS) setSize(path string, size int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sizes[f.name(path)] = size
+}
+
+// create adds an entry, replacing the empty file with the same name if any
+func (f *convertFS) create(entry *Entry) (io.Writer, error) {
+	f.dropEmpty(entry.Name)
+	if entry.ModTime.IsZero() {
+		entry.ModTime = f.times[entry.Name]
+	}
+	f.entries[entry.Name] = entry.Mode
+	return f.w.Create(entry)
+}
+
+// dropEmpty removes the empty file with the given name, returning it
+func (f *convertFS) dropEmpty(name string) *Entry {
+	for i, entry := range f.empty {
+		if entry.Name == name {
+			f.empty = append(f.empty[:i], f.empty[i+1:]...)
+			return entry
+		}
+	}
+	return nil
+}
+
+func (f *convertFS) emptyFile(name string) *Entry {
+	for _, entry := range f.empty {
+		if entry.Name == name {
+			return entry
+		}
+	}
+	return nil
+}
+
+func (f *convertFS) Link(oldname, newname string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	target, name := f.name(oldname), f.name(newname)
+	if entry := f.dropEmpty(target); entry != nil {
+		// The target must be written before the link
+		if _, err := f.create(entry); err != nil {
+			return err
+		}
+	}
+	mode, ok := f.entries[target]
+	if !ok {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: iofs.ErrNotExist}
+	}
+	_, err := f.create(&Entry{Name: name, Mode: mode, Linkname: target, HardLink: true})
+	return err
+}
+
+func (f *convertFS) MkdirAll(path string, perm os.FileMode) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	name := f.name(path)
+	if name == "" {
+		return nil
+	}
+	parts := strings.Split(name, "/")
+	for i := range parts {
+		dir := strings.Join(parts[:i+1], "/")
+		if mode, ok := f.entries[dir]; ok {
+			if !mode.IsDir() {
+				return &os.PathError{Op: "mkdir", Path: path, Err: syscall.ENOTDIR}
+			}
+			continue
+		}
+		if _, err := f.create(&Entry{Name: dir, Mode: os.ModeDir | perm&(os.ModePerm|modeSpecial)}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *convertFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	entry := &Entry{Name: f.name(name), Mode: perm & (os.ModePerm | modeSpecial), Size: -1}
+	if entry.Name == "" {
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+	}
+	if size, ok := f.sizes[entry.Name]; ok {
+		entry.Size = size
+		delete(f.sizes, entry.Name)
+	}
+	return &convertFile{fs: f, entry: entry}, nil
+}
+
+func (f *convertFS) Symlink(oldname, newname string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, err := f.create(&Entry{Name: f.name(newname), Mode: os.ModeSymlink | 0777, Linkname: filepath.ToSlash(oldname)})
+	return err
+}
+
+// Remove removes the empty files not written yet, the other entries are already
+// in the archive
+func (f *convertFS) Remove(path string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	name := f.name(path)
+	if _, ok := f.entries[name]; !ok {
+		return &os.PathError{Op: "remove", Path: path, Err: iofs.ErrNotExist}
+	}
+	f.dropEmpty(name)
+	delete(f.entries, name)
+	return nil
+}
+
+func (f *convertFS) Stat(path string) (os.FileInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	name := f.name(path)
+	if name == "" {
+		return &memInfo{name: "/", mode: os.ModeDir | 0755}, nil
+	}
+	mode, ok := f.entries[name]
+	if !ok {
+		return nil, &os.PathError{Op: "stat", Path: path, Err: iofs.ErrNotExist}
+	}
+	return &memInfo{name: filepath.Base(path), mode: mode, modTime: f.times[name]}, nil
+}
+
+// Chmod changes the mode of the empty files not written yet
+func (f *convertFS) Chmod(path string, mode os.FileMode) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if entry := f.emptyFile(f.name(path)); entry != nil {
+		entry.Mode = entry.Mode.Type() | mode&(os.ModePerm|modeSpecial)
+	}
+	return nil
+}
+
+// close writes the empty files
+func (f *convertFS) close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, entry := range f.empty {
+		if _, err := f.w.Create(entry); err != nil {
+			return err
+		}
+	}
+	f.empty = nil
+	return nil
+}
+
+// convertFile is a file being written by Convert. The entry is created when its
+// first data arrives, or at the end if it's empty.
+type convertFile struct {
+	fs    *convertFS
+	entry *Entry
+	w     io.Writer
+}
+
+func (c *convertFile) Write(p []byte) (int, error) {
+	if c.w == nil {
+		c.fs.mu.Lock()
+		w, err := c.fs.create(c.entry)
+		c.fs.mu.Unlock()
+		if err != nil {
+			return 0, errors.Annotatef(err, "Write %s", c.entry.Name)
+		}
+		c.w = w
+	}
+	return c.w.Write(p)
+}
+
+func (c *convertFile) Close() error {
+	if c.w != nil {
+		return nil
+	}
+	c.fs.mu.Lock()
+	defer c.fs.mu.Unlock()
+	c.fs.dropEmpty(c.entry.Name)
+	c.entry.ModTime = c.fs.times[c.entry.Name]
+	c.entry.Size = 0
+	c.fs.entries[c.entry.Name] = c.entry.Mode
+	c.fs.empty = append(c.fs.empty, c.entry)
+	return nil
+}
@@ -0,0 +1,183 @@
+package extract_test
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codeclysm/extract/v5"
+	"github.com/stretchr/testify/require"
+)
+
+// readTar returns the headers of a tar archive and the content of its files
+func readTar(t *testing.T, archive []byte) ([]*tar.Header, map[string]string) {
+	headers, contents := []*tar.Header{}, map[string]string{}
+	tr := tar.NewReader(bytes.NewReader(archive))
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return headers, contents
+		}
+		require.NoError(t, err)
+		data, err := io.ReadAll(tr)
+		require.NoError(t, err)
+		headers = append(headers, header)
+		contents[header.Name] = string(data)
+	}
+}
+
+// sizeRecorder records the sizes of the files created by Convert
+type sizeRecorder struct {
+	extract.ArchiveWriter
+	sizes map[string]int64
+}
+
+func (s *sizeRecorder) Create(entry *extract.Entry) (io.Writer, error) {
+	s.sizes[entry.Name] = entry.Size
+	return s.ArchiveWriter.Create(entry)
+}
+
+func TestConvert(t *testing.T) {
+	mtime := time.Date(2020, 5, 4, 3, 2, 0, 0, time.UTC)
+
+	t.Run("ZipToTar", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		zw := zip.NewWriter(buf)
+		header := &zip.FileHeader{Name: "dir/", Modified: mtime}
+		header.SetMode(os.ModeDir | os.ModeSticky | 0750)
+		zw.CreateHeader(header)
+		header = &zip.FileHeader{Name: "dir/run.sh", Method: zip.Deflate, Modified: mtime}
+		header.SetMode(os.ModeSetuid | 0755)
+		f, _ := zw.CreateHeader(header)
+		f.Write([]byte("#!/bin/sh"))
+		header = &zip.FileHeader{Name: "dir/link", Modified: mtime}
+		header.SetMode(os.ModeSymlink | 0777)
+		f, _ = zw.CreateHeader(header)
+		f.Write([]byte("run.sh"))
+		f, _ = zw.Create("skipped.txt")
+		f.Write([]byte("Skipped"))
+		zw.Close()
+
+		out := &bytes.Buffer{}
+		tw := extract.NewTarWriter(out)
+		rename := func(name string) string {
+			if strings.HasPrefix(name, "skipped") {
+				return ""
+			}
+			return name
+		}
+		require.NoError(t, extract.Convert(context.Background(), buf, tw, rename))
+		require.NoError(t, tw.Close())
+
+		headers, contents := readTar(t, out.Bytes())
+		require.Len(t, headers, 3)
+		require.Equal(t, "dir/", headers[0].Name)
+		require.Equal(t, byte(tar.TypeDir), headers[0].Typeflag)
+		require.Equal(t, int64(01750), headers[0].Mode)
+		require.Equal(t, "dir/run.sh", headers[1].Name)
+		require.Equal(t, int64(04755), headers[1].Mode)
+		require.True(t, headers[1].ModTime.Equal(mtime))
+		require.Equal(t, "#!/bin/sh", contents["dir/run.sh"])
+		require.Equal(t, "dir/link", headers[2].Name)
+		require.Equal(t, byte(tar.TypeSymlink), headers[2].Typeflag)
+		require.Equal(t, "run.sh", headers[2].Linkname)
+		require.True(t, headers[2].ModTime.Equal(mtime))
+	})
+
+	t.Run("TarToZip", func(t *testing.T) {
+		f, err := os.Open("testdata/archive.tar.gz")
+		require.NoError(t, err)
+		defer f.Close()
+		out := &bytes.Buffer{}
+		zw := extract.NewZipWriter(out)
+		require.NoError(t, extract.Convert(context.Background(), f, zw, nil))
+		require.NoError(t, zw.Close())
+
+		// The hard link becomes a symlink
+		mem := &extract.MemFS{}
+		extractor := extract.Extractor{FS: mem}
+		require.NoError(t, extractor.Zip(context.Background(), bytes.NewReader(out.Bytes()), "/", nil))
+		data, err := mem.ReadFile("/archive/link.txt")
+		require.NoError(t, err)
+		require.Equal(t, "File1\n", string(data))
+		target, err := mem.Readlink("/archive/link.txt")
+		require.NoError(t, err)
+		require.Equal(t, "file1.txt", target)
+		target, err = mem.Readlink("/archive/folderlink")
+		require.NoError(t, err)
+		require.Equal(t, "archive/folder", target)
+		info, err := mem.Stat("/archive/file2.txt")
+		require.NoError(t, err)
+		require.Equal(t, os.FileMode(0664), info.Mode())
+
+		archive, err := zip.NewReader(bytes.NewReader(out.Bytes()), int64(out.Len()))
+		require.NoError(t, err)
+		for _, file := range archive.File {
+			require.Equal(t, 2016, file.Modified.Year(), file.Name)
+		}
+	})
+
+	t.Run("CompressedFile", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		gw := gzip.NewWriter(buf)
+		gw.Name = "notes.txt"
+		gw.ModTime = mtime
+		gw.Write([]byte("Notes"))
+		gw.Close()
+
+		out := &bytes.Buffer{}
+		tw := extract.NewTarWriter(out)
+		require.NoError(t, extract.Convert(context.Background(), buf, tw, nil))
+		require.NoError(t, tw.Close())
+		headers, contents := readTar(t, out.Bytes())
+		require.Len(t, headers, 1)
+		require.Equal(t, "notes.txt", headers[0].Name)
+		require.True(t, headers[0].ModTime.Equal(mtime))
+		require.Equal(t, "Notes", contents["notes.txt"])
+	})
+
+	t.Run("ImagesToTar", func(t *testing.T) {
+		for _, test := range []struct {
+			name  string
+			image []byte
+			mtime time.Time
+		}{
+			{"Iso", makeIso(testIsoTree(), true, false), isoModTime},
+			{"Squashfs", makeSquashfs(testSquashfsTree(), 1, func([]byte) []byte { return nil }), squashfsModTime},
+		} {
+			t.Run(test.name, func(t *testing.T) {
+				out := &bytes.Buffer{}
+				w := &sizeRecorder{ArchiveWriter: extract.NewTarWriter(out), sizes: map[string]int64{}}
+				require.NoError(t, extract.Convert(context.Background(), bytes.NewReader(test.image), w, nil))
+				require.NoError(t, w.ArchiveWriter.(*extract.TarWriter).Close())
+
+				headers, contents := readTar(t, out.Bytes())
+				require.NotEmpty(t, headers)
+				for _, header := range headers {
+					require.True(t, header.ModTime.Equal(test.mtime), header.Name)
+					if header.Typeflag == tar.TypeReg {
+						// The size is known before the data
+						require.Equal(t, int64(len(contents[header.Name])), w.sizes[header.Name], header.Name)
+					}
+				}
+			})
+		}
+	})
+
+	t.Run("Empty", func(t *testing.T) {
+		files := map[string]string{"empty.txt": "", "full.txt": "Full"}
+		out := &bytes.Buffer{}
+		tw := extract.NewTarWriter(out)
+		require.NoError(t, extract.Convert(context.Background(), bytes.NewReader(makeZip(files)), tw, nil))
+		require.NoError(t, tw.Close())
+		_, contents := readTar(t, out.Bytes())
+		require.Equal(t, files, contents)
+	})
+}
@@ -0,0 +1,299 @@
+package extract
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// cpioHeader is the header of an entry of a cpio archive
+type cpioHeader struct {
+	Name    string
+	Mode    os.FileMode
+	Size    int64
+	Dev     uint64
+	Ino     uint64
+	Nlink   uint64
+	ModTime time.Time
+}
+
+// cpioReader reads the entries of a cpio archive in the "new ASCII" (newc), "crc"
+// and "portable ASCII" (odc) formats. It works like tar.Reader: Next advances to
+// the next entry and Read reads its content.
+type cpioReader struct {
+	r         io.Reader
+	remaining int64
+	padding   int64
+	align     int64
+}
+
+func newCpioReader(r io.Reader) *cpioReader {
+	return &cpioReader{r: r}
+}
+
+// Next advances to the next entry of the archive. It returns io.EOF at the end
+// of the archive.
+func (cr *cpioReader) Next() (*cpioHeader, error) {
+	// Skip the unread part of the current entry and the padding
+	if _, err := io.CopyN(io.Discard, cr.r, cr.remaining+cr.padding); err != nil {
+		return nil, errors.Annotatef(err, "Skip cpio entry")
+	}
+	cr.remaining, cr.padding = 0, 0
+
+	magic := make([]byte, 6)
+	if _, err := io.ReadFull(cr.r, magic); err != nil {
+		return nil, errors.Annotatef(err, "Read cpio header")
+	}
+
+	var header *cpioHeader
+	var nameSize int64
+	var err error
+	switch string(magic) {
+	case "070701", "070702":
+		header, nameSize, err = cr.readNewcHeader()
+		cr.align = 4
+	case "070707":
+		header, nameSize, err = cr.readOdcHeader()
+		cr.align = 1
+	default:
+		return nil, errors.Errorf("Invalid cpio magic %q", magic)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	name := make([]byte, nameSize)
+	if _, err := io.ReadFull(cr.r, name); err != nil {
+		return nil, errors.Annotatef(err, "Read cpio entry name")
+	}
+	header.Name = string(bytes.TrimRight(name, "\x00"))
+	if header.Name == "TRAILER!!!" {
+		return nil, io.EOF
+	}
+
+	// In the newc format both the header and the data are aligned to 4 bytes
+	headerSize := int64(110) + nameSize
+	if _, err := io.CopyN(io.Discard, cr.r, cr.pad(headerSize)); err != nil {
+		return nil, errors.Annotatef(err, "Read cpio header")
+	}
+	cr.remaining = header.Size
+	cr.padding = cr.pad(header.Size)
+	return header, nil
+}
+
+func (cr *cpioReader) pad(n int64) int64 {
+	return (cr.align - n%cr.align) % cr.align
+}
+
+func (cr *cpioReader) readNewcHeader() (*cpioHeader, int64, error) {
+	raw := make([]byte, 104)
+	if _, err := io.ReadFull(cr.r, raw); err != nil {
+		return nil, 0, errors.Annotatef(err, "Read cpio header")
+	}
+	var fields [13]uint64
+	for i := range fields {
+		v, err := strconv.ParseUint(string(raw[i*8:i*8+8]), 16, 32)
+		if err != nil {
+			return nil, 0, errors.Errorf("Invalid cpio header field %q", raw[i*8:i*8+8])
+		}
+		fields[i] = v
+	}
+	return &cpioHeader{
+		Ino:     fields[0],
+		Mode:    unixMode(uint32(fields[1])),
+		Nlink:   fields[4],
+		ModTime: time.Unix(int64(fields[5]), 0),
+		Size:    int64(fields[6]),
+		Dev:     fields[7]<<32 | fields[8],
+	}, int64(fields[11]), nil
+}
+
+func (cr *cpioReader) readOdcHeader() (*cpioHeader, int64, error) {
+	raw := make([]byte, 70)
+	if _, err := io.ReadFull(cr.r, raw); err != nil {
+		return nil, 0, errors.Annotatef(err, "Read cpio header")
+	}
+	field := func(start, size int) (uint64, error) {
+		v, err := strconv.ParseUint(string(raw[start:start+size]), 8, 64)
+		if err != nil {
+			return 0, errors.Errorf("Invalid cpio header field %q", raw[start:start+size])
+		}
+		return v, nil
+	}
+	// dev(6) ino(6) mode(6) uid(6) gid(6) nlink(6) rdev(6) mtime(11) namesize(6) filesize(11)
+	var values [6]uint64
+	for i, f := range [][2]int{{0, 6}, {6, 6}, {12, 6}, {30, 6}, {53, 6}, {42, 11}} {
+		v, err := field(f[0], f[1])
+		if err != nil {
+			return nil, 0, err
+		}
+		values[i] = v
+	}
+	size, err := field(59, 11)
+	if err != nil {
+		return nil, 0, err
+	}
+	return &cpioHeader{
+		Dev:     values[0],
+		Ino:     values[1],
+		Mode:    unixMode(uint32(values[2])),
+		Nlink:   values[3],
+		ModTime: time.Unix(int64(values[5]), 0),
+		Size:    int64(size),
+	}, int64(values[4]), nil
+}
+
+// Read reads from the current entry of the archive.
+func (cr *cpioReader) Read(p []byte) (int, error) {
+	if cr.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > cr.remaining {
+		p = p[:cr.remaining]
+	}
+	n, err := cr.r.Read(p)
+	cr.remaining -= int64(n)
+	if err == io.EOF && cr.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// unixMode converts the st_mode of a unix file into an os.FileMode
+func unixMode(mode uint32) os.FileMode {
+	res := os.FileMode(mode & 0777)
+	switch mode & 0170000 {
+	case 0040000:
+		res |= os.ModeDir
+	case 0120000:
+		res |= os.ModeSymlink
+	case 0020000:
+		res |= os.ModeDevice | os.ModeCharDevice
+	case 0060000:
+		res |= os.ModeDevice
+	case 0010000:
+		res |= os.ModeNamedPipe
+	case 0140000:
+		res |= os.ModeSocket
+	}
+	if mode&04000 != 0 {
+		res |= os.ModeSetuid
+	}
+	if mode&02000 != 0 {
+		res |= os.ModeSetgid
+	}
+	if mode&01000 != 0 {
+		res |= os.ModeSticky
+	}
+	return res
+}
+
+// Cpio extracts a .cpio archived stream of data in the specified location.
+// It accepts a rename function to handle the names of the files (see the example)
+func (e *Extractor) Cpio(ctx context.Context, body io.Reader, location string, rename Renamer) error {
+	type inode struct{ dev, ino uint64 }
+	hardlinks := map[inode][]string{}
+	contents := map[inode]string{}
+	order := []inode{}
+	symlinks := []*link{}
+
+	cr := newCpioReader(body)
+	for {
+		select {
+		case <-ctx.Done():
+			return errors.New("interrupted")
+		default:
+		}
+
+		header, err := cr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Annotatef(err, "Read cpio stream")
+		}
+
+		path := header.Name
+		if rename != nil {
+			path = rename(path)
+		}
+
+		if path == "" {
+			continue
+		}
+
+		if path, err = safeJoin(location, path); err != nil {
+			continue
+		}
+		e.modTime(path, header.ModTime)
+		e.fileSize(path, header.Size)
+
+		switch {
+		case header.Mode.IsDir():
+			if err := e.FS.MkdirAll(path, e.Modes.perm(header.Mode)); err != nil {
+				return errors.Annotatef(err, "Create directory %s", path)
+			}
+		case header.Mode&os.ModeSymlink != 0:
+			name, err := io.ReadAll(cr)
+			if err != nil {
+				return errors.Annotatef(err, "Read address of link %s", path)
+			}
+			symlinks = append(symlinks, &link{Path: path, Name: string(name)})
+		case header.Mode.IsRegular():
+			if header.Nlink > 1 {
+				// Hard linked files are stored multiple times, only one of them
+				// (usually the last) with the actual content
+				key := inode{header.Dev, header.Ino}
+				if _, ok := hardlinks[key]; !ok {
+					order = append(order, key)
+				}
+				hardlinks[key] = append(hardlinks[key], path)
+				if header.Size == 0 {
+					continue
+				}
+				contents[key] = path
+			}
+			if err := e.copy(ctx, path, e.Modes.perm(header.Mode), cr); err != nil {
+				return errors.Annotatef(err, "Create file %s", path)
+			}
+		}
+	}
+
+	// Now we make another pass creating the hard links
+	for _, key := range order {
+		select {
+		case <-ctx.Done():
+			return errors.New("interrupted")
+		default:
+		}
+
+		target, ok := contents[key]
+		if !ok {
+			// All the links are empty files
+			target = hardlinks[key][0]
+			if err := e.copy(ctx, target, 0666, bytes.NewReader(nil)); err != nil {
+				return errors.Annotatef(err, "Create file %s", target)
+			}
+		}
+		for _, path := range hardlinks[key] {
+			if path == target {
+				continue
+			}
+			_ = e.FS.Remove(path)
+			if err := e.FS.Link(target, path); err != nil {
+				return errors.Annotatef(err, "Create link %s", path)
+			}
+		}
+	}
+
+	if err := e.extractSymlinks(ctx, location, symlinks); err != nil {
+		return err
+	}
+
+	return nil
+}
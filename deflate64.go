@@ -0,0 +1,341 @@
+package extract
+
+import (
+	"bufio"
+	"io"
+
+	"github.com/juju/errors"
+)
+
+// Deflate64 (or enhanced deflate) is deflate with a window of 64KiB, two more
+// distance codes and the last length code with 16 extra bits
+var (
+	deflate64LengthBase  = [29]int{3, 4, 5, 6, 7, 8, 9, 10, 11, 13, 15, 17, 19, 23, 27, 31, 35, 43, 51, 59, 67, 83, 99, 115, 131, 163, 195, 227, 3}
+	deflate64LengthExtra = [29]uint{0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 2, 2, 3, 3, 3, 3, 4, 4, 4, 4, 5, 5, 5, 5, 16}
+	deflate64DistBase    = [32]int{1, 2, 3, 4, 5, 7, 9, 13, 17, 25, 33, 49, 65, 97, 129, 193, 257, 385, 513, 769, 1025, 1537, 2049, 3073, 4097, 6145, 8193, 12289, 16385, 24577, 32769, 49153}
+	deflate64DistExtra   = [32]uint{0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 6, 7, 7, 8, 8, 9, 9, 10, 10, 11, 11, 12, 12, 13, 13, 14, 14}
+	deflateCodeOrder     = [19]int{16, 17, 18, 0, 8, 7, 9, 6, 10, 5, 11, 4, 12, 3, 13, 2, 14, 1, 15}
+)
+
+const deflate64Window = 1 << 16
+
+const (
+	deflateStateHeader = iota
+	deflateStateStored
+	deflateStateHuffman
+)
+
+var errCorruptDeflate64 = errors.New("Corrupted deflate64 data")
+
+// huffman is a canonical huffman code, stored as the number of codes for every
+// length and the symbols ordered by code
+type huffman struct {
+	counts  [16]int
+	symbols []int
+}
+
+func newHuffman(lengths []uint8) (*huffman, error) {
+	h := &huffman{symbols: make([]int, len(lengths))}
+	for _, length := range lengths {
+		h.counts[length]++
+	}
+	// Check that the code isn't over-subscribed
+	left := 1
+	for length := 1; length < 16; length++ {
+		left = left<<1 - h.counts[length]
+		if left < 0 {
+			return nil, errCorruptDeflate64
+		}
+	}
+	offsets := [16]int{}
+	for length := 1; length < 15; length++ {
+		offsets[length+1] = offsets[length] + h.counts[length]
+	}
+	for symbol, length := range lengths {
+		if length != 0 {
+			h.symbols[offsets[length]] = symbol
+			offsets[length]++
+		}
+	}
+	return h, nil
+}
+
+// deflate64Reader decompresses a deflate64 stream
+type deflate64Reader struct {
+	r     io.ByteReader
+	bits  uint32
+	nbits uint
+
+	window [deflate64Window]byte
+	pos    int
+	total  int
+
+	state     int
+	final     bool
+	stored    int
+	lit, dist *huffman
+
+	buf, out []byte
+	err      error
+}
+
+func newDeflate64Reader(r io.Reader) io.Reader {
+	byteReader, ok := r.(io.ByteReader)
+	if !ok {
+		byteReader = bufio.NewReader(r)
+	}
+	return &deflate64Reader{r: byteReader}
+}
+
+func (d *deflate64Reader) Read(p []byte) (int, error) {
+	for len(d.out) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+		d.err = d.step()
+		d.out = d.buf
+	}
+	n := copy(p, d.out)
+	d.out = d.out[n:]
+	return n, nil
+}
+
+func (d *deflate64Reader) getBits(n uint) (int, error) {
+	for d.nbits < n {
+		b, err := d.r.ReadByte()
+		if err == io.EOF {
+			return 0, io.ErrUnexpectedEOF
+		} else if err != nil {
+			return 0, err
+		}
+		d.bits |= uint32(b) << d.nbits
+		d.nbits += 8
+	}
+	v := d.bits & (1<<n - 1)
+	d.bits >>= n
+	d.nbits -= n
+	return int(v), nil
+}
+
+// decode reads a symbol one bit at a time
+func (d *deflate64Reader) decode(h *huffman) (int, error) {
+	code, first, index := 0, 0, 0
+	for length := 1; length < 16; length++ {
+		bit, err := d.getBits(1)
+		if err != nil {
+			return 0, err
+		}
+		code |= bit
+		count := h.counts[length]
+		if code-count < first {
+			return h.symbols[index+code-first], nil
+		}
+		index += count
+		first = (first + count) << 1
+		code <<= 1
+	}
+	return 0, errCorruptDeflate64
+}
+
+func (d *deflate64Reader) emit(b byte) {
+	d.window[d.pos] = b
+	d.pos = (d.pos + 1) % deflate64Window
+	d.total++
+	d.buf = append(d.buf, b)
+}
+
+// step decodes some data in buf, returning io.EOF after the last block
+func (d *deflate64Reader) step() error {
+	d.buf = d.buf[:0]
+	for len(d.buf) < deflate64Window/2 {
+		switch d.state {
+		case deflateStateHeader:
+			if d.final {
+				return io.EOF
+			}
+			header, err := d.getBits(3)
+			if err != nil {
+				return err
+			}
+			d.final = header&1 == 1
+			switch header >> 1 {
+			case 0:
+				// Stored blocks start at the next byte
+				d.bits, d.nbits = 0, 0
+				length, err := d.getBits(16)
+				if err != nil {
+					return err
+				}
+				nlength, err := d.getBits(16)
+				if err != nil {
+					return err
+				}
+				if length != ^nlength&0xffff {
+					return errCorruptDeflate64
+				}
+				d.stored = length
+				d.state = deflateStateStored
+			case 1:
+				d.lit, d.dist = fixedDeflate64Codes()
+				d.state = deflateStateHuffman
+			case 2:
+				if err := d.readCodes(); err != nil {
+					return err
+				}
+				d.state = deflateStateHuffman
+			default:
+				return errCorruptDeflate64
+			}
+
+		case deflateStateStored:
+			if d.stored == 0 {
+				d.state = deflateStateHeader
+				continue
+			}
+			b, err := d.r.ReadByte()
+			if err == io.EOF {
+				return io.ErrUnexpectedEOF
+			} else if err != nil {
+				return err
+			}
+			d.emit(b)
+			d.stored--
+
+		case deflateStateHuffman:
+			symbol, err := d.decode(d.lit)
+			if err != nil {
+				return err
+			}
+			switch {
+			case symbol < 256:
+				d.emit(byte(symbol))
+				continue
+			case symbol == 256:
+				d.state = deflateStateHeader
+				continue
+			case symbol > 285:
+				return errCorruptDeflate64
+			}
+			symbol -= 257
+			extra, err := d.getBits(deflate64LengthExtra[symbol])
+			if err != nil {
+				return err
+			}
+			length := deflate64LengthBase[symbol] + extra
+
+			symbol, err = d.decode(d.dist)
+			if err != nil {
+				return err
+			}
+			if symbol >= len(deflate64DistBase) {
+				return errCorruptDeflate64
+			}
+			extra, err = d.getBits(deflate64DistExtra[symbol])
+			if err != nil {
+				return err
+			}
+			distance := deflate64DistBase[symbol] + extra
+			if distance > d.total || distance > deflate64Window {
+				return errCorruptDeflate64
+			}
+			for i := 0; i < length; i++ {
+				d.emit(d.window[(d.pos-distance+deflate64Window)%deflate64Window])
+			}
+		}
+	}
+	return nil
+}
+
+// readCodes reads the huffman codes of a dynamic block
+func (d *deflate64Reader) readCodes() error {
+	hlit, err := d.getBits(5)
+	if err != nil {
+		return err
+	}
+	hdist, err := d.getBits(5)
+	if err != nil {
+		return err
+	}
+	hclen, err := d.getBits(4)
+	if err != nil {
+		return err
+	}
+
+	lengths := make([]uint8, 19)
+	for i := 0; i < hclen+4; i++ {
+		length, err := d.getBits(3)
+		if err != nil {
+			return err
+		}
+		lengths[deflateCodeOrder[i]] = uint8(length)
+	}
+	codes, err := newHuffman(lengths)
+	if err != nil {
+		return err
+	}
+
+	lengths = make([]uint8, hlit+257+hdist+1)
+	for i := 0; i < len(lengths); {
+		symbol, err := d.decode(codes)
+		if err != nil {
+			return err
+		}
+		if symbol < 16 {
+			lengths[i] = uint8(symbol)
+			i++
+			continue
+		}
+		value, repeat := uint8(0), 0
+		switch symbol {
+		case 16:
+			if i == 0 {
+				return errCorruptDeflate64
+			}
+			value = lengths[i-1]
+			repeat, err = d.getBits(2)
+			repeat += 3
+		case 17:
+			repeat, err = d.getBits(3)
+			repeat += 3
+		default:
+			repeat, err = d.getBits(7)
+			repeat += 11
+		}
+		if err != nil {
+			return err
+		}
+		if i+repeat > len(lengths) {
+			return errCorruptDeflate64
+		}
+		for ; repeat > 0; repeat-- {
+			lengths[i] = value
+			i++
+		}
+	}
+
+	if d.lit, err = newHuffman(lengths[:hlit+257]); err != nil {
+		return err
+	}
+	d.dist, err = newHuffman(lengths[hlit+257:])
+	return err
+}
+
+// fixedDeflate64Codes returns the huffman codes of the fixed blocks
+func fixedDeflate64Codes() (*huffman, *huffman) {
+	lengths := make([]uint8, 288)
+	for i := range lengths {
+		switch {
+		case i < 144:
+			lengths[i] = 8
+		case i < 256:
+			lengths[i] = 9
+		case i < 280:
+			lengths[i] = 7
+		default:
+			lengths[i] = 8
+		}
+	}
+	lit, _ := newHuffman(lengths)
+	dist, _ := newHuffman([]uint8{5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5})
+	return lit, dist
+}
@@ -31,6 +31,7 @@ import (
 	"context"
 	"io"
 	"os"
+	"time"
 )
 
 // Renamer is a function that can be used to rename the files when you're extracting
@@ -89,6 +90,90 @@ func Zip(ctx context.Context, body io.Reader, location string, rename Renamer) e
 	return extractor.Zip(ctx, body, location, rename)
 }
 
+// ZipSplit extracts a zip archive split in many volumes in the specified location.
+// The volumes must be given in order, with the .zip one as the last.
+// It accepts a rename function to handle the names of the files (see the example)
+func ZipSplit(ctx context.Context, volumes []io.Reader, location string, rename Renamer) error {
+	extractor := Extractor{FS: fs{}}
+	return extractor.ZipSplit(ctx, volumes, location, rename)
+}
+
+// Ar extracts a .a or .ar archived stream of data in the specified location.
+// It accepts a rename function to handle the names of the files (see the example)
+func Ar(ctx context.Context, body io.Reader, location string, rename Renamer) error {
+	extractor := Extractor{FS: fs{}}
+	return extractor.Ar(ctx, body, location, rename)
+}
+
+// Deb extracts a .deb package in the specified location, with the control files
+// in the DEBIAN folder inside it.
+// It accepts a rename function to handle the names of the files (see the example)
+func Deb(ctx context.Context, body io.Reader, location string, rename Renamer) error {
+	extractor := Extractor{FS: fs{}}
+	return extractor.Deb(ctx, body, location, rename)
+}
+
+// Cpio extracts a .cpio archived stream of data in the specified location.
+// It accepts a rename function to handle the names of the files (see the example)
+func Cpio(ctx context.Context, body io.Reader, location string, rename Renamer) error {
+	extractor := Extractor{FS: fs{}}
+	return extractor.Cpio(ctx, body, location, rename)
+}
+
+// Rpm extracts the files of an .rpm package in the specified location and returns
+// the metadata of the package.
+// It accepts a rename function to handle the names of the files (see the example)
+func Rpm(ctx context.Context, body io.Reader, location string, rename Renamer) (*RpmPackage, error) {
+	extractor := Extractor{FS: fs{}}
+	return extractor.Rpm(ctx, body, location, rename)
+}
+
+// Iso extracts an ISO 9660 image in the specified location.
+// It accepts a rename function to handle the names of the files (see the example)
+func Iso(ctx context.Context, body io.ReaderAt, location string, rename Renamer) error {
+	extractor := Extractor{FS: fs{}}
+	return extractor.Iso(ctx, body, location, rename)
+}
+
+// Squashfs extracts a squashfs image in the specified location.
+// It accepts a rename function to handle the names of the files (see the example)
+func Squashfs(ctx context.Context, body io.ReaderAt, location string, rename Renamer) error {
+	extractor := Extractor{FS: fs{}}
+	return extractor.Squashfs(ctx, body, location, rename)
+}
+
+// AppImage extracts the squashfs image embedded in an AppImage in the specified location.
+// It accepts a rename function to handle the names of the files (see the example)
+func AppImage(ctx context.Context, body io.ReaderAt, location string, rename Renamer) error {
+	extractor := Extractor{FS: fs{}}
+	return extractor.AppImage(ctx, body, location, rename)
+}
+
+// ApplyLayer extracts a container image layer over the content of location,
+// applying its whiteouts.
+// It accepts a rename function to handle the names of the files (see the example)
+func ApplyLayer(ctx context.Context, body io.Reader, location string, rename Renamer) error {
+	extractor := Extractor{FS: fs{}}
+	return extractor.ApplyLayer(ctx, body, location, rename)
+}
+
+// ApplyOCILayout extracts the filesystem of an image stored in an OCI image layout
+// directory in the specified location, choosing the image for platform if there
+// are many.
+// It accepts a rename function to handle the names of the files (see the example)
+func ApplyOCILayout(ctx context.Context, layout, platform, location string, rename Renamer) error {
+	extractor := Extractor{FS: fs{}}
+	return extractor.ApplyOCILayout(ctx, layout, platform, location, rename)
+}
+
+// Convert reads an archive in any of the formats supported by Archive and writes
+// its entries in w, such as a TarWriter or a ZipWriter, without extracting them.
+// It accepts a rename function to handle the names of the files (see the example)
+func Convert(ctx context.Context, body io.Reader, w ArchiveWriter, rename Renamer) error {
+	extractor := Extractor{FS: fs{}}
+	return extractor.Convert(ctx, body, w, rename)
+}
+
 type fs struct{}
 
 func (f fs) Link(oldname, newname string) error {
@@ -103,8 +188,12 @@ func (f fs) Symlink(oldname, newname string) error {
 	return os.Symlink(oldname, newname)
 }
 
-func (f fs) OpenFile(name string, flag int, perm os.FileMode) (*os.File, error) {
-	return os.OpenFile(name, flag, perm)
+func (f fs) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	file, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
 }
 
 func (f fs) Remove(path string) error {
@@ -115,6 +204,30 @@ func (f fs) Stat(name string) (os.FileInfo, error) {
 	return os.Stat(name)
 }
 
+func (f fs) Lstat(name string) (os.FileInfo, error) {
+	return os.Lstat(name)
+}
+
+func (f fs) Readlink(name string) (string, error) {
+	return os.Readlink(name)
+}
+
 func (f fs) Chmod(name string, mode os.FileMode) error {
 	return os.Chmod(name, mode)
 }
+
+func (f fs) RemoveAll(path string) error {
+	return os.RemoveAll(path)
+}
+
+func (f fs) ReadDir(name string) ([]os.DirEntry, error) {
+	return os.ReadDir(name)
+}
+
+func (f fs) Open(name string) (io.ReadCloser, error) {
+	return os.Open(name)
+}
+
+func (f fs) Chtimes(name string, atime, mtime time.Time) error {
+	return os.Chtimes(name, atime, mtime)
+}
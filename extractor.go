@@ -5,7 +5,6 @@ import (
 	"archive/zip"
 	"bytes"
 	"compress/bzip2"
-	"compress/gzip"
 	"context"
 	"fmt"
 	"io"
@@ -16,36 +15,123 @@ import (
 	filetype "github.com/h2non/filetype"
 	"github.com/h2non/filetype/types"
 	"github.com/juju/errors"
-	"github.com/klauspost/compress/zstd"
-	"github.com/ulikunitz/xz"
+	"golang.org/x/text/encoding"
 )
 
 // Extractor is more sophisticated than the base functions. It allows to write over an interface
 // rather than directly on the filesystem
 type Extractor struct {
-	FS interface {
-		// Link creates newname as a hard link to the oldname file. If there is an error, it will be of type *LinkError.
-		Link(oldname, newname string) error
-
-		// MkdirAll creates the directory path and all his parents if needed.
-		MkdirAll(path string, perm os.FileMode) error
-
-		// OpenFile opens the named file with specified flag (O_RDONLY etc.).
-		OpenFile(name string, flag int, perm os.FileMode) (*os.File, error)
-
-		// Symlink creates newname as a symbolic link to oldname.
-		Symlink(oldname, newname string) error
-
-		// Remove removes the named file or (empty) directory.
-		Remove(path string) error
+	FS FS
+
+	// Password returns the password used to decrypt the named entry of an encrypted
+	// zip archive, whose name is decoded like ZipEncoding says. If it's nil the
+	// encrypted entries can't be extracted.
+	Password func(name string) (string, error)
+
+	// ZipEncoding is the encoding of the names of the zip entries that aren't
+	// flagged as UTF-8, such as charmap.CodePage437 or japanese.ShiftJIS. If it's
+	// nil the names that aren't valid UTF-8 are decoded with a guessed encoding.
+	ZipEncoding encoding.Encoding
+
+	// MaxDepth is the number of levels of nested archives that are extracted
+	// recursively: the files that are archives themselves are extracted in a
+	// folder with their name instead of being written. Zero disables it.
+	MaxDepth int
+
+	// Nested is called for every nested archive found within MaxDepth, with its
+	// path and its depth, starting from 1 for the archives inside the main one.
+	// It returns whether the archive should be extracted and the Renamer for its
+	// files. If it's nil all the nested archives are extracted without renaming.
+	Nested func(path string, depth int) (bool, Renamer)
+
+	// IgnoreZeros makes Tar go on after the blocks of zeros that mark the end of
+	// an archive, to extract the archives concatenated one after the other like
+	// tar --ignore-zeros does.
+	IgnoreZeros bool
+
+	// KeepOriginalName makes the functions for single compressed files (gz, bz2,
+	// xz and zst) write the file inside location when it's an existing directory,
+	// named like in the gzip header or like the compressed file without its
+	// extension, with the modification time stored in the header or of the
+	// compressed file. The FS must implement ChtimesFS to set the time.
+	KeepOriginalName bool
+
+	// DecoderConcurrency is the number of goroutines decompressing the gzip, xz
+	// and zstd streams. The gzip streams are decompressed in parallel when they
+	// are BGZF files or have sync points like the ones made by pigz, and the xz
+	// streams when they are made by multithreaded encoders. The others are
+	// decompressed sequentially. Zero uses the default decoders, a negative
+	// value one goroutine per CPU.
+	DecoderConcurrency int
+
+	// Writers is the number of goroutines writing the files of tar and zip
+	// archives, which helps with many small files. The tar archives are still
+	// read sequentially, buffering the files in memory until they're written;
+	// the files of zip archives are decompressed in parallel. Links are created
+	// after all the files. Zero or one writes a file at a time. The Nested
+	// callback may be called from many goroutines.
+	Writers int
+
+	// WriterMemory is the maximum size of the files of a tar archive buffered in
+	// memory by the Writers, 64MiB if it's zero. Bigger files are written after
+	// the others.
+	WriterMemory int64
+
+	// StreamZip extracts zip archives that can't be read at random positions
+	// as their data arrives, reading the entries from their local headers
+	// instead of reading the whole archive first. The modes of the files and
+	// the symlinks are restored at the end, from the central directory.
+	StreamZip bool
+
+	// VerifyZipDirectory makes StreamZip fail if the central directory is
+	// missing or doesn't match the local headers of the entries.
+	VerifyZipDirectory bool
+
+	// SpillThreshold is the maximum size of an archive that can't be read at
+	// random positions kept in memory by Zip and Archive. Bigger archives are
+	// copied to a temporary file. If it's zero they're always kept in memory.
+	SpillThreshold int64
+
+	// Symlinks is the policy for the symlinks of the archives. By default they
+	// are created as they are.
+	Symlinks SymlinkPolicy
+
+	// SymlinkRejected is called with the path and the target of every symlink
+	// rejected by the Symlinks policy. The symlink is skipped if it returns nil,
+	// otherwise the extraction fails with its error. If it's nil the extraction
+	// fails with an error caused by ErrSymlinkRejected.
+	SymlinkRejected func(path, target string) error
+
+	// Collisions are the ways in which the paths of different entries of tar
+	// and zip archives can name the same file on the destination volume, such
+	// as FoldCase|FoldUnicode for macOS. Zero disables the detection.
+	Collisions Folding
+
+	// OnCollision is what happens to the entries whose paths collide with the
+	// ones of previous entries under Collisions. The same path is never a
+	// collision, the later entries overwrite the previous ones.
+	OnCollision CollisionAction
+
+	// Modes changes the permissions of the files and the directories
+	// extracted, such as stripping their setuid bits.
+	Modes ModePolicy
+
+	depth int
+	layer *layer
+}
 
-		// Stat returns a FileInfo describing the named file.
-		Stat(name string) (os.FileInfo, error)
+// NodeFS can be implemented by the FS of an Extractor to create device nodes and
+// named pipes. If it's not implemented these entries are skipped.
+type NodeFS interface {
+	// Mknod creates a device node or a named pipe, depending on mode.
+	Mknod(path string, mode os.FileMode, major, minor uint32) error
+}
 
-		// Chmod changes the mode of the named file to mode.
-		// If the file is a symbolic link, it changes the mode of the link's target.
-		Chmod(name string, mode os.FileMode) error
-	}
+// XattrFS can be implemented by the FS of an Extractor to set the extended attributes
+// of the extracted files. If it's not implemented the attributes are skipped.
+type XattrFS interface {
+	// Lsetxattr sets an extended attribute of the named file, without following symlinks.
+	Lsetxattr(path, name string, value []byte) error
 }
 
 // Archive extracts a generic archived stream of data in the specified location.
@@ -53,12 +139,12 @@ type Extractor struct {
 // handle the names of the files.
 // If the file is not an archive, an error is returned.
 func (e *Extractor) Archive(ctx context.Context, body io.Reader, location string, rename Renamer) error {
-	body, kind, err := match(body)
+	body, extension, err := detect(body)
 	if err != nil {
-		errors.Annotatef(err, "Detect archive type")
+		return err
 	}
 
-	switch kind.Extension {
+	switch extension {
 	case "zip":
 		return e.Zip(ctx, body, location, rename)
 	case "gz":
@@ -71,16 +157,39 @@ func (e *Extractor) Archive(ctx context.Context, body io.Reader, location string
 		return e.Zstd(ctx, body, location, rename)
 	case "tar":
 		return e.Tar(ctx, body, location, rename)
+	case "ar":
+		return e.Ar(ctx, body, location, rename)
+	case "deb":
+		return e.Deb(ctx, body, location, rename)
+	case "rpm":
+		_, err := e.Rpm(ctx, body, location, rename)
+		return err
+	case "iso", "squashfs", "AppImage":
+		bodyReaderAt, _, cleanup, err := e.bodyAt(ctx, body)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+		switch extension {
+		case "iso":
+			return e.Iso(ctx, bodyReaderAt, location, rename)
+		case "squashfs":
+			return e.Squashfs(ctx, bodyReaderAt, location, rename)
+		default:
+			return e.AppImage(ctx, bodyReaderAt, location, rename)
+		}
 	default:
-		return errors.New("Not a supported archive: " + kind.Extension)
+		return errors.New("Not a supported archive: " + extension)
 	}
 }
 
 func (e *Extractor) Zstd(ctx context.Context, body io.Reader, location string, rename Renamer) error {
-	reader, err := zstd.NewReader(body)
+	file := compressedFile(body, ".zst", ".zstd")
+	reader, closer, err := e.unzstd(body)
 	if err != nil {
 		return errors.Annotatef(err, "opening zstd: detect")
 	}
+	defer closer()
 
 	body, kind, err := match(reader)
 	if err != nil {
@@ -91,18 +200,16 @@ func (e *Extractor) Zstd(ctx context.Context, body io.Reader, location string, r
 		return e.Tar(ctx, body, location, rename)
 	}
 
-	err = e.copy(ctx, location, 0666, body)
-	if err != nil {
-		return err
-	}
-	return nil
+	return e.writeSingle(ctx, body, location, rename, file)
 }
 
 func (e *Extractor) Xz(ctx context.Context, body io.Reader, location string, rename Renamer) error {
-	reader, err := xz.NewReader(body)
+	file := compressedFile(body, ".xz", ".txz")
+	reader, closer, err := e.unxz(body)
 	if err != nil {
 		return errors.Annotatef(err, "opening xz: detect")
 	}
+	defer closer()
 
 	body, kind, err := match(reader)
 	if err != nil {
@@ -113,16 +220,13 @@ func (e *Extractor) Xz(ctx context.Context, body io.Reader, location string, ren
 		return e.Tar(ctx, body, location, rename)
 	}
 
-	err = e.copy(ctx, location, 0666, body)
-	if err != nil {
-		return err
-	}
-	return nil
+	return e.writeSingle(ctx, body, location, rename, file)
 }
 
 // Bz2 extracts a .bz2 or .tar.bz2 archived stream of data in the specified location.
 // It accepts a rename function to handle the names of the files (see the example)
 func (e *Extractor) Bz2(ctx context.Context, body io.Reader, location string, rename Renamer) error {
+	file := compressedFile(body, ".bz2", ".bz", ".tbz2", ".tbz")
 	reader := bzip2.NewReader(body)
 
 	body, kind, err := match(reader)
@@ -134,20 +238,25 @@ func (e *Extractor) Bz2(ctx context.Context, body io.Reader, location string, re
 		return e.Tar(ctx, body, location, rename)
 	}
 
-	err = e.copy(ctx, location, 0666, body)
-	if err != nil {
-		return err
-	}
-	return nil
+	return e.writeSingle(ctx, body, location, rename, file)
 }
 
 // Gz extracts a .gz or .tar.gz archived stream of data in the specified location.
 // It accepts a rename function to handle the names of the files (see the example)
 func (e *Extractor) Gz(ctx context.Context, body io.Reader, location string, rename Renamer) error {
-	reader, err := gzip.NewReader(body)
+	file := compressedFile(body, ".gz", ".gzip", ".z", ".tgz")
+	reader, header, closer, err := e.gunzip(body)
 	if err != nil {
 		return errors.Annotatef(err, "Gunzip")
 	}
+	defer closer()
+	// The header stores the original name and time, unless gzip -n was used
+	if header.Name != "" {
+		file.name = header.Name
+	}
+	if !header.ModTime.IsZero() {
+		file.mtime = header.ModTime
+	}
 
 	body, kind, err := match(reader)
 	if err != nil {
@@ -157,11 +266,8 @@ func (e *Extractor) Gz(ctx context.Context, body io.Reader, location string, ren
 	if kind.Extension == "tar" {
 		return e.Tar(ctx, body, location, rename)
 	}
-	err = e.copy(ctx, location, 0666, body)
-	if err != nil {
-		return err
-	}
-	return nil
+
+	return e.writeSingle(ctx, body, location, rename, file)
 }
 
 type link struct {
@@ -174,6 +280,9 @@ type link struct {
 func (e *Extractor) Tar(ctx context.Context, body io.Reader, location string, rename Renamer) error {
 	links := []*link{}
 	symlinks := []*link{}
+	collisions := e.newCollisions(location)
+	writers := e.newWriters(ctx)
+	defer writers.wait()
 
 	// We make the first pass creating the directory structure, or we could end up
 	// attempting to create a file where there's no folder
@@ -186,6 +295,16 @@ func (e *Extractor) Tar(ctx context.Context, body io.Reader, location string, re
 		}
 
 		header, err := tr.Next()
+		if err == io.EOF && e.IgnoreZeros {
+			var more bool
+			if body, more, err = skipZeroBlocks(body); err != nil {
+				return errors.Annotatef(err, "Read tar stream")
+			} else if more {
+				tr = tar.NewReader(body)
+				continue
+			}
+			break
+		}
 		if err == io.EOF {
 			break
 		}
@@ -207,16 +326,39 @@ func (e *Extractor) Tar(ctx context.Context, body io.Reader, location string, re
 			continue
 		}
 
-		info := header.FileInfo()
+		var ok bool
+		if path, ok, err = collisions.add(path); err != nil {
+			return err
+		} else if !ok {
+			continue
+		}
+
+		if e.layer != nil {
+			// The whiteouts may remove the files being written
+			if strings.HasPrefix(filepath.Base(path), whiteoutPrefix) {
+				if err := writers.wait(); err != nil {
+					return err
+				}
+			}
+			if whiteout, err := e.layer.apply(path, header.Typeflag == tar.TypeDir); err != nil {
+				return err
+			} else if whiteout {
+				continue
+			}
+		}
+
+		mode := e.Modes.apply(header.FileInfo().Mode())
+		e.modTime(path, header.ModTime)
+		e.fileSize(path, header.Size)
 
 		switch header.Typeflag {
 		case tar.TypeDir:
-			if err := e.FS.MkdirAll(path, info.Mode()); err != nil {
+			if err := e.FS.MkdirAll(path, mode); err != nil {
 				return errors.Annotatef(err, "Create directory %s", path)
 			}
 		case tar.TypeReg, tar.TypeRegA:
-			if err := e.copy(ctx, path, info.Mode(), tr); err != nil {
-				return errors.Annotatef(err, "Create file %s", path)
+			if err := writers.write(path, mode, tr, header.Size); err != nil {
+				return err
 			}
 		case tar.TypeLink:
 			name := header.Linkname
@@ -228,12 +370,19 @@ func (e *Extractor) Tar(ctx context.Context, body io.Reader, location string, re
 			if err != nil {
 				continue
 			}
+			if name, ok = collisions.lookup(name); !ok {
+				continue
+			}
 			links = append(links, &link{Path: path, Name: name})
 		case tar.TypeSymlink:
 			symlinks = append(symlinks, &link{Path: path, Name: header.Linkname})
 		}
 	}
 
+	if err := writers.wait(); err != nil {
+		return err
+	}
+
 	// Now we make another pass creating the links
 	for i := range links {
 		select {
@@ -247,18 +396,33 @@ func (e *Extractor) Tar(ctx context.Context, body io.Reader, location string, re
 		}
 	}
 
-	if err := e.extractSymlinks(ctx, symlinks); err != nil {
+	if err := e.extractSymlinks(ctx, location, symlinks); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func (e *Extractor) extractSymlinks(ctx context.Context, symlinks []*link) error {
+func (e *Extractor) extractSymlinks(ctx context.Context, location string, symlinks []*link) error {
+	_, err := e.createSymlinks(ctx, location, symlinks)
+	return err
+}
+
+// createSymlinks is extractSymlinks returning the symlinks actually created,
+// without the ones rejected by the Symlinks policy or copied
+func (e *Extractor) createSymlinks(ctx context.Context, location string, symlinks []*link) ([]*link, error) {
+	symlinks, err := e.symlinkPolicy(location, symlinks)
+	if err != nil {
+		return nil, err
+	}
+	if e.Symlinks == CopySymlinks {
+		return nil, e.copySymlinks(ctx, location, symlinks)
+	}
+
 	for _, symlink := range symlinks {
 		select {
 		case <-ctx.Done():
-			return errors.New("interrupted")
+			return nil, errors.New("interrupted")
 		default:
 		}
 
@@ -266,57 +430,49 @@ func (e *Extractor) extractSymlinks(ctx context.Context, symlinks []*link) error
 		_ = e.FS.Remove(symlink.Path)
 		f, err := e.FS.OpenFile(symlink.Path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.FileMode(0666))
 		if err != nil {
-			return fmt.Errorf("creating symlink placeholder %s: %w", symlink.Path, err)
+			return nil, fmt.Errorf("creating symlink placeholder %s: %w", symlink.Path, err)
 		}
 		if err := f.Close(); err != nil {
-			return fmt.Errorf("creating symlink placeholder %s: %w", symlink.Path, err)
+			return nil, fmt.Errorf("creating symlink placeholder %s: %w", symlink.Path, err)
 		}
 	}
 
 	for _, symlink := range symlinks {
 		select {
 		case <-ctx.Done():
-			return errors.New("interrupted")
+			return nil, errors.New("interrupted")
 		default:
 		}
 		_ = e.FS.Remove(symlink.Path)
 		if err := e.FS.Symlink(symlink.Name, symlink.Path); err != nil {
-			return errors.Annotatef(err, "Create link %s", symlink.Path)
+			return nil, errors.Annotatef(err, "Create link %s", symlink.Path)
 		}
 	}
 
-	return nil
+	return symlinks, nil
 }
 
 // Zip extracts a .zip archived stream of data in the specified location.
 // It accepts a rename function to handle the names of the files (see the example).
 func (e *Extractor) Zip(ctx context.Context, body io.Reader, location string, rename Renamer) error {
-	var bodySize int64
-	bodyReaderAt, isReaderAt := (body).(io.ReaderAt)
-	if bodySeeker, isSeeker := (body).(io.Seeker); isReaderAt && isSeeker {
-		// get the size by seeking to the end
-		endPos, err := bodySeeker.Seek(0, io.SeekEnd)
-		if err != nil {
-			return fmt.Errorf("failed to seek to the end of the body: %s", err)
-		}
-		// reset the reader to the beginning
-		if _, err := bodySeeker.Seek(0, io.SeekStart); err != nil {
-			return fmt.Errorf("failed to seek to the beginning of the body: %w", err)
-		}
-		bodySize = endPos
-	} else {
-		// read the whole body into a buffer. Not sure this is the best way to do it
-		buffer := bytes.NewBuffer([]byte{})
-		copyCancel(ctx, buffer, body)
-		bodyReaderAt = bytes.NewReader(buffer.Bytes())
-		bodySize = int64(buffer.Len())
+	if !isReaderAt(body) && e.StreamZip {
+		return e.zipStream(ctx, body, location, rename)
 	}
+	bodyReaderAt, bodySize, cleanup, err := e.bodyAt(ctx, body)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
 	archive, err := zip.NewReader(bodyReaderAt, bodySize)
 	if err != nil {
 		return errors.Annotatef(err, "Read the zip file")
 	}
 
 	links := []*link{}
+	names := zipNames(archive.File, e.ZipEncoding)
+	collisions := e.newCollisions(location)
+	writers := e.newWriters(ctx)
+	defer writers.wait()
 
 	// We make the first pass creating the directory structure, or we could end up
 	// attempting to create a file where there's no folder
@@ -327,33 +483,23 @@ func (e *Extractor) Zip(ctx context.Context, body io.Reader, location string, re
 		default:
 		}
 
-		path := header.Name
-
-		// Replace backslash with forward slash. There are archives in the wild made with
-		// buggy compressors that use backslash as path separator. The ZIP format explicitly
-		// denies the use of "\" so we just replace it with slash "/".
-		// Moreover it seems that folders are stored as "files" but with a final "\" in the
-		// filename... oh, well...
-		forceDir := strings.HasSuffix(path, "\\")
-		path = strings.Replace(path, "\\", "/", -1)
-
-		if rename != nil {
-			path = rename(path)
-		}
-
-		if path == "" {
+		path, forceDir, ok := zipPath(names[header], location, rename)
+		if !ok {
 			continue
 		}
-
-		if path, err = safeJoin(location, path); err != nil {
+		if path, ok, err = collisions.add(path); err != nil {
+			return err
+		} else if !ok {
 			continue
 		}
 
 		info := header.FileInfo()
+		e.modTime(path, header.Modified)
+		e.fileSize(path, int64(header.UncompressedSize64))
 
 		switch {
 		case info.IsDir() || forceDir:
-			dirMode := info.Mode() | os.ModeDir | 0100
+			dirMode := e.Modes.apply(info.Mode()|os.ModeDir) | 0100
 			if _, err := e.FS.Stat(path); err == nil {
 				// directory already created, update permissions
 				if err := e.FS.Chmod(path, dirMode); err != nil {
@@ -364,7 +510,7 @@ func (e *Extractor) Zip(ctx context.Context, body io.Reader, location string, re
 			}
 		// We only check for symlinks because hard links aren't possible
 		case info.Mode()&os.ModeSymlink != 0:
-			if f, err := header.Open(); err != nil {
+			if f, err := e.openZip(header, names[header]); err != nil {
 				return errors.Annotatef(err, "Open link %s", path)
 			} else if name, err := io.ReadAll(f); err != nil {
 				return errors.Annotatef(err, "Read address of link %s", path)
@@ -373,62 +519,216 @@ func (e *Extractor) Zip(ctx context.Context, body io.Reader, location string, re
 				f.Close()
 			}
 		default:
-			if f, err := header.Open(); err != nil {
+			if f, err := e.openZip(header, names[header]); err != nil {
 				return errors.Annotatef(err, "Open file %s", path)
-			} else if err := e.copy(ctx, path, info.Mode(), f); err != nil {
-				return errors.Annotatef(err, "Create file %s", path)
-			} else {
-				f.Close()
+			} else if err := writers.write(path, e.Modes.apply(info.Mode()), f, -1); err != nil {
+				return err
 			}
 		}
 	}
 
-	if err := e.extractSymlinks(ctx, links); err != nil {
+	if err := writers.wait(); err != nil {
+		return err
+	}
+
+	if err := e.extractSymlinks(ctx, location, links); err != nil {
 		return err
 	}
 
 	return nil
 }
 
+// zipPath returns where an entry of a zip archive is extracted, and whether it's
+// a directory because of a final backslash. It returns false if it's skipped.
+func zipPath(name, location string, rename Renamer) (string, bool, bool) {
+	// Replace backslash with forward slash. There are archives in the wild made with
+	// buggy compressors that use backslash as path separator. The ZIP format explicitly
+	// denies the use of "\" so we just replace it with slash "/".
+	// Moreover it seems that folders are stored as "files" but with a final "\" in the
+	// filename... oh, well...
+	forceDir := strings.HasSuffix(name, "\\")
+	path := strings.Replace(name, "\\", "/", -1)
+
+	if rename != nil {
+		path = rename(path)
+	}
+
+	if path == "" {
+		return "", false, false
+	}
+
+	path, err := safeJoin(location, path)
+	if err != nil {
+		return "", false, false
+	}
+	return path, forceDir, true
+}
+
+// readerAt returns body as an io.ReaderAt together with its size. If body can't
+// be read at random positions it's read into memory.
+func readerAt(ctx context.Context, body io.Reader) (io.ReaderAt, int64, error) {
+	bodyReaderAt, _ := (body).(io.ReaderAt)
+	if bodySeeker, isSeeker := (body).(io.Seeker); isReaderAt(body) && isSeeker {
+		// get the size by seeking to the end
+		endPos, err := bodySeeker.Seek(0, io.SeekEnd)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to seek to the end of the body: %s", err)
+		}
+		// reset the reader to the beginning
+		if _, err := bodySeeker.Seek(0, io.SeekStart); err != nil {
+			return nil, 0, fmt.Errorf("failed to seek to the beginning of the body: %w", err)
+		}
+		return bodyReaderAt, endPos, nil
+	}
+
+	// read the whole body into a buffer. Not sure this is the best way to do it
+	buffer := bytes.NewBuffer([]byte{})
+	if _, err := copyCancel(ctx, buffer, body); err != nil {
+		return nil, 0, err
+	}
+	return bytes.NewReader(buffer.Bytes()), int64(buffer.Len()), nil
+}
+
+// bodyAt is like readerAt, but if body is bigger than SpillThreshold it's
+// copied to a temporary file, removed by the returned function
+func (e *Extractor) bodyAt(ctx context.Context, body io.Reader) (io.ReaderAt, int64, func(), error) {
+	if isReaderAt(body) || e.SpillThreshold <= 0 {
+		bodyReaderAt, size, err := readerAt(ctx, body)
+		return bodyReaderAt, size, func() {}, err
+	}
+
+	buffer := &bytes.Buffer{}
+	if _, err := copyCancel(ctx, buffer, io.LimitReader(body, e.SpillThreshold+1)); err != nil {
+		return nil, 0, nil, err
+	}
+	if int64(buffer.Len()) <= e.SpillThreshold {
+		return bytes.NewReader(buffer.Bytes()), int64(buffer.Len()), func() {}, nil
+	}
+
+	file, err := os.CreateTemp("", "extract-*")
+	if err != nil {
+		return nil, 0, nil, errors.Annotatef(err, "Create temporary file")
+	}
+	cleanup := func() {
+		file.Close()
+		os.Remove(file.Name())
+	}
+	size, err := copyCancel(ctx, file, io.MultiReader(buffer, body))
+	if err != nil {
+		cleanup()
+		return nil, 0, nil, errors.Annotatef(err, "Write temporary file")
+	}
+	return file, size, cleanup, nil
+}
+
+// isReaderAt tells if body can be read at random positions
+func isReaderAt(body io.Reader) bool {
+	_, isReaderAt := body.(io.ReaderAt)
+	_, isSeeker := body.(io.Seeker)
+	return isReaderAt && isSeeker
+}
+
 func (e *Extractor) copy(ctx context.Context, path string, mode os.FileMode, src io.Reader) error {
 	// We add the execution permission to be able to create files inside it
-	err := e.FS.MkdirAll(filepath.Dir(path), mode|os.ModeDir|0100)
+	err := e.FS.MkdirAll(filepath.Dir(path), e.Modes.apply(mode|os.ModeDir)|0100)
 	if err != nil {
 		return err
 	}
+	if e.depth < e.MaxDepth {
+		var extracted bool
+		if src, extracted, err = e.extractNested(ctx, path, mode, src); err != nil || extracted {
+			return err
+		}
+	}
 	_ = e.FS.Remove(path)
 	file, err := e.FS.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
-	_, err = copyCancel(ctx, file, src)
-	return err
+	if _, err := copyCancel(ctx, file, src); err != nil {
+		// Don't leave a partial file, such as an encrypted one whose
+		// authentication code is checked only at its end
+		abortFile(file, err)
+		_ = e.FS.Remove(path)
+		return err
+	}
+	return file.Close()
+}
+
+// detect returns the extension of the type of the archive, together with a
+// reader for the whole stream
+func detect(body io.Reader) (io.Reader, string, error) {
+	body, kind, err := match(body)
+	if body == nil {
+		return nil, "", errors.Annotatef(err, "Detect archive type")
+	}
+	// Otherwise the error comes from filetype, which fails on empty streams
+	// that are simply of unknown type
+
+	extension := kind.Extension
+	if extension == "ar" {
+		// filetype matches the ar signature of Debian packages first
+		var buffer []byte
+		if body, buffer, err = peek(body, 8+len("debian-binary")); err != nil {
+			return nil, "", errors.Annotatef(err, "Detect archive type")
+		}
+		if len(buffer) > 8 && bytes.HasPrefix(buffer[8:], []byte("debian-binary")) {
+			extension = "deb"
+		}
+	}
+	if kind == types.Unknown || extension == "elf" {
+		// Some formats are not known by filetype, and ISO 9660 images are
+		// recognized only after the 32KiB of their system area
+		var buffer []byte
+		if body, buffer, err = peek(body, isoMagicOffset+5); err != nil {
+			return nil, "", errors.Annotatef(err, "Detect archive type")
+		}
+		switch {
+		case isIso(buffer):
+			extension = "iso"
+		case isSquashfs(buffer):
+			extension = "squashfs"
+		case isAppImage(buffer):
+			extension = "AppImage"
+		}
+	}
+	return body, extension, nil
 }
 
 // match reads the first 512 bytes, calls types.Match and returns a reader
 // for the whole stream
 func match(r io.Reader) (io.Reader, types.Type, error) {
-	buffer := make([]byte, 512)
-
-	n, err := r.Read(buffer)
-	if err != nil && err != io.EOF {
+	r, buffer, err := peek(r, 512)
+	if err != nil {
 		return nil, types.Unknown, err
 	}
 
+	typ, err := filetype.Match(buffer)
+
+	return r, typ, err
+}
+
+// peek reads the first n bytes and returns them together with a reader for the
+// whole stream
+func peek(r io.Reader, n int) (io.Reader, []byte, error) {
+	buffer := make([]byte, n)
+
+	n, err := io.ReadFull(r, buffer)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, nil, err
+	}
+
 	if seeker, ok := r.(io.Seeker); ok {
 		// if the stream is seekable, we just rewind it
 		if _, err := seeker.Seek(0, io.SeekStart); err != nil {
-			return nil, types.Unknown, err
+			return nil, nil, err
 		}
 	} else {
 		// otherwise we create a new reader that will prepend the buffer
 		r = io.MultiReader(bytes.NewBuffer(buffer[:n]), r)
 	}
 
-	typ, err := filetype.Match(buffer)
-
-	return r, typ, err
+	return r, buffer[:n], nil
 }
 
 // safeJoin performs a filepath.Join of 'parent' and 'subdir' but returns an error
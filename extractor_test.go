@@ -14,7 +14,8 @@ import (
 	"testing"
 
 	"github.com/arduino/go-paths-helper"
-	"github.com/codeclysm/extract/v4"
+	"github.com/codeclysm/extract/v5"
+	"github.com/codeclysm/extract/v5/extracttest"
 	"github.com/stretchr/testify/require"
 )
 
@@ -48,9 +49,9 @@ func testArchive(t *testing.T, archivePath *paths.Path) {
 	buffer := bytes.NewBuffer(data)
 
 	extractor := extract.Extractor{
-		FS: MockDisk{
+		FS: extract.FromOSFS(MockDisk{
 			Base: tmp.String(),
-		},
+		}),
 	}
 	err = extractor.Archive(context.Background(), buffer, "/", nil)
 	require.NoError(t, err)
@@ -70,7 +71,7 @@ func testArchive(t *testing.T, archivePath *paths.Path) {
 
 func TestZipSlipHardening(t *testing.T) {
 	t.Run("ZipTraversal", func(t *testing.T) {
-		logger := &LoggingFS{}
+		logger := &extracttest.LoggingFS{}
 		extractor := extract.Extractor{FS: logger}
 		data, err := os.Open("testdata/zipslip/evil.zip")
 		require.NoError(t, err)
@@ -81,7 +82,7 @@ func TestZipSlipHardening(t *testing.T) {
 	})
 
 	t.Run("TarTraversal", func(t *testing.T) {
-		logger := &LoggingFS{}
+		logger := &extracttest.LoggingFS{}
 		extractor := extract.Extractor{FS: logger}
 		data, err := os.Open("testdata/zipslip/evil.tar")
 		require.NoError(t, err)
@@ -92,7 +93,7 @@ func TestZipSlipHardening(t *testing.T) {
 	})
 
 	t.Run("TarLinkTraversal", func(t *testing.T) {
-		logger := &LoggingFS{}
+		logger := &extracttest.LoggingFS{}
 		extractor := extract.Extractor{FS: logger}
 		data, err := os.Open("testdata/zipslip/evil-link-traversal.tar")
 		require.NoError(t, err)
@@ -106,7 +107,7 @@ func TestZipSlipHardening(t *testing.T) {
 		if runtime.GOOS != "windows" {
 			t.Skip("Skipped on non-Windows host")
 		}
-		logger := &LoggingFS{}
+		logger := &extracttest.LoggingFS{}
 		extractor := extract.Extractor{FS: logger}
 		data, err := os.Open("testdata/zipslip/evil-win.tar")
 		require.NoError(t, err)
@@ -154,7 +155,7 @@ func TestSymLinkMazeHardening(t *testing.T) {
 		require.NoError(t, tw.Close())
 
 		// Run extract
-		extractor := extract.Extractor{FS: &LoggingFS{}}
+		extractor := extract.Extractor{FS: &extracttest.LoggingFS{}}
 		require.Error(t, extractor.Tar(context.Background(), outputTar, targetDir.String(), nil))
 		require.NoFileExists(t, tmp.Join("sym").String())
 	})
@@ -173,7 +174,7 @@ func TestSymLinkMazeHardening(t *testing.T) {
 		require.NoError(t, zw.Close())
 
 		// Run extract
-		extractor := extract.Extractor{FS: &LoggingFS{}}
+		extractor := extract.Extractor{FS: &extracttest.LoggingFS{}}
 		err := extractor.Zip(context.Background(), outputZip, targetDir.String(), nil)
 		require.NoFileExists(t, tmp.Join("sym").String())
 		require.Error(t, err)
@@ -194,7 +195,7 @@ func TestSymLinkMazeHardening(t *testing.T) {
 		addTarSymlink(t, tw, "aaa/sym", "something")
 		require.NoError(t, tw.Close())
 
-		extractor := extract.Extractor{FS: &LoggingFS{}}
+		extractor := extract.Extractor{FS: &extracttest.LoggingFS{}}
 		require.Error(t, extractor.Tar(context.Background(), outputTar, targetDir.String(), nil))
 		require.NoFileExists(t, checkDir.Join("sym").String())
 	})
@@ -213,7 +214,7 @@ func TestSymLinkMazeHardening(t *testing.T) {
 		addTarSymlink(t, tw, "aaa/sym", "something")
 		require.NoError(t, tw.Close())
 
-		extractor := extract.Extractor{FS: &LoggingFS{}}
+		extractor := extract.Extractor{FS: &extracttest.LoggingFS{}}
 		require.Error(t, extractor.Tar(context.Background(), outputTar, targetDir.String(), nil))
 		require.NoFileExists(t, targetDir.Join("tmp", "sym").String())
 	})
@@ -235,7 +236,7 @@ func TestSymLinkMazeHardening(t *testing.T) {
 		addTarSymlink(t, tw, "sym-maze/oops", "/tmp/something")
 		require.NoError(t, tw.Close())
 
-		extractor := extract.Extractor{FS: &LoggingFS{}}
+		extractor := extract.Extractor{FS: &extracttest.LoggingFS{}}
 		require.Error(t, extractor.Tar(context.Background(), outputTar, targetDir.String(), nil))
 		require.NoFileExists(t, tmp.Join("oops").String())
 	})
@@ -253,7 +254,7 @@ func TestSymLinkMazeHardening(t *testing.T) {
 		addTarSymlink(t, tw, "aaa", "../tmp")
 		require.NoError(t, tw.Close())
 
-		extractor := extract.Extractor{FS: &LoggingFS{}}
+		extractor := extract.Extractor{FS: &extracttest.LoggingFS{}}
 		require.NoError(t, extractor.Tar(context.Background(), outputTar, targetDir.String(), nil))
 		st, err := targetDir.Join("aaa").Lstat()
 		require.NoError(t, err)
@@ -369,3 +370,115 @@ func (m MockDisk) Chmod(name string, mode os.FileMode) error {
 	name = filepath.Join(m.Base, name)
 	return os.Chmod(name, mode)
 }
+
+func TestAr(t *testing.T) {
+	t.Run("GNU", func(t *testing.T) {
+		tmp := mkTempDir(t)
+		f, err := os.Open("testdata/archive.ar")
+		require.NoError(t, err)
+		defer f.Close()
+
+		require.NoError(t, extract.Ar(context.Background(), f, tmp.String(), nil))
+		testWalk(t, tmp.String(), Files{
+			"":                                      "dir",
+			"/file1.txt":                            "File1",
+			"/a-very-long-file-name-for-gnu-ar.txt": "File2",
+		})
+	})
+
+	t.Run("BSD", func(t *testing.T) {
+		addMember := func(buf *bytes.Buffer, name, data string) {
+			header := fmt.Sprintf("%-16s%-12d%-6d%-6d%-8o%-10d`\n", name, 0, 0, 0, 0644, len(data))
+			buf.WriteString(header)
+			buf.WriteString(data)
+			if len(data)%2 == 1 {
+				buf.WriteString("\n")
+			}
+		}
+		longName := "a-very-long-file-name-for-bsd-ar.txt"
+		archive := bytes.NewBufferString("!<arch>\n")
+		addMember(archive, "__.SYMDEF", "symbols")
+		addMember(archive, "file1.txt", "File1")
+		addMember(archive, fmt.Sprintf("#1/%d", len(longName)), longName+"File2")
+
+		tmp := mkTempDir(t)
+		require.NoError(t, extract.Ar(context.Background(), archive, tmp.String(), nil))
+		testWalk(t, tmp.String(), Files{
+			"":             "dir",
+			"/file1.txt":   "File1",
+			"/" + longName: "File2",
+		})
+	})
+
+	t.Run("Inferred", func(t *testing.T) {
+		tmp := mkTempDir(t)
+		f, err := os.Open("testdata/archive.ar")
+		require.NoError(t, err)
+		defer f.Close()
+
+		require.NoError(t, extract.Archive(context.Background(), f, tmp.String(), nil))
+		require.FileExists(t, tmp.Join("file1.txt").String())
+	})
+}
+
+func TestDeb(t *testing.T) {
+	t.Run("Combined", func(t *testing.T) {
+		tmp := mkTempDir(t)
+		f, err := os.Open("testdata/archive.deb")
+		require.NoError(t, err)
+		defer f.Close()
+
+		require.NoError(t, extract.Deb(context.Background(), f, tmp.String(), nil))
+		testWalk(t, tmp.String(), Files{
+			"":                          "dir",
+			"/DEBIAN":                   "dir",
+			"/DEBIAN/control":           "Package: archive\nVersion: 1.0\nArchitecture: all\nMaintainer: test <test@example.com>\nDescription: test package",
+			"/archive":                  "dir",
+			"/archive/folder":           "dir",
+			"/archive/folderlink":       "link",
+			"/archive/folder/file1.txt": "folder/File1",
+			"/archive/file1.txt":        "File1",
+			"/archive/file2.txt":        "File2",
+		})
+	})
+
+	t.Run("Split", func(t *testing.T) {
+		tmp := mkTempDir(t)
+		f, err := os.Open("testdata/archive.deb")
+		require.NoError(t, err)
+		defer f.Close()
+
+		extractor := extract.Extractor{FS: &extracttest.LoggingFS{}}
+		err = extractor.DebSplit(context.Background(), f, "", tmp.Join("data").String(), nil)
+		require.NoError(t, err)
+		require.NoFileExists(t, tmp.Join("data", "control").String())
+		require.FileExists(t, tmp.Join("data", "archive", "file1.txt").String())
+	})
+
+	t.Run("Archive", func(t *testing.T) {
+		tmp := mkTempDir(t)
+		f, err := os.Open("testdata/archive.deb")
+		require.NoError(t, err)
+		defer f.Close()
+
+		require.NoError(t, extract.Archive(context.Background(), f, tmp.String(), nil))
+		require.FileExists(t, tmp.Join("DEBIAN", "control").String())
+		require.FileExists(t, tmp.Join("archive", "file1.txt").String())
+	})
+
+	t.Run("NotADeb", func(t *testing.T) {
+		tmp := mkTempDir(t)
+		f, err := os.Open("testdata/archive.ar")
+		require.NoError(t, err)
+		defer f.Close()
+
+		require.Error(t, extract.Deb(context.Background(), f, tmp.String(), nil))
+	})
+
+	t.Run("Truncated", func(t *testing.T) {
+		tmp := mkTempDir(t)
+		for _, data := range []string{"!<arch>", "!<arch>\ndebian"} {
+			require.Error(t, extract.Archive(context.Background(), strings.NewReader(data), tmp.String(), nil), data)
+		}
+	})
+}
@@ -0,0 +1,31 @@
+//go:build linux || darwin
+
+package extracttest
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+func (disk) Mknod(path string, mode os.FileMode, major, minor uint32) error {
+	typ := uint32(unix.S_IFIFO)
+	switch {
+	case mode&os.ModeCharDevice != 0:
+		typ = unix.S_IFCHR
+	case mode&os.ModeDevice != 0:
+		typ = unix.S_IFBLK
+	}
+	err := unix.Mknod(path, typ|uint32(mode.Perm()), int(unix.Mkdev(major, minor)))
+	if err != nil {
+		return &os.PathError{Op: "mknod", Path: path, Err: err}
+	}
+	return nil
+}
+
+func (disk) Lsetxattr(path, name string, value []byte) error {
+	if err := unix.Lsetxattr(path, name, value, 0); err != nil {
+		return &os.PathError{Op: "lsetxattr", Path: path, Err: err}
+	}
+	return nil
+}
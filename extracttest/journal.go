@@ -0,0 +1,87 @@
+package extracttest
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// UpdateEnv is the environment variable that, when set, makes CompareGolden
+// write the golden files instead of comparing them.
+const UpdateEnv = "EXTRACTTEST_UPDATE"
+
+// Lines returns the journal with an operation per line, like "open -rw-r--r--
+// dir/file.txt". The paths are relative to base and slash separated, and the
+// errors are reported without their message, so that the lines don't depend on
+// the machine running the test.
+func (m *LoggingFS) Lines(base string) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	lines := make([]string, 0, len(m.Journal))
+	for _, op := range m.Journal {
+		line := op.Op + " "
+		switch op.Op {
+		case "mkdirall", "open", "chmod", "mknod":
+			line += op.Mode.String() + " "
+		}
+		line += relative(base, op.Path)
+		switch op.Op {
+		case "link":
+			line += " -> " + relative(base, op.OldPath)
+		case "symlink":
+			line += " -> " + filepath.ToSlash(op.OldPath)
+		}
+		if op.Err != nil {
+			line += " error"
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func relative(base, path string) string {
+	if rel, err := filepath.Rel(base, path); err == nil && !strings.HasPrefix(rel, "..") {
+		path = rel
+	}
+	return filepath.ToSlash(path)
+}
+
+// CompareGolden compares lines with the ones of the golden file, failing t if
+// they differ. If the UpdateEnv environment variable is set the golden file is
+// written instead.
+func CompareGolden(t testing.TB, golden string, lines []string) {
+	t.Helper()
+	got := strings.Join(lines, "\n") + "\n"
+	if os.Getenv(UpdateEnv) != "" {
+		if err := os.WriteFile(golden, []byte(got), 0644); err != nil {
+			t.Fatalf("Write golden file %s: %s", golden, err)
+		}
+		return
+	}
+
+	data, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatalf("Read golden file %s: %s", golden, err)
+	}
+	if diff := Diff(strings.Split(strings.TrimSuffix(string(data), "\n"), "\n"), lines); diff != "" {
+		t.Errorf("The journal doesn't match %s (set %s=1 to update it):\n%s", golden, UpdateEnv, diff)
+	}
+}
+
+// Diff returns a description of the first difference between the expected
+// lines and the actual ones, or an empty string if they're the same.
+func Diff(want, got []string) string {
+	for i := 0; i < max(len(want), len(got)); i++ {
+		switch {
+		case i >= len(want):
+			return fmt.Sprintf("line %d: unexpected %q", i+1, got[i])
+		case i >= len(got):
+			return fmt.Sprintf("line %d: missing %q", i+1, want[i])
+		case want[i] != got[i]:
+			return fmt.Sprintf("line %d: expected %q, got %q", i+1, want[i], got[i])
+		}
+	}
+	return ""
+}
@@ -0,0 +1,375 @@
+// Package extracttest provides helpers to test the code using extract: a
+// LoggingFS journaling the operations made on another FS, which can also make
+// some of them fail, and functions to compare the journals with golden files.
+package extracttest
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codeclysm/extract/v5"
+)
+
+// ErrInjected is the error returned by the operations failed by a Fault without
+// an Err.
+var ErrInjected = errors.New("injected fault")
+
+// LoggingFS is an extract.FS that logs every operation made on the FS it wraps,
+// useful for unit-testing. If FS is nil the operations are made on the disk.
+// It implements the optional extract.NodeFS, extract.XattrFS,
+// extract.ChtimesFS, extract.RemoveAllFS, extract.ReadDirFS, extract.LstatFS,
+// extract.ReadlinkFS and extract.OpenFS interfaces too, failing with
+// errors.ErrUnsupported if the wrapped FS doesn't.
+type LoggingFS struct {
+	// FS is the wrapped FS, the disk if it's nil.
+	FS extract.FS
+
+	// Faults make the matching operations fail instead of being made on FS.
+	Faults []*Fault
+
+	// Log, if set, receives every operation as soon as it's made.
+	Log io.Writer
+
+	// Journal is the list of the operations made, in order.
+	Journal []*LoggedOp
+
+	mu sync.Mutex
+}
+
+// LoggedOp is an operation logged in a LoggingFS journal.
+type LoggedOp struct {
+	Op      string
+	Path    string
+	OldPath string
+	Mode    os.FileMode
+	Info    os.FileInfo
+	Flags   int
+	Err     error
+}
+
+func (op *LoggedOp) String() string {
+	res := ""
+	switch op.Op {
+	case "link":
+		res += fmt.Sprintf("link     %s -> %s", op.Path, op.OldPath)
+	case "symlink":
+		res += fmt.Sprintf("symlink  %s -> %s", op.Path, op.OldPath)
+	case "mkdirall":
+		res += fmt.Sprintf("mkdirall %v %s", op.Mode, op.Path)
+	case "open":
+		res += fmt.Sprintf("open     %v %s (flags=%04x)", op.Mode, op.Path, op.Flags)
+	case "mknod":
+		res += fmt.Sprintf("mknod    %v %s", op.Mode, op.Path)
+	case "lsetxattr":
+		res += fmt.Sprintf("lsetxattr %s", op.Path)
+	case "remove":
+		res += fmt.Sprintf("remove   %v", op.Path)
+	case "removeall":
+		res += fmt.Sprintf("removeall %v", op.Path)
+	case "stat":
+		res += fmt.Sprintf("stat     %v -> %v", op.Path, op.Info)
+	case "lstat":
+		res += fmt.Sprintf("lstat    %v -> %v", op.Path, op.Info)
+	case "readdir":
+		res += fmt.Sprintf("readdir  %v", op.Path)
+	case "read":
+		res += fmt.Sprintf("read     %v", op.Path)
+	case "readlink":
+		res += fmt.Sprintf("readlink %v", op.Path)
+	case "chmod":
+		res += fmt.Sprintf("chmod    %v %s", op.Mode, op.Path)
+	case "chtimes":
+		res += fmt.Sprintf("chtimes  %s", op.Path)
+	default:
+		panic("unknown LoggedOP " + op.Op)
+	}
+	if op.Err != nil {
+		res += " error: " + op.Err.Error()
+	} else {
+		res += " success"
+	}
+	return res
+}
+
+// Fault makes some operations of a LoggingFS fail.
+type Fault struct {
+	// Op is the name of the failing operation, such as "open" or "symlink", or
+	// every operation if it's empty.
+	Op string
+
+	// Pattern is matched against the slash separated path of the operation
+	// with path.Match, or against its base name if it has no slash. Every
+	// path matches if it's empty.
+	Pattern string
+
+	// Nth makes fail only the Nth operation matching Op and Pattern, counting
+	// from 1, instead of all of them.
+	Nth int
+
+	// Err is the error returned, ErrInjected if it's nil.
+	Err error
+
+	count int
+}
+
+// FailNth returns a Fault failing the nth operation of any kind.
+func FailNth(n int) *Fault {
+	return &Fault{Nth: n}
+}
+
+// FailOn returns a Fault failing the operations op on the paths matching pattern.
+func FailOn(op, pattern string) *Fault {
+	return &Fault{Op: op, Pattern: pattern}
+}
+
+// match tells if the fault makes the operation fail, counting it
+func (f *Fault) match(op *LoggedOp) bool {
+	if f.Op != "" && f.Op != op.Op {
+		return false
+	}
+	if f.Pattern != "" {
+		name := filepath.ToSlash(op.Path)
+		if !strings.Contains(f.Pattern, "/") {
+			name = path.Base(name)
+		}
+		if ok, _ := path.Match(f.Pattern, name); !ok {
+			return false
+		}
+	}
+	f.count++
+	return f.Nth == 0 || f.Nth == f.count
+}
+
+// do makes an operation, unless a fault makes it fail, and logs it
+func (m *LoggingFS) do(op *LoggedOp, f func() error) error {
+	m.mu.Lock()
+	for _, fault := range m.Faults {
+		if fault.match(op) {
+			op.Err = fault.Err
+			if op.Err == nil {
+				op.Err = ErrInjected
+			}
+			break
+		}
+	}
+	m.mu.Unlock()
+	if op.Err == nil {
+		op.Err = f()
+	}
+	m.log(op)
+	return op.Err
+}
+
+// log appends an operation to the journal, the files may be written concurrently
+func (m *LoggingFS) log(op *LoggedOp) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Journal = append(m.Journal, op)
+	if m.Log != nil {
+		fmt.Fprintln(m.Log, "FS>", op)
+	}
+}
+
+func (m *LoggingFS) fs() extract.FS {
+	if m.FS == nil {
+		return disk{}
+	}
+	return m.FS
+}
+
+func (m *LoggingFS) Link(oldname, newname string) error {
+	op := &LoggedOp{Op: "link", OldPath: oldname, Path: newname}
+	return m.do(op, func() error { return m.fs().Link(oldname, newname) })
+}
+
+func (m *LoggingFS) MkdirAll(path string, perm os.FileMode) error {
+	op := &LoggedOp{Op: "mkdirall", Path: path, Mode: perm}
+	return m.do(op, func() error { return m.fs().MkdirAll(path, perm) })
+}
+
+func (m *LoggingFS) Symlink(oldname, newname string) error {
+	op := &LoggedOp{Op: "symlink", OldPath: oldname, Path: newname}
+	return m.do(op, func() error { return m.fs().Symlink(oldname, newname) })
+}
+
+func (m *LoggingFS) OpenFile(name string, flags int, perm os.FileMode) (extract.File, error) {
+	var f extract.File
+	op := &LoggedOp{Op: "open", Path: name, Mode: perm, Flags: flags}
+	err := m.do(op, func() (err error) {
+		f, err = m.fs().OpenFile(name, flags, perm)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (m *LoggingFS) Mknod(path string, mode os.FileMode, major, minor uint32) error {
+	op := &LoggedOp{Op: "mknod", Path: path, Mode: mode}
+	return m.do(op, func() error {
+		fs, ok := m.fs().(extract.NodeFS)
+		if !ok {
+			return errors.ErrUnsupported
+		}
+		return fs.Mknod(path, mode, major, minor)
+	})
+}
+
+func (m *LoggingFS) Lsetxattr(path, name string, value []byte) error {
+	op := &LoggedOp{Op: "lsetxattr", Path: path}
+	return m.do(op, func() error {
+		fs, ok := m.fs().(extract.XattrFS)
+		if !ok {
+			return errors.ErrUnsupported
+		}
+		return fs.Lsetxattr(path, name, value)
+	})
+}
+
+func (m *LoggingFS) Remove(path string) error {
+	op := &LoggedOp{Op: "remove", Path: path}
+	return m.do(op, func() error { return m.fs().Remove(path) })
+}
+
+func (m *LoggingFS) Stat(path string) (os.FileInfo, error) {
+	op := &LoggedOp{Op: "stat", Path: path}
+	err := m.do(op, func() (err error) {
+		op.Info, err = m.fs().Stat(path)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return op.Info, nil
+}
+
+func (m *LoggingFS) Lstat(path string) (os.FileInfo, error) {
+	op := &LoggedOp{Op: "lstat", Path: path}
+	err := m.do(op, func() (err error) {
+		fs, ok := m.fs().(extract.LstatFS)
+		if !ok {
+			return errors.ErrUnsupported
+		}
+		op.Info, err = fs.Lstat(path)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return op.Info, nil
+}
+
+func (m *LoggingFS) Chmod(path string, mode os.FileMode) error {
+	op := &LoggedOp{Op: "chmod", Path: path, Mode: mode}
+	return m.do(op, func() error { return m.fs().Chmod(path, mode) })
+}
+
+func (m *LoggingFS) Chtimes(path string, atime, mtime time.Time) error {
+	op := &LoggedOp{Op: "chtimes", Path: path}
+	return m.do(op, func() error {
+		fs, ok := m.fs().(extract.ChtimesFS)
+		if !ok {
+			return errors.ErrUnsupported
+		}
+		return fs.Chtimes(path, atime, mtime)
+	})
+}
+
+func (m *LoggingFS) RemoveAll(path string) error {
+	op := &LoggedOp{Op: "removeall", Path: path}
+	return m.do(op, func() error {
+		fs, ok := m.fs().(extract.RemoveAllFS)
+		if !ok {
+			return errors.ErrUnsupported
+		}
+		return fs.RemoveAll(path)
+	})
+}
+
+func (m *LoggingFS) ReadDir(path string) ([]os.DirEntry, error) {
+	var entries []os.DirEntry
+	op := &LoggedOp{Op: "readdir", Path: path}
+	err := m.do(op, func() (err error) {
+		fs, ok := m.fs().(extract.ReadDirFS)
+		if !ok {
+			return errors.ErrUnsupported
+		}
+		entries, err = fs.ReadDir(path)
+		return err
+	})
+	return entries, err
+}
+
+func (m *LoggingFS) Open(path string) (io.ReadCloser, error) {
+	var r io.ReadCloser
+	op := &LoggedOp{Op: "read", Path: path}
+	err := m.do(op, func() (err error) {
+		fs, ok := m.fs().(extract.OpenFS)
+		if !ok {
+			return errors.ErrUnsupported
+		}
+		r, err = fs.Open(path)
+		return err
+	})
+	return r, err
+}
+
+func (m *LoggingFS) Readlink(path string) (string, error) {
+	var target string
+	op := &LoggedOp{Op: "readlink", Path: path}
+	err := m.do(op, func() (err error) {
+		fs, ok := m.fs().(extract.ReadlinkFS)
+		if !ok {
+			return errors.ErrUnsupported
+		}
+		target, err = fs.Readlink(path)
+		return err
+	})
+	return target, err
+}
+
+func (m *LoggingFS) String() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res := ""
+	for _, op := range m.Journal {
+		res += op.String()
+		res += "\n"
+	}
+	return res
+}
+
+// disk is the FS writing on the disk
+type disk struct{}
+
+func (disk) Link(oldname, newname string) error           { return os.Link(oldname, newname) }
+func (disk) MkdirAll(path string, perm os.FileMode) error { return os.MkdirAll(path, perm) }
+func (disk) Symlink(oldname, newname string) error        { return os.Symlink(oldname, newname) }
+func (disk) Remove(path string) error                     { return os.Remove(path) }
+func (disk) Stat(name string) (os.FileInfo, error)        { return os.Stat(name) }
+func (disk) Lstat(name string) (os.FileInfo, error)       { return os.Lstat(name) }
+func (disk) Chmod(name string, mode os.FileMode) error    { return os.Chmod(name, mode) }
+func (disk) RemoveAll(path string) error                  { return os.RemoveAll(path) }
+func (disk) ReadDir(name string) ([]os.DirEntry, error)   { return os.ReadDir(name) }
+func (disk) Open(name string) (io.ReadCloser, error)      { return os.Open(name) }
+func (disk) Readlink(name string) (string, error)         { return os.Readlink(name) }
+
+func (disk) Chtimes(name string, atime, mtime time.Time) error {
+	return os.Chtimes(name, atime, mtime)
+}
+
+func (disk) OpenFile(name string, flag int, perm os.FileMode) (extract.File, error) {
+	file, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
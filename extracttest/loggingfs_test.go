@@ -0,0 +1,63 @@
+package extracttest_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/codeclysm/extract/v5"
+	"github.com/codeclysm/extract/v5/extracttest"
+	"github.com/stretchr/testify/require"
+)
+
+func makeTar() []byte {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	tw.WriteHeader(&tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755})
+	for _, name := range []string{"dir/a.txt", "dir/b.txt", "c.txt"} {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: 4})
+		tw.Write([]byte("Data"))
+	}
+	tw.WriteHeader(&tar.Header{Name: "dir/link", Typeflag: tar.TypeSymlink, Linkname: "a.txt"})
+	tw.Close()
+	return buf.Bytes()
+}
+
+func TestLoggingFS(t *testing.T) {
+	t.Run("Golden", func(t *testing.T) {
+		mem := &extract.MemFS{}
+		fs := &extracttest.LoggingFS{FS: mem}
+		extractor := extract.Extractor{FS: fs}
+		require.NoError(t, extractor.Tar(context.Background(), bytes.NewReader(makeTar()), "/out", nil))
+		extracttest.CompareGolden(t, "testdata/tar.golden", fs.Lines("/out"))
+
+		data, err := mem.ReadFile("/out/dir/link")
+		require.NoError(t, err)
+		require.Equal(t, "Data", string(data))
+	})
+
+	t.Run("FailNth", func(t *testing.T) {
+		fs := &extracttest.LoggingFS{FS: &extract.MemFS{}, Faults: []*extracttest.Fault{extracttest.FailNth(4)}}
+		extractor := extract.Extractor{FS: fs}
+		err := extractor.Tar(context.Background(), bytes.NewReader(makeTar()), "/out", nil)
+		require.ErrorContains(t, err, extracttest.ErrInjected.Error())
+		require.Len(t, fs.Journal, 4)
+		require.Equal(t, extracttest.ErrInjected, fs.Journal[3].Err)
+	})
+
+	t.Run("FailOn", func(t *testing.T) {
+		fs := &extracttest.LoggingFS{FS: &extract.MemFS{}, Faults: []*extracttest.Fault{extracttest.FailOn("open", "b.*")}}
+		extractor := extract.Extractor{FS: fs}
+		err := extractor.Tar(context.Background(), bytes.NewReader(makeTar()), "/out", nil)
+		require.ErrorContains(t, err, extracttest.ErrInjected.Error())
+		lines := fs.Lines("/out")
+		require.Equal(t, "open -rw-r--r-- dir/b.txt error", lines[len(lines)-1])
+	})
+
+	t.Run("Diff", func(t *testing.T) {
+		require.Empty(t, extracttest.Diff([]string{"a", "b"}, []string{"a", "b"}))
+		require.Equal(t, `line 2: expected "b", got "c"`, extracttest.Diff([]string{"a", "b"}, []string{"a", "c"}))
+		require.Equal(t, `line 2: missing "b"`, extracttest.Diff([]string{"a", "b"}, []string{"a"}))
+	})
+}
@@ -0,0 +1,97 @@
+package extract
+
+import (
+	"io"
+	"os"
+)
+
+// FS is where an Extractor writes the files. It can also implement NodeFS,
+// XattrFS, RemoveAllFS, ReadDirFS, LstatFS, ReadlinkFS, ChtimesFS and OpenFS.
+type FS interface {
+	// Link creates newname as a hard link to the oldname file. If there is an error, it will be of type *LinkError.
+	Link(oldname, newname string) error
+
+	// MkdirAll creates the directory path and all his parents if needed.
+	MkdirAll(path string, perm os.FileMode) error
+
+	// OpenFile opens the named file for writing, with the specified flag (O_CREATE etc.).
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+
+	// Symlink creates newname as a symbolic link to oldname.
+	Symlink(oldname, newname string) error
+
+	// Remove removes the named file or (empty) directory.
+	Remove(path string) error
+
+	// Stat returns a FileInfo describing the named file.
+	Stat(name string) (os.FileInfo, error)
+
+	// Chmod changes the mode of the named file to mode.
+	// If the file is a symbolic link, it changes the mode of the link's target.
+	Chmod(name string, mode os.FileMode) error
+}
+
+// File is a file opened by the FS of an Extractor. Only its Write and Close
+// methods are used, unless it also has a CloseWithError(error) error method
+// like *io.PipeWriter, which is called instead of Close when the data of the
+// file can't be written entirely.
+type File interface {
+	io.WriteCloser
+}
+
+// abortFile closes a file whose data is incomplete, with CloseWithError if it
+// has it
+func abortFile(file File, err error) {
+	if f, ok := file.(interface{ CloseWithError(error) error }); ok {
+		f.CloseWithError(err)
+	} else {
+		file.Close()
+	}
+}
+
+// OSFS is the FS of the previous versions, whose OpenFile returns an *os.File.
+// It can be used as an FS through FromOSFS.
+type OSFS interface {
+	Link(oldname, newname string) error
+	MkdirAll(path string, perm os.FileMode) error
+	OpenFile(name string, flag int, perm os.FileMode) (*os.File, error)
+	Symlink(oldname, newname string) error
+	Remove(path string) error
+	Stat(name string) (os.FileInfo, error)
+	Chmod(name string, mode os.FileMode) error
+}
+
+// FromOSFS returns an FS writing on fs. The optional interfaces implemented by fs,
+// such as NodeFS, are still used by the Extractor.
+func FromOSFS(fs OSFS) FS {
+	return osFS{fs}
+}
+
+type osFS struct {
+	OSFS
+}
+
+func (f osFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	file, err := f.OSFS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (f osFS) unwrap() any {
+	return f.OSFS
+}
+
+// fsAs returns fs as a T, looking also inside the adapters like FromOSFS
+func fsAs[T any](fs FS) (T, bool) {
+	if t, ok := fs.(T); ok {
+		return t, true
+	}
+	if wrapper, ok := fs.(interface{ unwrap() any }); ok {
+		t, ok := wrapper.unwrap().(T)
+		return t, ok
+	}
+	var zero T
+	return zero, false
+}
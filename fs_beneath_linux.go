@@ -0,0 +1,377 @@
+package extract
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// BeneathFS is an FS writing only beneath a directory, which it keeps open.
+// Every path is resolved from the directory with openat2 and
+// RESOLVE_BENEATH|RESOLVE_NO_SYMLINKS, or component by component with
+// O_NOFOLLOW on the kernels older than 5.6, so that no file can be created
+// outside of it even if the symlinks in it are changed during the extraction.
+// The symlinks are never followed, not even by Stat and Chmod.
+type BeneathFS struct {
+	dir string
+	fd  int
+
+	// noOpenat2 is set when the kernel doesn't support openat2
+	noOpenat2 atomic.Bool
+}
+
+// OpenBeneath opens dir, which must exist, to write beneath it. The paths given
+// to the returned FS must be inside dir, so dir is usually the location passed
+// to the Extractor. It must be closed after the extraction.
+func OpenBeneath(dir string) (*BeneathFS, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := unix.Open(dir, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: dir, Err: err}
+	}
+	return &BeneathFS{dir: dir, fd: fd}, nil
+}
+
+// Close closes the directory.
+func (b *BeneathFS) Close() error {
+	return unix.Close(b.fd)
+}
+
+// rel returns path relative to the directory, in slash form
+func (b *BeneathFS) rel(op, path string) (string, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", &os.PathError{Op: op, Path: path, Err: err}
+	}
+	rel, err := filepath.Rel(b.dir, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", &os.PathError{Op: op, Path: path, Err: unix.EXDEV}
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+// beneathRetries is how many times openat2 is tried again when a rename in the
+// directory makes it fail, before walking the components one at a time
+const beneathRetries = 16
+
+// syscallMode returns the permissions and the setuid, setgid and sticky bits of
+// mode as the ones of the syscalls, like os.OpenFile does
+func syscallMode(mode os.FileMode) uint32 {
+	res := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		res |= unix.S_ISUID
+	}
+	if mode&os.ModeSetgid != 0 {
+		res |= unix.S_ISGID
+	}
+	if mode&os.ModeSticky != 0 {
+		res |= unix.S_ISVTX
+	}
+	return res
+}
+
+// openDir opens the directory rel with O_PATH, creating it and its parents
+// with perm if mkdir is true. The returned fd must be closed.
+func (b *BeneathFS) openDir(rel string, mkdir bool, perm os.FileMode) (int, error) {
+	if !mkdir && !b.noOpenat2.Load() {
+		how := &unix.OpenHow{
+			Flags:   unix.O_PATH | unix.O_DIRECTORY | unix.O_CLOEXEC,
+			Resolve: unix.RESOLVE_BENEATH | unix.RESOLVE_NO_SYMLINKS,
+		}
+		for i := 0; ; i++ {
+			fd, err := unix.Openat2(b.fd, rel, how)
+			if err == unix.EAGAIN {
+				// The directory was being renamed, it's safe to try again
+				if i < beneathRetries {
+					continue
+				}
+				break
+			}
+			if err != unix.ENOSYS {
+				return fd, err
+			}
+			b.noOpenat2.Store(true)
+			break
+		}
+	}
+
+	// Walk the components one at a time. They are already clean, so none of
+	// them is "..", and O_NOFOLLOW makes the symlinks fail with ENOTDIR.
+	fd := b.fd
+	for _, name := range strings.Split(rel, "/") {
+		if mkdir && name != "." {
+			if err := unix.Mkdirat(fd, name, syscallMode(perm)); err != nil && err != unix.EEXIST {
+				if fd != b.fd {
+					unix.Close(fd)
+				}
+				return -1, err
+			}
+		}
+		next, err := unix.Openat(fd, name, unix.O_PATH|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+		if fd != b.fd {
+			unix.Close(fd)
+		}
+		if err != nil {
+			return -1, err
+		}
+		fd = next
+	}
+	return fd, nil
+}
+
+// parent opens the parent directory of path, returning its fd, which must be
+// closed, and the name of path in it
+func (b *BeneathFS) parent(op, path string) (int, string, error) {
+	rel, err := b.rel(op, path)
+	if err != nil {
+		return -1, "", err
+	}
+	if rel == "." {
+		return -1, "", &os.PathError{Op: op, Path: path, Err: unix.EBUSY}
+	}
+	dir, name := ".", rel
+	if i := strings.LastIndex(rel, "/"); i >= 0 {
+		dir, name = rel[:i], rel[i+1:]
+	}
+	fd, err := b.openDir(dir, false, 0)
+	if err != nil {
+		return -1, "", &os.PathError{Op: op, Path: path, Err: err}
+	}
+	return fd, name, nil
+}
+
+// open opens path with O_PATH, without following it if it's a symlink
+func (b *BeneathFS) open(op, path string) (*os.File, error) {
+	rel, err := b.rel(op, path)
+	if err != nil {
+		return nil, err
+	}
+	if rel == "." {
+		fd, err := unix.Dup(b.fd)
+		if err != nil {
+			return nil, &os.PathError{Op: op, Path: path, Err: err}
+		}
+		return os.NewFile(uintptr(fd), path), nil
+	}
+	dirfd, name, err := b.parent(op, path)
+	if err != nil {
+		return nil, err
+	}
+	defer unix.Close(dirfd)
+	fd, err := unix.Openat(dirfd, name, unix.O_PATH|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: op, Path: path, Err: err}
+	}
+	return os.NewFile(uintptr(fd), path), nil
+}
+
+func (b *BeneathFS) Link(oldname, newname string) error {
+	olddir, oldbase, err := b.parent("link", oldname)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(olddir)
+	newdir, newbase, err := b.parent("link", newname)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(newdir)
+	if err := unix.Linkat(olddir, oldbase, newdir, newbase, 0); err != nil {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: err}
+	}
+	return nil
+}
+
+func (b *BeneathFS) MkdirAll(path string, perm os.FileMode) error {
+	rel, err := b.rel("mkdir", path)
+	if err != nil {
+		return err
+	}
+	fd, err := b.openDir(rel, true, perm)
+	if err != nil {
+		return &os.PathError{Op: "mkdir", Path: path, Err: err}
+	}
+	return unix.Close(fd)
+}
+
+func (b *BeneathFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	dirfd, base, err := b.parent("open", name)
+	if err != nil {
+		return nil, err
+	}
+	defer unix.Close(dirfd)
+	fd, err := unix.Openat(dirfd, base, flag|unix.O_NOFOLLOW|unix.O_CLOEXEC, syscallMode(perm))
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	return os.NewFile(uintptr(fd), name), nil
+}
+
+func (b *BeneathFS) Symlink(oldname, newname string) error {
+	dirfd, base, err := b.parent("symlink", newname)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(dirfd)
+	if err := unix.Symlinkat(oldname, dirfd, base); err != nil {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: err}
+	}
+	return nil
+}
+
+func (b *BeneathFS) Remove(path string) error {
+	dirfd, base, err := b.parent("remove", path)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(dirfd)
+	err = unix.Unlinkat(dirfd, base, 0)
+	if err == unix.EISDIR {
+		err = unix.Unlinkat(dirfd, base, unix.AT_REMOVEDIR)
+	}
+	if err != nil {
+		return &os.PathError{Op: "remove", Path: path, Err: err}
+	}
+	return nil
+}
+
+// Open opens the named file for reading, failing if it's a symlink.
+func (b *BeneathFS) Open(name string) (io.ReadCloser, error) {
+	return b.openRead("open", name, 0)
+}
+
+// ReadDir reads the named directory, returning all its entries sorted by
+// filename.
+func (b *BeneathFS) ReadDir(name string) ([]os.DirEntry, error) {
+	f, err := b.openRead("readdir", name, unix.O_DIRECTORY)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	entries, err := f.ReadDir(-1)
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, err
+}
+
+// openRead opens path for reading, without following it if it's a symlink
+func (b *BeneathFS) openRead(op, path string, flag int) (*os.File, error) {
+	flag |= unix.O_RDONLY | unix.O_NOFOLLOW | unix.O_CLOEXEC
+	if rel, err := b.rel(op, path); err != nil {
+		return nil, err
+	} else if rel == "." {
+		fd, err := unix.Openat(b.fd, ".", flag, 0)
+		if err != nil {
+			return nil, &os.PathError{Op: op, Path: path, Err: err}
+		}
+		return os.NewFile(uintptr(fd), path), nil
+	}
+	dirfd, base, err := b.parent(op, path)
+	if err != nil {
+		return nil, err
+	}
+	defer unix.Close(dirfd)
+	fd, err := unix.Openat(dirfd, base, flag, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: op, Path: path, Err: err}
+	}
+	return os.NewFile(uintptr(fd), path), nil
+}
+
+// Stat returns a FileInfo describing the named file, which is the symlink
+// itself for a symlink.
+func (b *BeneathFS) Stat(name string) (os.FileInfo, error) {
+	f, err := b.open("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Stat()
+}
+
+// Lstat is the same as Stat.
+func (b *BeneathFS) Lstat(name string) (os.FileInfo, error) {
+	return b.Stat(name)
+}
+
+// Readlink returns the target of the named symlink.
+func (b *BeneathFS) Readlink(name string) (string, error) {
+	dirfd, base, err := b.parent("readlink", name)
+	if err != nil {
+		return "", err
+	}
+	defer unix.Close(dirfd)
+	buf := make([]byte, 128)
+	for {
+		n, err := unix.Readlinkat(dirfd, base, buf)
+		if err != nil {
+			return "", &os.PathError{Op: "readlink", Path: name, Err: err}
+		}
+		if n < len(buf) {
+			return string(buf[:n]), nil
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
+
+// Chmod changes the mode of the named file, failing if it's a symlink.
+func (b *BeneathFS) Chmod(name string, mode os.FileMode) error {
+	f, err := b.open("chmod", name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err != nil {
+		return err
+	} else if info.Mode()&os.ModeSymlink != 0 {
+		return &os.PathError{Op: "chmod", Path: name, Err: unix.ELOOP}
+	}
+	// An O_PATH fd can't be passed to fchmod, but its link in /proc refers to
+	// the file it was opened on
+	err = os.Chmod("/proc/self/fd/"+strconv.Itoa(int(f.Fd())), mode)
+	if pathErr, ok := err.(*os.PathError); ok {
+		pathErr.Path = name
+	}
+	return err
+}
+
+func (b *BeneathFS) Chtimes(name string, atime, mtime time.Time) error {
+	dirfd, base, err := b.parent("chtimes", name)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(dirfd)
+	times := []unix.Timespec{unix.NsecToTimespec(atime.UnixNano()), unix.NsecToTimespec(mtime.UnixNano())}
+	if err := unix.UtimesNanoAt(dirfd, base, times, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return &os.PathError{Op: "chtimes", Path: name, Err: err}
+	}
+	return nil
+}
+
+func (b *BeneathFS) Mknod(path string, mode os.FileMode, major, minor uint32) error {
+	dirfd, base, err := b.parent("mknod", path)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(dirfd)
+	typ := uint32(unix.S_IFIFO)
+	switch {
+	case mode&os.ModeCharDevice != 0:
+		typ = unix.S_IFCHR
+	case mode&os.ModeDevice != 0:
+		typ = unix.S_IFBLK
+	}
+	if err := unix.Mknodat(dirfd, base, typ|syscallMode(mode), int(unix.Mkdev(major, minor))); err != nil {
+		return &os.PathError{Op: "mknod", Path: path, Err: err}
+	}
+	return nil
+}
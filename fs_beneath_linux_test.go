@@ -0,0 +1,81 @@
+package extract_test
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+
+	"github.com/codeclysm/extract/v5"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBeneathFS(t *testing.T) {
+	for _, archive := range []string{"archive.tar.gz", "archive.zip"} {
+		t.Run(archive, func(t *testing.T) {
+			tmp := mkTempDir(t)
+			fs, err := extract.OpenBeneath(tmp.String())
+			require.NoError(t, err)
+			defer fs.Close()
+
+			data, err := os.ReadFile("testdata/" + archive)
+			require.NoError(t, err)
+			extractor := extract.Extractor{FS: fs}
+			require.NoError(t, extractor.Archive(context.Background(), bytes.NewReader(data), tmp.String(), nil))
+
+			content, err := tmp.Join("archive", "file1.txt").ReadFile()
+			require.NoError(t, err)
+			require.Equal(t, "File1", string(bytes.TrimSpace(content)))
+			info, err := fs.Stat(tmp.Join("archive", "folderlink").String())
+			require.NoError(t, err)
+			require.Equal(t, os.ModeSymlink, info.Mode().Type())
+		})
+	}
+
+	t.Run("SpecialBits", func(t *testing.T) {
+		userUmask := UnixUmaskZero()
+		defer UnixUmask(userUmask)
+
+		tmp := mkTempDir(t)
+		fs, err := extract.OpenBeneath(tmp.String())
+		require.NoError(t, err)
+		defer fs.Close()
+
+		f, err := fs.OpenFile(tmp.Join("setuid").String(), os.O_CREATE|os.O_WRONLY, os.ModeSetuid|0755)
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+		require.NoError(t, fs.MkdirAll(tmp.Join("sticky").String(), os.ModeSticky|0777))
+
+		info, err := fs.Stat(tmp.Join("setuid").String())
+		require.NoError(t, err)
+		require.Equal(t, os.ModeSetuid|0755, info.Mode())
+		info, err = fs.Stat(tmp.Join("sticky").String())
+		require.NoError(t, err)
+		require.Equal(t, os.ModeDir|os.ModeSticky|0777, info.Mode())
+	})
+
+	t.Run("Escape", func(t *testing.T) {
+		tmp, outside := mkTempDir(t), mkTempDir(t)
+		fs, err := extract.OpenBeneath(tmp.String())
+		require.NoError(t, err)
+		defer fs.Close()
+
+		// A symlink created after the checks of the Extractor can't be followed
+		require.NoError(t, os.Symlink(outside.String(), tmp.Join("escape").String()))
+		_, err = fs.OpenFile(tmp.Join("escape", "file.txt").String(), os.O_CREATE|os.O_WRONLY, 0644)
+		require.Error(t, err)
+		require.Error(t, fs.MkdirAll(tmp.Join("escape", "dir").String(), 0755))
+		require.Error(t, fs.Symlink("target", tmp.Join("escape", "link").String()))
+		require.Error(t, fs.Chmod(tmp.Join("escape").String(), 0700))
+		_, err = fs.OpenFile(tmp.Join("escape").String(), os.O_CREATE|os.O_WRONLY, 0644)
+		require.Error(t, err)
+
+		_, err = fs.OpenFile(outside.Join("file.txt").String(), os.O_CREATE|os.O_WRONLY, 0644)
+		require.Error(t, err)
+		require.Error(t, fs.Link(tmp.Join("escape").String(), outside.Join("link").String()))
+
+		entries, err := outside.ReadDir()
+		require.NoError(t, err)
+		require.Empty(t, entries)
+	})
+}
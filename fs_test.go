@@ -0,0 +1,52 @@
+package extract_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/codeclysm/extract/v5"
+	"github.com/codeclysm/extract/v5/extracttest"
+	"github.com/stretchr/testify/require"
+)
+
+// osLoggingFS is a LoggingFS whose OpenFile returns an *os.File, like the FS of
+// the previous versions
+type osLoggingFS struct {
+	extracttest.LoggingFS
+}
+
+func (m *osLoggingFS) OpenFile(name string, flags int, perm os.FileMode) (*os.File, error) {
+	f, err := m.LoggingFS.OpenFile(name, flags, perm)
+	if err != nil {
+		return nil, err
+	}
+	return f.(*os.File), nil
+}
+
+func TestFromOSFS(t *testing.T) {
+	mtime := time.Date(2020, 5, 4, 3, 2, 1, 0, time.UTC)
+	buf := &bytes.Buffer{}
+	gw := gzip.NewWriter(buf)
+	gw.Name = "notes.txt"
+	gw.ModTime = mtime
+	gw.Write([]byte("Notes"))
+	gw.Close()
+
+	tmp := mkTempDir(t)
+	fs := &osLoggingFS{}
+	extractor := extract.Extractor{FS: extract.FromOSFS(fs), KeepOriginalName: true}
+	require.NoError(t, extractor.Gz(context.Background(), buf, tmp.String(), nil))
+	testWalk(t, tmp.String(), Files{
+		"":           "dir",
+		"/notes.txt": "Notes",
+	})
+	// The optional interfaces of the adapted FS are used too
+	st, err := tmp.Join("notes.txt").Stat()
+	require.NoError(t, err)
+	require.True(t, st.ModTime().Equal(mtime))
+	require.Contains(t, fs.String(), "chtimes")
+}
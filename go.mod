@@ -1,4 +1,4 @@
-module github.com/codeclysm/extract/v4
+module github.com/codeclysm/extract/v5
 
 go 1.22
 
@@ -11,7 +11,9 @@ require (
 	github.com/klauspost/compress v1.15.13
 	github.com/stretchr/testify v1.9.0
 	github.com/ulikunitz/xz v0.5.12
+	golang.org/x/crypto v0.18.0
 	golang.org/x/sys v0.16.0
+	golang.org/x/text v0.21.0
 )
 
 require (
@@ -0,0 +1,470 @@
+package extract
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/juju/errors"
+)
+
+const isoSectorSize = 2048
+
+// isoMagicOffset is the offset of the "CD001" identifier of the first volume
+// descriptor, after the 16 sectors of the system area
+const isoMagicOffset = 16*isoSectorSize + 1
+
+// isIso checks if buf starts with an ISO 9660 image
+func isIso(buf []byte) bool {
+	return len(buf) >= isoMagicOffset+5 && string(buf[isoMagicOffset:isoMagicOffset+5]) == "CD001"
+}
+
+// isoImage reads the directory hierarchy of an ISO 9660 image
+type isoImage struct {
+	r io.ReaderAt
+
+	// joliet is true when the names are read from a Joliet supplementary volume
+	joliet bool
+
+	// rockRidge is true when the image has the Rock Ridge extensions, and
+	// susp is the number of bytes to skip in every system use area
+	rockRidge bool
+	susp      int
+}
+
+// isoRecord is a directory record, merged with the Rock Ridge information
+type isoRecord struct {
+	Name     string
+	Extents  []isoExtent
+	Dir      bool
+	Mode     os.FileMode
+	Linkname string
+	ModTime  time.Time
+
+	// relocated is true for the directories moved by Rock Ridge to keep the
+	// hierarchy within 8 levels: they are reached through their child link
+	relocated bool
+}
+
+type isoExtent struct {
+	Block  uint32
+	Length uint32
+}
+
+// open returns a reader over the content of the record, joining multi-extent files
+func (i *isoImage) open(r *isoRecord) io.Reader {
+	readers := []io.Reader{}
+	for _, extent := range r.Extents {
+		readers = append(readers, io.NewSectionReader(i.r, int64(extent.Block)*isoSectorSize, int64(extent.Length)))
+	}
+	return io.MultiReader(readers...)
+}
+
+// openIso reads the volume descriptors of the image and returns the root
+// directory, preferring Rock Ridge over Joliet over plain ISO 9660 names
+func openIso(r io.ReaderAt) (*isoImage, *isoRecord, error) {
+	var primary, joliet []byte
+	for sector := int64(16); sector < 16+64; sector++ {
+		descriptor := make([]byte, isoSectorSize)
+		if _, err := r.ReadAt(descriptor, sector*isoSectorSize); err != nil {
+			return nil, nil, errors.Annotatef(err, "Read iso volume descriptor")
+		}
+		if string(descriptor[1:6]) != "CD001" {
+			return nil, nil, errors.New("Not an iso image")
+		}
+		switch descriptor[0] {
+		case 1:
+			if primary == nil {
+				primary = descriptor
+			}
+		case 2:
+			escape := string(descriptor[88:91])
+			if escape == "%/@" || escape == "%/C" || escape == "%/E" {
+				joliet = descriptor
+			}
+		}
+		if descriptor[0] == 255 {
+			break
+		}
+		if sector == 16+63 {
+			return nil, nil, errors.New("Iso volume descriptor set terminator not found")
+		}
+	}
+	if primary == nil {
+		return nil, nil, errors.New("Iso image without primary volume descriptor")
+	}
+	if blockSize := binary.LittleEndian.Uint16(primary[128:130]); blockSize != isoSectorSize {
+		return nil, nil, errors.Errorf("Unsupported iso logical block size %d", blockSize)
+	}
+
+	image := &isoImage{r: r}
+	root, err := image.parseRecord(primary[156:190])
+	if err != nil {
+		return nil, nil, errors.Annotatef(err, "Read iso root directory")
+	}
+
+	// Rock Ridge is announced by a SUSP "SP" entry in the first record of the root
+	first := make([]byte, 255)
+	if _, err := r.ReadAt(first, int64(root.Extents[0].Block)*isoSectorSize); err != nil {
+		return nil, nil, errors.Annotatef(err, "Read iso root directory")
+	}
+	if length := int(first[0]); length >= 34 && length <= len(first) {
+		offset := isoSystemUse(int(first[32]))
+		if offset > length {
+			return nil, nil, errors.New("Invalid iso directory record")
+		}
+		systemUse := first[offset:length]
+		if len(systemUse) >= 7 && string(systemUse[0:2]) == "SP" && systemUse[4] == 0xbe && systemUse[5] == 0xef {
+			image.rockRidge = true
+			image.susp = int(systemUse[6])
+		}
+	}
+
+	if !image.rockRidge && joliet != nil {
+		image.joliet = true
+		if root, err = image.parseRecord(joliet[156:190]); err != nil {
+			return nil, nil, errors.Annotatef(err, "Read iso root directory")
+		}
+	}
+	return image, root, nil
+}
+
+// isoSystemUse returns the offset of the system use area of a directory record,
+// after the name and the padding byte that makes its length even
+func isoSystemUse(nameLen int) int {
+	return 33 + nameLen + 1 - nameLen%2
+}
+
+// parseRecord parses a single directory record
+func (i *isoImage) parseRecord(raw []byte) (*isoRecord, error) {
+	if len(raw) < 34 || int(raw[0]) > len(raw) || int(raw[0]) < isoSystemUse(int(raw[32])) {
+		return nil, errors.New("Invalid iso directory record")
+	}
+	raw = raw[:raw[0]]
+	flags := raw[25]
+	nameLen := int(raw[32])
+	rawName := raw[33 : 33+nameLen]
+
+	record := &isoRecord{
+		Extents: []isoExtent{{
+			Block:  binary.LittleEndian.Uint32(raw[2:6]),
+			Length: binary.LittleEndian.Uint32(raw[10:14]),
+		}},
+		Dir:     flags&0x02 != 0,
+		ModTime: isoRecordTime(raw[18:25]),
+	}
+
+	switch {
+	case nameLen == 1 && (rawName[0] == 0 || rawName[0] == 1):
+		// "." and ".." records
+		record.Name = string(rawName)
+	case i.joliet:
+		units := make([]uint16, nameLen/2)
+		for j := range units {
+			units[j] = binary.BigEndian.Uint16(rawName[j*2:])
+		}
+		record.Name = isoCleanName(string(utf16.Decode(units)))
+	default:
+		record.Name = isoCleanName(string(rawName))
+	}
+
+	if record.Dir {
+		record.Mode = os.ModeDir | 0755
+	} else {
+		record.Mode = 0644
+	}
+
+	if i.rockRidge {
+		systemUse := raw[isoSystemUse(nameLen):]
+		if len(systemUse) > i.susp {
+			if err := i.parseRockRidge(record, systemUse[i.susp:]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return record, nil
+}
+
+// isoRecordTime returns the recording time of a directory record, zero if it's
+// not specified
+func isoRecordTime(b []byte) time.Time {
+	if b[0] == 0 && b[1] == 0 && b[2] == 0 {
+		return time.Time{}
+	}
+	// The offset from UTC is in intervals of 15 minutes
+	zone := time.FixedZone("", int(int8(b[6]))*15*60)
+	return time.Date(1900+int(b[0]), time.Month(b[1]), int(b[2]), int(b[3]), int(b[4]), int(b[5]), 0, zone)
+}
+
+// isoCleanName removes the version and the trailing dot from an ISO 9660 name
+func isoCleanName(name string) string {
+	if idx := strings.LastIndex(name, ";"); idx != -1 {
+		name = name[:idx]
+	}
+	return strings.TrimSuffix(name, ".")
+}
+
+// parseRockRidge reads the SUSP entries of a record, following continuation areas
+func (i *isoImage) parseRockRidge(record *isoRecord, area []byte) error {
+	name := ""
+	hasName := false
+	var mode os.FileMode
+	hasMode := false
+	linkname := []string{}
+	component := ""
+	for continuations := 0; area != nil; continuations++ {
+		if continuations > 32 {
+			return errors.New("Too many iso continuation areas")
+		}
+		next := []byte(nil)
+		for len(area) >= 4 {
+			sig := string(area[0:2])
+			length := int(area[2])
+			if length < 4 || length > len(area) {
+				break
+			}
+			entry := area[:length]
+			area = area[length:]
+
+			switch sig {
+			case "ST":
+				area = nil
+			case "CE":
+				if length < 28 {
+					return errors.New("Invalid iso continuation entry")
+				}
+				block := binary.LittleEndian.Uint32(entry[4:8])
+				offset := binary.LittleEndian.Uint32(entry[12:16])
+				size := binary.LittleEndian.Uint32(entry[20:24])
+				if size > isoSectorSize {
+					return errors.New("Invalid iso continuation entry")
+				}
+				next = make([]byte, size)
+				if _, err := i.r.ReadAt(next, int64(block)*isoSectorSize+int64(offset)); err != nil {
+					return errors.Annotatef(err, "Read iso continuation area")
+				}
+			case "PX":
+				if length >= 12 {
+					mode = unixMode(binary.LittleEndian.Uint32(entry[4:8]))
+					hasMode = true
+				}
+			case "NM":
+				if length >= 5 && entry[4]&0x06 == 0 {
+					name += string(entry[5:])
+					hasName = true
+				}
+			case "SL":
+				if length < 5 {
+					continue
+				}
+				components := entry[5:]
+				for len(components) >= 2 {
+					flags, size := components[0], int(components[1])
+					if 2+size > len(components) {
+						break
+					}
+					content := string(components[2 : 2+size])
+					components = components[2+size:]
+					switch {
+					case flags&0x02 != 0:
+						content = "."
+					case flags&0x04 != 0:
+						content = ".."
+					case flags&0x08 != 0:
+						content = ""
+						if len(linkname) == 0 {
+							linkname = append(linkname, "")
+						}
+					}
+					component += content
+					if flags&0x01 == 0 && flags&0x08 == 0 {
+						linkname = append(linkname, component)
+						component = ""
+					}
+				}
+				record.Mode = os.ModeSymlink | 0777
+			case "CL":
+				// The record is a placeholder for a relocated directory
+				if length >= 12 {
+					record.Dir = true
+					record.Extents = []isoExtent{{Block: binary.LittleEndian.Uint32(entry[4:8])}}
+				}
+			case "RE":
+				record.relocated = true
+			}
+		}
+		area = next
+	}
+
+	if hasName {
+		record.Name = name
+	}
+	if hasMode && (mode.IsDir() == record.Dir || mode&os.ModeSymlink != 0) {
+		record.Mode = mode
+	} else if record.Dir {
+		record.Mode = os.ModeDir | 0755
+	}
+	if record.Mode&os.ModeSymlink != 0 {
+		record.Dir = false
+		record.Linkname = strings.Join(linkname, "/")
+		if record.Linkname == "" && len(linkname) > 0 {
+			record.Linkname = "/"
+		}
+	}
+	return nil
+}
+
+// readDir reads the records of a directory, merging multi-extent files
+func (i *isoImage) readDir(dir *isoRecord) ([]*isoRecord, error) {
+	extent := dir.Extents[0]
+	if extent.Length == 0 {
+		// Relocated directories are referenced without their size, which
+		// can be read from their "." record
+		first := make([]byte, 255)
+		if _, err := i.r.ReadAt(first, int64(extent.Block)*isoSectorSize); err != nil {
+			return nil, errors.Annotatef(err, "Read iso directory")
+		}
+		self, err := i.parseRecord(first)
+		if err != nil {
+			return nil, err
+		}
+		extent.Length = self.Extents[0].Length
+	}
+	if extent.Length > 64<<20 {
+		return nil, errors.New("Iso directory too big")
+	}
+
+	data := make([]byte, extent.Length)
+	if _, err := i.r.ReadAt(data, int64(extent.Block)*isoSectorSize); err != nil {
+		return nil, errors.Annotatef(err, "Read iso directory")
+	}
+
+	records := []*isoRecord{}
+	var multiExtent *isoRecord
+	for pos := 0; pos < len(data); {
+		length := int(data[pos])
+		if length == 0 {
+			// Records don't cross sector boundaries, the rest of the sector is padding
+			pos = (pos/isoSectorSize + 1) * isoSectorSize
+			continue
+		}
+		if pos+length > len(data) {
+			return nil, errors.New("Invalid iso directory record")
+		}
+		record, err := i.parseRecord(data[pos : pos+length])
+		if err != nil {
+			return nil, err
+		}
+		flags := data[pos+25]
+		pos += length
+
+		if record.Name == "\x00" || record.Name == "\x01" {
+			continue
+		}
+		if multiExtent != nil {
+			multiExtent.Extents = append(multiExtent.Extents, record.Extents...)
+			if flags&0x80 == 0 {
+				multiExtent = nil
+			}
+			continue
+		}
+		if flags&0x80 != 0 {
+			multiExtent = record
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// Iso extracts an ISO 9660 image in the specified location. The Rock Ridge
+// extensions are used, if present, for long names, permissions and symlinks,
+// otherwise the Joliet extensions are used for long names.
+// It accepts a rename function to handle the names of the files (see the example)
+func (e *Extractor) Iso(ctx context.Context, body io.ReaderAt, location string, rename Renamer) error {
+	image, root, err := openIso(body)
+	if err != nil {
+		return err
+	}
+
+	symlinks := []*link{}
+	visited := map[uint32]bool{}
+
+	var walk func(dir *isoRecord, prefix string, depth int) error
+	walk = func(dir *isoRecord, prefix string, depth int) error {
+		if depth > 64 || visited[dir.Extents[0].Block] {
+			return errors.New("Loop in iso directory hierarchy")
+		}
+		visited[dir.Extents[0].Block] = true
+
+		records, err := image.readDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, record := range records {
+			select {
+			case <-ctx.Done():
+				return errors.New("interrupted")
+			default:
+			}
+
+			if record.relocated || record.Name == "" || strings.ContainsAny(record.Name, "/\x00") {
+				continue
+			}
+			name := prefix + record.Name
+
+			path := name
+			if rename != nil {
+				path = rename(path)
+			}
+
+			if path != "" {
+				if path, err = safeJoin(location, path); err != nil {
+					path = ""
+				}
+			}
+
+			if path != "" {
+				e.modTime(path, record.ModTime)
+			}
+			switch {
+			case record.Dir:
+				if path != "" {
+					if err := e.FS.MkdirAll(path, e.Modes.perm(record.Mode)); err != nil {
+						return errors.Annotatef(err, "Create directory %s", path)
+					}
+				}
+				// Rename may skip a directory but keep its content
+				if err := walk(record, name+"/", depth+1); err != nil {
+					return err
+				}
+			case path == "":
+				continue
+			case record.Mode&os.ModeSymlink != 0:
+				symlinks = append(symlinks, &link{Path: path, Name: record.Linkname})
+			case record.Mode.IsRegular():
+				size := int64(0)
+				for _, extent := range record.Extents {
+					size += int64(extent.Length)
+				}
+				e.fileSize(path, size)
+				if err := e.copy(ctx, path, e.Modes.perm(record.Mode), image.open(record)); err != nil {
+					return errors.Annotatef(err, "Create file %s", path)
+				}
+			}
+		}
+		return nil
+	}
+	if err := walk(root, "", 0); err != nil {
+		return err
+	}
+
+	if err := e.extractSymlinks(ctx, location, symlinks); err != nil {
+		return err
+	}
+
+	return nil
+}
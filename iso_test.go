@@ -0,0 +1,275 @@
+package extract_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf16"
+
+	"github.com/codeclysm/extract/v5"
+	"github.com/stretchr/testify/require"
+)
+
+type isoEntry struct {
+	Name     string
+	Data     string
+	Link     string
+	Mode     uint32
+	Children []*isoEntry
+
+	lba, jolietLba uint32
+}
+
+func (e *isoEntry) isDir() bool {
+	return e.Mode&0170000 == 0040000
+}
+
+// isoModTime is the recording time of every record
+var isoModTime = time.Date(2021, 6, 15, 12, 30, 45, 0, time.UTC)
+
+// makeIso builds an ISO 9660 image with one sector for every directory, and
+// optionally the Rock Ridge and Joliet extensions
+func makeIso(root *isoEntry, rockRidge, joliet bool) []byte {
+	next := uint32(19)
+	var assign func(e *isoEntry, joliet bool)
+	assign = func(e *isoEntry, joliet bool) {
+		sort.Slice(e.Children, func(i, j int) bool { return e.Children[i].Name < e.Children[j].Name })
+		if e.isDir() {
+			if joliet {
+				e.jolietLba = next
+			} else {
+				e.lba = next
+			}
+			next++
+			for _, child := range e.Children {
+				assign(child, joliet)
+			}
+		} else if !joliet {
+			e.lba = next
+			next += uint32(len(e.Data)+2047) / 2048
+		}
+	}
+	assign(root, false)
+	if joliet {
+		assign(root, true)
+	}
+
+	image := make([]byte, next*2048)
+	both16 := func(b []byte, v uint16) {
+		binary.LittleEndian.PutUint16(b, v)
+		binary.BigEndian.PutUint16(b[2:], v)
+	}
+	both32 := func(b []byte, v uint32) {
+		binary.LittleEndian.PutUint32(b, v)
+		binary.BigEndian.PutUint32(b[4:], v)
+	}
+	record := func(lba, length uint32, dir bool, name []byte, systemUse []byte) []byte {
+		size := 33 + len(name) + 1 - len(name)%2 + len(systemUse)
+		size += size % 2
+		r := make([]byte, size)
+		r[0] = byte(size)
+		both32(r[2:], lba)
+		both32(r[10:], length)
+		if dir {
+			r[25] = 2
+		}
+		// The recording time is isoModTime, in UTC+2
+		copy(r[18:25], []byte{121, 6, 15, 14, 30, 45, 8})
+		both16(r[28:], 1)
+		r[32] = byte(len(name))
+		copy(r[33:], name)
+		copy(r[33+len(name)+1-len(name)%2:], systemUse)
+		return r
+	}
+	susp := func(sig string, data ...byte) []byte {
+		return append([]byte{sig[0], sig[1], byte(4 + len(data)), 1}, data...)
+	}
+	px := func(mode uint32) []byte {
+		data := make([]byte, 32)
+		both32(data, mode)
+		both32(data[8:], 1)
+		return susp("PX", data...)
+	}
+	descriptor := func(sector int, typ byte, root []byte) {
+		d := image[sector*2048:]
+		d[0] = typ
+		copy(d[1:], "CD001")
+		d[6] = 1
+		both32(d[80:], next)
+		both16(d[120:], 1)
+		both16(d[124:], 1)
+		both16(d[128:], 2048)
+		copy(d[156:], root)
+		d[881] = 1
+	}
+
+	var write func(e, parent *isoEntry, joliet bool)
+	write = func(e, parent *isoEntry, joliet bool) {
+		lba, parentLba := e.lba, parent.lba
+		if joliet {
+			lba, parentLba = e.jolietLba, parent.jolietLba
+		}
+		self := []byte(nil)
+		if rockRidge && !joliet {
+			self = px(e.Mode)
+			if e == parent {
+				self = append(susp("SP", 0xbe, 0xef, 0), self...)
+			}
+		}
+		dir := record(lba, 2048, true, []byte{0}, self)
+		dir = append(dir, record(parentLba, 2048, true, []byte{1}, nil)...)
+		for _, child := range e.Children {
+			name := strings.ToUpper(child.Name)
+			if !child.isDir() {
+				name += ";1"
+			}
+			rawName := []byte(name)
+			if joliet {
+				rawName = nil
+				for _, u := range utf16.Encode([]rune(child.Name + ";1")) {
+					rawName = binary.BigEndian.AppendUint16(rawName, u)
+				}
+			}
+			systemUse := []byte(nil)
+			if rockRidge && !joliet {
+				systemUse = append(px(child.Mode), susp("NM", append([]byte{0}, child.Name...)...)...)
+				if child.Link != "" {
+					components := []byte{}
+					for i, c := range strings.Split(child.Link, "/") {
+						switch {
+						case c == "" && i == 0:
+							components = append(components, 0x08, 0)
+						case c == ".":
+							components = append(components, 0x02, 0)
+						case c == "..":
+							components = append(components, 0x04, 0)
+						default:
+							components = append(components, 0, byte(len(c)))
+							components = append(components, c...)
+						}
+					}
+					systemUse = append(systemUse, susp("SL", append([]byte{0}, components...)...)...)
+				}
+			}
+			if child.isDir() {
+				childLba := child.lba
+				if joliet {
+					childLba = child.jolietLba
+				}
+				dir = append(dir, record(childLba, 2048, true, rawName, systemUse)...)
+				write(child, e, joliet)
+			} else {
+				dir = append(dir, record(child.lba, uint32(len(child.Data)), false, rawName, systemUse)...)
+				copy(image[child.lba*2048:], child.Data)
+			}
+		}
+		copy(image[lba*2048:], dir)
+	}
+
+	write(root, root, false)
+	descriptor(16, 1, record(root.lba, 2048, true, []byte{0}, nil))
+	if joliet {
+		write(root, root, true)
+		descriptor(17, 2, record(root.jolietLba, 2048, true, []byte{0}, nil))
+		copy(image[17*2048+88:], "%/E")
+	}
+	terminator := 17
+	if joliet {
+		terminator = 18
+	}
+	copy(image[terminator*2048:], []byte{255, 'C', 'D', '0', '0', '1', 1})
+	return image
+}
+
+func testIsoTree() *isoEntry {
+	return &isoEntry{Mode: 0040755, Children: []*isoEntry{
+		{Name: "archive", Mode: 0040755, Children: []*isoEntry{
+			{Name: "file1.txt", Mode: 0100644, Data: "File1"},
+			{Name: "a-long-name-for-the-file.txt", Mode: 0100600, Data: "File2"},
+			{Name: "folderlink", Mode: 0120777, Link: "./folder"},
+			{Name: "folder", Mode: 0040700, Children: []*isoEntry{
+				{Name: "file1.txt", Mode: 0100644, Data: "folder/File1"},
+			}},
+		}},
+	}}
+}
+
+func TestIso(t *testing.T) {
+	t.Run("RockRidge", func(t *testing.T) {
+		tmp := mkTempDir(t)
+		image := makeIso(testIsoTree(), true, true)
+		require.NoError(t, extract.Iso(context.Background(), bytes.NewReader(image), tmp.String(), nil))
+		testWalk(t, tmp.String(), Files{
+			"":                                      "dir",
+			"/archive":                              "dir",
+			"/archive/folder":                       "dir",
+			"/archive/folder/file1.txt":             "folder/File1",
+			"/archive/file1.txt":                    "File1",
+			"/archive/a-long-name-for-the-file.txt": "File2",
+			"/archive/folderlink":                   "link",
+		})
+		link, err := os.Readlink(tmp.Join("archive", "folderlink").String())
+		require.NoError(t, err)
+		require.Equal(t, "./folder", link)
+		st, err := tmp.Join("archive", "a-long-name-for-the-file.txt").Stat()
+		require.NoError(t, err)
+		require.Equal(t, os.FileMode(0600), st.Mode())
+	})
+
+	t.Run("Joliet", func(t *testing.T) {
+		tmp := mkTempDir(t)
+		image := makeIso(testIsoTree(), false, true)
+		require.NoError(t, extract.Iso(context.Background(), bytes.NewReader(image), tmp.String(), nil))
+		testWalk(t, tmp.String(), Files{
+			"":                                      "dir",
+			"/archive":                              "dir",
+			"/archive/folder":                       "dir",
+			"/archive/folder/file1.txt":             "folder/File1",
+			"/archive/file1.txt":                    "File1",
+			"/archive/a-long-name-for-the-file.txt": "File2",
+			"/archive/folderlink":                   "",
+		})
+	})
+
+	t.Run("Plain", func(t *testing.T) {
+		tmp := mkTempDir(t)
+		image := makeIso(testIsoTree(), false, false)
+		require.NoError(t, extract.Iso(context.Background(), bytes.NewReader(image), tmp.String(), shift))
+		testWalk(t, tmp.String(), Files{
+			"":                              "dir",
+			"/FOLDER":                       "dir",
+			"/FOLDER/FILE1.TXT":             "folder/File1",
+			"/FILE1.TXT":                    "File1",
+			"/A-LONG-NAME-FOR-THE-FILE.TXT": "File2",
+			"/FOLDERLINK":                   "",
+		})
+	})
+
+	t.Run("InvalidRecords", func(t *testing.T) {
+		// The names longer than the records, in the "." record of the root
+		// read for Rock Ridge and in the ".." one
+		root := 19 * 2048
+		for _, offset := range []func(image []byte) int{
+			func(image []byte) int { return root },
+			func(image []byte) int { return root + int(image[root]) },
+		} {
+			image := makeIso(testIsoTree(), true, false)
+			record := offset(image)
+			image[record], image[record+32] = 35, 2
+			err := extract.Iso(context.Background(), bytes.NewReader(image), mkTempDir(t).String(), nil)
+			require.ErrorContains(t, err, "Invalid iso directory record")
+		}
+	})
+
+	t.Run("Inferred", func(t *testing.T) {
+		tmp := mkTempDir(t)
+		image := makeIso(testIsoTree(), true, false)
+		require.NoError(t, extract.Archive(context.Background(), bytes.NewBuffer(image), tmp.String(), nil))
+		require.FileExists(t, tmp.Join("archive", "a-long-name-for-the-file.txt").String())
+	})
+}
@@ -0,0 +1,165 @@
+package extract
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// RemoveAllFS can be implemented by the FS of an Extractor to remove a path with
+// all its children. It's needed to apply the whiteouts of image layers.
+type RemoveAllFS interface {
+	// RemoveAll removes path and any children it contains.
+	RemoveAll(path string) error
+}
+
+// ReadDirFS can be implemented by the FS of an Extractor to list the content of
+// a directory. It's needed to apply the opaque whiteouts of image layers.
+type ReadDirFS interface {
+	// ReadDir reads the named directory, returning all its entries sorted by filename.
+	ReadDir(name string) ([]os.DirEntry, error)
+}
+
+// LstatFS can be implemented by the FS of an Extractor to describe a file
+// without following it if it's a symlink. It's needed to apply image layers.
+type LstatFS interface {
+	// Lstat returns a FileInfo describing the named file, which is the
+	// symlink itself for a symlink.
+	Lstat(name string) (os.FileInfo, error)
+}
+
+// layer keeps track of the paths created by an image layer, which are not
+// hidden by its whiteouts
+type layer struct {
+	fs interface {
+		RemoveAllFS
+		ReadDirFS
+		LstatFS
+	}
+	root    string
+	created map[string]bool
+}
+
+// ApplyLayer extracts a container image layer, a tar archive optionally compressed,
+// over the content of location. Unlike Tar it removes the paths marked by the
+// whiteout files (.wh.<name>) and the content of lower layers in the directories
+// marked as opaque (.wh..wh..opq), as described by the OCI image specification.
+// The paths going through the symlinks left by lower layers are refused, since
+// they may point anywhere on the host, and so are the whiteouts of "." or "..".
+// The FS must implement RemoveAllFS, ReadDirFS and LstatFS.
+// It accepts a rename function to handle the names of the files (see the example)
+func (e *Extractor) ApplyLayer(ctx context.Context, body io.Reader, location string, rename Renamer) error {
+	fs, ok := fsAs[interface {
+		RemoveAllFS
+		ReadDirFS
+		LstatFS
+	}](e.FS)
+	if !ok {
+		return errors.New("The FS can't remove files, so whiteouts can't be applied")
+	}
+
+	body, extension, err := detect(body)
+	if err != nil {
+		return err
+	}
+	switch extension {
+	case "tar":
+	case "gz", "bz2", "xz", "zst":
+		decompressed, closer, err := e.decompress(extension, body)
+		if err != nil {
+			return errors.Annotatef(err, "Decompress layer")
+		}
+		defer closer()
+		body = decompressed
+	default:
+		return errors.New("Not a layer: " + extension)
+	}
+
+	applier := *e
+	applier.layer = &layer{fs: fs, root: filepath.Clean(location), created: map[string]bool{}}
+	return applier.Tar(ctx, body, location, rename)
+}
+
+// apply handles the whiteout files, returning true if path was one, and prepares
+// the other paths to be created, removing what lower layers left there.
+func (l *layer) apply(path string, dir bool) (bool, error) {
+	if err := l.checkParents(path); err != nil {
+		return false, err
+	}
+	parent, name := filepath.Split(path)
+	switch {
+	case name == whiteoutOpaque:
+		return true, l.removeLower(filepath.Clean(parent))
+	case strings.HasPrefix(name, whiteoutPrefix):
+		hidden := strings.TrimPrefix(name, whiteoutPrefix)
+		if hidden == "" || hidden == "." || hidden == ".." || strings.ContainsAny(hidden, "/"+string(filepath.Separator)) {
+			return true, errors.Errorf("Invalid whiteout %s", path)
+		}
+		// The whiteouts remove only what's strictly inside the location
+		target := filepath.Join(parent, hidden)
+		if rel, err := filepath.Rel(l.root, target); err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return true, errors.Errorf("Invalid whiteout %s", path)
+		}
+		if err := l.fs.RemoveAll(target); err != nil {
+			return true, errors.Annotatef(err, "Remove whiteout %s", target)
+		}
+		return true, nil
+	}
+
+	// A directory can replace a file and vice versa, and a symlink is never
+	// kept in place of a directory
+	if st, err := l.fs.Lstat(path); err == nil && st.IsDir() != dir && !l.created[path] {
+		if err := l.fs.RemoveAll(path); err != nil {
+			return false, errors.Annotatef(err, "Remove %s", path)
+		}
+	}
+	for p := path; !l.created[p]; p = filepath.Dir(p) {
+		l.created[p] = true
+	}
+	return false, nil
+}
+
+// checkParents returns an error if a parent of path inside the root is a
+// symlink, which a lower layer may have pointed outside of the root. The
+// parents of the paths created by this layer were already checked.
+func (l *layer) checkParents(path string) error {
+	for p := filepath.Dir(path); len(p) > len(l.root) && !l.created[p]; p = filepath.Dir(p) {
+		if st, err := l.fs.Lstat(p); err == nil && st.Mode()&os.ModeSymlink != 0 {
+			return errors.Errorf("Refusing to extract %s through the symlink %s", path, p)
+		}
+	}
+	return nil
+}
+
+// removeLower removes the content of dir not created by this layer
+func (l *layer) removeLower(dir string) error {
+	entries, err := l.fs.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.Annotatef(err, "Read directory %s", dir)
+	}
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		switch {
+		case !l.created[path]:
+			if err := l.fs.RemoveAll(path); err != nil {
+				return errors.Annotatef(err, "Remove %s", path)
+			}
+		case entry.IsDir():
+			if err := l.removeLower(path); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+package extract_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/arduino/go-paths-helper"
+	"github.com/codeclysm/extract/v5"
+	"github.com/stretchr/testify/require"
+)
+
+type layerEntry struct {
+	Name string
+	Data string
+	Dir  bool
+	Link string
+}
+
+// makeLayer builds a gzipped tar layer with the entries in the given order
+func makeLayer(entries ...layerEntry) []byte {
+	buf := &bytes.Buffer{}
+	gw := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gw)
+	for _, entry := range entries {
+		if entry.Dir {
+			tw.WriteHeader(&tar.Header{Name: entry.Name + "/", Typeflag: tar.TypeDir, Mode: 0755})
+			continue
+		}
+		if entry.Link != "" {
+			tw.WriteHeader(&tar.Header{Name: entry.Name, Typeflag: tar.TypeSymlink, Linkname: entry.Link})
+			continue
+		}
+		tw.WriteHeader(&tar.Header{Name: entry.Name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(entry.Data))})
+		tw.Write([]byte(entry.Data))
+	}
+	tw.Close()
+	gw.Close()
+	return buf.Bytes()
+}
+
+func lowerLayer() []byte {
+	return makeLayer(
+		layerEntry{Name: "etc", Dir: true},
+		layerEntry{Name: "etc/passwd", Data: "root"},
+		layerEntry{Name: "etc/hosts", Data: "localhost"},
+		layerEntry{Name: "opt", Dir: true},
+		layerEntry{Name: "opt/app", Dir: true},
+		layerEntry{Name: "opt/app/old.txt", Data: "Old"},
+		layerEntry{Name: "opt/app/lib", Dir: true},
+		layerEntry{Name: "opt/app/lib/old.so", Data: "Old"},
+		layerEntry{Name: "var", Dir: true},
+		layerEntry{Name: "var/cache", Data: "Cache file"},
+	)
+}
+
+func upperLayer() []byte {
+	return makeLayer(
+		layerEntry{Name: "etc/.wh.hosts"},
+		layerEntry{Name: "opt/app", Dir: true},
+		layerEntry{Name: "opt/app/lib", Dir: true},
+		layerEntry{Name: "opt/app/lib/new.so", Data: "New"},
+		layerEntry{Name: "opt/app/.wh..wh..opq"},
+		layerEntry{Name: "opt/app/new.txt", Data: "New"},
+		layerEntry{Name: "var/cache", Dir: true},
+		layerEntry{Name: "var/cache/file", Data: "Cache dir"},
+	)
+}
+
+var appliedLayers = Files{
+	"":                    "dir",
+	"/etc":                "dir",
+	"/etc/passwd":         "root",
+	"/opt":                "dir",
+	"/opt/app":            "dir",
+	"/opt/app/new.txt":    "New",
+	"/opt/app/lib":        "dir",
+	"/opt/app/lib/new.so": "New",
+	"/var":                "dir",
+	"/var/cache":          "dir",
+	"/var/cache/file":     "Cache dir",
+}
+
+func TestApplyLayer(t *testing.T) {
+	t.Run("Whiteouts", func(t *testing.T) {
+		tmp := mkTempDir(t)
+		require.NoError(t, extract.ApplyLayer(context.Background(), bytes.NewReader(lowerLayer()), tmp.String(), nil))
+		require.NoError(t, extract.ApplyLayer(context.Background(), bytes.NewReader(upperLayer()), tmp.String(), nil))
+		testWalk(t, tmp.String(), appliedLayers)
+	})
+
+	t.Run("LowerSymlinks", func(t *testing.T) {
+		tmp, host := mkTempDir(t), mkTempDir(t)
+		require.NoError(t, host.Join("foo").WriteFile([]byte("Host")))
+		lower := makeLayer(
+			layerEntry{Name: "x", Link: host.String()},
+			layerEntry{Name: "etc", Link: host.String()},
+			layerEntry{Name: "opt", Link: host.String()},
+		)
+		require.NoError(t, extract.ApplyLayer(context.Background(), bytes.NewReader(lower), tmp.String(), nil))
+
+		for _, upper := range [][]layerEntry{
+			{{Name: "x/.wh.foo"}},
+			{{Name: "etc/passwd", Data: "root"}},
+			{{Name: "opt/.wh..wh..opq"}},
+		} {
+			err := extract.ApplyLayer(context.Background(), bytes.NewReader(makeLayer(upper...)), tmp.String(), nil)
+			require.ErrorContains(t, err, "through the symlink")
+		}
+		require.FileExists(t, host.Join("foo").String())
+		require.NoFileExists(t, host.Join("passwd").String())
+
+		// A directory of an upper layer replaces the symlink
+		upper := makeLayer(layerEntry{Name: "etc", Dir: true}, layerEntry{Name: "etc/passwd", Data: "root"})
+		require.NoError(t, extract.ApplyLayer(context.Background(), bytes.NewReader(upper), tmp.String(), nil))
+		require.FileExists(t, tmp.Join("etc", "passwd").String())
+		require.NoFileExists(t, host.Join("passwd").String())
+	})
+
+	t.Run("InvalidWhiteouts", func(t *testing.T) {
+		tmp := mkTempDir(t)
+		rootfs := tmp.Join("rootfs")
+		require.NoError(t, tmp.Join("keep").WriteFile([]byte("Keep")))
+		lower := makeLayer(layerEntry{Name: "dir", Dir: true}, layerEntry{Name: "dir/file", Data: "File"})
+		require.NoError(t, extract.ApplyLayer(context.Background(), bytes.NewReader(lower), rootfs.String(), nil))
+
+		for _, name := range []string{".wh..", ".wh...", "dir/.wh..", "dir/.wh..."} {
+			err := extract.ApplyLayer(context.Background(), bytes.NewReader(makeLayer(layerEntry{Name: name})), rootfs.String(), nil)
+			require.ErrorContains(t, err, "Invalid whiteout", name)
+		}
+		require.FileExists(t, tmp.Join("keep").String())
+		require.FileExists(t, rootfs.Join("dir", "file").String())
+	})
+
+	t.Run("UnsupportedFS", func(t *testing.T) {
+		tmp := mkTempDir(t)
+		extractor := extract.Extractor{FS: extract.FromOSFS(MockDisk{})}
+		require.Error(t, extractor.ApplyLayer(context.Background(), bytes.NewReader(lowerLayer()), tmp.String(), nil))
+	})
+}
+
+// writeBlob stores data in the blobs of an OCI layout and returns its descriptor
+func writeBlob(t *testing.T, layout *paths.Path, mediaType string, data []byte, platform map[string]string) map[string]any {
+	sum := sha256.Sum256(data)
+	digest := hex.EncodeToString(sum[:])
+	require.NoError(t, layout.Join("blobs", "sha256").MkdirAll())
+	require.NoError(t, layout.Join("blobs", "sha256", digest).WriteFile(data))
+	descriptor := map[string]any{"mediaType": mediaType, "digest": "sha256:" + digest, "size": len(data)}
+	if platform != nil {
+		descriptor["platform"] = platform
+	}
+	return descriptor
+}
+
+func writeImage(t *testing.T, layout *paths.Path, platform map[string]string, layers ...[]byte) map[string]any {
+	manifest := map[string]any{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.oci.image.manifest.v1+json",
+		"config":        writeBlob(t, layout, "application/vnd.oci.image.config.v1+json", []byte("{}"), nil),
+		"layers":        []any{},
+	}
+	for _, layer := range layers {
+		manifest["layers"] = append(manifest["layers"].([]any), writeBlob(t, layout, "application/vnd.oci.image.layer.v1.tar+gzip", layer, nil))
+	}
+	data, _ := json.Marshal(manifest)
+	return writeBlob(t, layout, "application/vnd.oci.image.manifest.v1+json", data, platform)
+}
+
+func writeIndex(t *testing.T, layout *paths.Path, manifests ...map[string]any) {
+	data, _ := json.Marshal(map[string]any{"schemaVersion": 2, "manifests": manifests})
+	require.NoError(t, layout.Join("index.json").WriteFile(data))
+	require.NoError(t, layout.Join("oci-layout").WriteFile([]byte(`{"imageLayoutVersion": "1.0.0"}`)))
+}
+
+func TestApplyOCILayout(t *testing.T) {
+	t.Run("SingleImage", func(t *testing.T) {
+		layout, tmp := mkTempDir(t), mkTempDir(t)
+		writeIndex(t, layout, writeImage(t, layout, nil, lowerLayer(), upperLayer()))
+		require.NoError(t, extract.ApplyOCILayout(context.Background(), layout.String(), "", tmp.String(), nil))
+		testWalk(t, tmp.String(), appliedLayers)
+	})
+
+	t.Run("MultiPlatform", func(t *testing.T) {
+		layout, tmp := mkTempDir(t), mkTempDir(t)
+		amd64 := writeImage(t, layout, map[string]string{"os": "linux", "architecture": "amd64"}, lowerLayer())
+		arm := writeImage(t, layout, map[string]string{"os": "linux", "architecture": "arm", "variant": "v7"},
+			makeLayer(layerEntry{Name: "arm", Data: "ARM"}))
+		data, _ := json.Marshal(map[string]any{"schemaVersion": 2, "manifests": []any{amd64, arm}})
+		writeIndex(t, layout, writeBlob(t, layout, "application/vnd.oci.image.index.v1+json", data, nil))
+
+		require.NoError(t, extract.ApplyOCILayout(context.Background(), layout.String(), "linux/arm/v7", tmp.String(), nil))
+		testWalk(t, tmp.String(), Files{
+			"":     "dir",
+			"/arm": "ARM",
+		})
+		require.Error(t, extract.ApplyOCILayout(context.Background(), layout.String(), "windows/amd64", tmp.String(), nil))
+	})
+
+	t.Run("CorruptedBlob", func(t *testing.T) {
+		layout, tmp := mkTempDir(t), mkTempDir(t)
+		writeIndex(t, layout, writeImage(t, layout, nil, lowerLayer()))
+		files, err := layout.Join("blobs", "sha256").ReadDir()
+		require.NoError(t, err)
+		for _, f := range files {
+			data, _ := f.ReadFile()
+			if bytes.HasPrefix(data, []byte{0x1f, 0x8b}) {
+				require.NoError(t, os.WriteFile(f.String(), append(data, 0), 0644))
+			}
+		}
+		require.Error(t, extract.ApplyOCILayout(context.Background(), layout.String(), "", tmp.String(), nil))
+	})
+}
@@ -0,0 +1,78 @@
+package extract
+
+import (
+	"github.com/juju/errors"
+)
+
+// lz4Decompress decodes a raw LZ4 block, without the frame format, as stored in
+// squashfs images. The output can't be bigger than max bytes.
+func lz4Decompress(src []byte, max int) ([]byte, error) {
+	dst := make([]byte, 0, max)
+	errCorrupt := errors.New("Corrupted lz4 block")
+
+	readLength := func(pos int, length int) (int, int, error) {
+		if length != 15 {
+			return pos, length, nil
+		}
+		for {
+			if pos >= len(src) {
+				return 0, 0, errCorrupt
+			}
+			b := src[pos]
+			pos++
+			length += int(b)
+			if length > max {
+				return 0, 0, errCorrupt
+			}
+			if b != 255 {
+				return pos, length, nil
+			}
+		}
+	}
+
+	for pos := 0; pos < len(src); {
+		token := src[pos]
+		pos++
+
+		// Literals
+		var literals, length int
+		var err error
+		pos, literals, err = readLength(pos, int(token>>4))
+		if err != nil {
+			return nil, err
+		}
+		if pos+literals > len(src) || len(dst)+literals > max {
+			return nil, errCorrupt
+		}
+		dst = append(dst, src[pos:pos+literals]...)
+		pos += literals
+		if pos == len(src) {
+			// The last sequence has only literals
+			break
+		}
+
+		// Match
+		if pos+2 > len(src) {
+			return nil, errCorrupt
+		}
+		offset := int(src[pos]) | int(src[pos+1])<<8
+		pos += 2
+		if offset == 0 || offset > len(dst) {
+			return nil, errCorrupt
+		}
+		pos, length, err = readLength(pos, int(token&0x0f))
+		if err != nil {
+			return nil, err
+		}
+		length += 4
+		if len(dst)+length > max {
+			return nil, errCorrupt
+		}
+		// The match may overlap with the bytes being written
+		start := len(dst) - offset
+		for i := 0; i < length; i++ {
+			dst = append(dst, dst[start+i])
+		}
+	}
+	return dst, nil
+}
@@ -0,0 +1,556 @@
+package extract
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	iofs "io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// memMaxLinks is the maximum number of symlinks followed resolving a path
+const memMaxLinks = 40
+
+// MemFS is an FS that keeps the files in memory, useful to inspect the result of
+// an extraction without touching the disk. It models directories, regular files,
+// symlinks, hard links, device nodes and their modes; the paths are slash
+// separated and rooted at "/", and on Windows the volume name is ignored.
+// The umask isn't applied to the modes. The zero value is an empty filesystem
+// ready to use, and it's safe to use it from many goroutines.
+type MemFS struct {
+	mu   sync.Mutex
+	root *memNode
+}
+
+// memNode is a file of a MemFS. Hard links share the same node.
+type memNode struct {
+	mode     os.FileMode
+	modTime  time.Time
+	data     []byte
+	target   string
+	dev      [2]uint32
+	children map[string]*memNode
+}
+
+func (n *memNode) isDir() bool {
+	return n.mode.IsDir()
+}
+
+func (n *memNode) isSymlink() bool {
+	return n.mode&os.ModeSymlink != 0
+}
+
+func (n *memNode) info(name string) os.FileInfo {
+	size := int64(len(n.data))
+	if n.isSymlink() {
+		size = int64(len(n.target))
+	}
+	return &memInfo{name: name, size: size, mode: n.mode, modTime: n.modTime}
+}
+
+// memInfo describes a file of a MemFS
+type memInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (i *memInfo) Name() string       { return i.name }
+func (i *memInfo) Size() int64        { return i.size }
+func (i *memInfo) Mode() os.FileMode  { return i.mode }
+func (i *memInfo) ModTime() time.Time { return i.modTime }
+func (i *memInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i *memInfo) Sys() any           { return nil }
+
+// memClean returns name as a clean slash separated path rooted at "/"
+func memClean(name string) string {
+	name = strings.TrimPrefix(name, filepath.VolumeName(name))
+	return path.Clean("/" + filepath.ToSlash(name))
+}
+
+// lookup returns the directory containing name, its path and the base name of
+// name, following the symlinks in the path and, if follow is set, the one at the
+// end. The directory is nil if name is the root.
+func (m *MemFS) lookup(op, name string, follow bool) (*memNode, string, string, error) {
+	if m.root == nil {
+		m.root = &memNode{mode: os.ModeDir | 0755, modTime: time.Now(), children: map[string]*memNode{}}
+	}
+	dir, dirPath := m.root, "/"
+	parts := strings.Split(memClean(name), "/")[1:]
+	if parts[0] == "" {
+		return nil, "", "", nil
+	}
+	for links := 0; ; {
+		part := parts[0]
+		child := dir.children[part]
+		last := len(parts) == 1
+		switch {
+		case child != nil && child.isSymlink() && (!last || follow):
+			if links++; links > memMaxLinks {
+				return nil, "", "", &os.PathError{Op: op, Path: name, Err: syscall.ELOOP}
+			}
+			target := child.target
+			if !path.IsAbs(target) {
+				target = path.Join(dirPath, target)
+			}
+			parts = strings.Split(memClean(path.Join(append([]string{target}, parts[1:]...)...)), "/")[1:]
+			dir, dirPath = m.root, "/"
+			if parts[0] == "" {
+				return nil, "", "", nil
+			}
+			continue
+		case last:
+			return dir, dirPath, part, nil
+		case child == nil:
+			return nil, "", "", &os.PathError{Op: op, Path: name, Err: iofs.ErrNotExist}
+		case !child.isDir():
+			return nil, "", "", &os.PathError{Op: op, Path: name, Err: syscall.ENOTDIR}
+		}
+		dir, dirPath, parts = child, path.Join(dirPath, part), parts[1:]
+	}
+}
+
+// node returns the file with the given name, or an error if it doesn't exist
+func (m *MemFS) node(op, name string, follow bool) (*memNode, error) {
+	dir, _, base, err := m.lookup(op, name, follow)
+	if err != nil {
+		return nil, err
+	}
+	if dir == nil {
+		return m.root, nil
+	}
+	if node := dir.children[base]; node != nil {
+		return node, nil
+	}
+	return nil, &os.PathError{Op: op, Path: name, Err: iofs.ErrNotExist}
+}
+
+// create adds a new file with the given name, failing if it exists already
+func (m *MemFS) create(op, name string, node *memNode) error {
+	dir, _, base, err := m.lookup(op, name, false)
+	if err != nil {
+		return err
+	}
+	if dir == nil || dir.children[base] != nil {
+		return &os.PathError{Op: op, Path: name, Err: iofs.ErrExist}
+	}
+	dir.children[base] = node
+	return nil
+}
+
+// Link creates newname as a hard link to the oldname file.
+func (m *MemFS) Link(oldname, newname string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	node, err := m.node("link", oldname, false)
+	if err != nil {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: err.(*os.PathError).Err}
+	}
+	if node.isDir() {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: syscall.EPERM}
+	}
+	if err := m.create("link", newname, node); err != nil {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: err.(*os.PathError).Err}
+	}
+	return nil
+}
+
+// MkdirAll creates the directory path and all his parents if needed.
+func (m *MemFS) MkdirAll(name string, perm os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.mkdirAll(name, perm)
+}
+
+func (m *MemFS) mkdirAll(name string, perm os.FileMode) error {
+	dir, _, base, err := m.lookup("mkdir", name, true)
+	if err != nil && errors.Is(err, iofs.ErrNotExist) {
+		// Create the parents first
+		if err := m.mkdirAll(path.Dir(memClean(name)), perm); err != nil {
+			return err
+		}
+		dir, _, base, err = m.lookup("mkdir", name, true)
+	}
+	if err != nil {
+		return err
+	}
+	if dir == nil {
+		return nil
+	}
+	if node := dir.children[base]; node != nil {
+		if !node.isDir() {
+			return &os.PathError{Op: "mkdir", Path: name, Err: syscall.ENOTDIR}
+		}
+		return nil
+	}
+	dir.children[base] = &memNode{mode: os.ModeDir | perm&(os.ModePerm|modeSpecial), modTime: time.Now(), children: map[string]*memNode{}}
+	return nil
+}
+
+// OpenFile opens the named file for writing, with the specified flag (O_CREATE etc.).
+// The returned File implements Chmod, Truncate and Sync too.
+func (m *MemFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dir, _, base, err := m.lookup("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+	node := m.root
+	if dir != nil {
+		node = dir.children[base]
+	}
+	switch {
+	case node == nil && flag&os.O_CREATE == 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: iofs.ErrNotExist}
+	case node == nil:
+		node = &memNode{mode: perm & (os.ModePerm | modeSpecial), modTime: time.Now()}
+		dir.children[base] = node
+	case flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		return nil, &os.PathError{Op: "open", Path: name, Err: iofs.ErrExist}
+	case node.isDir():
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+	case flag&os.O_TRUNC != 0:
+		node.data = nil
+		node.modTime = time.Now()
+	}
+	return &memFile{fs: m, name: name, node: node, append: flag&os.O_APPEND != 0}, nil
+}
+
+// Symlink creates newname as a symbolic link to oldname.
+func (m *MemFS) Symlink(oldname, newname string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	node := &memNode{mode: os.ModeSymlink | 0777, modTime: time.Now(), target: filepath.ToSlash(oldname)}
+	if err := m.create("symlink", newname, node); err != nil {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: err.(*os.PathError).Err}
+	}
+	return nil
+}
+
+// Mknod creates a device node or a named pipe, depending on mode.
+func (m *MemFS) Mknod(name string, mode os.FileMode, major, minor uint32) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	node := &memNode{mode: mode, modTime: time.Now(), dev: [2]uint32{major, minor}}
+	return m.create("mknod", name, node)
+}
+
+// Remove removes the named file or (empty) directory.
+func (m *MemFS) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dir, _, base, err := m.lookup("remove", name, false)
+	if err != nil {
+		return err
+	}
+	if dir == nil {
+		return &os.PathError{Op: "remove", Path: name, Err: syscall.EBUSY}
+	}
+	node := dir.children[base]
+	switch {
+	case node == nil:
+		return &os.PathError{Op: "remove", Path: name, Err: iofs.ErrNotExist}
+	case len(node.children) > 0:
+		return &os.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+	}
+	delete(dir.children, base)
+	return nil
+}
+
+// RemoveAll removes path and any children it contains.
+func (m *MemFS) RemoveAll(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dir, _, base, err := m.lookup("removeall", name, false)
+	if err != nil {
+		if errors.Is(err, iofs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	if dir == nil {
+		m.root.children = map[string]*memNode{}
+		return nil
+	}
+	delete(dir.children, base)
+	return nil
+}
+
+// Stat returns a FileInfo describing the named file, following the symlinks.
+func (m *MemFS) Stat(name string) (os.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	node, err := m.node("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return node.info(path.Base(memClean(name))), nil
+}
+
+// Lstat returns a FileInfo describing the named file, without following the
+// symlink at the end.
+func (m *MemFS) Lstat(name string) (os.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	node, err := m.node("lstat", name, false)
+	if err != nil {
+		return nil, err
+	}
+	return node.info(path.Base(memClean(name))), nil
+}
+
+// Chmod changes the mode of the named file to mode.
+// If the file is a symbolic link, it changes the mode of the link's target.
+func (m *MemFS) Chmod(name string, mode os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	node, err := m.node("chmod", name, true)
+	if err != nil {
+		return err
+	}
+	node.mode = node.mode.Type() | mode&(os.ModePerm|modeSpecial)
+	return nil
+}
+
+// Chtimes changes the modification time of the named file.
+func (m *MemFS) Chtimes(name string, atime, mtime time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	node, err := m.node("chtimes", name, true)
+	if err != nil {
+		return err
+	}
+	node.modTime = mtime
+	return nil
+}
+
+// ReadDir reads the named directory, returning all its entries sorted by filename.
+func (m *MemFS) ReadDir(name string) ([]os.DirEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	node, err := m.node("readdir", name, true)
+	if err != nil {
+		return nil, err
+	}
+	if !node.isDir() {
+		return nil, &os.PathError{Op: "readdir", Path: name, Err: syscall.ENOTDIR}
+	}
+	return node.entries(), nil
+}
+
+func (n *memNode) entries() []os.DirEntry {
+	entries := make([]os.DirEntry, 0, len(n.children))
+	for name, child := range n.children {
+		entries = append(entries, iofs.FileInfoToDirEntry(child.info(name)))
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries
+}
+
+// ReadFile returns the content of the named file, following the symlinks.
+func (m *MemFS) ReadFile(name string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	node, err := m.node("read", name, true)
+	if err != nil {
+		return nil, err
+	}
+	if node.isDir() {
+		return nil, &os.PathError{Op: "read", Path: name, Err: syscall.EISDIR}
+	}
+	return bytes.Clone(node.data), nil
+}
+
+// Open opens the named file for reading.
+func (m *MemFS) Open(name string) (io.ReadCloser, error) {
+	data, err := m.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// Readlink returns the target of the named symlink.
+func (m *MemFS) Readlink(name string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	node, err := m.node("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+	if !node.isSymlink() {
+		return "", &os.PathError{Op: "readlink", Path: name, Err: iofs.ErrInvalid}
+	}
+	return node.target, nil
+}
+
+// SameFile tells if the two named files are hard links to the same file.
+func (m *MemFS) SameFile(name1, name2 string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	node1, err1 := m.node("stat", name1, false)
+	node2, err2 := m.node("stat", name2, false)
+	return err1 == nil && err2 == nil && node1 == node2
+}
+
+// Device returns the major and minor numbers of the named device node.
+func (m *MemFS) Device(name string) (uint32, uint32, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	node, err := m.node("stat", name, false)
+	if err != nil {
+		return 0, 0, err
+	}
+	return node.dev[0], node.dev[1], nil
+}
+
+// FS returns a read only view of the files as an iofs.FS, where "." is the root.
+func (m *MemFS) FS() iofs.FS {
+	return memView{m}
+}
+
+// memFile is a file of a MemFS opened for writing
+type memFile struct {
+	fs     *MemFS
+	name   string
+	node   *memNode
+	offset int
+	append bool
+	closed bool
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.closed {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: os.ErrClosed}
+	}
+	if f.append {
+		f.offset = len(f.node.data)
+	}
+	if end := f.offset + len(p); end > len(f.node.data) {
+		f.node.data = append(f.node.data, make([]byte, end-len(f.node.data))...)
+	}
+	f.offset += copy(f.node.data[f.offset:], p)
+	f.node.modTime = time.Now()
+	return len(p), nil
+}
+
+func (f *memFile) Close() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.closed {
+		return &os.PathError{Op: "close", Path: f.name, Err: os.ErrClosed}
+	}
+	f.closed = true
+	return nil
+}
+
+// Chmod changes the mode of the file to mode.
+func (f *memFile) Chmod(mode os.FileMode) error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	f.node.mode = f.node.mode.Type() | mode&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)
+	return nil
+}
+
+// Truncate changes the size of the file.
+func (f *memFile) Truncate(size int64) error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if size < 0 {
+		return &os.PathError{Op: "truncate", Path: f.name, Err: iofs.ErrInvalid}
+	}
+	if int(size) <= len(f.node.data) {
+		f.node.data = f.node.data[:size]
+	} else {
+		f.node.data = append(f.node.data, make([]byte, int(size)-len(f.node.data))...)
+	}
+	return nil
+}
+
+// Sync does nothing, the data is already in memory.
+func (f *memFile) Sync() error {
+	return nil
+}
+
+// memView is the iofs.FS view of a MemFS
+type memView struct {
+	m *MemFS
+}
+
+func (v memView) Open(name string) (iofs.File, error) {
+	if !iofs.ValidPath(name) {
+		return nil, &iofs.PathError{Op: "open", Path: name, Err: iofs.ErrInvalid}
+	}
+	v.m.mu.Lock()
+	defer v.m.mu.Unlock()
+	node, err := v.m.node("open", name, true)
+	if err != nil {
+		return nil, &iofs.PathError{Op: "open", Path: name, Err: err.(*os.PathError).Err}
+	}
+	info := node.info(path.Base(name))
+	if node.isDir() {
+		return &memDirReader{info: info, entries: node.entries()}, nil
+	}
+	return &memFileReader{info: info, Reader: bytes.NewReader(bytes.Clone(node.data))}, nil
+}
+
+func (v memView) ReadLink(name string) (string, error) {
+	if !iofs.ValidPath(name) {
+		return "", &iofs.PathError{Op: "readlink", Path: name, Err: iofs.ErrInvalid}
+	}
+	return v.m.Readlink(name)
+}
+
+func (v memView) Lstat(name string) (iofs.FileInfo, error) {
+	if !iofs.ValidPath(name) {
+		return nil, &iofs.PathError{Op: "lstat", Path: name, Err: iofs.ErrInvalid}
+	}
+	return v.m.Lstat(name)
+}
+
+// memFileReader is a file of a MemFS opened for reading
+type memFileReader struct {
+	*bytes.Reader
+	info os.FileInfo
+}
+
+func (f *memFileReader) Stat() (iofs.FileInfo, error) { return f.info, nil }
+func (f *memFileReader) Close() error                 { return nil }
+
+// memDirReader is a directory of a MemFS opened for reading
+type memDirReader struct {
+	info    os.FileInfo
+	entries []os.DirEntry
+}
+
+func (d *memDirReader) Stat() (iofs.FileInfo, error) { return d.info, nil }
+func (d *memDirReader) Close() error                 { return nil }
+
+func (d *memDirReader) Read([]byte) (int, error) {
+	return 0, &iofs.PathError{Op: "read", Path: d.info.Name(), Err: syscall.EISDIR}
+}
+
+func (d *memDirReader) ReadDir(n int) ([]iofs.DirEntry, error) {
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	entries := d.entries[:min(n, len(d.entries))]
+	d.entries = d.entries[len(entries):]
+	return entries, nil
+}
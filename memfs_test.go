@@ -0,0 +1,119 @@
+package extract_test
+
+import (
+	"bytes"
+	"context"
+	"io/fs"
+	"os"
+	"testing"
+	"testing/fstest"
+
+	"github.com/codeclysm/extract/v5"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemFS(t *testing.T) {
+	t.Run("Tar", func(t *testing.T) {
+		archive, err := os.ReadFile("testdata/archive.tar.gz")
+		require.NoError(t, err)
+		mem := &extract.MemFS{}
+		extractor := extract.Extractor{FS: mem}
+		require.NoError(t, extractor.Gz(context.Background(), bytes.NewReader(archive), "/out", nil))
+
+		data, err := mem.ReadFile("/out/archive/folder/file1.txt")
+		require.NoError(t, err)
+		require.Equal(t, "folder/File1\n", string(data))
+		require.True(t, mem.SameFile("/out/archive/file1.txt", "/out/archive/link.txt"))
+		target, err := mem.Readlink("/out/archive/folderlink")
+		require.NoError(t, err)
+		require.Equal(t, "archive/folder", target)
+		info, err := mem.Stat("/out/archive/file2.txt")
+		require.NoError(t, err)
+		require.Equal(t, os.FileMode(0664), info.Mode())
+		info, err = mem.Lstat("/out/archive/folderlink")
+		require.NoError(t, err)
+		require.Equal(t, os.ModeSymlink, info.Mode().Type())
+
+		// The symlink is dangling, like on disk
+		require.NoError(t, mem.Remove("/out/archive/folderlink"))
+		require.NoError(t, mem.Symlink("folder", "/out/archive/folderlink"))
+		data, err = mem.ReadFile("/out/archive/folderlink/file1.txt")
+		require.NoError(t, err)
+		require.Equal(t, "folder/File1\n", string(data))
+
+		view, err := fs.Sub(mem.FS(), "out")
+		require.NoError(t, err)
+		require.NoError(t, fstest.TestFS(view,
+			"archive/file1.txt", "archive/file2.txt", "archive/link.txt", "archive/folder/file1.txt"))
+	})
+
+	t.Run("Writers", func(t *testing.T) {
+		files, _ := manyFiles()
+		mem := &extract.MemFS{}
+		extractor := extract.Extractor{FS: mem, Writers: 8}
+		require.NoError(t, extractor.Zip(context.Background(), bytes.NewReader(makeZip(files)), "/", nil))
+		for name, content := range files {
+			data, err := mem.ReadFile(name)
+			require.NoError(t, err)
+			require.Equal(t, content, string(data))
+		}
+	})
+
+	t.Run("Layers", func(t *testing.T) {
+		mem := &extract.MemFS{}
+		extractor := extract.Extractor{FS: mem}
+		require.NoError(t, extractor.ApplyLayer(context.Background(), bytes.NewReader(lowerLayer()), "/", nil))
+		require.NoError(t, extractor.ApplyLayer(context.Background(), bytes.NewReader(upperLayer()), "/", nil))
+		for name, content := range appliedLayers {
+			if name == "" {
+				continue
+			}
+			info, err := mem.Stat(name)
+			require.NoError(t, err, name)
+			if content == "dir" {
+				require.True(t, info.IsDir(), name)
+				continue
+			}
+			data, err := mem.ReadFile(name)
+			require.NoError(t, err)
+			require.Equal(t, content, string(data))
+		}
+		entries, err := mem.ReadDir("/opt/app")
+		require.NoError(t, err)
+		require.Len(t, entries, 2)
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		mem := &extract.MemFS{}
+		require.NoError(t, mem.MkdirAll("/dir", 0755))
+		f, err := mem.OpenFile("/dir/file", os.O_CREATE|os.O_WRONLY, 0644)
+		require.NoError(t, err)
+		f.Write([]byte("Data"))
+		require.NoError(t, f.Close())
+
+		require.ErrorIs(t, mem.Remove("/dir"), fs.ErrExist)
+		require.ErrorIs(t, mem.Symlink("dir", "/dir/file"), fs.ErrExist)
+		_, err = mem.OpenFile("/missing/file", os.O_CREATE|os.O_WRONLY, 0644)
+		require.ErrorIs(t, err, fs.ErrNotExist)
+		require.Error(t, mem.MkdirAll("/dir/file/sub", 0755))
+		require.NoError(t, mem.Symlink("loop", "/loop"))
+		_, err = mem.Stat("/loop")
+		require.Error(t, err)
+	})
+
+	t.Run("SpecialBits", func(t *testing.T) {
+		// The setuid, setgid and sticky bits are kept like on the disk
+		mem := &extract.MemFS{}
+		require.NoError(t, mem.MkdirAll("/tmp", os.ModeSticky|0777))
+		f, err := mem.OpenFile("/su", os.O_CREATE|os.O_WRONLY, os.ModeSetuid|0755)
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+
+		info, err := mem.Stat("/tmp")
+		require.NoError(t, err)
+		require.Equal(t, os.ModeDir|os.ModeSticky|0777, info.Mode())
+		info, err = mem.Stat("/su")
+		require.NoError(t, err)
+		require.Equal(t, os.ModeSetuid|0755, info.Mode())
+	})
+}
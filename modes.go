@@ -0,0 +1,52 @@
+package extract
+
+import "os"
+
+// modeSpecial are the setuid, setgid and sticky bits
+const modeSpecial = os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+// ModePolicy changes the permissions of the files and the directories of the
+// archives and the images before they're created. The zero value keeps the ones of
+// the archive.
+type ModePolicy struct {
+	// FileMode and DirMode, if they're not zero, replace the permissions of
+	// the files and of the directories, including their setuid, setgid and
+	// sticky bits.
+	FileMode os.FileMode
+	DirMode  os.FileMode
+
+	// StripSpecial removes the setuid, setgid and sticky bits.
+	StripSpecial bool
+
+	// Mask is removed from the permissions, like a umask.
+	Mask os.FileMode
+
+	// WritableDirs makes the directories writable by their owner, so that
+	// their content can be changed or removed after the extraction.
+	WritableDirs bool
+}
+
+// perm returns the permissions and the setuid, setgid and sticky bits of mode
+// changed by the policy, as they're given to the FS
+func (p ModePolicy) perm(mode os.FileMode) os.FileMode {
+	return p.apply(mode) & (os.ModePerm | modeSpecial)
+}
+
+// apply returns mode changed by the policy
+func (p ModePolicy) apply(mode os.FileMode) os.FileMode {
+	fixed := p.FileMode
+	if mode.IsDir() {
+		fixed = p.DirMode
+	}
+	if fixed != 0 {
+		mode = mode&^(os.ModePerm|modeSpecial) | fixed&(os.ModePerm|modeSpecial)
+	}
+	if p.StripSpecial {
+		mode &^= modeSpecial
+	}
+	mode &^= p.Mask & (os.ModePerm | modeSpecial)
+	if p.WritableDirs && mode.IsDir() {
+		mode |= 0200
+	}
+	return mode
+}
@@ -0,0 +1,185 @@
+package extract_test
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/codeclysm/extract/v5"
+	"github.com/codeclysm/extract/v5/extracttest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestModePolicy(t *testing.T) {
+	tarBuf := &bytes.Buffer{}
+	tw := tar.NewWriter(tarBuf)
+	tw.WriteHeader(&tar.Header{Name: "tmp/", Typeflag: tar.TypeDir, Mode: 01777})
+	tw.WriteHeader(&tar.Header{Name: "ro/", Typeflag: tar.TypeDir, Mode: 0555})
+	tw.WriteHeader(&tar.Header{Name: "ro/su", Typeflag: tar.TypeReg, Mode: 04755, Size: 2})
+	tw.Write([]byte("su"))
+	tw.WriteHeader(&tar.Header{Name: "ro/sg", Typeflag: tar.TypeReg, Mode: 02777, Size: 2})
+	tw.Write([]byte("sg"))
+	tw.Close()
+
+	zipBuf := &bytes.Buffer{}
+	zw := zip.NewWriter(zipBuf)
+	for _, entry := range []struct {
+		name string
+		mode os.FileMode
+	}{
+		{"tmp/", os.ModeDir | os.ModeSticky | 0777},
+		{"ro/", os.ModeDir | 0555},
+		{"ro/su", os.ModeSetuid | 0755},
+		{"ro/sg", os.ModeSetgid | 0777},
+	} {
+		header := &zip.FileHeader{Name: entry.name}
+		header.SetMode(entry.mode)
+		f, _ := zw.CreateHeader(header)
+		if !entry.mode.IsDir() {
+			f.Write([]byte("x"))
+		}
+	}
+	zw.Close()
+
+	// extractModes returns the mode given to the FS for every path by run
+	extractModes := func(t *testing.T, policy extract.ModePolicy, run func(*extract.Extractor) error) map[string]os.FileMode {
+		mem := &extract.MemFS{}
+		require.NoError(t, mem.MkdirAll("/out", 0755))
+		fs := &extracttest.LoggingFS{FS: mem}
+		extractor := extract.Extractor{FS: fs, Modes: policy}
+		require.NoError(t, run(&extractor))
+		modes := map[string]os.FileMode{}
+		for _, op := range fs.Journal {
+			switch op.Op {
+			case "mkdirall":
+				// The parents of the files are created again
+				if _, ok := modes[op.Path]; !ok {
+					modes[op.Path] = op.Mode
+				}
+			case "open", "chmod":
+				modes[op.Path] = op.Mode
+			}
+		}
+		return modes
+	}
+	modes := func(t *testing.T, policy extract.ModePolicy, archive []byte) map[string]os.FileMode {
+		return extractModes(t, policy, func(e *extract.Extractor) error {
+			return e.Archive(context.Background(), bytes.NewReader(archive), "/out", nil)
+		})
+	}
+
+	testCases := []struct {
+		name     string
+		policy   extract.ModePolicy
+		expected map[string]os.FileMode
+	}{
+		{"Default", extract.ModePolicy{}, map[string]os.FileMode{
+			"/out/tmp": os.ModeDir | os.ModeSticky | 0777, "/out/ro": os.ModeDir | 0555,
+			"/out/ro/su": os.ModeSetuid | 0755, "/out/ro/sg": os.ModeSetgid | 0777,
+		}},
+		{"StripSpecial", extract.ModePolicy{StripSpecial: true}, map[string]os.FileMode{
+			"/out/tmp": os.ModeDir | 0777, "/out/ro": os.ModeDir | 0555,
+			"/out/ro/su": 0755, "/out/ro/sg": 0777,
+		}},
+		{"Mask", extract.ModePolicy{Mask: 0022 | os.ModeSetgid}, map[string]os.FileMode{
+			"/out/tmp": os.ModeDir | os.ModeSticky | 0755, "/out/ro": os.ModeDir | 0555,
+			"/out/ro/su": os.ModeSetuid | 0755, "/out/ro/sg": 0755,
+		}},
+		{"Fixed", extract.ModePolicy{FileMode: 0644, DirMode: 0750}, map[string]os.FileMode{
+			"/out/tmp": os.ModeDir | 0750, "/out/ro": os.ModeDir | 0750,
+			"/out/ro/su": 0644, "/out/ro/sg": 0644,
+		}},
+		{"WritableDirs", extract.ModePolicy{WritableDirs: true, StripSpecial: true}, map[string]os.FileMode{
+			"/out/tmp": os.ModeDir | 0777, "/out/ro": os.ModeDir | 0755,
+			"/out/ro/su": 0755, "/out/ro/sg": 0777,
+		}},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			require.Equal(t, test.expected, modes(t, test.policy, tarBuf.Bytes()))
+
+			// The directories of zip archives are always searchable
+			expected := map[string]os.FileMode{}
+			for path, mode := range test.expected {
+				if mode.IsDir() {
+					mode |= 0100
+				}
+				expected[path] = mode
+			}
+			require.Equal(t, expected, modes(t, test.policy, zipBuf.Bytes()))
+		})
+	}
+
+	t.Run("Images", func(t *testing.T) {
+		cpioBuf := &bytes.Buffer{}
+		writeCpio(cpioBuf, []cpioEntry{
+			{Name: "ro", Mode: 0040555, Nlink: 2},
+			{Name: "ro/su", Mode: 0104777, Nlink: 1, Data: "su"},
+		})
+		image := makeSquashfs(&squashfsEntry{Mode: 0040755, Children: []*squashfsEntry{
+			{Name: "ro", Mode: 0040555, Children: []*squashfsEntry{
+				{Name: "su", Mode: 0104777, Data: "su"},
+			}},
+		}}, 1, func([]byte) []byte { return nil })
+
+		arBuf := bytes.NewBufferString("!<arch>\n")
+		fmt.Fprintf(arBuf, "%-16s%-12d%-6d%-6d%-8o%-10d`\n%s", "su", 0, 0, 0, 0104777, 2, "su")
+		iso := makeIso(&isoEntry{Mode: 0040755, Children: []*isoEntry{
+			{Name: "ro", Mode: 0040555, Children: []*isoEntry{
+				{Name: "su", Mode: 0104777, Data: "su"},
+			}},
+		}}, true, false)
+		streamed := &bytes.Buffer{}
+		zw := zip.NewWriter(streamed)
+		header := &zip.FileHeader{Name: "ro/su", Method: zip.Deflate}
+		header.SetMode(os.ModeSetuid | 0777)
+		f, _ := zw.CreateHeader(header)
+		f.Write([]byte("su"))
+		zw.Close()
+
+		for _, image := range []struct {
+			name string
+			run  func(*extract.Extractor) error
+			// su is the path of the setuid file, and dir tells if its folder is
+			// created with the mode in the image
+			su  string
+			dir bool
+		}{
+			{"Cpio", func(e *extract.Extractor) error {
+				return e.Cpio(context.Background(), bytes.NewReader(cpioBuf.Bytes()), "/out", nil)
+			}, "/out/ro/su", true},
+			{"Squashfs", func(e *extract.Extractor) error {
+				return e.Squashfs(context.Background(), bytes.NewReader(image), "/out", nil)
+			}, "/out/ro/su", true},
+			{"Ar", func(e *extract.Extractor) error {
+				return e.Ar(context.Background(), bytes.NewReader(arBuf.Bytes()), "/out", nil)
+			}, "/out/su", false},
+			{"Iso", func(e *extract.Extractor) error {
+				return e.Iso(context.Background(), bytes.NewReader(iso), "/out", nil)
+			}, "/out/ro/su", true},
+			{"StreamedZip", func(e *extract.Extractor) error {
+				e.StreamZip, e.VerifyZipDirectory = true, true
+				return e.Zip(context.Background(), struct{ io.Reader }{bytes.NewReader(streamed.Bytes())}, "/out", nil)
+			}, "/out/ro/su", false},
+		} {
+			t.Run(image.name, func(t *testing.T) {
+				modes := extractModes(t, extract.ModePolicy{}, image.run)
+				require.Equal(t, os.ModeSetuid|0777, modes[image.su])
+				if image.dir {
+					require.Equal(t, os.FileMode(0555), modes["/out/ro"])
+				}
+
+				modes = extractModes(t, extract.ModePolicy{StripSpecial: true, Mask: 0022, WritableDirs: true}, image.run)
+				require.Equal(t, os.FileMode(0755), modes[image.su])
+				if image.dir {
+					require.Equal(t, os.FileMode(0755), modes["/out/ro"])
+				}
+			})
+		}
+	})
+}
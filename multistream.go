@@ -0,0 +1,81 @@
+package extract
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+
+	"github.com/juju/errors"
+)
+
+// gzipReader decompresses all the members of a gzip stream, like the ones made by
+// concatenating many .gz files. The zeros that may pad the end of the stream are
+// ignored, as gzip does.
+type gzipReader struct {
+	r  *bufio.Reader
+	zr *gzip.Reader
+
+	// header is the header of the first member
+	header gzip.Header
+}
+
+func newGzipReader(body io.Reader) (io.Reader, error) {
+	// The members are read one at a time from a buffered reader, so that the
+	// decompressor doesn't read past the end of the current one
+	r := bufio.NewReader(body)
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	zr.Multistream(false)
+	return &gzipReader{r: r, zr: zr, header: zr.Header}, nil
+}
+
+func (g *gzipReader) Read(p []byte) (int, error) {
+	for {
+		n, err := g.zr.Read(p)
+		if err != io.EOF {
+			return n, err
+		}
+		if more, err := g.nextMember(); err != nil {
+			return n, err
+		} else if !more {
+			return n, io.EOF
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// nextMember starts reading the next member, returning false at the end of the
+// stream
+func (g *gzipReader) nextMember() (bool, error) {
+	if more, err := skipGzipPadding(g.r); !more || err != nil {
+		return false, err
+	}
+	if err := g.zr.Reset(g.r); err != nil {
+		return false, errors.Annotatef(err, "Read gzip member")
+	}
+	g.zr.Multistream(false)
+	return true, nil
+}
+
+// skipZeroBlocks skips the blocks of zeros that end a tar archive, returning a
+// reader for the next archive if there's one
+func skipZeroBlocks(r io.Reader) (io.Reader, bool, error) {
+	block := make([]byte, 512)
+	zero := make([]byte, 512)
+	for {
+		n, err := io.ReadFull(r, block)
+		if err == io.EOF || (err == io.ErrUnexpectedEOF && bytes.Equal(block[:n], zero[:n])) {
+			return nil, false, nil
+		} else if err != nil && err != io.ErrUnexpectedEOF {
+			return nil, false, err
+		}
+		if !bytes.Equal(block[:n], zero[:n]) {
+			return io.MultiReader(bytes.NewReader(block[:n]), r), true, nil
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package extract_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"os"
+	"testing"
+
+	"github.com/codeclysm/extract/v5"
+	"github.com/codeclysm/extract/v5/extracttest"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/require"
+	"github.com/ulikunitz/xz"
+)
+
+func makeTar(files map[string]string) []byte {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for name, data := range files {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data))})
+		tw.Write([]byte(data))
+	}
+	tw.Close()
+	return buf.Bytes()
+}
+
+func TestMultistream(t *testing.T) {
+	gz := makeGz
+	xzStream := func(data string) []byte {
+		buf := &bytes.Buffer{}
+		w, _ := xz.NewWriter(buf)
+		w.Write([]byte(data))
+		w.Close()
+		return buf.Bytes()
+	}
+	zstdFrame := func(data string) []byte {
+		buf := &bytes.Buffer{}
+		w, _ := zstd.NewWriter(buf)
+		w.Write([]byte(data))
+		w.Close()
+		return buf.Bytes()
+	}
+	bz2, err := os.ReadFile("testdata/multistream.bz2")
+	require.NoError(t, err)
+
+	for _, test := range []struct {
+		name   string
+		stream []byte
+	}{
+		{"Gz", bytes.Join([][]byte{gz("first\n"), gz("second\n")}, nil)},
+		{"GzTrailingZeros", bytes.Join([][]byte{gz("first\n"), gz("second\n"), make([]byte, 100)}, nil)},
+		{"Bz2", bz2},
+		{"Xz", bytes.Join([][]byte{xzStream("first\n"), make([]byte, 4), xzStream("second\n")}, nil)},
+		{"Zstd", bytes.Join([][]byte{zstdFrame("first\n"), zstdFrame("second\n")}, nil)},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			tmp := mkTempDir(t)
+			require.NoError(t, extract.Archive(context.Background(), bytes.NewReader(test.stream), tmp.Join("file").String(), nil))
+			data, err := tmp.Join("file").ReadFile()
+			require.NoError(t, err)
+			require.Equal(t, "first\nsecond\n", string(data))
+		})
+	}
+}
+
+func TestConcatenatedTar(t *testing.T) {
+	first := makeTar(map[string]string{"first.txt": "First"})
+	second := makeTar(map[string]string{"second.txt": "Second"})
+	// Like tar files padded to a full record
+	padding := make([]byte, 512*10)
+
+	t.Run("Default", func(t *testing.T) {
+		tmp := mkTempDir(t)
+		archive := bytes.Join([][]byte{first, padding, second}, nil)
+		require.NoError(t, extract.Tar(context.Background(), bytes.NewReader(archive), tmp.String(), nil))
+		testWalk(t, tmp.String(), Files{
+			"":           "dir",
+			"/first.txt": "First",
+		})
+	})
+
+	t.Run("IgnoreZeros", func(t *testing.T) {
+		tmp := mkTempDir(t)
+		archive := bytes.Join([][]byte{first, padding, second, padding}, nil)
+		extractor := extract.Extractor{FS: &extracttest.LoggingFS{}, IgnoreZeros: true}
+		require.NoError(t, extractor.Tar(context.Background(), bytes.NewReader(archive), tmp.String(), nil))
+		testWalk(t, tmp.String(), Files{
+			"":            "dir",
+			"/first.txt":  "First",
+			"/second.txt": "Second",
+		})
+	})
+
+	t.Run("ConcatenatedTarGz", func(t *testing.T) {
+		tmp := mkTempDir(t)
+		archive := bytes.Join([][]byte{makeGz(string(first)), makeGz(string(second))}, nil)
+		extractor := extract.Extractor{FS: &extracttest.LoggingFS{}, IgnoreZeros: true}
+		require.NoError(t, extractor.Gz(context.Background(), bytes.NewReader(archive), tmp.String(), nil))
+		testWalk(t, tmp.String(), Files{
+			"":            "dir",
+			"/first.txt":  "First",
+			"/second.txt": "Second",
+		})
+	})
+}
@@ -0,0 +1,87 @@
+package extract
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+
+	"github.com/juju/errors"
+)
+
+// extractNested extracts the data of the file at path in a folder with the same
+// name if it's an archive and the depth limit allows it. Otherwise it returns a
+// reader for the whole data, to be written as a file.
+func (e *Extractor) extractNested(ctx context.Context, path string, mode os.FileMode, src io.Reader) (io.Reader, bool, error) {
+	src, extension, err := detect(src)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var extract func(nested *Extractor, rename Renamer) error
+	var recorder *recordingReader
+	fallback := src
+	switch extension {
+	case "zip", "tar", "ar", "deb", "rpm", "iso", "squashfs", "AppImage":
+		extract = func(nested *Extractor, rename Renamer) error {
+			return nested.Archive(ctx, src, path, rename)
+		}
+	case "gz", "bz2", "xz", "zst":
+		// Compressed files are extracted only if they contain a tar archive. The
+		// compressed data read to find it out is recorded to give it back otherwise.
+		recorder = &recordingReader{r: src, recorded: &bytes.Buffer{}}
+		fallback = io.MultiReader(recorder.recorded, src)
+		decompressed, closer, err := e.decompress(extension, recorder)
+		if err != nil {
+			return fallback, false, nil
+		}
+		defer closer()
+		body, kind, _ := match(decompressed)
+		if body == nil || kind.Extension != "tar" {
+			return fallback, false, nil
+		}
+		extract = func(nested *Extractor, rename Renamer) error {
+			return nested.Tar(ctx, body, path, rename)
+		}
+	default:
+		return src, false, nil
+	}
+
+	nested := *e
+	nested.depth++
+	var rename Renamer
+	if e.Nested != nil {
+		var ok bool
+		if ok, rename = e.Nested(path, nested.depth); !ok {
+			return fallback, false, nil
+		}
+	}
+
+	if recorder != nil {
+		// The data is extracted, it doesn't need to be given back anymore
+		recorder.recorded = nil
+	}
+
+	_ = e.FS.Remove(path)
+	if err := e.FS.MkdirAll(path, e.Modes.apply(mode|os.ModeDir)|0100); err != nil {
+		return nil, false, err
+	}
+	if err := extract(&nested, rename); err != nil {
+		return nil, false, errors.Annotatef(err, "Extract nested archive %s", path)
+	}
+	return nil, true, nil
+}
+
+// recordingReader records the data read from r, until recorded is set to nil
+type recordingReader struct {
+	r        io.Reader
+	recorded *bytes.Buffer
+}
+
+func (r *recordingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if r.recorded != nil {
+		r.recorded.Write(p[:n])
+	}
+	return n, err
+}
@@ -0,0 +1,157 @@
+package extract_test
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"math/rand"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/codeclysm/extract/v5"
+	"github.com/codeclysm/extract/v5/extracttest"
+	"github.com/stretchr/testify/require"
+)
+
+func makeZip(files map[string]string) []byte {
+	buf := &bytes.Buffer{}
+	w := zip.NewWriter(buf)
+	for name, data := range files {
+		f, _ := w.Create(name)
+		f.Write([]byte(data))
+	}
+	w.Close()
+	return buf.Bytes()
+}
+
+func makeTarGz(files map[string]string) []byte {
+	buf := &bytes.Buffer{}
+	gw := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gw)
+	for name, data := range files {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data))})
+		tw.Write([]byte(data))
+	}
+	tw.Close()
+	gw.Close()
+	return buf.Bytes()
+}
+
+func makeGz(data string) []byte {
+	buf := &bytes.Buffer{}
+	gw := gzip.NewWriter(buf)
+	gw.Write([]byte(data))
+	gw.Close()
+	return buf.Bytes()
+}
+
+// makeBundle builds a zip with a tar.gz for every platform, where the linux one
+// contains a zip too
+func makeBundle() []byte {
+	return makeZip(map[string]string{
+		"README": "Bundle",
+		"linux.tar.gz": string(makeTarGz(map[string]string{
+			"bin/tool":    "Linux tool",
+			"plugins.zip": string(makeZip(map[string]string{"plugin": "Plugin"})),
+		})),
+		"windows.zip": string(makeZip(map[string]string{"tool.exe": "Windows tool"})),
+		"notes.gz":    string(makeGz("Not an archive")),
+	})
+}
+
+func TestNested(t *testing.T) {
+	t.Run("Disabled", func(t *testing.T) {
+		tmp := mkTempDir(t)
+		require.NoError(t, extract.Zip(context.Background(), bytes.NewReader(makeBundle()), tmp.String(), nil))
+		st, err := tmp.Join("linux.tar.gz").Stat()
+		require.NoError(t, err)
+		require.False(t, st.IsDir())
+	})
+
+	t.Run("OneLevel", func(t *testing.T) {
+		tmp := mkTempDir(t)
+		extractor := extract.Extractor{FS: &extracttest.LoggingFS{}, MaxDepth: 1}
+		require.NoError(t, extractor.Zip(context.Background(), bytes.NewReader(makeBundle()), tmp.String(), nil))
+		testWalk(t, tmp.String(), Files{
+			"":                          "dir",
+			"/README":                   "Bundle",
+			"/linux.tar.gz":             "dir",
+			"/linux.tar.gz/bin":         "dir",
+			"/linux.tar.gz/bin/tool":    "Linux tool",
+			"/linux.tar.gz/plugins.zip": strings.TrimSpace(string(makeZip(map[string]string{"plugin": "Plugin"}))),
+			"/windows.zip":              "dir",
+			"/windows.zip/tool.exe":     "Windows tool",
+			"/notes.gz":                 strings.TrimSpace(string(makeGz("Not an archive"))),
+		})
+	})
+
+	t.Run("TwoLevels", func(t *testing.T) {
+		tmp := mkTempDir(t)
+		extractor := extract.Extractor{FS: &extracttest.LoggingFS{}, MaxDepth: 2}
+		require.NoError(t, extractor.Zip(context.Background(), bytes.NewReader(makeBundle()), tmp.String(), nil))
+		data, err := os.ReadFile(tmp.Join("linux.tar.gz", "plugins.zip", "plugin").String())
+		require.NoError(t, err)
+		require.Equal(t, "Plugin", string(data))
+	})
+
+	t.Run("Hooks", func(t *testing.T) {
+		tmp := mkTempDir(t)
+		visited := []string{}
+		extractor := extract.Extractor{FS: &extracttest.LoggingFS{}, MaxDepth: 2, Nested: func(path string, depth int) (bool, extract.Renamer) {
+			visited = append(visited, strings.TrimPrefix(path, tmp.String()))
+			if strings.HasSuffix(path, "windows.zip") {
+				return false, nil
+			}
+			return true, func(name string) string {
+				if depth == 1 && name == "plugins.zip" {
+					return ""
+				}
+				return strings.ToUpper(name)
+			}
+		}}
+		require.NoError(t, extractor.Zip(context.Background(), bytes.NewReader(makeBundle()), tmp.String(), nil))
+		require.ElementsMatch(t, []string{"/linux.tar.gz", "/windows.zip"}, visited)
+		testWalk(t, tmp.String(), Files{
+			"":                       "dir",
+			"/README":                "Bundle",
+			"/linux.tar.gz":          "dir",
+			"/linux.tar.gz/BIN":      "dir",
+			"/linux.tar.gz/BIN/TOOL": "Linux tool",
+			"/windows.zip":           strings.TrimSpace(string(makeZip(map[string]string{"tool.exe": "Windows tool"}))),
+			"/notes.gz":              strings.TrimSpace(string(makeGz("Not an archive"))),
+		})
+	})
+
+	t.Run("Modes", func(t *testing.T) {
+		// The folders of the nested archives are directories for the policy
+		fs := &extracttest.LoggingFS{FS: &extract.MemFS{}}
+		extractor := extract.Extractor{FS: fs, MaxDepth: 1, Modes: extract.ModePolicy{FileMode: 0644, DirMode: 0750}}
+		require.NoError(t, fs.MkdirAll("/out", 0755))
+		require.NoError(t, extractor.Zip(context.Background(), bytes.NewReader(makeBundle()), "/out", nil))
+		info, err := fs.Stat("/out/windows.zip")
+		require.NoError(t, err)
+		require.Equal(t, os.ModeDir|0750, info.Mode())
+	})
+
+	t.Run("Streamed", func(t *testing.T) {
+		// The compressed data is recorded only until the tar archive is found
+		data := make([]byte, 16<<20)
+		rand.New(rand.NewSource(1)).Read(data)
+		archive := makeZip(map[string]string{"big.tar.gz": string(makeTarGz(map[string]string{"big": string(data)}))})
+
+		tmp := mkTempDir(t)
+		extractor := extract.Extractor{FS: &extracttest.LoggingFS{}, MaxDepth: 1}
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		require.NoError(t, extractor.Zip(context.Background(), bytes.NewReader(archive), tmp.String(), nil))
+		runtime.ReadMemStats(&after)
+		require.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(8<<20))
+		st, err := tmp.Join("big.tar.gz", "big").Stat()
+		require.NoError(t, err)
+		require.Equal(t, int64(len(data)), st.Size())
+	})
+}
@@ -0,0 +1,349 @@
+package extract
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	iofs "io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ObjectStore is a key/value store of objects, like the client of an object
+// storage service. The keys are slash separated paths without a leading slash;
+// the directories are stored as empty objects whose key ends with a slash.
+type ObjectStore interface {
+	// Put stores an object reading its data from r, replacing the one with the
+	// same key if any.
+	Put(key string, r io.Reader, meta ObjectMeta) error
+
+	// Head returns the metadata of an object, or an error satisfying
+	// errors.Is(err, fs.ErrNotExist) if it doesn't exist.
+	Head(key string) (ObjectMeta, error)
+
+	// Update replaces the metadata of an object, keeping its data.
+	Update(key string, meta ObjectMeta) error
+
+	// Delete removes an object. It's not an error if it doesn't exist.
+	Delete(key string) error
+}
+
+// ObjectMeta is the metadata of an object of an ObjectStore.
+type ObjectMeta struct {
+	// Mode is the type and the permissions of the file stored in the object.
+	Mode os.FileMode `json:"mode"`
+
+	// ModTime is the modification time of the file, zero if it's unknown.
+	ModTime time.Time `json:"modTime"`
+
+	// Symlink is the target of a symlink, whose object has no data.
+	Symlink string `json:"symlink,omitempty"`
+
+	// HardLink is the key of the object a hard link refers to. Its object has
+	// no data.
+	HardLink string `json:"hardLink,omitempty"`
+}
+
+// FromObjectStore returns an FS writing every file in an object of store, with
+// the key given by its path. The location passed to the Extractor is the prefix
+// of the keys, "/" to use the paths of the archive as they are. The symlinks and
+// the hard links are stored as objects without data, with their target in the
+// metadata.
+func FromObjectStore(store ObjectStore) FS {
+	return &objectFS{store: store, times: map[string]time.Time{}}
+}
+
+// objectFS is the FS writing in an ObjectStore
+type objectFS struct {
+	store ObjectStore
+
+	mu    sync.Mutex
+	times map[string]time.Time
+}
+
+// key returns the key of the object of path, empty for the root
+func (o *objectFS) key(path string) string {
+	return strings.TrimPrefix(memClean(path), "/")
+}
+
+func (o *objectFS) setModTime(path string, mtime time.Time) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.times[o.key(path)] = mtime
+}
+
+func (o *objectFS) modTime(key string) time.Time {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.times[key]
+}
+
+// head returns the metadata of the file or the directory at key
+func (o *objectFS) head(key string) (ObjectMeta, string, error) {
+	if key == "" {
+		return ObjectMeta{Mode: os.ModeDir | 0755}, "", nil
+	}
+	meta, err := o.store.Head(key)
+	if errors.Is(err, iofs.ErrNotExist) {
+		meta, err = o.store.Head(key + "/")
+		return meta, key + "/", err
+	}
+	return meta, key, err
+}
+
+func (o *objectFS) Link(oldname, newname string) error {
+	target, key := o.key(oldname), o.key(newname)
+	meta, _, err := o.head(target)
+	if err != nil {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: err}
+	}
+	if meta.Mode.IsDir() {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: syscall.EPERM}
+	}
+	if meta.HardLink != "" {
+		target = meta.HardLink
+	}
+	meta = ObjectMeta{Mode: meta.Mode, ModTime: o.modTime(key), HardLink: target}
+	return o.store.Put(key, strings.NewReader(""), meta)
+}
+
+func (o *objectFS) MkdirAll(path string, perm os.FileMode) error {
+	key := o.key(path)
+	if key == "" {
+		return nil
+	}
+	parts := strings.Split(key, "/")
+	for i := range parts {
+		dir := strings.Join(parts[:i+1], "/")
+		meta, _, err := o.head(dir)
+		if err == nil {
+			if !meta.Mode.IsDir() {
+				return &os.PathError{Op: "mkdir", Path: path, Err: syscall.ENOTDIR}
+			}
+			continue
+		} else if !errors.Is(err, iofs.ErrNotExist) {
+			return err
+		}
+		meta = ObjectMeta{Mode: os.ModeDir | perm&(os.ModePerm|modeSpecial), ModTime: o.modTime(dir)}
+		if err := o.store.Put(dir+"/", strings.NewReader(""), meta); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// OpenFile starts storing an object, whose data is streamed to the store as it's
+// written. The object is complete when the file is closed.
+func (o *objectFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	key := o.key(name)
+	if key == "" {
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+	}
+	pr, pw := io.Pipe()
+	file := &objectFile{PipeWriter: pw, done: make(chan error, 1)}
+	meta := ObjectMeta{Mode: perm & (os.ModePerm | modeSpecial), ModTime: o.modTime(key)}
+	go func() {
+		err := o.store.Put(key, pr, meta)
+		if err == nil {
+			err = io.ErrClosedPipe
+		}
+		pr.CloseWithError(err)
+		if err == io.ErrClosedPipe {
+			err = nil
+		}
+		file.done <- err
+	}()
+	return file, nil
+}
+
+func (o *objectFS) Symlink(oldname, newname string) error {
+	key := o.key(newname)
+	meta := ObjectMeta{Mode: os.ModeSymlink | 0777, ModTime: o.modTime(key), Symlink: filepath.ToSlash(oldname)}
+	return o.store.Put(key, strings.NewReader(""), meta)
+}
+
+func (o *objectFS) Remove(path string) error {
+	_, key, err := o.head(o.key(path))
+	if err != nil {
+		return err
+	}
+	return o.store.Delete(key)
+}
+
+func (o *objectFS) Stat(name string) (os.FileInfo, error) {
+	meta, _, err := o.head(o.key(name))
+	if err != nil {
+		return nil, err
+	}
+	return &memInfo{name: filepath.Base(name), mode: meta.Mode, modTime: meta.ModTime}, nil
+}
+
+func (o *objectFS) Chmod(name string, mode os.FileMode) error {
+	meta, key, err := o.head(o.key(name))
+	if err != nil {
+		return err
+	}
+	meta.Mode = meta.Mode.Type() | mode&(os.ModePerm|modeSpecial)
+	return o.store.Update(key, meta)
+}
+
+func (o *objectFS) Chtimes(name string, atime, mtime time.Time) error {
+	meta, key, err := o.head(o.key(name))
+	if err != nil {
+		return err
+	}
+	meta.ModTime = mtime
+	return o.store.Update(key, meta)
+}
+
+// objectFile is a file being stored in an ObjectStore
+type objectFile struct {
+	*io.PipeWriter
+	done chan error
+}
+
+// Close waits until the object is stored
+func (f *objectFile) Close() error {
+	f.PipeWriter.Close()
+	return <-f.done
+}
+
+// CloseWithError makes the store fail reading the data, so that the object
+// isn't stored, and waits until it gives up
+func (f *objectFile) CloseWithError(err error) error {
+	f.PipeWriter.CloseWithError(err)
+	return <-f.done
+}
+
+// DirStore is an ObjectStore keeping the objects in the files of a local
+// directory, useful as a stand-in for a remote store. Every object is stored
+// in a file with its escaped key as name, and its metadata in a JSON file next
+// to it.
+type DirStore struct {
+	dir string
+	mu  sync.Mutex
+}
+
+// NewDirStore returns a DirStore keeping the objects in dir, which must exist.
+func NewDirStore(dir string) *DirStore {
+	return &DirStore{dir: dir}
+}
+
+const (
+	dirStoreData = ".data"
+	dirStoreMeta = ".json"
+)
+
+func (s *DirStore) path(key string) string {
+	return filepath.Join(s.dir, url.PathEscape(key))
+}
+
+// Put stores an object reading its data from r.
+func (s *DirStore) Put(key string, r io.Reader, meta ObjectMeta) error {
+	// The data is written in a temporary file first, to replace the object
+	// only when it's complete
+	tmp, err := os.CreateTemp(s.dir, ".put-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.Rename(tmp.Name(), s.path(key)+dirStoreData); err != nil {
+		return err
+	}
+	return s.writeMeta(key, meta)
+}
+
+func (s *DirStore) writeMeta(key string, meta ObjectMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(s.path(key)+dirStoreMeta, data, 0644)
+}
+
+// Head returns the metadata of an object.
+func (s *DirStore) Head(key string) (ObjectMeta, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.head(key)
+}
+
+func (s *DirStore) head(key string) (ObjectMeta, error) {
+	meta := ObjectMeta{}
+	data, err := os.ReadFile(s.path(key) + dirStoreMeta)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return meta, &os.PathError{Op: "head", Path: key, Err: iofs.ErrNotExist}
+		}
+		return meta, err
+	}
+	return meta, json.Unmarshal(data, &meta)
+}
+
+// Update replaces the metadata of an object.
+func (s *DirStore) Update(key string, meta ObjectMeta) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.head(key); err != nil {
+		return err
+	}
+	return s.writeMeta(key, meta)
+}
+
+// Delete removes an object.
+func (s *DirStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, ext := range []string{dirStoreMeta, dirStoreData} {
+		if err := os.Remove(s.path(key) + ext); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get returns the data and the metadata of an object.
+func (s *DirStore) Get(key string) (io.ReadCloser, ObjectMeta, error) {
+	meta, err := s.Head(key)
+	if err != nil {
+		return nil, meta, err
+	}
+	f, err := os.Open(s.path(key) + dirStoreData)
+	return f, meta, err
+}
+
+// Keys returns the keys of the objects, sorted.
+func (s *DirStore) Keys() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	keys := []string{}
+	for _, entry := range entries {
+		if name, ok := strings.CutSuffix(entry.Name(), dirStoreMeta); ok {
+			if key, err := url.PathUnescape(name); err == nil {
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
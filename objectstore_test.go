@@ -0,0 +1,149 @@
+package extract_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	iofs "io/fs"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/codeclysm/extract/v5"
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestObjectStore(t *testing.T) {
+	mtime := time.Date(2021, 6, 5, 4, 3, 0, 0, time.UTC)
+
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	tw.WriteHeader(&tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0750, ModTime: mtime})
+	tw.WriteHeader(&tar.Header{Name: "dir/file.txt", Typeflag: tar.TypeReg, Mode: 0640, Size: 5, ModTime: mtime})
+	tw.Write([]byte("hello"))
+	tw.WriteHeader(&tar.Header{Name: "dir/link", Typeflag: tar.TypeSymlink, Linkname: "file.txt", ModTime: mtime})
+	tw.WriteHeader(&tar.Header{Name: "dir/hard", Typeflag: tar.TypeLink, Linkname: "dir/file.txt", ModTime: mtime})
+	tw.WriteHeader(&tar.Header{Name: "dir/hard2", Typeflag: tar.TypeLink, Linkname: "dir/hard", ModTime: mtime})
+	tw.Close()
+
+	store := extract.NewDirStore(mkTempDir(t).String())
+	extractor := extract.Extractor{FS: extract.FromObjectStore(store)}
+	require.NoError(t, extractor.Tar(context.Background(), bytes.NewReader(buf.Bytes()), "/prefix", nil))
+
+	keys, err := store.Keys()
+	require.NoError(t, err)
+	require.Equal(t, []string{"prefix/", "prefix/dir/", "prefix/dir/file.txt", "prefix/dir/hard", "prefix/dir/hard2", "prefix/dir/link"}, keys)
+
+	get := func(key string) (string, extract.ObjectMeta) {
+		r, meta, err := store.Get(key)
+		require.NoError(t, err)
+		defer r.Close()
+		data, err := io.ReadAll(r)
+		require.NoError(t, err)
+		return string(data), meta
+	}
+
+	_, meta := get("prefix/dir/")
+	require.Equal(t, os.ModeDir|0750, meta.Mode)
+	require.True(t, meta.ModTime.Equal(mtime))
+
+	data, meta := get("prefix/dir/file.txt")
+	require.Equal(t, "hello", data)
+	require.Equal(t, os.FileMode(0640), meta.Mode)
+	require.True(t, meta.ModTime.Equal(mtime))
+
+	data, meta = get("prefix/dir/link")
+	require.Empty(t, data)
+	require.Equal(t, os.ModeSymlink, meta.Mode.Type())
+	require.Equal(t, "file.txt", meta.Symlink)
+
+	data, meta = get("prefix/dir/hard")
+	require.Empty(t, data)
+	require.Equal(t, "prefix/dir/file.txt", meta.HardLink)
+	require.Equal(t, os.FileMode(0640), meta.Mode)
+
+	_, meta = get("prefix/dir/hard2")
+	require.Equal(t, "prefix/dir/file.txt", meta.HardLink)
+
+	t.Run("Errors", func(t *testing.T) {
+		fs := extract.FromObjectStore(store)
+		_, err := fs.Stat("/prefix/missing")
+		require.ErrorIs(t, err, iofs.ErrNotExist)
+		require.Error(t, fs.MkdirAll("/prefix/dir/file.txt/sub", 0755))
+		require.Error(t, fs.Link("/prefix/dir", "/prefix/dirlink"))
+
+		require.NoError(t, fs.Remove("/prefix/dir/link"))
+		_, err = fs.Stat("/prefix/dir/link")
+		require.Error(t, err)
+	})
+
+	t.Run("SpecialBits", func(t *testing.T) {
+		// The setuid, setgid and sticky bits are kept like on the disk
+		special := &bytes.Buffer{}
+		tw := tar.NewWriter(special)
+		tw.WriteHeader(&tar.Header{Name: "tmp/", Typeflag: tar.TypeDir, Mode: 01777})
+		tw.WriteHeader(&tar.Header{Name: "su", Typeflag: tar.TypeReg, Mode: 04755, Size: 2})
+		tw.Write([]byte("su"))
+		tw.Close()
+
+		store := extract.NewDirStore(mkTempDir(t).String())
+		extractor := extract.Extractor{FS: extract.FromObjectStore(store)}
+		require.NoError(t, extractor.Tar(context.Background(), special, "/prefix", nil))
+		for key, mode := range map[string]os.FileMode{
+			"prefix/tmp/": os.ModeDir | os.ModeSticky | 0777,
+			"prefix/su":   os.ModeSetuid | 0755,
+		} {
+			r, meta, err := store.Get(key)
+			require.NoError(t, err)
+			r.Close()
+			require.Equal(t, mode, meta.Mode, key)
+		}
+	})
+
+	t.Run("FailingPut", func(t *testing.T) {
+		store := &testStore{DirStore: extract.NewDirStore(mkTempDir(t).String()), fail: true}
+		extractor := extract.Extractor{FS: extract.FromObjectStore(store)}
+		err := extractor.Tar(context.Background(), bytes.NewReader(buf.Bytes()), "/prefix", nil)
+		require.Equal(t, errPutFailed, errors.Cause(err))
+	})
+
+	t.Run("Truncated", func(t *testing.T) {
+		// The data of the file ends before its size
+		truncated := &bytes.Buffer{}
+		tw := tar.NewWriter(truncated)
+		tw.WriteHeader(&tar.Header{Name: "file.txt", Typeflag: tar.TypeReg, Mode: 0640, Size: 1000})
+		tw.Write([]byte("hello"))
+
+		store := &testStore{DirStore: extract.NewDirStore(mkTempDir(t).String())}
+		extractor := extract.Extractor{FS: extract.FromObjectStore(store)}
+		require.Error(t, extractor.Tar(context.Background(), truncated, "/prefix", nil))
+		require.Equal(t, []string{"prefix/file.txt"}, store.aborted)
+		keys, err := store.Keys()
+		require.NoError(t, err)
+		require.NotContains(t, keys, "prefix/file.txt")
+	})
+}
+
+var errPutFailed = errors.New("put failed")
+
+// testStore is a DirStore that records the objects whose data couldn't be
+// read, and optionally fails storing the files
+type testStore struct {
+	*extract.DirStore
+	fail    bool
+	aborted []string
+}
+
+func (s *testStore) Put(key string, r io.Reader, meta extract.ObjectMeta) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		s.aborted = append(s.aborted, key)
+		return err
+	}
+	if s.fail && meta.Mode.IsRegular() && meta.HardLink == "" {
+		return errPutFailed
+	}
+	return s.DirStore.Put(key, bytes.NewReader(data), meta)
+}
@@ -0,0 +1,184 @@
+package extract
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+const (
+	ociIndexMediaType           = "application/vnd.oci.image.index.v1+json"
+	ociManifestMediaType        = "application/vnd.oci.image.manifest.v1+json"
+	dockerManifestListMediaType = "application/vnd.docker.distribution.manifest.list.v2+json"
+	dockerManifestMediaType     = "application/vnd.docker.distribution.manifest.v2+json"
+)
+
+type ociDescriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+	Platform  *struct {
+		Architecture string `json:"architecture"`
+		OS           string `json:"os"`
+		Variant      string `json:"variant"`
+	} `json:"platform"`
+}
+
+type ociIndex struct {
+	Manifests []ociDescriptor `json:"manifests"`
+}
+
+type ociManifest struct {
+	Layers []ociDescriptor `json:"layers"`
+}
+
+// ApplyOCILayout extracts the filesystem of an image stored in an OCI image layout
+// directory, applying its layers in order over the content of location. If the
+// image is available for many platforms the one for platform ("os/arch" or
+// "os/arch/variant") is chosen, or the current one if it's empty. The digest of
+// every blob is verified before using it.
+// It accepts a rename function to handle the names of the files (see the example)
+func (e *Extractor) ApplyOCILayout(ctx context.Context, layout, platform, location string, rename Renamer) error {
+	index := ociIndex{}
+	data, err := os.ReadFile(filepath.Join(layout, "index.json"))
+	if err != nil {
+		return errors.Annotatef(err, "Read the index of the layout")
+	}
+	if err := json.Unmarshal(data, &index); err != nil {
+		return errors.Annotatef(err, "Read the index of the layout")
+	}
+
+	descriptor, err := selectOCIManifest(layout, index, platform)
+	if err != nil {
+		return err
+	}
+	manifest := ociManifest{}
+	if data, err = readOCIBlob(layout, descriptor); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return errors.Annotatef(err, "Read manifest %s", descriptor.Digest)
+	}
+
+	for _, layer := range manifest.Layers {
+		select {
+		case <-ctx.Done():
+			return errors.New("interrupted")
+		default:
+		}
+
+		path, err := verifyOCIBlob(layout, layer)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return errors.Annotatef(err, "Open layer %s", layer.Digest)
+		}
+		err = e.ApplyLayer(ctx, f, location, rename)
+		f.Close()
+		if err != nil {
+			return errors.Annotatef(err, "Apply layer %s", layer.Digest)
+		}
+	}
+	return nil
+}
+
+// selectOCIManifest finds the manifest of the image for the platform, following
+// the nested indexes
+func selectOCIManifest(layout string, index ociIndex, platform string) (ociDescriptor, error) {
+	candidates := []ociDescriptor{}
+	for _, manifest := range index.Manifests {
+		switch manifest.MediaType {
+		case ociIndexMediaType, ociManifestMediaType, dockerManifestListMediaType, dockerManifestMediaType:
+			candidates = append(candidates, manifest)
+		}
+	}
+
+	// A single image without a platform is taken anyway, it's often a nested
+	// index with the images for all the platforms
+	selected := -1
+	if len(candidates) == 1 && (platform == "" || candidates[0].Platform == nil) {
+		selected = 0
+	} else {
+		if platform == "" {
+			platform = runtime.GOOS + "/" + runtime.GOARCH
+		}
+		for i, candidate := range candidates {
+			if candidate.Platform == nil {
+				continue
+			}
+			name := candidate.Platform.OS + "/" + candidate.Platform.Architecture
+			if name == platform || name+"/"+candidate.Platform.Variant == platform {
+				selected = i
+				break
+			}
+		}
+	}
+	if selected < 0 {
+		return ociDescriptor{}, errors.Errorf("No image for %s", platform)
+	}
+
+	descriptor := candidates[selected]
+	if descriptor.MediaType != ociIndexMediaType && descriptor.MediaType != dockerManifestListMediaType {
+		return descriptor, nil
+	}
+	data, err := readOCIBlob(layout, descriptor)
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+	nested := ociIndex{}
+	if err := json.Unmarshal(data, &nested); err != nil {
+		return ociDescriptor{}, errors.Annotatef(err, "Read index %s", descriptor.Digest)
+	}
+	return selectOCIManifest(layout, nested, platform)
+}
+
+// readOCIBlob reads a blob, verifying its digest
+func readOCIBlob(layout string, descriptor ociDescriptor) ([]byte, error) {
+	path, err := verifyOCIBlob(layout, descriptor)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(path)
+}
+
+// verifyOCIBlob returns the path of a blob after verifying its size and digest
+func verifyOCIBlob(layout string, descriptor ociDescriptor) (string, error) {
+	algorithm, encoded, ok := strings.Cut(descriptor.Digest, ":")
+	var h hash.Hash
+	switch algorithm {
+	case "sha256":
+		h = sha256.New()
+	case "sha512":
+		h = sha512.New()
+	}
+	if !ok || h == nil || strings.ContainsAny(encoded, `/\.`) {
+		return "", errors.Errorf("Unsupported digest %s", descriptor.Digest)
+	}
+
+	path := filepath.Join(layout, "blobs", algorithm, encoded)
+	f, err := os.Open(path)
+	if err != nil {
+		return "", errors.Annotatef(err, "Open blob %s", descriptor.Digest)
+	}
+	defer f.Close()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return "", errors.Annotatef(err, "Read blob %s", descriptor.Digest)
+	}
+	if size != descriptor.Size || hex.EncodeToString(h.Sum(nil)) != encoded {
+		return "", errors.Errorf("Blob %s doesn't match its digest", descriptor.Digest)
+	}
+	return path, nil
+}
@@ -0,0 +1,157 @@
+package extract
+
+import (
+	"compress/bzip2"
+	"compress/gzip"
+	"io"
+	"runtime"
+
+	"github.com/juju/errors"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// decoderConcurrency returns the number of goroutines to decompress a stream,
+// or zero to use the default decoders
+func (e *Extractor) decoderConcurrency() int {
+	if e.DecoderConcurrency < 0 {
+		return runtime.GOMAXPROCS(0)
+	}
+	return e.DecoderConcurrency
+}
+
+// decompress returns a reader for the decompressed data of a single-file
+// compressed stream, and a function to release its resources
+func (e *Extractor) decompress(extension string, body io.Reader) (io.Reader, func(), error) {
+	switch extension {
+	case "gz":
+		r, _, closer, err := e.gunzip(body)
+		return r, closer, err
+	case "bz2":
+		return bzip2.NewReader(body), func() {}, nil
+	case "xz":
+		return e.unxz(body)
+	case "zst":
+		return e.unzstd(body)
+	default:
+		return nil, nil, errors.New("Not a compressed stream: " + extension)
+	}
+}
+
+// gunzip returns a reader for the decompressed data of a gzip stream, together
+// with the header of its first member
+func (e *Extractor) gunzip(body io.Reader) (io.Reader, gzip.Header, func(), error) {
+	if workers := e.decoderConcurrency(); workers > 1 {
+		r, err := newParallelGzipReader(body, workers)
+		if err != nil {
+			return nil, gzip.Header{}, nil, err
+		}
+		return r, r.header, r.close, nil
+	}
+	r, err := newGzipReader(body)
+	if err != nil {
+		return nil, gzip.Header{}, nil, err
+	}
+	return r, r.(*gzipReader).header, func() {}, nil
+}
+
+func (e *Extractor) unxz(body io.Reader) (io.Reader, func(), error) {
+	if workers := e.decoderConcurrency(); workers > 1 {
+		r, err := newParallelXzReader(body, workers)
+		if err != nil {
+			return nil, nil, err
+		}
+		return r, r.close, nil
+	}
+	r, err := xz.NewReader(body)
+	return r, func() {}, err
+}
+
+func (e *Extractor) unzstd(body io.Reader) (io.Reader, func(), error) {
+	options := []zstd.DOption{}
+	if workers := e.decoderConcurrency(); workers > 0 {
+		options = append(options, zstd.WithDecoderConcurrency(workers))
+	}
+	r, err := zstd.NewReader(body, options...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return r, r.Close, nil
+}
+
+// pipeline processes the values of a stream on many goroutines, giving them
+// back in the order they were produced
+type pipeline[T any] struct {
+	tasks   chan *task[T]
+	stop    chan struct{}
+	stopped bool
+	err     error
+}
+
+type task[T any] struct {
+	value T
+	done  chan struct{}
+}
+
+// startPipeline calls next on a goroutine until it returns false, and runs work
+// on every value it returns on up to workers goroutines
+func startPipeline[T any](workers int, next func() (T, bool, error), work func(T)) *pipeline[T] {
+	p := &pipeline[T]{tasks: make(chan *task[T], workers), stop: make(chan struct{})}
+	running := make(chan struct{}, workers)
+	go func() {
+		defer close(p.tasks)
+		for {
+			select {
+			case <-p.stop:
+				return
+			default:
+			}
+			value, ok, err := next()
+			if err != nil || !ok {
+				p.err = err
+				return
+			}
+			// The value is queued even if the pipeline is stopping, close
+			// returns it
+			t := &task[T]{value: value, done: make(chan struct{})}
+			p.tasks <- t
+			select {
+			case running <- struct{}{}:
+			case <-p.stop:
+				return
+			}
+			go func() {
+				work(t.value)
+				<-running
+				close(t.done)
+			}()
+		}
+	}()
+	return p
+}
+
+// next returns the next value once its work is done, or false at the end of
+// the stream
+func (p *pipeline[T]) next() (T, bool, error) {
+	t, ok := <-p.tasks
+	if !ok {
+		var zero T
+		return zero, false, p.err
+	}
+	<-t.done
+	return t.value, true, nil
+}
+
+// close stops the pipeline, returning the values produced but not received yet.
+// When it returns, next is not called anymore.
+func (p *pipeline[T]) close() []T {
+	if !p.stopped {
+		p.stopped = true
+		close(p.stop)
+	}
+	rest := []T{}
+	for t := range p.tasks {
+		rest = append(rest, t.value)
+	}
+	return rest
+}
@@ -0,0 +1,233 @@
+package extract_test
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"math/rand"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/codeclysm/extract/v5"
+	"github.com/codeclysm/extract/v5/extracttest"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/require"
+	"github.com/ulikunitz/xz"
+)
+
+// randomData returns data that can't be compressed, with some pieces repeating
+// the data preceding them
+func randomData(size int) []byte {
+	rnd := rand.New(rand.NewSource(1))
+	data := make([]byte, 0, size)
+	for len(data) < size {
+		block := make([]byte, 50000)
+		rnd.Read(block)
+		data = append(data, block...)
+		data = append(data, data[len(data)-20000:len(data)-10000]...)
+	}
+	return data[:size]
+}
+
+// makePigz compresses data in a gzip member flushed every blockSize bytes, like
+// pigz does
+func makePigz(data []byte, blockSize int) []byte {
+	buf := &bytes.Buffer{}
+	gw := gzip.NewWriter(buf)
+	gw.Name = "data"
+	for len(data) > 0 {
+		n := min(blockSize, len(data))
+		gw.Write(data[:n])
+		gw.Flush()
+		data = data[n:]
+	}
+	gw.Close()
+	return buf.Bytes()
+}
+
+// makeBgzf compresses data in the independent members of a BGZF file, ended by
+// the empty one
+func makeBgzf(data []byte) []byte {
+	buf := &bytes.Buffer{}
+	member := func(block []byte) {
+		compressed := &bytes.Buffer{}
+		fw, _ := flate.NewWriter(compressed, flate.DefaultCompression)
+		fw.Write(block)
+		fw.Close()
+		header := []byte{0x1f, 0x8b, 8, 4, 0, 0, 0, 0, 0, 0xff, 6, 0, 'B', 'C', 2, 0, 0, 0}
+		binary.LittleEndian.PutUint16(header[16:], uint16(len(header)+compressed.Len()+8-1))
+		buf.Write(header)
+		buf.Write(compressed.Bytes())
+		binary.Write(buf, binary.LittleEndian, crc32.ChecksumIEEE(block))
+		binary.Write(buf, binary.LittleEndian, uint32(len(block)))
+	}
+	for len(data) > 0 {
+		n := min(0xff00, len(data))
+		member(data[:n])
+		data = data[n:]
+	}
+	member(nil)
+	return buf.Bytes()
+}
+
+func TestParallelGzip(t *testing.T) {
+	data := randomData(3 << 20)
+	plain := &bytes.Buffer{}
+	gw := gzip.NewWriter(plain)
+	gw.Write(randomData(10 << 20))
+	gw.Close()
+
+	testCases := []struct {
+		name     string
+		archive  []byte
+		expected []byte
+	}{
+		{"Pigz", makePigz(data, 128<<10), data},
+		{"BGZF", makeBgzf(data), data},
+		{"NoSyncPoints", plain.Bytes(), randomData(10 << 20)},
+		{"Members", append(append(append(makePigz(data, 100<<10), makeGz("Last member")...), 0, 0), makeBgzf([]byte("BGZF"))...),
+			append(append(data, "Last member"...), "BGZF"...)},
+		{"Small", makeGz("Small"), []byte("Small")},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			target := mkTempDir(t).Join("data")
+			extractor := extract.Extractor{FS: &extracttest.LoggingFS{}, DecoderConcurrency: 4}
+			require.NoError(t, extractor.Gz(context.Background(), bytes.NewReader(test.archive), target.String(), nil))
+			extracted, err := target.ReadFile()
+			require.NoError(t, err)
+			require.True(t, bytes.Equal(test.expected, extracted))
+		})
+	}
+
+	t.Run("Corrupted", func(t *testing.T) {
+		for _, archive := range [][]byte{makePigz(data, 128<<10), makeBgzf(data), plain.Bytes()} {
+			archive[len(archive)/2] ^= 0xff
+			extractor := extract.Extractor{FS: &extracttest.LoggingFS{}, DecoderConcurrency: 4}
+			require.Error(t, extractor.Gz(context.Background(), bytes.NewReader(archive), mkTempDir(t).Join("data").String(), nil))
+		}
+	})
+
+	t.Run("Bomb", func(t *testing.T) {
+		// The chunks decompressing to too much data aren't kept in memory
+		archive := makeGz(string(make([]byte, 256<<20)))
+		target := mkTempDir(t).Join("data")
+		extractor := extract.Extractor{FS: &extracttest.LoggingFS{}, DecoderConcurrency: 4}
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		require.NoError(t, extractor.Gz(context.Background(), bytes.NewReader(archive), target.String(), nil))
+		runtime.ReadMemStats(&after)
+		require.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(200<<20))
+		st, err := target.Stat()
+		require.NoError(t, err)
+		require.Equal(t, int64(256<<20), st.Size())
+	})
+
+	t.Run("Tar", func(t *testing.T) {
+		tmp := mkTempDir(t)
+		archive, err := os.ReadFile("testdata/archive.tar.gz")
+		require.NoError(t, err)
+		extractor := extract.Extractor{FS: &extracttest.LoggingFS{}, DecoderConcurrency: 4}
+		require.NoError(t, extractor.Gz(context.Background(), bytes.NewReader(archive), tmp.String(), nil))
+		testWalk(t, tmp.String(), Files{
+			"":                          "dir",
+			"/archive":                  "dir",
+			"/archive/folder":           "dir",
+			"/archive/folderlink":       "link",
+			"/archive/folder/file1.txt": "folder/File1",
+			"/archive/file1.txt":        "File1",
+			"/archive/file2.txt":        "File2",
+			"/archive/link.txt":         "File1",
+		})
+	})
+}
+
+func TestParallelXz(t *testing.T) {
+	lines := &strings.Builder{}
+	for i := 0; i < 50000; i++ {
+		fmt.Fprintf(lines, "line %d\n", i)
+	}
+	files := Files{
+		"":           "dir",
+		"/big.txt":   strings.TrimSpace(lines.String()),
+		"/small.txt": "Small",
+	}
+
+	t.Run("Blocks", func(t *testing.T) {
+		tmp := mkTempDir(t)
+		f, err := os.Open("testdata/multiblock.tar.xz")
+		require.NoError(t, err)
+		defer f.Close()
+		extractor := extract.Extractor{FS: &extracttest.LoggingFS{}, DecoderConcurrency: 4}
+		require.NoError(t, extractor.Xz(context.Background(), f, tmp.String(), nil))
+		testWalk(t, tmp.String(), files)
+	})
+
+	t.Run("Sequential", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		xw, _ := xz.NewWriter(buf)
+		xw.Write([]byte("Single block"))
+		xw.Close()
+		target := mkTempDir(t).Join("data")
+		extractor := extract.Extractor{FS: &extracttest.LoggingFS{}, DecoderConcurrency: 4}
+		require.NoError(t, extractor.Xz(context.Background(), buf, target.String(), nil))
+		data, err := target.ReadFile()
+		require.NoError(t, err)
+		require.Equal(t, "Single block", string(data))
+	})
+
+	t.Run("HostileSize", func(t *testing.T) {
+		// The first block claims to decompress to 1GiB, which isn't allocated
+		archive, err := os.ReadFile("testdata/multiblock.tar.xz")
+		require.NoError(t, err)
+		size := int(archive[12]+1) * 4
+		header := archive[12 : 12+size]
+		rest := header[2 : size-4]
+		compressed, n := binary.Uvarint(rest)
+		_, m := binary.Uvarint(rest[n:])
+		hostile := binary.AppendUvarint([]byte{0, header[1]}, compressed)
+		hostile = binary.AppendUvarint(hostile, 1<<30)
+		hostile = append(hostile, rest[n+m:]...)
+		for len(hostile)%4 != 0 {
+			hostile = append(hostile, 0)
+		}
+		hostile[0] = byte(len(hostile) / 4)
+		hostile = binary.LittleEndian.AppendUint32(hostile, crc32.ChecksumIEEE(hostile))
+		archive = append(append(append([]byte{}, archive[:12]...), hostile...), archive[12+size:]...)
+
+		extractor := extract.Extractor{FS: &extracttest.LoggingFS{}, DecoderConcurrency: 4}
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		require.Error(t, extractor.Xz(context.Background(), bytes.NewReader(archive), mkTempDir(t).String(), nil))
+		runtime.ReadMemStats(&after)
+		require.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(256<<20))
+	})
+
+	t.Run("Corrupted", func(t *testing.T) {
+		archive, err := os.ReadFile("testdata/multiblock.tar.xz")
+		require.NoError(t, err)
+		archive[len(archive)/2] ^= 0xff
+		extractor := extract.Extractor{FS: &extracttest.LoggingFS{}, DecoderConcurrency: 4}
+		require.Error(t, extractor.Xz(context.Background(), bytes.NewReader(archive), mkTempDir(t).String(), nil))
+	})
+}
+
+func TestParallelZstd(t *testing.T) {
+	buf := &bytes.Buffer{}
+	zw, _ := zstd.NewWriter(buf)
+	zw.Write(randomData(1 << 20))
+	zw.Close()
+	target := mkTempDir(t).Join("data")
+	extractor := extract.Extractor{FS: &extracttest.LoggingFS{}, DecoderConcurrency: -1}
+	require.NoError(t, extractor.Zstd(context.Background(), buf, target.String(), nil))
+	data, err := target.ReadFile()
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(randomData(1<<20), data))
+}
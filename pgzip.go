@@ -0,0 +1,569 @@
+package extract
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+const (
+	// pgzipChunkSize is the size of the pieces of a gzip stream decompressed in
+	// parallel. They're cut after the last sync point in their second half.
+	pgzipChunkSize = 1 << 20
+
+	// pgzipMaxPending is the size of the data that can't be decompressed on its
+	// own after which the rest of the stream is decompressed sequentially
+	pgzipMaxPending = 4 * pgzipChunkSize
+
+	// pgzipMaxOutput is the size of the data decompressed from a chunk in
+	// memory after which the rest of the stream is decompressed sequentially
+	pgzipMaxOutput = 16 * pgzipChunkSize
+
+	deflateWindow = 1 << 15
+)
+
+const (
+	gzipFlagHeaderCRC = 1 << 1
+	gzipFlagExtra     = 1 << 2
+	gzipFlagName      = 1 << 3
+	gzipFlagComment   = 1 << 4
+)
+
+// The parts of a gzip member
+const (
+	gzipHeaderPhase = iota
+	gzipDeflatePhase
+	gzipTrailerPhase
+)
+
+// errChunkTooBig is returned by inflateChunk when the data decompressed is more
+// than pgzipMaxOutput
+var errChunkTooBig = errors.New("gzip: the chunk is too big to be decompressed in memory")
+
+// deflateSyncPoint ends the empty stored block written by a full flush, which
+// pigz writes between the blocks of data it compresses in parallel
+var deflateSyncPoint = []byte{0, 0, 0xff, 0xff}
+
+// parallelGzipReader decompresses a gzip stream on many goroutines, writing the
+// data in a pipe
+type parallelGzipReader struct {
+	*io.PipeReader
+	header gzip.Header
+	done   chan struct{}
+}
+
+// gzipDecoder is the state of a parallelGzipReader
+type gzipDecoder struct {
+	r       *bufio.Reader
+	w       io.Writer
+	workers int
+
+	// carry is the data read after the last chunk
+	carry   []byte
+	aligned bool
+
+	phase   int
+	pending []byte
+	synced  bool
+	window  []byte
+	crc     uint32
+	size    uint32
+}
+
+// gzipChunk is a piece of the compressed data of a gzip stream
+type gzipChunk struct {
+	data []byte
+
+	// aligned is true if the chunk starts after a sync point, so that it can be
+	// decompressed speculatively, synced if it ends at one
+	aligned bool
+	synced  bool
+
+	decoded bool
+	out     []byte
+	rest    []byte
+	final   bool
+	err     error
+}
+
+// bgzfMember is a member of a BGZF file
+type bgzfMember struct {
+	// data is the compressed data with the trailer
+	data []byte
+	out  []byte
+	err  error
+
+	// header is the header of a member that isn't part of a BGZF file, from
+	// which the stream is decompressed sequentially
+	header []byte
+}
+
+// newParallelGzipReader decompresses a gzip stream on up to workers goroutines.
+// The members of BGZF files store their size, so they're decompressed
+// independently. The other streams are split at their sync points, like the ones
+// made by pigz, and the pieces are decompressed speculatively without the data
+// preceding them, then again with it if they refer to it. The streams that can't
+// be split are decompressed sequentially.
+func newParallelGzipReader(body io.Reader, workers int) (*parallelGzipReader, error) {
+	r := bufio.NewReaderSize(body, 1<<16)
+	header, raw, err := readGzipHeader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	d := &gzipDecoder{r: r, w: pw, workers: workers}
+	reader := &parallelGzipReader{PipeReader: pr, header: header, done: make(chan struct{})}
+	go func() {
+		defer close(reader.done)
+		if bgzfSize(header.Extra) > 0 {
+			pw.CloseWithError(d.bgzf(raw))
+		} else {
+			pw.CloseWithError(d.chunks())
+		}
+	}()
+	return reader, nil
+}
+
+// close stops the decompression, waiting for the goroutines to end
+func (r *parallelGzipReader) close() {
+	r.PipeReader.Close()
+	<-r.done
+}
+
+// bgzf decompresses the members of a BGZF file, the first one starting with the
+// header already read
+func (d *gzipDecoder) bgzf(header []byte) error {
+	tail := false
+	next := func() (*bgzfMember, bool, error) {
+		if tail {
+			return nil, false, nil
+		}
+		if header == nil {
+			more, err := skipGzipPadding(d.r)
+			if !more || err != nil {
+				return nil, false, err
+			}
+			parsed, raw, err := readGzipHeader(d.r)
+			if err != nil {
+				return nil, false, err
+			}
+			if bgzfSize(parsed.Extra) == 0 {
+				tail = true
+				return &bgzfMember{header: raw}, true, nil
+			}
+			header = raw
+		}
+		parsed, _, _ := parseGzipHeader(header)
+		size := bgzfSize(parsed.Extra) - len(header)
+		if size < 8 {
+			return nil, false, gzip.ErrHeader
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(d.r, data); err != nil {
+			return nil, false, unexpectedEOF(err)
+		}
+		header = nil
+		return &bgzfMember{data: data}, true, nil
+	}
+	work := func(m *bgzfMember) {
+		if m.header == nil {
+			m.out, m.err = inflateGzipMember(m.data)
+		}
+	}
+
+	p := startPipeline(d.workers, next, work)
+	defer p.close()
+	for {
+		m, ok, err := p.next()
+		if !ok || err != nil {
+			return err
+		}
+		if m.header != nil {
+			p.close()
+			return d.sequential(io.MultiReader(bytes.NewReader(m.header), d.r))
+		}
+		if m.err != nil {
+			return m.err
+		}
+		if _, err := d.w.Write(m.out); err != nil {
+			return err
+		}
+	}
+}
+
+// chunks decompresses a gzip stream split in chunks at its sync points, starting
+// after the header of the first member
+func (d *gzipDecoder) chunks() error {
+	d.aligned = true
+	d.phase = gzipDeflatePhase
+	work := func(c *gzipChunk) {
+		if c.aligned {
+			c.out, c.rest, c.final, c.err = inflateChunk(c.data, nil)
+			c.decoded = true
+		}
+	}
+
+	p := startPipeline(d.workers, d.nextChunk, work)
+	defer p.close()
+	for {
+		c, ok, err := p.next()
+		if err != nil {
+			return err
+		} else if !ok {
+			break
+		}
+
+		// The speculative result is right only if the chunk starts where the
+		// decompression arrived
+		if d.phase == gzipDeflatePhase && len(d.pending) == 0 && c.decoded && c.err == nil {
+			if err := d.inflated(c.out, c.rest, c.final); err != nil {
+				return err
+			}
+		} else {
+			d.pending = append(d.pending, c.data...)
+		}
+		d.synced = c.synced
+
+		err = d.advance(false)
+		if err == errChunkTooBig || err == nil && d.phase == gzipDeflatePhase && len(d.pending) > pgzipMaxPending {
+			// There are no sync points or the data decompressed is too big to
+			// be kept in memory, give up
+			readers := []io.Reader{bytes.NewReader(d.pending)}
+			for _, c := range p.close() {
+				readers = append(readers, bytes.NewReader(c.data))
+			}
+			readers = append(readers, bytes.NewReader(d.carry), d.r)
+			return d.finish(bufio.NewReader(io.MultiReader(readers...)))
+		} else if err != nil {
+			return err
+		}
+	}
+	if err := d.advance(true); err != errChunkTooBig {
+		return err
+	}
+	return d.finish(bufio.NewReader(bytes.NewReader(d.pending)))
+}
+
+// nextChunk reads the next chunk of the stream, cutting it after a sync point
+func (d *gzipDecoder) nextChunk() (*gzipChunk, bool, error) {
+	buf := make([]byte, pgzipChunkSize)
+	n := copy(buf, d.carry)
+	m, err := io.ReadFull(d.r, buf[n:])
+	buf = buf[:n+m]
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		d.carry = nil
+		return &gzipChunk{data: buf, aligned: d.aligned, synced: true}, len(buf) > 0, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+
+	cut, synced := len(buf), false
+	if i := bytes.LastIndex(buf[len(buf)/2:], deflateSyncPoint); i >= 0 {
+		cut, synced = len(buf)/2+i+len(deflateSyncPoint), true
+	}
+	d.carry = append([]byte(nil), buf[cut:]...)
+	chunk := &gzipChunk{data: buf[:cut], aligned: d.aligned, synced: synced}
+	d.aligned = synced
+	return chunk, true, nil
+}
+
+// advance decompresses the pending data as far as possible. At the end of the
+// stream all of it must be consumed.
+func (d *gzipDecoder) advance(eof bool) error {
+	for {
+		switch d.phase {
+		case gzipTrailerPhase:
+			if len(d.pending) < 8 {
+				return errorAtEOF(eof)
+			}
+			if binary.LittleEndian.Uint32(d.pending) != d.crc || binary.LittleEndian.Uint32(d.pending[4:]) != d.size {
+				return gzip.ErrChecksum
+			}
+			d.pending = d.pending[8:]
+			d.phase = gzipHeaderPhase
+
+		case gzipHeaderPhase:
+			d.pending = bytes.TrimLeft(d.pending, "\x00")
+			if len(d.pending) == 0 {
+				return nil
+			}
+			_, n, err := parseGzipHeader(d.pending)
+			if err != nil {
+				return err
+			} else if n == 0 {
+				return errorAtEOF(eof)
+			}
+			d.pending = d.pending[n:]
+			d.phase = gzipDeflatePhase
+			d.crc, d.size, d.window = 0, 0, nil
+
+		case gzipDeflatePhase:
+			if len(d.pending) == 0 {
+				return errorAtEOF(eof)
+			}
+			if !eof && !d.synced {
+				// The data can't end at a block boundary
+				return nil
+			}
+			out, rest, final, err := inflateChunk(d.pending, d.window)
+			if err == errChunkTooBig {
+				return err
+			} else if err != nil {
+				// Probably the data ends at a false sync point, wait for more
+				if eof {
+					return err
+				}
+				return nil
+			}
+			d.pending = nil
+			if err := d.inflated(out, rest, final); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// inflated writes the data decompressed from a chunk. If the member ended within
+// it the rest of the chunk is left pending.
+func (d *gzipDecoder) inflated(out, rest []byte, final bool) error {
+	if _, err := d.w.Write(out); err != nil {
+		return err
+	}
+	d.crc = crc32.Update(d.crc, crc32.IEEETable, out)
+	d.size += uint32(len(out))
+	if len(out) >= deflateWindow {
+		d.window = append([]byte(nil), out[len(out)-deflateWindow:]...)
+	} else {
+		d.window = append(d.window, out...)
+		if len(d.window) > deflateWindow {
+			d.window = append([]byte(nil), d.window[len(d.window)-deflateWindow:]...)
+		}
+	}
+	if final {
+		d.pending = rest
+		d.phase = gzipTrailerPhase
+	}
+	return nil
+}
+
+// finish decompresses sequentially the rest of the stream, which continues the
+// compressed data of the current member
+func (d *gzipDecoder) finish(r *bufio.Reader) error {
+	zr := flate.NewReaderDict(r, d.window)
+	buf := make([]byte, 1<<16)
+	for {
+		n, err := zr.Read(buf)
+		if n > 0 {
+			if _, err := d.w.Write(buf[:n]); err != nil {
+				return err
+			}
+			d.crc = crc32.Update(d.crc, crc32.IEEETable, buf[:n])
+			d.size += uint32(n)
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+
+	trailer := make([]byte, 8)
+	if _, err := io.ReadFull(r, trailer); err != nil {
+		return unexpectedEOF(err)
+	}
+	if binary.LittleEndian.Uint32(trailer) != d.crc || binary.LittleEndian.Uint32(trailer[4:]) != d.size {
+		return gzip.ErrChecksum
+	}
+	return d.sequential(r)
+}
+
+// sequential decompresses the rest of the stream on a single goroutine
+func (d *gzipDecoder) sequential(r io.Reader) error {
+	br := bufio.NewReader(r)
+	if more, err := skipGzipPadding(br); !more || err != nil {
+		return err
+	}
+	zr, err := newGzipReader(br)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(d.w, zr)
+	return err
+}
+
+// inflateChunk decompresses a piece of a deflate stream starting at a block
+// boundary, with dict as the data preceding it. If the stream ends within the
+// piece the data after it is returned as rest, otherwise the piece must end at a
+// block boundary: it's checked by appending an empty final block. It fails with
+// errChunkTooBig rather than decompressing more than pgzipMaxOutput.
+func inflateChunk(data, dict []byte) (out, rest []byte, final bool, err error) {
+	input := make([]byte, len(data), len(data)+5)
+	copy(input, data)
+	input = append(input, 1, 0, 0, 0xff, 0xff)
+
+	r := bytes.NewReader(input)
+	out, err = io.ReadAll(io.LimitReader(flate.NewReaderDict(r, dict), pgzipMaxOutput+1))
+	switch {
+	case len(out) > pgzipMaxOutput:
+		return nil, nil, false, errChunkTooBig
+	case err != nil:
+		return nil, nil, false, err
+	case r.Len() == 0:
+		return out, nil, false, nil
+	case r.Len() >= 5:
+		return out, data[len(input)-r.Len():], true, nil
+	default:
+		return nil, nil, false, flate.CorruptInputError(len(input) - r.Len())
+	}
+}
+
+// inflateGzipMember decompresses the data of a gzip member, checking it with its
+// trailer
+func inflateGzipMember(data []byte) ([]byte, error) {
+	trailer := data[len(data)-8:]
+	size := int64(binary.LittleEndian.Uint32(trailer[4:]))
+	out, err := io.ReadAll(io.LimitReader(flate.NewReader(bytes.NewReader(data[:len(data)-8])), size+1))
+	if err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(out) != binary.LittleEndian.Uint32(trailer) || uint32(len(out)) != binary.LittleEndian.Uint32(trailer[4:]) {
+		return nil, gzip.ErrChecksum
+	}
+	return out, nil
+}
+
+// readGzipHeader reads the header of a gzip member, returning also its bytes
+func readGzipHeader(r *bufio.Reader) (gzip.Header, []byte, error) {
+	for size := 512; ; size *= 2 {
+		data, err := r.Peek(size)
+		header, n, perr := parseGzipHeader(data)
+		if perr != nil {
+			return header, nil, perr
+		}
+		if n > 0 {
+			raw := append([]byte(nil), data[:n]...)
+			_, err = r.Discard(n)
+			return header, raw, err
+		}
+		if err == bufio.ErrBufferFull {
+			return header, nil, errors.New("The gzip header is too big")
+		} else if err != nil {
+			return header, nil, unexpectedEOF(err)
+		}
+	}
+}
+
+// parseGzipHeader parses the header at the start of data, returning its size,
+// or zero if data is too short
+func parseGzipHeader(data []byte) (gzip.Header, int, error) {
+	header := gzip.Header{}
+	if len(data) < 10 {
+		return header, 0, nil
+	}
+	if data[0] != 0x1f || data[1] != 0x8b || data[2] != 8 {
+		return header, 0, gzip.ErrHeader
+	}
+	flags := data[3]
+	if t := binary.LittleEndian.Uint32(data[4:8]); t > 0 {
+		header.ModTime = time.Unix(int64(t), 0)
+	}
+	header.OS = data[9]
+
+	n := 10
+	if flags&gzipFlagExtra != 0 {
+		if len(data) < n+2 {
+			return header, 0, nil
+		}
+		size := int(binary.LittleEndian.Uint16(data[n:]))
+		if len(data) < n+2+size {
+			return header, 0, nil
+		}
+		header.Extra = append([]byte(nil), data[n+2:n+2+size]...)
+		n += 2 + size
+	}
+	for _, flag := range []byte{gzipFlagName, gzipFlagComment} {
+		if flags&flag == 0 {
+			continue
+		}
+		i := bytes.IndexByte(data[n:], 0)
+		if i < 0 {
+			return header, 0, nil
+		}
+		// The strings are ISO 8859-1
+		runes := make([]rune, i)
+		for j, b := range data[n : n+i] {
+			runes[j] = rune(b)
+		}
+		if flag == gzipFlagName {
+			header.Name = string(runes)
+		} else {
+			header.Comment = string(runes)
+		}
+		n += i + 1
+	}
+	if flags&gzipFlagHeaderCRC != 0 {
+		if len(data) < n+2 {
+			return header, 0, nil
+		}
+		if uint16(crc32.ChecksumIEEE(data[:n])) != binary.LittleEndian.Uint16(data[n:]) {
+			return header, 0, gzip.ErrHeader
+		}
+		n += 2
+	}
+	return header, n, nil
+}
+
+// bgzfSize returns the size of a BGZF member from the extra field of its header,
+// or zero if it's not one
+func bgzfSize(extra []byte) int {
+	for len(extra) >= 4 {
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+		if len(extra) < 4+size {
+			break
+		}
+		if extra[0] == 'B' && extra[1] == 'C' && size == 2 {
+			return int(binary.LittleEndian.Uint16(extra[4:])) + 1
+		}
+		extra = extra[4+size:]
+	}
+	return 0
+}
+
+// skipGzipPadding skips the zeros after a gzip member, returning false at the
+// end of the stream
+func skipGzipPadding(r *bufio.Reader) (bool, error) {
+	for {
+		b, err := r.Peek(1)
+		if err == io.EOF {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		if b[0] != 0 {
+			return true, nil
+		}
+		r.ReadByte()
+	}
+}
+
+func errorAtEOF(eof bool) error {
+	if eof {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
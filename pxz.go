@@ -0,0 +1,300 @@
+package extract
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+
+	"github.com/juju/errors"
+	"github.com/ulikunitz/xz"
+)
+
+// pxzMaxBlockSize limits the memory used to decompress a block
+const pxzMaxBlockSize = 1 << 30
+
+var xzMagic = []byte{0xfd, '7', 'z', 'X', 'Z', 0}
+
+// parallelXzReader decompresses an xz stream on many goroutines, writing the
+// data in a pipe
+type parallelXzReader struct {
+	*io.PipeReader
+	done chan struct{}
+}
+
+// xzDecoder is the state of a parallelXzReader
+type xzDecoder struct {
+	r *bufio.Reader
+
+	// header is the header of the current stream, nil between the streams
+	header  []byte
+	records []xzRecord
+	tail    bool
+}
+
+// xzRecord is a record of the index of an xz stream
+type xzRecord struct {
+	unpadded     uint64
+	uncompressed uint64
+}
+
+// xzBlock is a block of an xz stream
+type xzBlock struct {
+	header []byte
+	data   []byte
+	record xzRecord
+	out    []byte
+	err    error
+
+	// tail is the start of a stream whose blocks don't store their size, from
+	// which it's decompressed sequentially
+	tail []byte
+}
+
+// newParallelXzReader decompresses an xz stream on up to workers goroutines.
+// The streams made by multithreaded encoders store the sizes of their blocks,
+// so these are decompressed independently. The streams whose first block
+// doesn't store them are decompressed sequentially.
+func newParallelXzReader(body io.Reader, workers int) (*parallelXzReader, error) {
+	r := bufio.NewReaderSize(body, 1<<16)
+	if magic, err := r.Peek(len(xzMagic)); err != nil || !bytes.Equal(magic, xzMagic) {
+		return nil, errors.New("xz: invalid header magic bytes")
+	}
+
+	pr, pw := io.Pipe()
+	d := &xzDecoder{r: r}
+	reader := &parallelXzReader{PipeReader: pr, done: make(chan struct{})}
+	go func() {
+		defer close(reader.done)
+		pw.CloseWithError(d.decode(pw, workers))
+	}()
+	return reader, nil
+}
+
+// close stops the decompression, waiting for the goroutines to end
+func (r *parallelXzReader) close() {
+	r.PipeReader.Close()
+	<-r.done
+}
+
+func (d *xzDecoder) decode(w io.Writer, workers int) error {
+	p := startPipeline(workers, d.nextBlock, (*xzBlock).decode)
+	defer p.close()
+	for {
+		b, ok, err := p.next()
+		if !ok || err != nil {
+			return err
+		}
+		if b.tail != nil {
+			p.close()
+			r, err := xz.NewReader(io.MultiReader(bytes.NewReader(b.tail), d.r))
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(w, r)
+			return err
+		}
+		if b.err != nil {
+			return b.err
+		}
+		if _, err := w.Write(b.out); err != nil {
+			return err
+		}
+	}
+}
+
+// nextBlock reads the next block, going through the indexes and the headers of
+// the streams
+func (d *xzDecoder) nextBlock() (*xzBlock, bool, error) {
+	for !d.tail {
+		if d.header == nil {
+			// Streams can be padded with zeros
+			more, err := skipGzipPadding(d.r)
+			if !more || err != nil {
+				return nil, false, err
+			}
+			d.header = make([]byte, 12)
+			if _, err := io.ReadFull(d.r, d.header); err != nil {
+				return nil, false, unexpectedEOF(err)
+			}
+			if !bytes.Equal(d.header[:6], xzMagic) || crc32.ChecksumIEEE(d.header[6:8]) != binary.LittleEndian.Uint32(d.header[8:]) {
+				return nil, false, errors.New("xz: invalid stream header")
+			}
+			d.records = nil
+		}
+
+		size, err := d.r.ReadByte()
+		if err != nil {
+			return nil, false, unexpectedEOF(err)
+		}
+		if size == 0 {
+			if err := d.readIndex(); err != nil {
+				return nil, false, err
+			}
+			d.header = nil
+			continue
+		}
+
+		header := make([]byte, (int(size)+1)*4)
+		header[0] = size
+		if _, err := io.ReadFull(d.r, header[1:]); err != nil {
+			return nil, false, unexpectedEOF(err)
+		}
+		compressed, uncompressed, err := parseXzBlockHeader(header)
+		if err != nil {
+			return nil, false, err
+		}
+		if compressed == 0 || uncompressed == 0 {
+			if len(d.records) > 0 {
+				return nil, false, errors.New("xz: a block doesn't store its size, so it can't be decompressed in parallel")
+			}
+			d.tail = true
+			return &xzBlock{tail: append(d.header, header...)}, true, nil
+		}
+		if compressed > pxzMaxBlockSize || uncompressed > pxzMaxBlockSize {
+			return nil, false, errors.New("xz: the block is too big to be decompressed in parallel")
+		}
+
+		check := xzCheckSize(d.header[7])
+		data := make([]byte, (compressed+3)&^3+uint64(check))
+		if _, err := io.ReadFull(d.r, data); err != nil {
+			return nil, false, unexpectedEOF(err)
+		}
+		record := xzRecord{unpadded: uint64(len(header)) + compressed + uint64(check), uncompressed: uncompressed}
+		d.records = append(d.records, record)
+		return &xzBlock{header: d.header, data: append(header, data...), record: record}, true, nil
+	}
+	return nil, false, nil
+}
+
+// readIndex reads the index of a stream after its indicator, checking it against
+// the blocks, and the footer of the stream
+func (d *xzDecoder) readIndex() error {
+	index := []byte{0}
+	readVarint := func() (uint64, error) {
+		var value uint64
+		for i := 0; i < 9; i++ {
+			b, err := d.r.ReadByte()
+			if err != nil {
+				return 0, unexpectedEOF(err)
+			}
+			index = append(index, b)
+			value |= uint64(b&0x7f) << (7 * i)
+			if b&0x80 == 0 {
+				return value, nil
+			}
+		}
+		return 0, errors.New("xz: invalid index")
+	}
+
+	count, err := readVarint()
+	if err != nil {
+		return err
+	}
+	if count != uint64(len(d.records)) {
+		return errors.New("xz: the index doesn't match the blocks")
+	}
+	for _, record := range d.records {
+		unpadded, err := readVarint()
+		if err != nil {
+			return err
+		}
+		uncompressed, err := readVarint()
+		if err != nil {
+			return err
+		}
+		if unpadded != record.unpadded || uncompressed != record.uncompressed {
+			return errors.New("xz: the index doesn't match the blocks")
+		}
+	}
+
+	rest := make([]byte, (4-len(index)%4)%4+4+12)
+	if _, err := io.ReadFull(d.r, rest); err != nil {
+		return unexpectedEOF(err)
+	}
+	padding, sum, footer := rest[:len(rest)-16], rest[len(rest)-16:len(rest)-12], rest[len(rest)-12:]
+	index = append(index, padding...)
+	if crc32.ChecksumIEEE(index) != binary.LittleEndian.Uint32(sum) {
+		return errors.New("xz: invalid index")
+	}
+	if crc32.ChecksumIEEE(footer[4:10]) != binary.LittleEndian.Uint32(footer) ||
+		binary.LittleEndian.Uint32(footer[4:]) != uint32((len(index)+4)/4-1) ||
+		!bytes.Equal(footer[8:10], d.header[6:8]) || string(footer[10:]) != "YZ" {
+		return errors.New("xz: invalid stream footer")
+	}
+	return nil
+}
+
+// decode decompresses the block as a stream of its own
+func (b *xzBlock) decode() {
+	if b.tail != nil {
+		return
+	}
+	index := []byte{0}
+	index = binary.AppendUvarint(index, 1)
+	index = binary.AppendUvarint(index, b.record.unpadded)
+	index = binary.AppendUvarint(index, b.record.uncompressed)
+	for len(index)%4 != 0 {
+		index = append(index, 0)
+	}
+	index = binary.LittleEndian.AppendUint32(index, crc32.ChecksumIEEE(index))
+
+	footer := make([]byte, 12)
+	binary.LittleEndian.PutUint32(footer[4:], uint32(len(index)/4-1))
+	copy(footer[8:], b.header[6:8])
+	binary.LittleEndian.PutUint32(footer, crc32.ChecksumIEEE(footer[4:10]))
+	copy(footer[10:], "YZ")
+
+	stream := io.MultiReader(bytes.NewReader(b.header), bytes.NewReader(b.data), bytes.NewReader(index), bytes.NewReader(footer))
+	r, err := xz.ReaderConfig{SingleStream: true}.NewReader(stream)
+	if err != nil {
+		b.err = err
+		return
+	}
+	// The size in the header isn't trusted to allocate the data, which grows
+	// only as it's decompressed
+	out := &bytes.Buffer{}
+	n, err := io.Copy(out, io.LimitReader(r, int64(b.record.uncompressed)+1))
+	if err != nil {
+		b.err = err
+		return
+	}
+	if uint64(n) != b.record.uncompressed {
+		b.err = errors.New("xz: the block doesn't match its size")
+		return
+	}
+	b.out = out.Bytes()
+}
+
+// parseXzBlockHeader returns the compressed and uncompressed sizes stored in the
+// header of a block, or zero if they're not
+func parseXzBlockHeader(header []byte) (uint64, uint64, error) {
+	if crc32.ChecksumIEEE(header[:len(header)-4]) != binary.LittleEndian.Uint32(header[len(header)-4:]) {
+		return 0, 0, errors.New("xz: invalid block header")
+	}
+	flags := header[1]
+	rest := header[2 : len(header)-4]
+	sizes := [2]uint64{}
+	for i, flag := range []byte{0x40, 0x80} {
+		if flags&flag == 0 {
+			continue
+		}
+		value, n := binary.Uvarint(rest)
+		if n <= 0 {
+			return 0, 0, errors.New("xz: invalid block header")
+		}
+		sizes[i], rest = value, rest[n:]
+	}
+	return sizes[0], sizes[1], nil
+}
+
+// xzCheckSize returns the size of the check of the blocks for the flags of a
+// stream
+func xzCheckSize(flags byte) int {
+	id := flags & 0x0f
+	if id == 0 {
+		return 0
+	}
+	return 4 << ((id - 1) / 3)
+}
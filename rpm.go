@@ -0,0 +1,254 @@
+package extract
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"context"
+	"encoding/binary"
+	"io"
+	"path"
+
+	"github.com/juju/errors"
+	"github.com/ulikunitz/xz/lzma"
+)
+
+// RpmPackage contains the metadata of an RPM package
+type RpmPackage struct {
+	Name    string
+	Version string
+	Release string
+	Epoch   int
+	Arch    string
+	Summary string
+
+	// Files is the list of the absolute paths of the files contained in the package
+	Files []string
+
+	// PayloadFormat and PayloadCompressor describe how the files are stored, e.g.
+	// "cpio" compressed with "xz"
+	PayloadFormat     string
+	PayloadCompressor string
+}
+
+var (
+	rpmLeadMagic   = []byte{0xed, 0xab, 0xee, 0xdb}
+	rpmHeaderMagic = []byte{0x8e, 0xad, 0xe8, 0x01}
+)
+
+// Tags of the RPM header
+const (
+	rpmTagName              = 1000
+	rpmTagVersion           = 1001
+	rpmTagRelease           = 1002
+	rpmTagEpoch             = 1003
+	rpmTagSummary           = 1004
+	rpmTagArch              = 1022
+	rpmTagOldFilenames      = 1027
+	rpmTagDirIndexes        = 1116
+	rpmTagBasenames         = 1117
+	rpmTagDirNames          = 1118
+	rpmTagPayloadFormat     = 1124
+	rpmTagPayloadCompressor = 1125
+)
+
+// Types of the values in the RPM header
+const (
+	rpmTypeInt32       = 4
+	rpmTypeString      = 6
+	rpmTypeStringArray = 8
+	rpmTypeI18nString  = 9
+)
+
+// rpmHeader is a parsed header structure of an RPM package
+type rpmHeader struct {
+	entries map[uint32]rpmEntry
+	store   []byte
+}
+
+type rpmEntry struct {
+	typ    uint32
+	offset uint32
+	count  uint32
+}
+
+// readRpmHeader reads a header structure. If pad is true the header is padded to
+// a multiple of 8 bytes, as it happens for the signature.
+func readRpmHeader(r io.Reader, pad bool) (*rpmHeader, error) {
+	var intro [16]byte
+	if _, err := io.ReadFull(r, intro[:]); err != nil {
+		return nil, errors.Annotatef(err, "Read rpm header")
+	}
+	if !bytes.Equal(intro[:4], rpmHeaderMagic) {
+		return nil, errors.New("Invalid rpm header magic")
+	}
+	count := binary.BigEndian.Uint32(intro[8:12])
+	size := binary.BigEndian.Uint32(intro[12:16])
+	if count > 1<<16 || size > 1<<28 {
+		return nil, errors.New("Rpm header too big")
+	}
+
+	index := make([]byte, count*16)
+	if _, err := io.ReadFull(r, index); err != nil {
+		return nil, errors.Annotatef(err, "Read rpm header index")
+	}
+	store := make([]byte, size)
+	if _, err := io.ReadFull(r, store); err != nil {
+		return nil, errors.Annotatef(err, "Read rpm header store")
+	}
+	if pad {
+		if _, err := io.CopyN(io.Discard, r, int64((8-size%8)%8)); err != nil {
+			return nil, errors.Annotatef(err, "Read rpm header")
+		}
+	}
+
+	h := &rpmHeader{entries: map[uint32]rpmEntry{}, store: store}
+	for i := uint32(0); i < count; i++ {
+		entry := index[i*16 : i*16+16]
+		h.entries[binary.BigEndian.Uint32(entry[0:4])] = rpmEntry{
+			typ:    binary.BigEndian.Uint32(entry[4:8]),
+			offset: binary.BigEndian.Uint32(entry[8:12]),
+			count:  binary.BigEndian.Uint32(entry[12:16]),
+		}
+	}
+	return h, nil
+}
+
+// strings returns the strings stored in tag, or nil if the tag is missing or has
+// a different type
+func (h *rpmHeader) strings(tag uint32) []string {
+	entry, ok := h.entries[tag]
+	if !ok || entry.offset > uint32(len(h.store)) {
+		return nil
+	}
+	switch entry.typ {
+	case rpmTypeString:
+		entry.count = 1
+	case rpmTypeStringArray, rpmTypeI18nString:
+	default:
+		return nil
+	}
+	data := h.store[entry.offset:]
+	res := []string{}
+	for i := uint32(0); i < entry.count; i++ {
+		end := bytes.IndexByte(data, 0)
+		if end == -1 {
+			break
+		}
+		res = append(res, string(data[:end]))
+		data = data[end+1:]
+	}
+	return res
+}
+
+func (h *rpmHeader) string(tag uint32) string {
+	if values := h.strings(tag); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// ints returns the int32 values stored in tag, or nil if the tag is missing or has
+// a different type
+func (h *rpmHeader) ints(tag uint32) []int {
+	entry, ok := h.entries[tag]
+	if !ok || entry.typ != rpmTypeInt32 || uint64(entry.offset)+uint64(entry.count)*4 > uint64(len(h.store)) {
+		return nil
+	}
+	res := make([]int, entry.count)
+	for i := range res {
+		res[i] = int(int32(binary.BigEndian.Uint32(h.store[int(entry.offset)+i*4:])))
+	}
+	return res
+}
+
+// readRpm reads the lead, the signature and the header of an RPM package, leaving
+// body at the beginning of the payload.
+func readRpm(body io.Reader) (*RpmPackage, error) {
+	var lead [96]byte
+	if _, err := io.ReadFull(body, lead[:]); err != nil {
+		return nil, errors.Annotatef(err, "Read rpm lead")
+	}
+	if !bytes.Equal(lead[:4], rpmLeadMagic) {
+		return nil, errors.New("Not an rpm package")
+	}
+	if _, err := readRpmHeader(body, true); err != nil {
+		return nil, errors.Annotatef(err, "Read rpm signature")
+	}
+	header, err := readRpmHeader(body, false)
+	if err != nil {
+		return nil, err
+	}
+
+	pkg := &RpmPackage{
+		Name:              header.string(rpmTagName),
+		Version:           header.string(rpmTagVersion),
+		Release:           header.string(rpmTagRelease),
+		Arch:              header.string(rpmTagArch),
+		Summary:           header.string(rpmTagSummary),
+		PayloadFormat:     header.string(rpmTagPayloadFormat),
+		PayloadCompressor: header.string(rpmTagPayloadCompressor),
+	}
+	if epoch := header.ints(rpmTagEpoch); len(epoch) > 0 {
+		pkg.Epoch = epoch[0]
+	}
+	if names := header.strings(rpmTagOldFilenames); names != nil {
+		pkg.Files = names
+	} else {
+		dirs := header.strings(rpmTagDirNames)
+		indexes := header.ints(rpmTagDirIndexes)
+		for i, base := range header.strings(rpmTagBasenames) {
+			if i >= len(indexes) || indexes[i] < 0 || indexes[i] >= len(dirs) {
+				return nil, errors.New("Invalid file list in rpm header")
+			}
+			pkg.Files = append(pkg.Files, path.Join(dirs[indexes[i]], base))
+		}
+	}
+	return pkg, nil
+}
+
+// Rpm extracts the files of an .rpm package in the specified location, and returns
+// the metadata of the package.
+// It accepts a rename function to handle the names of the files (see the example)
+func (e *Extractor) Rpm(ctx context.Context, body io.Reader, location string, rename Renamer) (*RpmPackage, error) {
+	pkg, err := readRpm(body)
+	if err != nil {
+		return nil, err
+	}
+
+	if pkg.PayloadFormat != "" && pkg.PayloadFormat != "cpio" {
+		return pkg, errors.Errorf("Unsupported rpm payload format %s", pkg.PayloadFormat)
+	}
+
+	var payload io.Reader
+	switch pkg.PayloadCompressor {
+	case "gzip", "":
+		var closer func()
+		payload, _, closer, err = e.gunzip(body)
+		if err == nil {
+			defer closer()
+		}
+	case "bzip2":
+		payload = bzip2.NewReader(body)
+	case "xz":
+		var closer func()
+		payload, closer, err = e.unxz(body)
+		if err == nil {
+			defer closer()
+		}
+	case "lzma":
+		payload, err = lzma.NewReader(body)
+	case "zstd":
+		var closer func()
+		payload, closer, err = e.unzstd(body)
+		if err == nil {
+			defer closer()
+		}
+	default:
+		return pkg, errors.Errorf("Unsupported rpm payload compressor %s", pkg.PayloadCompressor)
+	}
+	if err != nil {
+		return pkg, errors.Annotatef(err, "Open rpm payload")
+	}
+
+	return pkg, e.Cpio(ctx, payload, location, rename)
+}
@@ -0,0 +1,160 @@
+package extract_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/codeclysm/extract/v5"
+	"github.com/stretchr/testify/require"
+	"github.com/ulikunitz/xz"
+)
+
+type cpioEntry struct {
+	Name  string
+	Mode  uint32
+	Ino   int
+	Nlink int
+	Data  string
+}
+
+// writeCpio writes a newc cpio archive
+func writeCpio(w io.Writer, entries []cpioEntry) {
+	pad := func(n int) {
+		w.Write(make([]byte, (4-n%4)%4))
+	}
+	for _, e := range append(entries, cpioEntry{Name: "TRAILER!!!", Nlink: 1}) {
+		header := fmt.Sprintf("070701%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x",
+			e.Ino, e.Mode, 0, 0, e.Nlink, 0, len(e.Data), 0, 0, 0, 0, len(e.Name)+1, 0)
+		io.WriteString(w, header)
+		io.WriteString(w, e.Name+"\x00")
+		pad(len(header) + len(e.Name) + 1)
+		io.WriteString(w, e.Data)
+		pad(len(e.Data))
+	}
+}
+
+// writeRpmHeader writes an rpm header structure with the given string and string
+// array tags
+func writeRpmHeader(w io.Writer, tags map[uint32][]string, pad bool) {
+	index := &bytes.Buffer{}
+	store := &bytes.Buffer{}
+	for tag := uint32(1000); tag < 1200; tag++ {
+		values, ok := tags[tag]
+		if !ok {
+			continue
+		}
+		typ := uint32(8)
+		if len(values) == 1 {
+			typ = 6
+		}
+		binary.Write(index, binary.BigEndian, []uint32{tag, typ, uint32(store.Len()), uint32(len(values))})
+		for _, v := range values {
+			store.WriteString(v + "\x00")
+		}
+	}
+	// Dir indexes are int32
+	binary.Write(index, binary.BigEndian, []uint32{1116, 4, uint32(store.Len()), 3})
+	binary.Write(store, binary.BigEndian, []uint32{0, 0, 1})
+
+	w.Write([]byte{0x8e, 0xad, 0xe8, 0x01, 0, 0, 0, 0})
+	binary.Write(w, binary.BigEndian, []uint32{uint32(index.Len() / 16), uint32(store.Len())})
+	w.Write(index.Bytes())
+	w.Write(store.Bytes())
+	if pad {
+		w.Write(make([]byte, (8-store.Len()%8)%8))
+	}
+}
+
+func makeRpm(t *testing.T, compressor string) []byte {
+	payload := &bytes.Buffer{}
+	var w io.WriteCloser
+	switch compressor {
+	case "gzip":
+		w = gzip.NewWriter(payload)
+	case "xz":
+		var err error
+		w, err = xz.NewWriter(payload)
+		require.NoError(t, err)
+	}
+	writeCpio(w, []cpioEntry{
+		{Name: "./usr/share/archive", Mode: 0040755, Ino: 1, Nlink: 2},
+		{Name: "./usr/share/archive/file1.txt", Mode: 0100644, Ino: 2, Nlink: 1, Data: "File1"},
+		{Name: "./usr/share/archive/link.txt", Mode: 0100644, Ino: 3, Nlink: 2},
+		{Name: "./usr/share/archive/file2.txt", Mode: 0100644, Ino: 3, Nlink: 2, Data: "File2"},
+		{Name: "./usr/share/archive/folderlink", Mode: 0120777, Ino: 4, Nlink: 1, Data: "file1.txt"},
+	})
+	require.NoError(t, w.Close())
+
+	rpm := &bytes.Buffer{}
+	lead := make([]byte, 96)
+	copy(lead, []byte{0xed, 0xab, 0xee, 0xdb, 3, 0})
+	rpm.Write(lead)
+	writeRpmHeader(rpm, map[uint32][]string{}, true)
+	writeRpmHeader(rpm, map[uint32][]string{
+		1000: {"archive"},
+		1001: {"1.0"},
+		1002: {"1"},
+		1004: {"test package"},
+		1022: {"noarch"},
+		1117: {"file1.txt", "file2.txt", "archive"},
+		1118: {"/usr/share/archive/", "/usr/share/"},
+		1124: {"cpio"},
+		1125: {compressor},
+	}, false)
+	rpm.Write(payload.Bytes())
+	return rpm.Bytes()
+}
+
+func TestRpm(t *testing.T) {
+	for _, compressor := range []string{"gzip", "xz"} {
+		t.Run(compressor, func(t *testing.T) {
+			tmp := mkTempDir(t)
+			pkg, err := extract.Rpm(context.Background(), bytes.NewReader(makeRpm(t, compressor)), tmp.String(), nil)
+			require.NoError(t, err)
+			require.Equal(t, &extract.RpmPackage{
+				Name:              "archive",
+				Version:           "1.0",
+				Release:           "1",
+				Arch:              "noarch",
+				Summary:           "test package",
+				Files:             []string{"/usr/share/archive/file1.txt", "/usr/share/archive/file2.txt", "/usr/share/archive"},
+				PayloadFormat:     "cpio",
+				PayloadCompressor: compressor,
+			}, pkg)
+
+			testWalk(t, tmp.String(), Files{
+				"":                              "dir",
+				"/usr":                          "dir",
+				"/usr/share":                    "dir",
+				"/usr/share/archive":            "dir",
+				"/usr/share/archive/file1.txt":  "File1",
+				"/usr/share/archive/file2.txt":  "File2",
+				"/usr/share/archive/link.txt":   "File2",
+				"/usr/share/archive/folderlink": "link",
+			})
+			st1, err := os.Stat(tmp.Join("usr", "share", "archive", "file2.txt").String())
+			require.NoError(t, err)
+			st2, err := os.Stat(tmp.Join("usr", "share", "archive", "link.txt").String())
+			require.NoError(t, err)
+			require.True(t, os.SameFile(st1, st2))
+		})
+	}
+
+	t.Run("Inferred", func(t *testing.T) {
+		tmp := mkTempDir(t)
+		err := extract.Archive(context.Background(), bytes.NewReader(makeRpm(t, "gzip")), tmp.String(), nil)
+		require.NoError(t, err)
+		require.FileExists(t, tmp.Join("usr", "share", "archive", "file1.txt").String())
+	})
+
+	t.Run("NotAnRpm", func(t *testing.T) {
+		_, err := extract.Rpm(context.Background(), bytes.NewReader(make([]byte, 200)), mkTempDir(t).String(), nil)
+		require.Error(t, err)
+	})
+}
@@ -0,0 +1,139 @@
+package extract
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Sanitizer renames the files to names that are valid on Windows, macOS and
+// Linux: the characters not allowed on Windows, the invalid UTF-8 and the
+// trailing dots and spaces are replaced with underscores, the reserved device
+// names like aux.txt get an underscore in front, and the names longer than
+// MaxLength are cut, keeping their extension and adding a hash of the original
+// name. It keeps a report of the renamed files. The sanitized names can still
+// collide, see Extractor.Collisions.
+type Sanitizer struct {
+	// MaxLength is the maximum length in bytes of every name in a path, 255
+	// if it's zero.
+	MaxLength int
+
+	// Rename is applied to the names before sanitizing them, if it's not nil.
+	Rename Renamer
+
+	mu      sync.Mutex
+	renamed map[string]string
+}
+
+// reservedNames are the device names reserved by Windows, with any extension
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true, "CONIN$": true, "CONOUT$": true,
+	"COM0": true, "COM1": true, "COM2": true, "COM3": true, "COM4": true,
+	"COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"COM¹": true, "COM²": true, "COM³": true,
+	"LPT0": true, "LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true,
+	"LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+	"LPT¹": true, "LPT²": true, "LPT³": true,
+}
+
+// Renamer returns the Renamer to pass to the Extractor.
+func (s *Sanitizer) Renamer() Renamer {
+	return s.sanitize
+}
+
+// Report returns the original paths of the renamed files, with their sanitized
+// paths.
+func (s *Sanitizer) Report() map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	report := make(map[string]string, len(s.renamed))
+	for original, sanitized := range s.renamed {
+		report[original] = sanitized
+	}
+	return report
+}
+
+func (s *Sanitizer) sanitize(path string) string {
+	original := path
+	if s.Rename != nil {
+		path = s.Rename(path)
+	}
+	if path == "" {
+		return ""
+	}
+
+	names := strings.Split(path, "/")
+	for i, name := range names {
+		names[i] = s.sanitizeName(name)
+	}
+	sanitized := strings.Join(names, "/")
+	if sanitized != path {
+		s.mu.Lock()
+		if s.renamed == nil {
+			s.renamed = map[string]string{}
+		}
+		s.renamed[original] = sanitized
+		s.mu.Unlock()
+	}
+	return sanitized
+}
+
+// sanitizeName returns a name of a path valid on every system
+func (s *Sanitizer) sanitizeName(name string) string {
+	if name == "" || name == "." || name == ".." {
+		return name
+	}
+	original := name
+
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f || strings.ContainsRune(`<>:"\|?*`, r) || r == utf8.RuneError {
+			return '_'
+		}
+		return r
+	}, name)
+
+	// Windows drops the trailing dots and spaces
+	trimmed := strings.TrimRight(name, ". ")
+	name = trimmed + strings.Repeat("_", len(name)-len(trimmed))
+
+	base, _, _ := strings.Cut(name, ".")
+	if reservedNames[strings.ToUpper(strings.TrimRight(base, " "))] {
+		name = "_" + name
+	}
+
+	maxLength := s.MaxLength
+	if maxLength <= 0 {
+		maxLength = 255
+	}
+	if len(name) > maxLength {
+		name = shortenName(name, original, maxLength)
+	}
+	return name
+}
+
+// shortenName cuts name to max bytes, keeping its extension if it's short and
+// adding a hash of the original name to keep the names different
+func shortenName(name, original string, max int) string {
+	hash := fnv.New32a()
+	hash.Write([]byte(original))
+	suffix := fmt.Sprintf("~%08x", hash.Sum32())
+
+	ext := ""
+	if i := strings.LastIndex(name, "."); i > 0 && len(name)-i <= 16 {
+		ext = name[i:]
+	}
+	if len(suffix)+len(ext) >= max {
+		ext = ""
+	}
+	keep := max - len(suffix) - len(ext)
+	if keep < 0 {
+		return suffix[len(suffix)-max:]
+	}
+	// Don't cut a character in half
+	for keep > 0 && !utf8.RuneStart(name[keep]) {
+		keep--
+	}
+	return name[:keep] + suffix + ext
+}
@@ -0,0 +1,80 @@
+package extract_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/codeclysm/extract/v5"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSanitizer(t *testing.T) {
+	long := strings.Repeat("a", 300)
+	testCases := []struct {
+		name, expected string
+	}{
+		{"dir/file.txt", "dir/file.txt"},
+		{"dir/", "dir/"},
+		{"./dir/../file", "./dir/../file"},
+		{"a:b/c*d?.txt", "a_b/c_d_.txt"},
+		{"tab\there\x7f", "tab_here_"},
+		{`back\slash "quoted" <x>|y`, "back_slash _quoted_ _x__y"},
+		{"invalid\xff", "invalid_"},
+		{"trailing. /dots..", "trailing__/dots__"},
+		{"aux.txt", "_aux.txt"},
+		{"dir/CON", "dir/_CON"},
+		{"Com1.tar.gz", "_Com1.tar.gz"},
+		{"lpt¹", "_lpt¹"},
+		{"nul .txt", "_nul .txt"},
+		{"auxiliary.txt", "auxiliary.txt"},
+		{"com10", "com10"},
+	}
+	for _, test := range testCases {
+		s := &extract.Sanitizer{}
+		require.Equal(t, test.expected, s.Renamer()(test.name), test.name)
+	}
+
+	t.Run("Long", func(t *testing.T) {
+		s := &extract.Sanitizer{}
+		name := s.Renamer()("dir/" + long + ".txt")
+		require.True(t, strings.HasPrefix(name, "dir/aaaa"))
+		require.True(t, strings.HasSuffix(name, ".txt"))
+		require.Len(t, name, len("dir/")+255)
+		require.NotEqual(t, name, s.Renamer()("dir/"+long+"b.txt"))
+
+		s = &extract.Sanitizer{MaxLength: 20}
+		name = s.Renamer()(strings.Repeat("è", 20))
+		require.LessOrEqual(t, len(name), 20)
+		require.True(t, strings.HasPrefix(name, "èèè"))
+		require.Regexp(t, "^(è)+~[0-9a-f]{8}$", name)
+	})
+
+	t.Run("Extract", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		tw := tar.NewWriter(buf)
+		for _, name := range []string{"skip/aux.txt", "keep/aux.txt", "keep/a:b", "keep/fine.txt"} {
+			tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: 1})
+			tw.Write([]byte("x"))
+		}
+		tw.Close()
+
+		mem := &extract.MemFS{}
+		s := &extract.Sanitizer{Rename: func(name string) string {
+			if strings.HasPrefix(name, "skip/") {
+				return ""
+			}
+			return name
+		}}
+		extractor := extract.Extractor{FS: mem}
+		require.NoError(t, extractor.Tar(context.Background(), buf, "/out", s.Renamer()))
+
+		_, err := mem.ReadFile("/out/keep/_aux.txt")
+		require.NoError(t, err)
+		_, err = mem.ReadFile("/out/keep/a_b")
+		require.NoError(t, err)
+		require.Equal(t, map[string]string{"keep/aux.txt": "keep/_aux.txt", "keep/a:b": "keep/a_b"}, s.Report())
+	})
+}
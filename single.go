@@ -0,0 +1,88 @@
+package extract
+
+import (
+	"context"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// ChtimesFS can be implemented by the FS of an Extractor to set the modification
+// time of the extracted files. If it's not implemented the times are not set.
+type ChtimesFS interface {
+	// Chtimes changes the access and modification times of the named file.
+	Chtimes(name string, atime, mtime time.Time) error
+}
+
+// singleFile describes the file compressed in a stream that isn't a tar archive
+type singleFile struct {
+	name  string
+	mtime time.Time
+}
+
+// compressedFile returns the name and the modification time of the compressed
+// file when body is a file, removing the first of the extensions it has
+func compressedFile(body io.Reader, extensions ...string) singleFile {
+	f, ok := body.(interface {
+		Name() string
+		Stat() (os.FileInfo, error)
+	})
+	if !ok {
+		return singleFile{}
+	}
+	file := singleFile{name: filepath.Base(f.Name())}
+	for _, extension := range extensions {
+		if trimmed := strings.TrimSuffix(file.name, extension); trimmed != file.name && trimmed != "" {
+			file.name = trimmed
+			break
+		}
+	}
+	if st, err := f.Stat(); err == nil {
+		file.mtime = st.ModTime()
+	}
+	return file
+}
+
+// writeSingle writes the content of a compressed stream that isn't a tar archive.
+// With KeepOriginalName, if location is a directory the file is written inside it
+// with its original name, and its modification time is restored.
+func (e *Extractor) writeSingle(ctx context.Context, body io.Reader, location string, rename Renamer, file singleFile) error {
+	target := location
+	if e.KeepOriginalName {
+		if st, err := e.FS.Stat(location); err == nil && st.IsDir() {
+			// The name may come from another system, keep only its last element
+			name := path.Base(strings.ReplaceAll(file.name, `\`, "/"))
+			if file.name == "" || name == "." || name == "/" || name == ".." {
+				return errors.New("The original name of the compressed file is unknown")
+			}
+			if rename != nil {
+				name = rename(name)
+			}
+			if name == "" {
+				return nil
+			}
+			if target, err = safeJoin(location, name); err != nil {
+				return errors.Annotatef(err, "Write %s", name)
+			}
+		}
+	}
+
+	if e.KeepOriginalName && !file.mtime.IsZero() {
+		e.modTime(target, file.mtime)
+	}
+	if err := e.copy(ctx, target, 0666, body); err != nil {
+		return err
+	}
+
+	if fs, ok := fsAs[ChtimesFS](e.FS); ok && e.KeepOriginalName && !file.mtime.IsZero() {
+		if err := fs.Chtimes(target, file.mtime, file.mtime); err != nil {
+			return errors.Annotatef(err, "Set modification time of %s", target)
+		}
+	}
+	return nil
+}
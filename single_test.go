@@ -0,0 +1,79 @@
+package extract_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codeclysm/extract/v5"
+	"github.com/codeclysm/extract/v5/extracttest"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeepOriginalName(t *testing.T) {
+	mtime := time.Date(2020, 5, 4, 3, 2, 1, 0, time.UTC)
+
+	t.Run("GzipHeader", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		gw := gzip.NewWriter(buf)
+		gw.Name = "notes.txt"
+		gw.ModTime = mtime
+		gw.Write([]byte("Notes"))
+		gw.Close()
+
+		tmp := mkTempDir(t)
+		extractor := extract.Extractor{FS: &extracttest.LoggingFS{}, KeepOriginalName: true}
+		require.NoError(t, extractor.Gz(context.Background(), buf, tmp.String(), nil))
+		testWalk(t, tmp.String(), Files{
+			"":           "dir",
+			"/notes.txt": "Notes",
+		})
+		st, err := tmp.Join("notes.txt").Stat()
+		require.NoError(t, err)
+		require.True(t, st.ModTime().Equal(mtime))
+	})
+
+	t.Run("CompressedFileName", func(t *testing.T) {
+		src := mkTempDir(t).Join("notes.txt.zst")
+		buf := &bytes.Buffer{}
+		zw, _ := zstd.NewWriter(buf)
+		zw.Write([]byte("Notes"))
+		zw.Close()
+		require.NoError(t, src.WriteFile(buf.Bytes()))
+		require.NoError(t, os.Chtimes(src.String(), mtime, mtime))
+
+		f, err := os.Open(src.String())
+		require.NoError(t, err)
+		defer f.Close()
+		tmp := mkTempDir(t)
+		extractor := extract.Extractor{FS: &extracttest.LoggingFS{}, KeepOriginalName: true}
+		require.NoError(t, extractor.Archive(context.Background(), f, tmp.String(), strings.ToUpper))
+		testWalk(t, tmp.String(), Files{
+			"":           "dir",
+			"/NOTES.TXT": "Notes",
+		})
+		st, err := tmp.Join("NOTES.TXT").Stat()
+		require.NoError(t, err)
+		require.True(t, st.ModTime().Equal(mtime))
+	})
+
+	t.Run("UnknownName", func(t *testing.T) {
+		tmp := mkTempDir(t)
+		extractor := extract.Extractor{FS: &extracttest.LoggingFS{}, KeepOriginalName: true}
+		require.Error(t, extractor.Gz(context.Background(), bytes.NewReader(makeGz("Notes")), tmp.String(), nil))
+	})
+
+	t.Run("FileLocation", func(t *testing.T) {
+		target := mkTempDir(t).Join("notes")
+		extractor := extract.Extractor{FS: &extracttest.LoggingFS{}, KeepOriginalName: true}
+		require.NoError(t, extractor.Gz(context.Background(), bytes.NewReader(makeGz("Notes")), target.String(), nil))
+		data, err := target.ReadFile()
+		require.NoError(t, err)
+		require.Equal(t, "Notes", string(data))
+	})
+}
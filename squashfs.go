@@ -0,0 +1,910 @@
+package extract
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"debug/elf"
+	"encoding/binary"
+	goerrors "errors"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+	"github.com/ulikunitz/xz/lzma"
+)
+
+var squashfsMagic = []byte("hsqs")
+
+const (
+	squashfsMetadataSize     = 8192
+	squashfsNoFragment       = 0xffffffff
+	squashfsNoXattr          = 0xffffffff
+	squashfsUncompressedData = 1 << 24
+)
+
+// Inode types of squashfs, the extended ones are the basic ones plus 7
+const (
+	squashfsDir = iota + 1
+	squashfsFile
+	squashfsSymlink
+	squashfsBlockDev
+	squashfsCharDev
+	squashfsFifo
+	squashfsSocket
+)
+
+// squashfsSuperblock is the header of a squashfs v4 image
+type squashfsSuperblock struct {
+	Magic               uint32
+	InodeCount          uint32
+	ModTime             uint32
+	BlockSize           uint32
+	FragmentCount       uint32
+	Compressor          uint16
+	BlockLog            uint16
+	Flags               uint16
+	IDCount             uint16
+	VersionMajor        uint16
+	VersionMinor        uint16
+	RootInode           uint64
+	BytesUsed           uint64
+	IDTableStart        uint64
+	XattrIDTableStart   uint64
+	InodeTableStart     uint64
+	DirectoryTableStart uint64
+	FragmentTableStart  uint64
+	ExportTableStart    uint64
+}
+
+// squashfsImage reads the content of a squashfs v4 image
+type squashfsImage struct {
+	r  io.ReaderAt
+	sb squashfsSuperblock
+
+	decompress func(src []byte, max int) ([]byte, error)
+	close      func()
+
+	metadata  map[int64]squashfsMetadataBlock
+	fragments []squashfsFragment
+	xattrs    []squashfsXattrID
+}
+
+type squashfsMetadataBlock struct {
+	data []byte
+	next int64
+}
+
+type squashfsFragment struct {
+	Start uint64
+	Size  uint32
+	_     uint32
+}
+
+type squashfsXattrID struct {
+	Ref   uint64
+	Count uint32
+	Size  uint32
+}
+
+// squashfsInode is an inode of any type, with the fields needed for extraction
+type squashfsInode struct {
+	Type    uint16
+	Mode    os.FileMode
+	Number  uint32
+	ModTime time.Time
+
+	// Directories
+	DirBlock  uint32
+	DirOffset uint16
+	DirSize   uint32
+
+	// Regular files
+	BlocksStart    uint64
+	Size           uint64
+	Fragment       uint32
+	FragmentOffset uint32
+	Blocks         []uint32
+
+	// Symlinks
+	Target string
+
+	// Devices
+	Major, Minor uint32
+
+	Nlink uint32
+	Xattr uint32
+}
+
+// isSquashfs checks if buf starts with a squashfs image
+func isSquashfs(buf []byte) bool {
+	return bytes.HasPrefix(buf, squashfsMagic)
+}
+
+// isAppImage checks if buf starts with an AppImage of type 2, that is an ELF
+// executable marked with "AI\x02" in the padding of its identification
+func isAppImage(buf []byte) bool {
+	return len(buf) > 11 && string(buf[0:4]) == elf.ELFMAG && string(buf[8:11]) == "AI\x02"
+}
+
+// SquashfsOffset returns the position of the squashfs image inside r, which may
+// be a squashfs image itself or an AppImage, where the image is appended to an
+// ELF executable.
+func SquashfsOffset(r io.ReaderAt) (int64, error) {
+	magic := make([]byte, 4)
+	if _, err := r.ReadAt(magic, 0); err != nil {
+		return 0, errors.Annotatef(err, "Read squashfs magic")
+	}
+	if bytes.Equal(magic, squashfsMagic) {
+		return 0, nil
+	}
+
+	exe, err := elf.NewFile(r)
+	if err != nil {
+		return 0, errors.New("Not a squashfs image or an AppImage")
+	}
+	defer exe.Close()
+
+	// The image starts after the end of the ELF file, that is the end of the
+	// section headers table or the end of the last section or segment
+	var offset int64
+	switch exe.Class {
+	case elf.ELFCLASS64:
+		hdr := new(elf.Header64)
+		if err := binary.Read(io.NewSectionReader(r, 0, math.MaxInt64), exe.ByteOrder, hdr); err != nil {
+			return 0, errors.Annotatef(err, "Read ELF header")
+		}
+		offset = int64(hdr.Shoff) + int64(hdr.Shentsize)*int64(hdr.Shnum)
+	case elf.ELFCLASS32:
+		hdr := new(elf.Header32)
+		if err := binary.Read(io.NewSectionReader(r, 0, math.MaxInt64), exe.ByteOrder, hdr); err != nil {
+			return 0, errors.Annotatef(err, "Read ELF header")
+		}
+		offset = int64(hdr.Shoff) + int64(hdr.Shentsize)*int64(hdr.Shnum)
+	}
+	for _, section := range exe.Sections {
+		if section.Type != elf.SHT_NOBITS {
+			offset = max(offset, int64(section.Offset+section.FileSize))
+		}
+	}
+	for _, prog := range exe.Progs {
+		offset = max(offset, int64(prog.Off+prog.Filesz))
+	}
+
+	if _, err := r.ReadAt(magic, offset); err != nil || !bytes.Equal(magic, squashfsMagic) {
+		return 0, errors.New("No squashfs image found after the ELF executable")
+	}
+	return offset, nil
+}
+
+func openSquashfs(r io.ReaderAt) (*squashfsImage, error) {
+	image := &squashfsImage{r: r, metadata: map[int64]squashfsMetadataBlock{}}
+	if err := binary.Read(io.NewSectionReader(r, 0, 96), binary.LittleEndian, &image.sb); err != nil {
+		return nil, errors.Annotatef(err, "Read squashfs superblock")
+	}
+	sb := &image.sb
+	if sb.Magic != binary.LittleEndian.Uint32(squashfsMagic) {
+		return nil, errors.New("Not a squashfs image")
+	}
+	if sb.VersionMajor != 4 || sb.VersionMinor != 0 {
+		return nil, errors.Errorf("Unsupported squashfs version %d.%d", sb.VersionMajor, sb.VersionMinor)
+	}
+	if sb.BlockSize < 4096 || sb.BlockSize > 1<<20 || sb.BlockSize != 1<<sb.BlockLog {
+		return nil, errors.Errorf("Invalid squashfs block size %d", sb.BlockSize)
+	}
+
+	if sb.InodeTableStart > sb.DirectoryTableStart || sb.DirectoryTableStart > sb.BytesUsed {
+		return nil, errors.New("Invalid squashfs tables")
+	}
+	// The sizes in the superblock are trusted only if the image is that long
+	var last [1]byte
+	if _, err := r.ReadAt(last[:], int64(sb.BytesUsed)-1); sb.BytesUsed == 0 || err != nil {
+		return nil, errors.New("Truncated squashfs image")
+	}
+	image.close = func() {}
+	switch sb.Compressor {
+	case 1:
+		image.decompress = func(src []byte, max int) ([]byte, error) {
+			r, err := zlib.NewReader(bytes.NewReader(src))
+			if err != nil {
+				return nil, err
+			}
+			return readAtMost(r, max)
+		}
+	case 2:
+		image.decompress = func(src []byte, max int) ([]byte, error) {
+			r, err := lzma.NewReader(bytes.NewReader(src))
+			if err != nil {
+				return nil, err
+			}
+			return readAtMost(r, max)
+		}
+	case 4:
+		image.decompress = func(src []byte, max int) ([]byte, error) {
+			r, err := xz.ReaderConfig{SingleStream: true}.NewReader(bytes.NewReader(src))
+			if err != nil {
+				return nil, err
+			}
+			return readAtMost(r, max)
+		}
+	case 5:
+		image.decompress = lz4Decompress
+	case 6:
+		decoder, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, errors.Annotatef(err, "Open zstd decoder")
+		}
+		image.close = decoder.Close
+		image.decompress = func(src []byte, max int) ([]byte, error) {
+			res, err := decoder.DecodeAll(src, make([]byte, 0, max))
+			if err == nil && len(res) > max {
+				return nil, errors.New("Decompressed squashfs block too big")
+			}
+			return res, err
+		}
+	case 3:
+		return nil, errors.New("Unsupported squashfs compression: lzo")
+	default:
+		return nil, errors.Errorf("Unsupported squashfs compression %d", sb.Compressor)
+	}
+	return image, nil
+}
+
+// readAtMost reads r until EOF, failing if there are more than max bytes
+func readAtMost(r io.Reader, max int) ([]byte, error) {
+	res, err := io.ReadAll(io.LimitReader(r, int64(max)+1))
+	if err == nil && len(res) > max {
+		return nil, errors.New("Decompressed squashfs block too big")
+	}
+	return res, err
+}
+
+// readMetadataBlock reads the metadata block at the absolute offset pos
+func (s *squashfsImage) readMetadataBlock(pos int64) (squashfsMetadataBlock, error) {
+	if block, ok := s.metadata[pos]; ok {
+		return block, nil
+	}
+	var header [2]byte
+	if _, err := s.r.ReadAt(header[:], pos); err != nil {
+		return squashfsMetadataBlock{}, errors.Annotatef(err, "Read squashfs metadata")
+	}
+	size := binary.LittleEndian.Uint16(header[:])
+	raw := make([]byte, size&0x7fff)
+	if _, err := s.r.ReadAt(raw, pos+2); err != nil {
+		return squashfsMetadataBlock{}, errors.Annotatef(err, "Read squashfs metadata")
+	}
+	data := raw
+	if size&0x8000 == 0 {
+		var err error
+		if data, err = s.decompress(raw, squashfsMetadataSize); err != nil {
+			return squashfsMetadataBlock{}, errors.Annotatef(err, "Decompress squashfs metadata")
+		}
+	}
+	block := squashfsMetadataBlock{data: data, next: pos + 2 + int64(len(raw))}
+	s.metadata[pos] = block
+	return block, nil
+}
+
+// metadataReader reads a stream of metadata blocks starting from the block at
+// the absolute offset pos, skipping the first offset bytes
+type squashfsMetadataReader struct {
+	image *squashfsImage
+	block squashfsMetadataBlock
+	pos   int
+}
+
+func (s *squashfsImage) metadataReader(pos int64, offset int) (*squashfsMetadataReader, error) {
+	block, err := s.readMetadataBlock(pos)
+	if err != nil {
+		return nil, err
+	}
+	if offset > len(block.data) {
+		return nil, errors.New("Invalid squashfs metadata reference")
+	}
+	return &squashfsMetadataReader{image: s, block: block, pos: offset}, nil
+}
+
+func (m *squashfsMetadataReader) Read(p []byte) (int, error) {
+	if m.pos >= len(m.block.data) {
+		if m.block.next >= int64(m.image.sb.BytesUsed) {
+			return 0, io.EOF
+		}
+		block, err := m.image.readMetadataBlock(m.block.next)
+		if err != nil {
+			return 0, err
+		}
+		m.block, m.pos = block, 0
+		if len(block.data) == 0 {
+			return 0, io.ErrUnexpectedEOF
+		}
+	}
+	n := copy(p, m.block.data[m.pos:])
+	m.pos += n
+	return n, nil
+}
+
+// readTable reads a table stored in metadata blocks, whose locations are listed
+// at the absolute offset start. Each entry of the table is decoded in entries.
+func (s *squashfsImage) readTable(start uint64, entries any, count int, entrySize int) error {
+	if count == 0 {
+		return nil
+	}
+	blocks := (count*entrySize + squashfsMetadataSize - 1) / squashfsMetadataSize
+	locations := make([]uint64, blocks)
+	if err := binary.Read(io.NewSectionReader(s.r, int64(start), int64(blocks*8)), binary.LittleEndian, locations); err != nil {
+		return errors.Annotatef(err, "Read squashfs lookup table")
+	}
+	data := []byte{}
+	for _, location := range locations {
+		block, err := s.readMetadataBlock(int64(location))
+		if err != nil {
+			return err
+		}
+		data = append(data, block.data...)
+	}
+	if len(data) < count*entrySize {
+		return errors.New("Squashfs lookup table too short")
+	}
+	return binary.Read(bytes.NewReader(data[:count*entrySize]), binary.LittleEndian, entries)
+}
+
+// readInode reads the inode at the given reference, which contains the position
+// of the metadata block in the upper bits and the offset inside it in the lower 16
+func (s *squashfsImage) readInode(ref uint64) (*squashfsInode, error) {
+	m, err := s.metadataReader(int64(s.sb.InodeTableStart+ref>>16), int(ref&0xffff))
+	if err != nil {
+		return nil, err
+	}
+
+	var header struct {
+		Type, Mode, UID, GID uint16
+		ModTime, Number      uint32
+	}
+	if err := binary.Read(m, binary.LittleEndian, &header); err != nil {
+		return nil, errors.Annotatef(err, "Read squashfs inode")
+	}
+	inode := &squashfsInode{
+		Type:    header.Type,
+		Number:  header.Number,
+		ModTime: time.Unix(int64(header.ModTime), 0),
+		Nlink:   1,
+		Xattr:   squashfsNoXattr,
+	}
+	extended := header.Type > squashfsSocket
+	if extended {
+		inode.Type -= squashfsSocket
+	}
+
+	read := func(fields ...any) error {
+		for _, field := range fields {
+			if err := binary.Read(m, binary.LittleEndian, field); err != nil {
+				return errors.Annotatef(err, "Read squashfs inode")
+			}
+		}
+		return nil
+	}
+
+	var typ os.FileMode
+	switch inode.Type {
+	case squashfsDir:
+		typ = os.ModeDir
+		var parent uint32
+		if !extended {
+			var size uint16
+			if err := read(&inode.DirBlock, &inode.Nlink, &size, &inode.DirOffset, &parent); err != nil {
+				return nil, err
+			}
+			inode.DirSize = uint32(size)
+		} else {
+			var indexCount uint16
+			if err := read(&inode.Nlink, &inode.DirSize, &inode.DirBlock, &parent, &indexCount, &inode.DirOffset, &inode.Xattr); err != nil {
+				return nil, err
+			}
+		}
+	case squashfsFile:
+		if !extended {
+			var start, size uint32
+			if err := read(&start, &inode.Fragment, &inode.FragmentOffset, &size); err != nil {
+				return nil, err
+			}
+			inode.BlocksStart, inode.Size = uint64(start), uint64(size)
+		} else {
+			var sparse uint64
+			if err := read(&inode.BlocksStart, &inode.Size, &sparse, &inode.Nlink, &inode.Fragment, &inode.FragmentOffset, &inode.Xattr); err != nil {
+				return nil, err
+			}
+		}
+		blocks := inode.Size / uint64(s.sb.BlockSize)
+		if inode.Fragment == squashfsNoFragment && inode.Size%uint64(s.sb.BlockSize) != 0 {
+			blocks++
+		}
+		// The block sizes follow the inode, and every metadata block of the
+		// inode table takes at least its two bytes of header
+		tableSize := (s.sb.DirectoryTableStart - s.sb.InodeTableStart) / 2 * squashfsMetadataSize
+		if blocks > s.sb.BytesUsed || blocks*4 > tableSize {
+			return nil, errors.New("Invalid squashfs file size")
+		}
+		inode.Blocks = make([]uint32, blocks)
+		if err := read(inode.Blocks); err != nil {
+			return nil, err
+		}
+	case squashfsSymlink:
+		typ = os.ModeSymlink
+		var size uint32
+		if err := read(&inode.Nlink, &size); err != nil {
+			return nil, err
+		}
+		if size > 4096 {
+			return nil, errors.New("Invalid squashfs symlink")
+		}
+		target := make([]byte, size)
+		if err := read(target); err != nil {
+			return nil, err
+		}
+		inode.Target = string(target)
+		if extended {
+			if err := read(&inode.Xattr); err != nil {
+				return nil, err
+			}
+		}
+	case squashfsBlockDev, squashfsCharDev:
+		typ = os.ModeDevice
+		if inode.Type == squashfsCharDev {
+			typ |= os.ModeCharDevice
+		}
+		var dev uint32
+		if err := read(&inode.Nlink, &dev); err != nil {
+			return nil, err
+		}
+		inode.Major = (dev >> 8) & 0xfff
+		inode.Minor = (dev & 0xff) | ((dev >> 12) & 0xfff00)
+		if extended {
+			if err := read(&inode.Xattr); err != nil {
+				return nil, err
+			}
+		}
+	case squashfsFifo, squashfsSocket:
+		typ = os.ModeNamedPipe
+		if inode.Type == squashfsSocket {
+			typ = os.ModeSocket
+		}
+		if err := read(&inode.Nlink); err != nil {
+			return nil, err
+		}
+		if extended {
+			if err := read(&inode.Xattr); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, errors.Errorf("Invalid squashfs inode type %d", header.Type)
+	}
+	inode.Mode = unixMode(uint32(header.Mode)&07777) | typ
+	return inode, nil
+}
+
+// squashfsDirEntry is an entry of a directory listing
+type squashfsDirEntry struct {
+	Name  string
+	Inode uint64
+}
+
+// readDir reads the entries of a directory
+func (s *squashfsImage) readDir(dir *squashfsInode) ([]squashfsDirEntry, error) {
+	// The size includes the implicit "." and ".." entries
+	if dir.DirSize <= 3 {
+		return nil, nil
+	}
+	m, err := s.metadataReader(int64(s.sb.DirectoryTableStart)+int64(dir.DirBlock), int(dir.DirOffset))
+	if err != nil {
+		return nil, err
+	}
+	listing := io.LimitReader(m, int64(dir.DirSize-3))
+
+	entries := []squashfsDirEntry{}
+	for {
+		var header struct {
+			Count, Start, Inode uint32
+		}
+		if err := binary.Read(listing, binary.LittleEndian, &header); err == io.EOF {
+			return entries, nil
+		} else if err != nil {
+			return nil, errors.Annotatef(err, "Read squashfs directory")
+		}
+		if header.Count >= 256 {
+			return nil, errors.New("Invalid squashfs directory header")
+		}
+		for i := uint32(0); i <= header.Count; i++ {
+			var entry struct {
+				Offset      uint16
+				InodeOffset int16
+				Type        uint16
+				NameSize    uint16
+			}
+			if err := binary.Read(listing, binary.LittleEndian, &entry); err != nil {
+				return nil, errors.Annotatef(err, "Read squashfs directory")
+			}
+			name := make([]byte, int(entry.NameSize)+1)
+			if _, err := io.ReadFull(listing, name); err != nil {
+				return nil, errors.Annotatef(err, "Read squashfs directory")
+			}
+			entries = append(entries, squashfsDirEntry{
+				Name:  string(name),
+				Inode: uint64(header.Start)<<16 | uint64(entry.Offset),
+			})
+		}
+	}
+}
+
+// readDataBlock reads and decompresses a data block stored at pos, whose size has
+// the same encoding of the block list of the inodes
+func (s *squashfsImage) readDataBlock(pos uint64, size uint32) ([]byte, error) {
+	raw := make([]byte, size&^squashfsUncompressedData)
+	if _, err := s.r.ReadAt(raw, int64(pos)); err != nil {
+		return nil, errors.Annotatef(err, "Read squashfs data block")
+	}
+	if size&squashfsUncompressedData != 0 {
+		return raw, nil
+	}
+	data, err := s.decompress(raw, int(s.sb.BlockSize))
+	if err != nil {
+		return nil, errors.Annotatef(err, "Decompress squashfs data block")
+	}
+	return data, nil
+}
+
+// open returns a reader over the content of a regular file
+func (s *squashfsImage) open(inode *squashfsInode) io.Reader {
+	return &squashfsFileReader{image: s, inode: inode, pos: inode.BlocksStart}
+}
+
+type squashfsFileReader struct {
+	image   *squashfsImage
+	inode   *squashfsInode
+	pos     uint64
+	block   int
+	read    uint64
+	pending []byte
+}
+
+func (f *squashfsFileReader) Read(p []byte) (int, error) {
+	for len(f.pending) == 0 {
+		if f.read >= f.inode.Size {
+			return 0, io.EOF
+		}
+		if err := f.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, f.pending)
+	f.pending = f.pending[n:]
+	return n, nil
+}
+
+// next loads the next block of the file in pending
+func (f *squashfsFileReader) next() error {
+	s := f.image
+	blockSize := uint64(s.sb.BlockSize)
+	expected := min(blockSize, f.inode.Size-f.read)
+
+	var data []byte
+	if f.block < len(f.inode.Blocks) {
+		size := f.inode.Blocks[f.block]
+		f.block++
+		if size == 0 {
+			// Sparse block
+			data = make([]byte, expected)
+		} else {
+			var err error
+			if data, err = s.readDataBlock(f.pos, size); err != nil {
+				return err
+			}
+			f.pos += uint64(size &^ squashfsUncompressedData)
+		}
+	} else {
+		// The tail of the file is stored in a fragment
+		if f.inode.Fragment == squashfsNoFragment {
+			return errors.New("Squashfs file too short")
+		}
+		if s.fragments == nil {
+			s.fragments = make([]squashfsFragment, s.sb.FragmentCount)
+			if err := s.readTable(s.sb.FragmentTableStart, s.fragments, int(s.sb.FragmentCount), 16); err != nil {
+				return errors.Annotatef(err, "Read squashfs fragment table")
+			}
+		}
+		if f.inode.Fragment >= uint32(len(s.fragments)) {
+			return errors.New("Invalid squashfs fragment")
+		}
+		fragment := s.fragments[f.inode.Fragment]
+		block, err := s.readDataBlock(fragment.Start, fragment.Size)
+		if err != nil {
+			return err
+		}
+		start := uint64(f.inode.FragmentOffset)
+		if start+expected > uint64(len(block)) {
+			return errors.New("Invalid squashfs fragment")
+		}
+		data = block[start : start+expected]
+	}
+
+	if uint64(len(data)) != expected {
+		return errors.New("Invalid squashfs data block size")
+	}
+	f.read += expected
+	f.pending = data
+	return nil
+}
+
+// readXattrs returns the extended attributes with the given index
+func (s *squashfsImage) readXattrs(index uint32) (map[string][]byte, error) {
+	if index == squashfsNoXattr || s.sb.XattrIDTableStart == math.MaxUint64 {
+		return nil, nil
+	}
+	var table struct {
+		Start uint64
+		Count uint32
+		_     uint32
+	}
+	if err := binary.Read(io.NewSectionReader(s.r, int64(s.sb.XattrIDTableStart), 16), binary.LittleEndian, &table); err != nil {
+		return nil, errors.Annotatef(err, "Read squashfs xattr table")
+	}
+	if s.xattrs == nil {
+		if table.Count > 1<<24 {
+			return nil, errors.New("Invalid squashfs xattr table")
+		}
+		s.xattrs = make([]squashfsXattrID, table.Count)
+		if err := s.readTable(s.sb.XattrIDTableStart+16, s.xattrs, int(table.Count), 16); err != nil {
+			return nil, errors.Annotatef(err, "Read squashfs xattr table")
+		}
+	}
+	if index >= uint32(len(s.xattrs)) {
+		return nil, errors.New("Invalid squashfs xattr index")
+	}
+
+	id := s.xattrs[index]
+	m, err := s.metadataReader(int64(table.Start+id.Ref>>16), int(id.Ref&0xffff))
+	if err != nil {
+		return nil, err
+	}
+	prefixes := []string{"user.", "trusted.", "security."}
+	res := map[string][]byte{}
+	for i := uint32(0); i < id.Count; i++ {
+		var key struct{ Type, Size uint16 }
+		if err := binary.Read(m, binary.LittleEndian, &key); err != nil {
+			return nil, errors.Annotatef(err, "Read squashfs xattr")
+		}
+		name := make([]byte, key.Size)
+		if _, err := io.ReadFull(m, name); err != nil {
+			return nil, errors.Annotatef(err, "Read squashfs xattr")
+		}
+		if int(key.Type&0xff) >= len(prefixes) {
+			return nil, errors.Errorf("Invalid squashfs xattr type %d", key.Type)
+		}
+
+		var size uint32
+		if err := binary.Read(m, binary.LittleEndian, &size); err != nil {
+			return nil, errors.Annotatef(err, "Read squashfs xattr")
+		}
+		valueReader := io.Reader(m)
+		if key.Type&0x100 != 0 {
+			// The value is stored out of line, and here there is its reference
+			var ref uint64
+			if err := binary.Read(m, binary.LittleEndian, &ref); err != nil {
+				return nil, errors.Annotatef(err, "Read squashfs xattr")
+			}
+			ool, err := s.metadataReader(int64(table.Start+ref>>16), int(ref&0xffff))
+			if err != nil {
+				return nil, err
+			}
+			if err := binary.Read(ool, binary.LittleEndian, &size); err != nil {
+				return nil, errors.Annotatef(err, "Read squashfs xattr")
+			}
+			valueReader = ool
+		}
+		if size > 1<<16 {
+			return nil, errors.New("Invalid squashfs xattr size")
+		}
+		value := make([]byte, size)
+		if _, err := io.ReadFull(valueReader, value); err != nil {
+			return nil, errors.Annotatef(err, "Read squashfs xattr")
+		}
+		res[prefixes[key.Type&0xff]+string(name)] = value
+	}
+	return res, nil
+}
+
+// Squashfs extracts a squashfs image in the specified location. Device nodes and
+// named pipes are created only if the FS implements NodeFS, and the extended
+// attributes are set only if it implements XattrFS. In both cases the entries
+// that are not permitted or not supported by the FS are skipped.
+// To extract the image inside an AppImage use SquashfsOffset to locate it.
+// It accepts a rename function to handle the names of the files (see the example)
+func (e *Extractor) Squashfs(ctx context.Context, body io.ReaderAt, location string, rename Renamer) error {
+	image, err := openSquashfs(body)
+	if err != nil {
+		return err
+	}
+	defer image.close()
+
+	root, err := image.readInode(image.sb.RootInode)
+	if err != nil {
+		return errors.Annotatef(err, "Read squashfs root directory")
+	}
+	if root.Type != squashfsDir {
+		return errors.New("Squashfs root is not a directory")
+	}
+
+	nodeFS, _ := fsAs[NodeFS](e.FS)
+	xattrFS, _ := fsAs[XattrFS](e.FS)
+	setXattrs := func(path string, index uint32) error {
+		if xattrFS == nil {
+			return nil
+		}
+		xattrs, err := image.readXattrs(index)
+		if err != nil {
+			return err
+		}
+		for name, value := range xattrs {
+			if err := xattrFS.Lsetxattr(path, name, value); err != nil && !isNotPermitted(err) {
+				return errors.Annotatef(err, "Set extended attribute %s of %s", name, path)
+			}
+		}
+		return nil
+	}
+
+	links := []*link{}
+	symlinks := []*link{}
+	symlinkXattrs := map[string]uint32{}
+	hardlinks := map[uint32]string{}
+	visited := map[uint32]bool{}
+
+	var walk func(dir *squashfsInode, prefix string, depth int) error
+	walk = func(dir *squashfsInode, prefix string, depth int) error {
+		if depth > 256 || visited[dir.Number] {
+			return errors.New("Loop in squashfs directory hierarchy")
+		}
+		visited[dir.Number] = true
+
+		entries, err := image.readDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			select {
+			case <-ctx.Done():
+				return errors.New("interrupted")
+			default:
+			}
+
+			if entry.Name == "." || entry.Name == ".." || strings.ContainsAny(entry.Name, "/\x00") {
+				continue
+			}
+			inode, err := image.readInode(entry.Inode)
+			if err != nil {
+				return err
+			}
+			name := prefix + entry.Name
+
+			path := name
+			if rename != nil {
+				path = rename(path)
+			}
+
+			if path != "" {
+				if path, err = safeJoin(location, path); err != nil {
+					path = ""
+				}
+			}
+
+			if path != "" {
+				e.modTime(path, inode.ModTime)
+			}
+			if inode.Type == squashfsDir {
+				if path != "" {
+					if err := e.FS.MkdirAll(path, e.Modes.perm(inode.Mode)); err != nil {
+						return errors.Annotatef(err, "Create directory %s", path)
+					}
+					if err := setXattrs(path, inode.Xattr); err != nil {
+						return err
+					}
+				}
+				// Rename may skip a directory but keep its content
+				if err := walk(inode, name+"/", depth+1); err != nil {
+					return err
+				}
+				continue
+			}
+			if path == "" {
+				continue
+			}
+
+			// Hard links share the same inode
+			if target, ok := hardlinks[inode.Number]; ok {
+				links = append(links, &link{Path: path, Name: target})
+				continue
+			}
+
+			switch inode.Type {
+			case squashfsFile:
+				e.fileSize(path, int64(inode.Size))
+				if err := e.copy(ctx, path, e.Modes.perm(inode.Mode), image.open(inode)); err != nil {
+					return errors.Annotatef(err, "Create file %s", path)
+				}
+			case squashfsSymlink:
+				symlinks = append(symlinks, &link{Path: path, Name: inode.Target})
+				symlinkXattrs[path] = inode.Xattr
+				continue
+			case squashfsBlockDev, squashfsCharDev, squashfsFifo:
+				if nodeFS == nil {
+					continue
+				}
+				_ = e.FS.Remove(path)
+				if err := nodeFS.Mknod(path, e.Modes.apply(inode.Mode), inode.Major, inode.Minor); err != nil {
+					if isNotPermitted(err) {
+						continue
+					}
+					return errors.Annotatef(err, "Create node %s", path)
+				}
+			default:
+				continue
+			}
+			if inode.Nlink > 1 {
+				hardlinks[inode.Number] = path
+			}
+			if err := setXattrs(path, inode.Xattr); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk(root, "", 0); err != nil {
+		return err
+	}
+
+	// Now we make another pass creating the links
+	for i := range links {
+		select {
+		case <-ctx.Done():
+			return errors.New("interrupted")
+		default:
+		}
+		_ = e.FS.Remove(links[i].Path)
+		if err := e.FS.Link(links[i].Name, links[i].Path); err != nil {
+			return errors.Annotatef(err, "Create link %s", links[i].Path)
+		}
+	}
+
+	symlinks, err = e.createSymlinks(ctx, location, symlinks)
+	if err != nil {
+		return err
+	}
+	for _, symlink := range symlinks {
+		if err := setXattrs(symlink.Path, symlinkXattrs[symlink.Path]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// AppImage extracts the squashfs image embedded in an AppImage in the specified
+// location.
+// It accepts a rename function to handle the names of the files (see the example)
+func (e *Extractor) AppImage(ctx context.Context, body io.ReaderAt, location string, rename Renamer) error {
+	offset, err := SquashfsOffset(body)
+	if err != nil {
+		return err
+	}
+	return e.Squashfs(ctx, io.NewSectionReader(body, offset, math.MaxInt64-offset), location, rename)
+}
+
+// isNotPermitted returns true if err is caused by missing privileges or by a
+// missing feature of the underlying filesystem
+func isNotPermitted(err error) bool {
+	return goerrors.Is(err, os.ErrPermission) || goerrors.Is(err, goerrors.ErrUnsupported)
+}
@@ -0,0 +1,573 @@
+package extract_test
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codeclysm/extract/v5"
+	"github.com/codeclysm/extract/v5/extracttest"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/require"
+	"github.com/ulikunitz/xz"
+)
+
+type squashfsEntry struct {
+	Name         string
+	Mode         uint32
+	Data         string
+	Target       string
+	Major, Minor uint32
+	Xattrs       map[string]string
+	Children     []*squashfsEntry
+	HardLink     *squashfsEntry
+
+	ref    uint64
+	number uint32
+	nlink  uint32
+}
+
+// squashfsMetaWriter writes a stream of metadata blocks
+type squashfsMetaWriter struct {
+	compress func([]byte) []byte
+	out      bytes.Buffer
+	cur      bytes.Buffer
+	blocks   []int
+}
+
+func (m *squashfsMetaWriter) ref() uint64 {
+	return uint64(m.out.Len())<<16 | uint64(m.cur.Len())
+}
+
+func (m *squashfsMetaWriter) write(data ...any) {
+	for _, d := range data {
+		binary.Write(&m.cur, binary.LittleEndian, d)
+	}
+	for m.cur.Len() >= 8192 {
+		m.flushBlock(m.cur.Next(8192))
+	}
+}
+
+func (m *squashfsMetaWriter) flush() {
+	if m.cur.Len() > 0 {
+		m.flushBlock(m.cur.Next(m.cur.Len()))
+	}
+}
+
+func (m *squashfsMetaWriter) flushBlock(block []byte) {
+	m.blocks = append(m.blocks, m.out.Len())
+	if compressed := m.compress(block); compressed != nil {
+		binary.Write(&m.out, binary.LittleEndian, uint16(len(compressed)))
+		m.out.Write(compressed)
+	} else {
+		binary.Write(&m.out, binary.LittleEndian, uint16(len(block))|0x8000)
+		m.out.Write(block)
+	}
+}
+
+// squashfsWriter builds a squashfs image with 4KiB blocks
+type squashfsWriter struct {
+	compress  func([]byte) []byte
+	image     bytes.Buffer
+	fragment  bytes.Buffer
+	fragments [][2]uint64
+	inodes    *squashfsMetaWriter
+	dirs      *squashfsMetaWriter
+	xattrKV   *squashfsMetaWriter
+	xattrIDs  *squashfsMetaWriter
+	xattrs    uint32
+	count     uint32
+}
+
+func (w *squashfsWriter) writeBlock(block []byte) uint32 {
+	if compressed := w.compress(block); compressed != nil {
+		w.image.Write(compressed)
+		return uint32(len(compressed))
+	}
+	w.image.Write(block)
+	return uint32(len(block)) | 1<<24
+}
+
+func (w *squashfsWriter) flushFragment() {
+	if w.fragment.Len() == 0 {
+		return
+	}
+	start := uint64(w.image.Len())
+	size := w.writeBlock(w.fragment.Bytes())
+	w.fragments = append(w.fragments, [2]uint64{start, uint64(size)})
+	w.fragment.Reset()
+}
+
+func (w *squashfsWriter) writeXattrs(xattrs map[string]string) uint32 {
+	if len(xattrs) == 0 {
+		return 0xffffffff
+	}
+	ref := w.xattrKV.ref()
+	size := 0
+	names := []string{}
+	for name := range xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for typ, prefix := range []string{"user.", "trusted.", "security."} {
+			if strings.HasPrefix(name, prefix) {
+				key := strings.TrimPrefix(name, prefix)
+				w.xattrKV.write(uint16(typ), uint16(len(key)), []byte(key), uint32(len(xattrs[name])), []byte(xattrs[name]))
+				size += len(name) + len(xattrs[name])
+			}
+		}
+	}
+	w.xattrIDs.write(ref, uint32(len(xattrs)), uint32(size))
+	w.xattrs++
+	return w.xattrs - 1
+}
+
+func (w *squashfsWriter) writeEntry(e *squashfsEntry) {
+	if e.HardLink != nil {
+		return
+	}
+	w.count++
+	e.number = w.count
+	xattr := w.writeXattrs(e.Xattrs)
+	extended := uint16(0)
+	if xattr != 0xffffffff || e.nlink > 1 {
+		extended = 7
+	}
+	header := func(typ uint16) {
+		e.ref = w.inodes.ref()
+		w.inodes.write(typ+extended, uint16(e.Mode&07777), uint16(0), uint16(0), uint32(squashfsModTime.Unix()), e.number)
+	}
+
+	switch e.Mode & 0170000 {
+	case 0040000:
+		sort.Slice(e.Children, func(i, j int) bool { return e.Children[i].Name < e.Children[j].Name })
+		for _, child := range e.Children {
+			w.writeEntry(child)
+		}
+		dirRef := w.dirs.ref()
+		size := 0
+		for i := 0; i < len(e.Children); {
+			// Every header groups the entries with inodes in the same metadata block
+			target := func(c *squashfsEntry) *squashfsEntry {
+				if c.HardLink != nil {
+					return c.HardLink
+				}
+				return c
+			}
+			first := target(e.Children[i])
+			j := i
+			for j < len(e.Children) && target(e.Children[j]).ref>>16 == first.ref>>16 {
+				j++
+			}
+			w.dirs.write(uint32(j-i-1), uint32(first.ref>>16), first.number)
+			size += 12
+			for _, child := range e.Children[i:j] {
+				inode := target(child)
+				typ := map[uint32]uint16{0040000: 1, 0100000: 2, 0120000: 3, 0060000: 4, 0020000: 5, 0010000: 6}[inode.Mode&0170000]
+				w.dirs.write(uint16(inode.ref&0xffff), int16(inode.number-first.number), typ, uint16(len(child.Name)-1), []byte(child.Name))
+				size += 8 + len(child.Name)
+			}
+			i = j
+		}
+		header(1)
+		if extended == 0 {
+			w.inodes.write(uint32(dirRef>>16), uint32(2), uint16(size+3), uint16(dirRef&0xffff), uint32(0))
+		} else {
+			w.inodes.write(uint32(2), uint32(size+3), uint32(dirRef>>16), uint32(0), uint16(0), uint16(dirRef&0xffff), xattr)
+		}
+	case 0100000:
+		start := uint64(w.image.Len())
+		data := []byte(e.Data)
+		sizes := []uint32{}
+		for len(data) >= 4096 {
+			block := data[:4096]
+			data = data[4096:]
+			if bytes.Count(block, []byte{0}) == len(block) {
+				sizes = append(sizes, 0)
+			} else {
+				sizes = append(sizes, w.writeBlock(block))
+			}
+		}
+		fragment, offset := uint32(0xffffffff), uint32(0)
+		if len(data) > 0 {
+			if w.fragment.Len()+len(data) > 4096 {
+				w.flushFragment()
+			}
+			fragment, offset = uint32(len(w.fragments)), uint32(w.fragment.Len())
+			w.fragment.Write(data)
+		}
+		header(2)
+		if extended == 0 {
+			w.inodes.write(uint32(start), fragment, offset, uint32(len(e.Data)), sizes)
+		} else {
+			w.inodes.write(start, uint64(len(e.Data)), uint64(0), e.nlink, fragment, offset, xattr, sizes)
+		}
+	case 0120000:
+		header(3)
+		w.inodes.write(e.nlink, uint32(len(e.Target)), []byte(e.Target))
+		if extended != 0 {
+			w.inodes.write(xattr)
+		}
+	case 0060000, 0020000:
+		typ := uint16(4)
+		if e.Mode&0170000 == 0020000 {
+			typ = 5
+		}
+		header(typ)
+		w.inodes.write(e.nlink, e.Minor&0xff|e.Major<<8|(e.Minor&^0xff)<<12)
+		if extended != 0 {
+			w.inodes.write(xattr)
+		}
+	case 0010000:
+		header(6)
+		w.inodes.write(e.nlink)
+		if extended != 0 {
+			w.inodes.write(xattr)
+		}
+	}
+}
+
+// squashfsModTime is the modification time of every inode
+var squashfsModTime = time.Date(2021, 6, 15, 12, 30, 45, 0, time.UTC)
+
+func makeSquashfs(root *squashfsEntry, compressor uint16, compress func([]byte) []byte) []byte {
+	w := &squashfsWriter{compress: compress}
+	newMeta := func() *squashfsMetaWriter { return &squashfsMetaWriter{compress: compress} }
+	w.inodes, w.dirs, w.xattrKV, w.xattrIDs = newMeta(), newMeta(), newMeta(), newMeta()
+
+	var countLinks func(e *squashfsEntry)
+	countLinks = func(e *squashfsEntry) {
+		e.nlink++
+		if e.HardLink != nil {
+			e.HardLink.nlink++
+		}
+		for _, child := range e.Children {
+			countLinks(child)
+		}
+	}
+	countLinks(root)
+
+	w.image.Write(make([]byte, 96))
+	w.writeEntry(root)
+	w.flushFragment()
+
+	table := func(m *squashfsMetaWriter) uint64 {
+		m.flush()
+		start := uint64(w.image.Len())
+		w.image.Write(m.out.Bytes())
+		return start
+	}
+	lookup := func(m *squashfsMetaWriter, start uint64) uint64 {
+		pos := uint64(w.image.Len())
+		for _, block := range m.blocks {
+			binary.Write(&w.image, binary.LittleEndian, start+uint64(block))
+		}
+		return pos
+	}
+
+	inodeTable := table(w.inodes)
+	dirTable := table(w.dirs)
+
+	fragmentEntries := newMeta()
+	for _, f := range w.fragments {
+		fragmentEntries.write(f[0], uint32(f[1]), uint32(0))
+	}
+	fragmentTable := lookup(fragmentEntries, table(fragmentEntries))
+
+	ids := newMeta()
+	ids.write(uint32(0))
+	idTable := lookup(ids, table(ids))
+
+	xattrTable := uint64(0xffffffffffffffff)
+	if w.xattrs > 0 {
+		kv := table(w.xattrKV)
+		idsStart := table(w.xattrIDs)
+		xattrTable = uint64(w.image.Len())
+		for _, v := range []any{kv, w.xattrs, uint32(0)} {
+			binary.Write(&w.image, binary.LittleEndian, v)
+		}
+		lookup(w.xattrIDs, idsStart)
+	}
+
+	image := w.image.Bytes()
+	sb := &bytes.Buffer{}
+	for _, v := range []any{
+		[]byte("hsqs"), w.count, uint32(0), uint32(4096), uint32(len(w.fragments)),
+		compressor, uint16(12), uint16(0), uint16(1), uint16(4), uint16(0),
+		root.ref, uint64(len(image)), idTable, xattrTable, inodeTable, dirTable, fragmentTable, uint64(0xffffffffffffffff),
+	} {
+		binary.Write(sb, binary.LittleEndian, v)
+	}
+	copy(image, sb.Bytes())
+	return image
+}
+
+func testSquashfsTree() *squashfsEntry {
+	file2 := &squashfsEntry{Name: "file2.txt", Mode: 0100644, Data: "File2"}
+	return &squashfsEntry{Mode: 0040755, Children: []*squashfsEntry{
+		{Name: "archive", Mode: 0040755, Children: []*squashfsEntry{
+			{Name: "file1.txt", Mode: 0100644, Data: "File1"},
+			file2,
+			{Name: "link.txt", HardLink: file2},
+			{Name: "big.txt", Mode: 0100600, Data: strings.Repeat("0123456789", 1000)},
+			{Name: "sparse.txt", Mode: 0100644, Data: strings.Repeat("\x00", 4096) + "sparse"},
+			{Name: "folderlink", Mode: 0120777, Target: "folder"},
+			{Name: "folder", Mode: 0040700, Xattrs: map[string]string{"user.folder": "yes"}, Children: []*squashfsEntry{
+				{Name: "file1.txt", Mode: 0104755, Data: "folder/File1", Xattrs: map[string]string{"user.mime": "text/plain", "security.selinux": "label"}},
+			}},
+		}},
+	}}
+}
+
+func TestSquashfs(t *testing.T) {
+	compressors := []struct {
+		name     string
+		id       uint16
+		compress func([]byte) []byte
+	}{
+		{"none", 1, func([]byte) []byte { return nil }},
+		{"gzip", 1, func(b []byte) []byte {
+			out := &bytes.Buffer{}
+			w := zlib.NewWriter(out)
+			w.Write(b)
+			w.Close()
+			return out.Bytes()
+		}},
+		{"xz", 4, func(b []byte) []byte {
+			out := &bytes.Buffer{}
+			w, _ := xz.NewWriter(out)
+			w.Write(b)
+			w.Close()
+			return out.Bytes()
+		}},
+		{"zstd", 6, func(b []byte) []byte {
+			enc, _ := zstd.NewWriter(nil)
+			defer enc.Close()
+			return enc.EncodeAll(b, nil)
+		}},
+		{"lz4", 5, lz4RunLength},
+	}
+	for _, compressor := range compressors {
+		t.Run(compressor.name, func(t *testing.T) {
+			userUmask := UnixUmaskZero()
+			defer UnixUmask(userUmask)
+
+			tmp := mkTempDir(t)
+			image := makeSquashfs(testSquashfsTree(), compressor.id, compressor.compress)
+			require.NoError(t, extract.Squashfs(context.Background(), bytes.NewReader(image), tmp.String(), nil))
+			testWalk(t, tmp.String(), Files{
+				"":                          "dir",
+				"/archive":                  "dir",
+				"/archive/folder":           "dir",
+				"/archive/folderlink":       "link",
+				"/archive/folder/file1.txt": "folder/File1",
+				"/archive/file1.txt":        "File1",
+				"/archive/file2.txt":        "File2",
+				"/archive/link.txt":         "File2",
+				"/archive/big.txt":          strings.Repeat("0123456789", 1000),
+				"/archive/sparse.txt":       strings.Repeat("\x00", 4096) + "sparse",
+			})
+			st1, err := tmp.Join("archive", "file2.txt").Stat()
+			require.NoError(t, err)
+			st2, err := tmp.Join("archive", "link.txt").Stat()
+			require.NoError(t, err)
+			require.True(t, os.SameFile(st1, st2))
+			st, err := tmp.Join("archive", "folder").Stat()
+			require.NoError(t, err)
+			require.Equal(t, os.FileMode(OsDirPerms(0700)), st.Mode().Perm())
+		})
+	}
+
+	t.Run("SpecialFiles", func(t *testing.T) {
+		root := &squashfsEntry{Mode: 0040755, Children: []*squashfsEntry{
+			{Name: "null", Mode: 0020666, Major: 1, Minor: 3},
+			{Name: "sda", Mode: 0060660, Major: 8, Minor: 300},
+			{Name: "fifo", Mode: 0010644},
+			{Name: "file.txt", Mode: 0100644, Data: "File", Xattrs: map[string]string{"user.mime": "text/plain", "security.selinux": "label"}},
+		}}
+		image := makeSquashfs(root, 1, func([]byte) []byte { return nil })
+
+		fs := &specialFS{}
+		extractor := extract.Extractor{FS: fs}
+		tmp := mkTempDir(t)
+		require.NoError(t, extractor.Squashfs(context.Background(), bytes.NewReader(image), tmp.String(), nil))
+		require.Equal(t, []string{
+			"fifo prw-r--r-- 0:0",
+			"null Dcrw-rw-rw- 1:3",
+			"sda Drw-rw---- 8:300",
+		}, fs.Nodes)
+		require.Equal(t, []string{
+			"file.txt security.selinux=label",
+			"file.txt user.mime=text/plain",
+		}, fs.Xattrs)
+	})
+
+	t.Run("SymlinkXattrs", func(t *testing.T) {
+		root := &squashfsEntry{Mode: 0040755, Children: []*squashfsEntry{
+			{Name: "file.txt", Mode: 0100644, Data: "File"},
+			{Name: "kept", Mode: 0120777, Target: "file.txt", Xattrs: map[string]string{"user.link": "kept"}},
+			{Name: "escape", Mode: 0120777, Target: "../outside", Xattrs: map[string]string{"user.link": "escape"}},
+		}}
+		image := makeSquashfs(root, 1, func([]byte) []byte { return nil })
+
+		// Only the symlinks created get their extended attributes, not the
+		// rejected ones nor the copies
+		for policy, expected := range map[extract.SymlinkPolicy][]string{
+			extract.RejectEscapingSymlinks: {"kept user.link=kept"},
+			extract.CopySymlinks:           nil,
+		} {
+			fs := &specialFS{}
+			extractor := extract.Extractor{
+				FS:              fs,
+				Symlinks:        policy,
+				SymlinkRejected: func(path, target string) error { return nil },
+			}
+			tmp := mkTempDir(t)
+			require.NoError(t, extractor.Squashfs(context.Background(), bytes.NewReader(image), tmp.String(), nil))
+			require.Equal(t, expected, fs.Xattrs)
+		}
+	})
+
+	t.Run("LoggedSpecialFiles", func(t *testing.T) {
+		root := &squashfsEntry{Mode: 0040755, Children: []*squashfsEntry{
+			{Name: "null", Mode: 0020666, Major: 1, Minor: 3},
+			{Name: "fifo", Mode: 0010644},
+		}}
+		image := makeSquashfs(root, 1, func([]byte) []byte { return nil })
+
+		// The nodes are created by the wrapped FS
+		mem := &extract.MemFS{}
+		require.NoError(t, mem.MkdirAll("/out", 0755))
+		fs := &extracttest.LoggingFS{FS: mem}
+		extractor := extract.Extractor{FS: fs}
+		require.NoError(t, extractor.Squashfs(context.Background(), bytes.NewReader(image), "/out", nil))
+		major, minor, err := mem.Device("/out/null")
+		require.NoError(t, err)
+		require.Equal(t, []uint32{1, 3}, []uint32{major, minor})
+		st, err := mem.Lstat("/out/fifo")
+		require.NoError(t, err)
+		require.Equal(t, os.ModeNamedPipe, st.Mode().Type())
+		require.Contains(t, fs.String(), "mknod")
+	})
+
+	t.Run("AppImage", func(t *testing.T) {
+		// A minimal ELF executable, followed by the image
+		elf := make([]byte, 128)
+		copy(elf, "\x7fELF\x02\x01\x01\x00AI\x02")
+		binary.LittleEndian.PutUint16(elf[16:], 2)    // type
+		binary.LittleEndian.PutUint16(elf[18:], 0x3e) // machine
+		binary.LittleEndian.PutUint32(elf[20:], 1)    // version
+		binary.LittleEndian.PutUint64(elf[40:], 64)   // section headers offset
+		binary.LittleEndian.PutUint16(elf[52:], 64)   // header size
+		binary.LittleEndian.PutUint16(elf[58:], 64)   // section header size
+		binary.LittleEndian.PutUint16(elf[60:], 1)    // section headers count
+		image := makeSquashfs(testSquashfsTree(), 1, func([]byte) []byte { return nil })
+		appImage := append(elf, image...)
+
+		offset, err := extract.SquashfsOffset(bytes.NewReader(appImage))
+		require.NoError(t, err)
+		require.Equal(t, int64(128), offset)
+
+		tmp := mkTempDir(t)
+		require.NoError(t, extract.Archive(context.Background(), bytes.NewBuffer(appImage), tmp.String(), nil))
+		require.FileExists(t, tmp.Join("archive", "big.txt").String())
+	})
+
+	t.Run("HugeFile", func(t *testing.T) {
+		root := &squashfsEntry{Mode: 0040755, Children: []*squashfsEntry{
+			{Name: "file.txt", Mode: 0100644, Data: "File", Xattrs: map[string]string{"user.mime": "text/plain"}},
+		}}
+		image := makeSquashfs(root, 1, func([]byte) []byte { return nil })
+		// The extended inode of the file is the first one of the inode table
+		inodeTable := binary.LittleEndian.Uint64(image[64:])
+		binary.LittleEndian.PutUint64(image[inodeTable+2+24:], 1<<50)
+
+		tmp := mkTempDir(t)
+		err := extract.Squashfs(context.Background(), bytes.NewReader(image), tmp.String(), nil)
+		require.ErrorContains(t, err, "Invalid squashfs file size")
+
+		// The size of the image in the superblock can't be trusted either
+		binary.LittleEndian.PutUint64(image[40:], 1<<60)
+		err = extract.Squashfs(context.Background(), bytes.NewReader(image), tmp.String(), nil)
+		require.ErrorContains(t, err, "Truncated squashfs image")
+	})
+
+	t.Run("Inferred", func(t *testing.T) {
+		tmp := mkTempDir(t)
+		image := makeSquashfs(testSquashfsTree(), 1, func([]byte) []byte { return nil })
+		require.NoError(t, extract.Archive(context.Background(), bytes.NewReader(image), tmp.String(), nil))
+		require.FileExists(t, tmp.Join("archive", "big.txt").String())
+	})
+}
+
+// specialFS records the device nodes and the extended attributes
+type specialFS struct {
+	extracttest.LoggingFS
+	Nodes  []string
+	Xattrs []string
+}
+
+func (s *specialFS) Mknod(path string, mode os.FileMode, major, minor uint32) error {
+	s.Nodes = append(s.Nodes, fmt.Sprintf("%s %v %d:%d", filepath.Base(path), mode, major, minor))
+	sort.Strings(s.Nodes)
+	return nil
+}
+
+func (s *specialFS) Lsetxattr(path, name string, value []byte) error {
+	s.Xattrs = append(s.Xattrs, fmt.Sprintf("%s %s=%s", filepath.Base(path), name, value))
+	sort.Strings(s.Xattrs)
+	return nil
+}
+
+// lz4RunLength encodes a raw lz4 block, replacing the runs of repeated bytes
+// with overlapping matches
+func lz4RunLength(b []byte) []byte {
+	out := []byte{}
+	length := func(n int) {
+		for ; n >= 255; n -= 255 {
+			out = append(out, 255)
+		}
+		out = append(out, byte(n))
+	}
+	sequence := func(literals []byte, match int) {
+		token := byte(min(len(literals), 15)) << 4
+		if match > 0 {
+			token |= byte(min(match-4, 15))
+		}
+		out = append(out, token)
+		if len(literals) >= 15 {
+			length(len(literals) - 15)
+		}
+		out = append(out, literals...)
+		if match > 0 {
+			out = append(out, 1, 0)
+			if match-4 >= 15 {
+				length(match - 4 - 15)
+			}
+		}
+	}
+
+	start := 0
+	for i := 0; i < len(b); {
+		j := i + 1
+		for j < len(b) && b[j] == b[i] {
+			j++
+		}
+		if j-i-1 >= 4 {
+			sequence(b[start:i+1], j-i-1)
+			start = j
+		}
+		i = j
+	}
+	sequence(b[start:], 0)
+	return out
+}
@@ -0,0 +1,365 @@
+package extract
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// SymlinkPolicy is how an Extractor creates the symlinks of the archives.
+type SymlinkPolicy int
+
+const (
+	// AllowSymlinks creates the symlinks with their targets as they are.
+	AllowSymlinks SymlinkPolicy = iota
+
+	// RejectAbsoluteSymlinks rejects the symlinks with an absolute target.
+	RejectAbsoluteSymlinks
+
+	// RejectEscapingSymlinks rejects the symlinks whose target, resolved
+	// through the other symlinks of the archive and the ones already in the
+	// location, is outside of the location, and the ones with an absolute
+	// target. The symlinks already in the location are only seen if the FS
+	// implements LstatFS and ReadlinkFS, otherwise the location is assumed to
+	// have none of them, and image layers can't be applied.
+	RejectEscapingSymlinks
+
+	// RootfsSymlinks treats the location as the root of the archive, like the
+	// root filesystem of a container: the absolute targets are rewritten to be
+	// relative to the location, then the symlinks escaping it are rejected like
+	// with RejectEscapingSymlinks.
+	RootfsSymlinks
+
+	// CopySymlinks writes a copy of the target in place of every symlink,
+	// rejecting the ones that RejectEscapingSymlinks rejects and the ones whose
+	// target doesn't exist or contains the symlink itself. The FS must implement
+	// OpenFS, and ReadDirFS to copy directories.
+	CopySymlinks
+)
+
+// ErrSymlinkRejected is the cause of the error returned when a symlink is
+// rejected by the Symlinks policy of an Extractor and SymlinkRejected is nil.
+var ErrSymlinkRejected = errors.New("Symlink rejected")
+
+// OpenFS can be implemented by the FS of an Extractor to read the extracted
+// files. It's needed to copy the symlinks with CopySymlinks.
+type OpenFS interface {
+	// Open opens the named file for reading.
+	Open(name string) (io.ReadCloser, error)
+}
+
+// ReadlinkFS can be implemented by the FS of an Extractor to read the targets
+// of the symlinks. With LstatFS, it's needed to follow the symlinks already in
+// the location when checking the ones of the archive.
+type ReadlinkFS interface {
+	// Readlink returns the target of the named symlink.
+	Readlink(name string) (string, error)
+}
+
+// maxSymlinks is the maximum number of symlinks followed resolving a path,
+// like the limit of Linux
+const maxSymlinks = 40
+
+// symlinkPolicy applies the Symlinks policy to symlinks, returning the ones to
+// create. With CopySymlinks their Name is the path of the target to copy.
+func (e *Extractor) symlinkPolicy(location string, symlinks []*link) ([]*link, error) {
+	if e.Symlinks == AllowSymlinks || len(symlinks) == 0 {
+		return symlinks, nil
+	}
+
+	root := filepath.Clean(location)
+	targets := map[string]string{}
+	for _, symlink := range symlinks {
+		targets[filepath.Clean(symlink.Path)] = symlink.Name
+	}
+	if e.Symlinks == RootfsSymlinks {
+		for path, target := range targets {
+			rel, err := rootfsTarget(root, path, target)
+			if err != nil {
+				return nil, err
+			}
+			targets[path] = rel
+		}
+	}
+	var lookup func(path string) (string, bool, error)
+	if e.Symlinks != RejectAbsoluteSymlinks {
+		var err error
+		if lookup, err = e.symlinkLookup(root, targets); err != nil {
+			return nil, err
+		}
+	}
+
+	result := []*link{}
+	for _, symlink := range symlinks {
+		path := filepath.Clean(symlink.Path)
+		target := targets[path]
+		resolved, ok := "", true
+		switch e.Symlinks {
+		case RejectAbsoluteSymlinks:
+			ok = !isAbsTarget(target)
+		default:
+			var err error
+			if resolved, ok, err = resolveSymlink(root, lookup, filepath.Dir(path), target); err != nil {
+				return nil, err
+			}
+		}
+		if ok && e.Symlinks == CopySymlinks {
+			ok = resolved != path && !strings.HasPrefix(path, resolved+string(filepath.Separator))
+			target = resolved
+		}
+		if !ok {
+			if err := e.rejectSymlink(symlink.Path, symlink.Name); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		result = append(result, &link{Path: symlink.Path, Name: target})
+	}
+	return result, nil
+}
+
+// rootfsTarget rewrites the absolute target of the symlink path to be relative
+// to root, like RootfsSymlinks does
+func rootfsTarget(root, path, target string) (string, error) {
+	if !isAbsTarget(target) {
+		return target, nil
+	}
+	rel, err := filepath.Rel(filepath.Dir(path), filepath.Join(root, target))
+	if err != nil {
+		return "", errors.Annotatef(err, "Rewrite link %s to %s", path, target)
+	}
+	return rel, nil
+}
+
+// symlinkLookup returns a function looking up the target of the symlink path,
+// which is one of targets or one already in the location. Those are read once,
+// with LstatFS and ReadlinkFS if the FS implements them.
+func (e *Extractor) symlinkLookup(root string, targets map[string]string) (func(path string) (string, bool, error), error) {
+	fs, ok := fsAs[interface {
+		LstatFS
+		ReadlinkFS
+	}](e.FS)
+	if !ok {
+		if e.layer != nil {
+			return nil, errors.New("The FS can't read symlinks, so the ones of the lower layers can't be checked")
+		}
+		return func(path string) (string, bool, error) {
+			target, ok := targets[path]
+			return target, ok, nil
+		}, nil
+	}
+
+	onDisk := map[string]*string{}
+	return func(path string) (string, bool, error) {
+		if target, ok := targets[path]; ok {
+			return target, true, nil
+		}
+		if target, ok := onDisk[path]; ok {
+			if target == nil {
+				return "", false, nil
+			}
+			return *target, true, nil
+		}
+		onDisk[path] = nil
+		info, err := fs.Lstat(path)
+		if os.IsNotExist(errors.Cause(err)) {
+			return "", false, nil
+		} else if err != nil {
+			return "", false, errors.Annotatef(err, "Stat %s", path)
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			return "", false, nil
+		}
+		target, err := fs.Readlink(path)
+		if err != nil {
+			return "", false, errors.Annotatef(err, "Read link %s", path)
+		}
+		if e.Symlinks == RootfsSymlinks {
+			if target, err = rootfsTarget(root, path, target); err != nil {
+				return "", false, err
+			}
+		}
+		onDisk[path] = &target
+		return target, true, nil
+	}, nil
+}
+
+// rejectSymlink reports a symlink rejected by the policy, returning the error
+// that stops the extraction if any
+func (e *Extractor) rejectSymlink(path, target string) error {
+	if e.SymlinkRejected == nil {
+		return errors.Annotatef(ErrSymlinkRejected, "Create link %s to %s", path, target)
+	}
+	return e.SymlinkRejected(path, target)
+}
+
+// resolveSymlink returns the path pointed by target, relative to the directory
+// base, following the symlinks found by lookup. It returns false if it goes
+// outside of root, if it's absolute or if there are too many symlinks to follow.
+func resolveSymlink(root string, lookup func(path string) (string, bool, error), base, target string) (string, bool, error) {
+	if isAbsTarget(target) {
+		return "", false, nil
+	}
+	rel, err := filepath.Rel(root, base)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false, nil
+	}
+	pending := append(splitTarget(rel), splitTarget(target)...)
+	resolved, followed := root, 0
+	for len(pending) > 0 {
+		name := pending[0]
+		pending = pending[1:]
+		switch name {
+		case ".":
+			continue
+		case "..":
+			if resolved == root {
+				return "", false, nil
+			}
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+
+		next := filepath.Join(resolved, name)
+		target, ok, err := lookup(next)
+		if err != nil {
+			return "", false, err
+		} else if !ok {
+			resolved = next
+			continue
+		}
+		followed++
+		if followed > maxSymlinks || isAbsTarget(target) {
+			return "", false, nil
+		}
+		// The target is relative to the directory of the symlink, which is
+		// the one resolved so far
+		pending = append(splitTarget(target), pending...)
+	}
+	return resolved, true, nil
+}
+
+// isAbsTarget returns whether the target of a symlink is an absolute path
+func isAbsTarget(target string) bool {
+	return strings.HasPrefix(target, "/") || filepath.IsAbs(target)
+}
+
+// splitTarget returns the names of a symlink target or of a relative path
+func splitTarget(target string) []string {
+	return strings.FieldsFunc(target, func(r rune) bool {
+		return r == '/' || r == filepath.Separator
+	})
+}
+
+// copySymlinks writes a copy of the target of every symlink in its place. The
+// targets containing other symlinks are copied after them, so the copies don't
+// depend on the order of the archive.
+func (e *Extractor) copySymlinks(ctx context.Context, location string, symlinks []*link) error {
+	if len(symlinks) == 0 {
+		return nil
+	}
+	fs, ok := fsAs[OpenFS](e.FS)
+	if !ok {
+		return errors.New("The FS can't read files, so symlinks can't be copied")
+	}
+
+	for len(symlinks) > 0 {
+		pending := []*link{}
+		for _, symlink := range symlinks {
+			select {
+			case <-ctx.Done():
+				return errors.New("interrupted")
+			default:
+			}
+
+			if containsSymlink(symlink.Name, symlinks) {
+				pending = append(pending, symlink)
+				continue
+			}
+			_ = e.FS.Remove(symlink.Path)
+			if err := e.copyFile(ctx, fs, symlink.Name, symlink.Path); os.IsNotExist(errors.Cause(err)) {
+				if err := e.rejectSymlink(symlink.Path, symlink.Name); err != nil {
+					return err
+				}
+			} else if err != nil {
+				return errors.Annotatef(err, "Copy link %s", symlink.Path)
+			}
+		}
+
+		// The symlinks still pending contain each other
+		if len(pending) == len(symlinks) {
+			for _, symlink := range pending {
+				if err := e.rejectSymlink(symlink.Path, symlink.Name); err != nil {
+					return err
+				}
+			}
+			break
+		}
+		symlinks = pending
+	}
+	return nil
+}
+
+// containsSymlink returns whether path is or contains one of the symlinks
+func containsSymlink(path string, symlinks []*link) bool {
+	for _, symlink := range symlinks {
+		if symlink.Path == path || strings.HasPrefix(symlink.Path, path+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// copyFile copies the file or the directory src to dst, skipping the special
+// files and the symlinks inside a directory
+func (e *Extractor) copyFile(ctx context.Context, fs OpenFS, src, dst string) error {
+	info, err := e.FS.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	if info.IsDir() {
+		readDir, ok := fsAs[ReadDirFS](e.FS)
+		if !ok {
+			return errors.New("The FS can't read directories, so they can't be copied")
+		}
+		if err := e.FS.MkdirAll(dst, e.Modes.perm(info.Mode())); err != nil {
+			return errors.Annotatef(err, "Create directory %s", dst)
+		}
+		entries, err := readDir.ReadDir(src)
+		if err != nil {
+			return errors.Annotatef(err, "Read directory %s", src)
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() && !entry.Type().IsRegular() {
+				continue
+			}
+			if err := e.copyFile(ctx, fs, filepath.Join(src, entry.Name()), filepath.Join(dst, entry.Name())); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+
+	r, err := fs.Open(src)
+	if err != nil {
+		return errors.Annotatef(err, "Open file %s", src)
+	}
+	defer r.Close()
+	f, err := e.FS.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, e.Modes.perm(info.Mode()))
+	if err != nil {
+		return errors.Annotatef(err, "Create file %s", dst)
+	}
+	if _, err := copyCancel(ctx, f, r); err != nil {
+		abortFile(f, err)
+		return errors.Annotatef(err, "Copy file %s", dst)
+	}
+	return f.Close()
+}
@@ -0,0 +1,148 @@
+package extract_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/codeclysm/extract/v5"
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSymlinkPolicy(t *testing.T) {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	tw.WriteHeader(&tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755})
+	tw.WriteHeader(&tar.Header{Name: "dir/file.txt", Typeflag: tar.TypeReg, Mode: 0644, Size: 5})
+	tw.Write([]byte("hello"))
+	tw.WriteHeader(&tar.Header{Name: "usr/bin/busybox", Typeflag: tar.TypeReg, Mode: 0755, Size: 4})
+	tw.Write([]byte("echo"))
+	tw.WriteHeader(&tar.Header{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0755})
+	symlinks := map[string]string{
+		"abs":          "/etc/passwd",
+		"up":           "../outside",
+		"file":         "dir/file.txt",
+		"dirlink":      "dir",
+		"dir/parent":   "..",
+		"chain":        "dir/parent/..",
+		"bin/sh":       "/usr/bin/busybox",
+		"dir/dangling": "missing",
+	}
+	for name, target := range symlinks {
+		tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeSymlink, Linkname: target})
+	}
+	tw.Close()
+
+	extractWith := func(t *testing.T, policy extract.SymlinkPolicy) (*extract.MemFS, []string) {
+		mem := &extract.MemFS{}
+		rejected := []string{}
+		extractor := extract.Extractor{
+			FS:       mem,
+			Symlinks: policy,
+			SymlinkRejected: func(path, target string) error {
+				rejected = append(rejected, path)
+				return nil
+			},
+		}
+		require.NoError(t, extractor.Tar(context.Background(), bytes.NewReader(buf.Bytes()), "/out", nil))
+		sort.Strings(rejected)
+		return mem, rejected
+	}
+	readlink := func(t *testing.T, mem *extract.MemFS, path string) string {
+		target, err := mem.Readlink(path)
+		require.NoError(t, err)
+		return target
+	}
+
+	t.Run("Allow", func(t *testing.T) {
+		mem, rejected := extractWith(t, extract.AllowSymlinks)
+		require.Empty(t, rejected)
+		require.Equal(t, "/etc/passwd", readlink(t, mem, "/out/abs"))
+		require.Equal(t, "../outside", readlink(t, mem, "/out/up"))
+	})
+
+	t.Run("RejectAbsolute", func(t *testing.T) {
+		mem, rejected := extractWith(t, extract.RejectAbsoluteSymlinks)
+		require.Equal(t, []string{"/out/abs", "/out/bin/sh"}, rejected)
+		require.Equal(t, "../outside", readlink(t, mem, "/out/up"))
+		_, err := mem.Lstat("/out/abs")
+		require.Error(t, err)
+	})
+
+	t.Run("RejectEscaping", func(t *testing.T) {
+		mem, rejected := extractWith(t, extract.RejectEscapingSymlinks)
+		require.Equal(t, []string{"/out/abs", "/out/bin/sh", "/out/chain", "/out/up"}, rejected)
+		require.Equal(t, "..", readlink(t, mem, "/out/dir/parent"))
+		require.Equal(t, "missing", readlink(t, mem, "/out/dir/dangling"))
+	})
+
+	t.Run("Rootfs", func(t *testing.T) {
+		mem, rejected := extractWith(t, extract.RootfsSymlinks)
+		require.Equal(t, []string{"/out/chain", "/out/up"}, rejected)
+		require.Equal(t, "../usr/bin/busybox", readlink(t, mem, "/out/bin/sh"))
+		require.Equal(t, "etc/passwd", readlink(t, mem, "/out/abs"))
+		data, err := mem.ReadFile("/out/bin/sh")
+		require.NoError(t, err)
+		require.Equal(t, "echo", string(data))
+	})
+
+	t.Run("Copy", func(t *testing.T) {
+		mem, rejected := extractWith(t, extract.CopySymlinks)
+		require.Equal(t, []string{"/out/abs", "/out/bin/sh", "/out/chain", "/out/dir/dangling", "/out/dir/parent", "/out/up"}, rejected)
+		info, err := mem.Lstat("/out/file")
+		require.NoError(t, err)
+		require.Equal(t, os.FileMode(0644), info.Mode())
+		data, err := mem.ReadFile("/out/file")
+		require.NoError(t, err)
+		require.Equal(t, "hello", string(data))
+		info, err = mem.Lstat("/out/dirlink")
+		require.NoError(t, err)
+		require.True(t, info.IsDir())
+		data, err = mem.ReadFile("/out/dirlink/file.txt")
+		require.NoError(t, err)
+		require.Equal(t, "hello", string(data))
+	})
+
+	t.Run("InLocation", func(t *testing.T) {
+		// The symlinks left by a previous extraction are followed too
+		mem := &extract.MemFS{}
+		require.NoError(t, mem.MkdirAll("/out", 0755))
+		require.NoError(t, mem.Symlink(".", "/out/b"))
+		require.NoError(t, mem.Symlink("/", "/out/root"))
+		upper := &bytes.Buffer{}
+		tw := tar.NewWriter(upper)
+		tw.WriteHeader(&tar.Header{Name: "escape", Typeflag: tar.TypeSymlink, Linkname: "b/.."})
+		tw.WriteHeader(&tar.Header{Name: "rootfs", Typeflag: tar.TypeSymlink, Linkname: "root/.."})
+		tw.WriteHeader(&tar.Header{Name: "inside", Typeflag: tar.TypeSymlink, Linkname: "b/b/file.txt"})
+		tw.Close()
+
+		for policy, want := range map[extract.SymlinkPolicy][]string{
+			extract.RejectEscapingSymlinks: {"/out/escape", "/out/rootfs"},
+			extract.RootfsSymlinks:         {"/out/escape", "/out/rootfs"},
+		} {
+			rejected := []string{}
+			extractor := extract.Extractor{
+				FS:       mem,
+				Symlinks: policy,
+				SymlinkRejected: func(path, target string) error {
+					rejected = append(rejected, path)
+					return nil
+				},
+			}
+			require.NoError(t, extractor.Tar(context.Background(), bytes.NewReader(upper.Bytes()), "/out", nil))
+			sort.Strings(rejected)
+			require.Equal(t, want, rejected)
+			require.Equal(t, "b/b/file.txt", readlink(t, mem, "/out/inside"))
+		}
+	})
+
+	t.Run("Error", func(t *testing.T) {
+		extractor := extract.Extractor{FS: &extract.MemFS{}, Symlinks: extract.RejectEscapingSymlinks}
+		err := extractor.Tar(context.Background(), bytes.NewReader(buf.Bytes()), "/out", nil)
+		require.Equal(t, extract.ErrSymlinkRejected, errors.Cause(err))
+	})
+}
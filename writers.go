@@ -0,0 +1,122 @@
+package extract
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/juju/errors"
+)
+
+// defaultWriterMemory is the memory used to buffer the files waiting to be
+// written when WriterMemory is not set
+const defaultWriterMemory = 64 << 20
+
+// writers writes the files of an archive on up to Extractor.Writers goroutines.
+// The same path is never written twice at the same time, and after an error no
+// more files are written.
+type writers struct {
+	e      *Extractor
+	ctx    context.Context
+	max    int
+	memory int64
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	running int
+	used    int64
+	paths   map[string]bool
+	err     error
+}
+
+func (e *Extractor) newWriters(ctx context.Context) *writers {
+	w := &writers{e: e, ctx: ctx, max: e.Writers, memory: e.WriterMemory, paths: map[string]bool{}}
+	if w.memory <= 0 {
+		w.memory = defaultWriterMemory
+	}
+	w.cond = sync.NewCond(&w.mu)
+	return w
+}
+
+// write writes a file on a goroutine, closing src after it if it's an io.Closer.
+// If size is not negative src is read into memory before returning, so that the
+// next file can be read from the same stream; otherwise it's read by the
+// goroutine. The error is the one of a previous file, if any.
+func (w *writers) write(path string, mode os.FileMode, src io.Reader, size int64) error {
+	if w.max <= 1 || size > w.memory {
+		// The files too big to be buffered are written after the others
+		if err := w.wait(); err != nil {
+			closeReader(src)
+			return err
+		}
+		return w.copy(path, mode, src)
+	}
+
+	buffered := max(size, 0)
+	w.mu.Lock()
+	for w.err == nil && (w.running >= w.max || w.paths[path] || w.used+buffered > w.memory) {
+		w.cond.Wait()
+	}
+	if err := w.err; err != nil {
+		w.mu.Unlock()
+		closeReader(src)
+		return err
+	}
+	w.running++
+	w.used += buffered
+	w.paths[path] = true
+	w.mu.Unlock()
+
+	if size >= 0 {
+		data := make([]byte, size)
+		if _, err := io.ReadFull(src, data); err != nil {
+			err = errors.Annotatef(err, "Read file %s", path)
+			w.done(path, buffered, err)
+			return err
+		}
+		src = bytes.NewReader(data)
+	}
+	go func() {
+		w.done(path, buffered, w.copy(path, mode, src))
+	}()
+	return nil
+}
+
+func (w *writers) copy(path string, mode os.FileMode, src io.Reader) error {
+	err := w.e.copy(w.ctx, path, mode, src)
+	closeReader(src)
+	if err != nil {
+		return errors.Annotatef(err, "Create file %s", path)
+	}
+	return nil
+}
+
+func (w *writers) done(path string, buffered int64, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.running--
+	w.used -= buffered
+	delete(w.paths, path)
+	if err != nil && w.err == nil {
+		w.err = err
+	}
+	w.cond.Broadcast()
+}
+
+// wait waits for the files being written, returning the first error
+func (w *writers) wait() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for w.running > 0 {
+		w.cond.Wait()
+	}
+	return w.err
+}
+
+func closeReader(r io.Reader) {
+	if closer, ok := r.(io.Closer); ok {
+		closer.Close()
+	}
+}
@@ -0,0 +1,76 @@
+package extract_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/codeclysm/extract/v5"
+	"github.com/codeclysm/extract/v5/extracttest"
+	"github.com/stretchr/testify/require"
+)
+
+func manyFiles() (map[string]string, Files) {
+	files := map[string]string{}
+	expected := Files{"": "dir", "/dir": "dir"}
+	for i := 0; i < 200; i++ {
+		name := fmt.Sprintf("dir/file%03d.txt", i)
+		files[name] = fmt.Sprintf("File %d", i)
+		expected["/"+name] = files[name]
+	}
+	files["dir/big.txt"] = strings.Repeat("Big file ", 100)
+	expected["/dir/big.txt"] = strings.TrimSpace(files["dir/big.txt"])
+	return files, expected
+}
+
+func TestWriters(t *testing.T) {
+	t.Run("Tar", func(t *testing.T) {
+		files, expected := manyFiles()
+		buf := &bytes.Buffer{}
+		tw := tar.NewWriter(buf)
+		tw.WriteHeader(&tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755})
+		for i := 0; i < 200; i++ {
+			name := fmt.Sprintf("dir/file%03d.txt", i)
+			tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(files[name]))})
+			tw.Write([]byte(files[name]))
+		}
+		tw.WriteHeader(&tar.Header{Name: "dir/big.txt", Mode: 0644, Size: int64(len(files["dir/big.txt"]))})
+		tw.Write([]byte(files["dir/big.txt"]))
+		// The same file twice, the last one wins
+		tw.WriteHeader(&tar.Header{Name: "dir/file000.txt", Mode: 0644, Size: 7})
+		tw.Write([]byte("Rewrite"))
+		tw.WriteHeader(&tar.Header{Name: "dir/link.txt", Typeflag: tar.TypeLink, Linkname: "dir/file001.txt"})
+		tw.WriteHeader(&tar.Header{Name: "dir/symlink.txt", Typeflag: tar.TypeSymlink, Linkname: "file002.txt"})
+		tw.Close()
+		expected["/dir/file000.txt"] = "Rewrite"
+		expected["/dir/link.txt"] = "File 1"
+		expected["/dir/symlink.txt"] = "link"
+
+		tmp := mkTempDir(t)
+		extractor := extract.Extractor{FS: &extracttest.LoggingFS{}, Writers: 8, WriterMemory: 500}
+		require.NoError(t, extractor.Tar(context.Background(), buf, tmp.String(), nil))
+		testWalk(t, tmp.String(), expected)
+	})
+
+	t.Run("Zip", func(t *testing.T) {
+		files, expected := manyFiles()
+		tmp := mkTempDir(t)
+		extractor := extract.Extractor{FS: &extracttest.LoggingFS{}, Writers: 8}
+		require.NoError(t, extractor.Zip(context.Background(), bytes.NewReader(makeZip(files)), tmp.String(), nil))
+		testWalk(t, tmp.String(), expected)
+	})
+
+	t.Run("Error", func(t *testing.T) {
+		files, _ := manyFiles()
+		fs := &extracttest.LoggingFS{Faults: []*extracttest.Fault{extracttest.FailOn("open", "file100.txt")}}
+		extractor := extract.Extractor{FS: fs, Writers: 8}
+		err := extractor.Zip(context.Background(), bytes.NewReader(makeZip(files)), mkTempDir(t).String(), nil)
+		require.ErrorContains(t, err, extracttest.ErrInjected.Error())
+
+		err = extractor.Tar(context.Background(), bytes.NewReader(makeTar(files)), mkTempDir(t).String(), nil)
+		require.ErrorContains(t, err, extracttest.ErrInjected.Error())
+	})
+}
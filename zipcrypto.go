@@ -0,0 +1,197 @@
+package extract
+
+import (
+	"archive/zip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/binary"
+	"hash"
+	"hash/crc32"
+	"io"
+
+	"github.com/juju/errors"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// ErrWrongPassword is the cause of the error returned when an encrypted zip entry
+// can't be decrypted with the given password. Use errors.Cause to check for it.
+var ErrWrongPassword = errors.New("Wrong password")
+
+const (
+	zipFlagEncrypted      = 0x1
+	zipFlagDataDescriptor = 0x8
+	zipMethodAes          = 99
+	zipExtraAes           = 0x9901
+)
+
+// decryptZip returns the decrypted data of an encrypted zip entry, together with
+// the actual compression method and whether the crc has to be verified
+func (e *Extractor) decryptZip(header *zip.File, name string, raw io.Reader) (io.Reader, uint16, bool, error) {
+	if e.Password == nil {
+		return nil, 0, false, errors.New("Encrypted file, a password is needed")
+	}
+	password, err := e.Password(name)
+	if err != nil {
+		return nil, 0, false, err
+	}
+
+	if header.Method == zipMethodAes {
+		version, strength, method, err := zipAesExtra(header.Extra)
+		if err != nil {
+			return nil, 0, false, err
+		}
+		decrypted, err := newZipAesReader(raw, int64(header.CompressedSize64), []byte(password), strength)
+		// AE-2 doesn't store the crc, the hmac is enough to spot corrupted data
+		return decrypted, method, version == 1, err
+	}
+
+	// The last byte of the encryption header is checked against the crc, or
+	// against the modification time if the crc was unknown when writing
+	check := byte(header.CRC32 >> 24)
+	if header.Flags&zipFlagDataDescriptor != 0 {
+		check = byte(header.ModifiedTime >> 8)
+	}
+	decrypted, err := newZipCryptoReader(raw, []byte(password), check)
+	return decrypted, header.Method, true, err
+}
+
+// zipCryptoReader decrypts the traditional PKWARE encryption
+type zipCryptoReader struct {
+	r    io.Reader
+	keys [3]uint32
+}
+
+func newZipCryptoReader(r io.Reader, password []byte, check byte) (io.Reader, error) {
+	z := &zipCryptoReader{r: r, keys: [3]uint32{0x12345678, 0x23456789, 0x34567890}}
+	for _, b := range password {
+		z.update(b)
+	}
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(z, header); err != nil {
+		return nil, errors.Annotatef(err, "Read encryption header")
+	}
+	if header[11] != check {
+		return nil, ErrWrongPassword
+	}
+	return z, nil
+}
+
+func (z *zipCryptoReader) update(b byte) {
+	z.keys[0] = crc32.IEEETable[byte(z.keys[0])^b] ^ z.keys[0]>>8
+	z.keys[1] = (z.keys[1]+z.keys[0]&0xff)*134775813 + 1
+	z.keys[2] = crc32.IEEETable[byte(z.keys[2])^byte(z.keys[1]>>24)] ^ z.keys[2]>>8
+}
+
+func (z *zipCryptoReader) Read(p []byte) (int, error) {
+	n, err := z.r.Read(p)
+	for i := 0; i < n; i++ {
+		temp := uint16(z.keys[2] | 2)
+		p[i] ^= byte(uint32(temp) * uint32(temp^1) >> 8)
+		z.update(p[i])
+	}
+	return n, err
+}
+
+// zipAesExtra parses the WinZip AES extra field, returning the version (AE-1 or
+// AE-2), the key strength and the actual compression method
+func zipAesExtra(extra []byte) (version uint16, strength byte, method uint16, err error) {
+	for len(extra) >= 4 {
+		id := binary.LittleEndian.Uint16(extra)
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+		extra = extra[4:]
+		if size > len(extra) {
+			break
+		}
+		if id == zipExtraAes && size >= 7 {
+			version = binary.LittleEndian.Uint16(extra)
+			strength = extra[4]
+			method = binary.LittleEndian.Uint16(extra[5:])
+			if version < 1 || version > 2 || strength < 1 || strength > 3 {
+				return 0, 0, 0, errors.New("Unsupported AES encryption")
+			}
+			return version, strength, method, nil
+		}
+		extra = extra[size:]
+	}
+	return 0, 0, 0, errors.New("Missing AES extra field")
+}
+
+// zipAesReader decrypts the WinZip AES encryption, verifying the authentication
+// code at the end of the data
+type zipAesReader struct {
+	raw    io.Reader
+	data   io.Reader
+	stream cipher.Stream
+	mac    hash.Hash
+}
+
+func newZipAesReader(raw io.Reader, size int64, password []byte, strength byte) (io.Reader, error) {
+	keyLen := 8 + 8*int(strength)
+	saltLen := keyLen / 2
+	if size < int64(saltLen+2+10) {
+		return nil, errors.New("Corrupted AES encrypted file")
+	}
+	salt := make([]byte, saltLen+2)
+	if _, err := io.ReadFull(raw, salt); err != nil {
+		return nil, errors.Annotatef(err, "Read encryption header")
+	}
+	keys := pbkdf2.Key(password, salt[:saltLen], 1000, 2*keyLen+2, sha1.New)
+	if subtle.ConstantTimeCompare(keys[2*keyLen:], salt[saltLen:]) != 1 {
+		return nil, ErrWrongPassword
+	}
+	block, err := aes.NewCipher(keys[:keyLen])
+	if err != nil {
+		return nil, err
+	}
+	return &zipAesReader{
+		raw:    raw,
+		data:   io.LimitReader(raw, size-int64(saltLen+2+10)),
+		stream: &zipAesCtr{block: block, pos: aes.BlockSize},
+		mac:    hmac.New(sha1.New, keys[keyLen:2*keyLen]),
+	}, nil
+}
+
+func (z *zipAesReader) Read(p []byte) (int, error) {
+	n, err := z.data.Read(p)
+	z.mac.Write(p[:n])
+	z.stream.XORKeyStream(p[:n], p[:n])
+	if err == io.EOF {
+		code := make([]byte, 10)
+		if _, err := io.ReadFull(z.raw, code); err != nil {
+			return n, errors.Annotatef(err, "Read authentication code")
+		}
+		if !hmac.Equal(code, z.mac.Sum(nil)[:10]) {
+			return n, errors.New("Authentication of the encrypted data failed")
+		}
+	}
+	return n, err
+}
+
+// zipAesCtr is the CTR mode used by WinZip, where the counter is little endian
+// and starts from 1
+type zipAesCtr struct {
+	block   cipher.Block
+	counter [aes.BlockSize]byte
+	key     [aes.BlockSize]byte
+	pos     int
+}
+
+func (c *zipAesCtr) XORKeyStream(dst, src []byte) {
+	for i := range src {
+		if c.pos == aes.BlockSize {
+			for j := range c.counter {
+				c.counter[j]++
+				if c.counter[j] != 0 {
+					break
+				}
+			}
+			c.block.Encrypt(c.key[:], c.counter[:])
+			c.pos = 0
+		}
+		dst[i] = src[i] ^ c.key[c.pos]
+		c.pos++
+	}
+}
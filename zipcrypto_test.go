@@ -0,0 +1,199 @@
+package extract_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"testing"
+
+	"github.com/codeclysm/extract/v5"
+	"github.com/codeclysm/extract/v5/extracttest"
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/text/encoding/charmap"
+)
+
+// makeAesZip builds a zip archive where every file is deflated and then encrypted
+// with WinZip AES, using the password returned by password
+func makeAesZip(files map[string]string, version uint16, strength byte, password func(string) string) []byte {
+	buf := &bytes.Buffer{}
+	w := zip.NewWriter(buf)
+	for name, data := range files {
+		compressed := &bytes.Buffer{}
+		fw, _ := flate.NewWriter(compressed, flate.BestCompression)
+		fw.Write([]byte(data))
+		fw.Close()
+
+		keyLen := 8 + 8*int(strength)
+		salt := bytes.Repeat([]byte{strength}, keyLen/2)
+		keys := pbkdf2.Key([]byte(password(name)), salt, 1000, 2*keyLen+2, sha1.New)
+		block, _ := aes.NewCipher(keys[:keyLen])
+		encrypted := compressed.Bytes()
+		counter, stream := make([]byte, 16), make([]byte, 16)
+		for i := range encrypted {
+			if i%16 == 0 {
+				binary.LittleEndian.PutUint64(counter, uint64(i/16+1))
+				block.Encrypt(stream, counter)
+			}
+			encrypted[i] ^= stream[i%16]
+		}
+		mac := hmac.New(sha1.New, keys[keyLen:2*keyLen])
+		mac.Write(encrypted)
+
+		extra := []byte{0x01, 0x99, 7, 0, byte(version), 0, 'A', 'E', strength, byte(zip.Deflate), 0}
+		header := &zip.FileHeader{
+			Name:               name,
+			Method:             99,
+			Flags:              0x1,
+			Extra:              extra,
+			CompressedSize64:   uint64(len(salt) + 2 + len(encrypted) + 10),
+			UncompressedSize64: uint64(len(data)),
+		}
+		if version == 1 {
+			header.CRC32 = crc32.ChecksumIEEE([]byte(data))
+		}
+		header.SetMode(0644)
+		raw, _ := w.CreateRaw(header)
+		raw.Write(salt)
+		raw.Write(keys[2*keyLen:])
+		raw.Write(encrypted)
+		raw.Write(mac.Sum(nil)[:10])
+	}
+	w.Close()
+	return buf.Bytes()
+}
+
+func password(p string) func(string) (string, error) {
+	return func(string) (string, error) {
+		return p, nil
+	}
+}
+
+func TestZipEncrypted(t *testing.T) {
+	t.Run("ZipCrypto", func(t *testing.T) {
+		tmp := mkTempDir(t)
+		f, err := os.Open("testdata/archive-encrypted.zip")
+		require.NoError(t, err)
+		defer f.Close()
+
+		extractor := extract.Extractor{FS: &extracttest.LoggingFS{}, Password: password("secret")}
+		require.NoError(t, extractor.Zip(context.Background(), f, tmp.String(), nil))
+		testWalk(t, tmp.String(), Files{
+			"":                          "dir",
+			"/archive":                  "dir",
+			"/archive/folder":           "dir",
+			"/archive/folderlink":       "link",
+			"/archive/folder/file1.txt": "folder/File1",
+			"/archive/file1.txt":        "File1",
+			"/archive/file2.txt":        "File2",
+			"/archive/link.txt":         "File1",
+		})
+	})
+
+	t.Run("ZipCryptoWrongPassword", func(t *testing.T) {
+		tmp := mkTempDir(t)
+		f, err := os.Open("testdata/archive-encrypted.zip")
+		require.NoError(t, err)
+		defer f.Close()
+
+		extractor := extract.Extractor{FS: &extracttest.LoggingFS{}, Password: password("wrong")}
+		err = extractor.Zip(context.Background(), f, tmp.String(), nil)
+		require.Error(t, err)
+		require.Equal(t, extract.ErrWrongPassword, errors.Cause(err))
+	})
+
+	t.Run("NoPassword", func(t *testing.T) {
+		tmp := mkTempDir(t)
+		f, err := os.Open("testdata/archive-encrypted.zip")
+		require.NoError(t, err)
+		defer f.Close()
+
+		require.Error(t, extract.Zip(context.Background(), f, tmp.String(), nil))
+	})
+
+	files := map[string]string{
+		"file1.txt":        "File1",
+		"folder/file2.txt": string(bytes.Repeat([]byte("File2"), 1000)),
+	}
+	for _, test := range []struct {
+		name     string
+		version  uint16
+		strength byte
+	}{
+		{"AE-1/AES-128", 1, 1},
+		{"AE-2/AES-192", 2, 2},
+		{"AE-2/AES-256", 2, 3},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			tmp := mkTempDir(t)
+			archive := makeAesZip(files, test.version, test.strength, func(string) string { return "secret" })
+			extractor := extract.Extractor{FS: &extracttest.LoggingFS{}, Password: password("secret")}
+			require.NoError(t, extractor.Zip(context.Background(), bytes.NewReader(archive), tmp.String(), nil))
+			testWalk(t, tmp.String(), Files{
+				"":                  "dir",
+				"/file1.txt":        "File1",
+				"/folder":           "dir",
+				"/folder/file2.txt": files["folder/file2.txt"],
+			})
+		})
+	}
+
+	t.Run("AesPasswordPerEntry", func(t *testing.T) {
+		tmp := mkTempDir(t)
+		passwords := map[string]string{"file1.txt": "one", "folder/file2.txt": "two"}
+		archive := makeAesZip(files, 2, 3, func(name string) string { return passwords[name] })
+		extractor := extract.Extractor{FS: &extracttest.LoggingFS{}, Password: func(name string) (string, error) {
+			return passwords[name], nil
+		}}
+		require.NoError(t, extractor.Zip(context.Background(), bytes.NewReader(archive), tmp.String(), nil))
+		require.FileExists(t, tmp.Join("folder", "file2.txt").String())
+	})
+
+	t.Run("AesDecodedName", func(t *testing.T) {
+		// The name is given to Password as it's extracted, decoded from CP437
+		tmp := mkTempDir(t)
+		archive := makeAesZip(map[string]string{"caf\x82.txt": "File"}, 2, 3, func(string) string { return "secret" })
+		names := []string{}
+		extractor := extract.Extractor{
+			FS:          &extracttest.LoggingFS{},
+			ZipEncoding: charmap.CodePage437,
+			Password: func(name string) (string, error) {
+				names = append(names, name)
+				return "secret", nil
+			},
+		}
+		require.NoError(t, extractor.Zip(context.Background(), bytes.NewReader(archive), tmp.String(), nil))
+		require.Equal(t, []string{"café.txt"}, names)
+		require.FileExists(t, tmp.Join("café.txt").String())
+	})
+
+	t.Run("AesWrongPassword", func(t *testing.T) {
+		tmp := mkTempDir(t)
+		archive := makeAesZip(files, 2, 3, func(string) string { return "secret" })
+		extractor := extract.Extractor{FS: &extracttest.LoggingFS{}, Password: password("wrong")}
+		err := extractor.Zip(context.Background(), bytes.NewReader(archive), tmp.String(), nil)
+		require.Error(t, err)
+		require.Equal(t, extract.ErrWrongPassword, errors.Cause(err))
+	})
+
+	t.Run("AesTampered", func(t *testing.T) {
+		tmp := mkTempDir(t)
+		archive := makeAesZip(map[string]string{"file1.txt": "File1"}, 2, 1, func(string) string { return "secret" })
+		// The encrypted data starts after the local header, the salt and the
+		// password verification value
+		archive[30+len("file1.txt")+11+8+2] ^= 0xff
+		extractor := extract.Extractor{FS: &extracttest.LoggingFS{}, Password: password("secret")}
+		err := extractor.Zip(context.Background(), bytes.NewReader(archive), tmp.String(), nil)
+		require.Error(t, err)
+		require.NotEqual(t, extract.ErrWrongPassword, errors.Cause(err))
+		require.NoFileExists(t, tmp.Join("file1.txt").String())
+	})
+}
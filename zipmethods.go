@@ -0,0 +1,158 @@
+package extract
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/bzip2"
+	"compress/flate"
+	"encoding/binary"
+	"hash"
+	"hash/crc32"
+	"io"
+
+	"github.com/juju/errors"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+	"github.com/ulikunitz/xz/lzma"
+)
+
+const (
+	zipMethodDeflate64 = 9
+	zipMethodBzip2     = 12
+	zipMethodLzma      = 14
+	zipMethodZstd      = 93
+	zipMethodXz        = 95
+
+	zipFlagLzmaEOS = 0x2
+)
+
+// zipDecompressor returns a reader for the uncompressed data of a zip entry
+type zipDecompressor func(r io.Reader, header *zip.File) (io.ReadCloser, error)
+
+// zipDecompressors contains the compression methods supported for the entries
+// that archive/zip can't open by itself
+var zipDecompressors = map[uint16]zipDecompressor{
+	zip.Store: func(r io.Reader, header *zip.File) (io.ReadCloser, error) {
+		return io.NopCloser(r), nil
+	},
+	zip.Deflate: func(r io.Reader, header *zip.File) (io.ReadCloser, error) {
+		return flate.NewReader(r), nil
+	},
+	zipMethodDeflate64: func(r io.Reader, header *zip.File) (io.ReadCloser, error) {
+		return io.NopCloser(newDeflate64Reader(r)), nil
+	},
+	zipMethodBzip2: func(r io.Reader, header *zip.File) (io.ReadCloser, error) {
+		return io.NopCloser(bzip2.NewReader(r)), nil
+	},
+	zipMethodLzma: func(r io.Reader, header *zip.File) (io.ReadCloser, error) {
+		// The data starts with the version of the lzma sdk and the properties, while
+		// the size is given by the zip header or by the end of stream marker
+		info := make([]byte, 4)
+		if _, err := io.ReadFull(r, info); err != nil {
+			return nil, errors.Annotatef(err, "Read lzma header")
+		}
+		properties := make([]byte, binary.LittleEndian.Uint16(info[2:]))
+		if len(properties) != 5 {
+			return nil, errors.New("Invalid lzma properties")
+		}
+		if _, err := io.ReadFull(r, properties); err != nil {
+			return nil, errors.Annotatef(err, "Read lzma header")
+		}
+		size := header.UncompressedSize64
+		if header.Flags&zipFlagLzmaEOS != 0 {
+			size = 0xffffffffffffffff
+		}
+		classic := binary.LittleEndian.AppendUint64(properties, size)
+		lr, err := lzma.NewReader(io.MultiReader(bytes.NewReader(classic), r))
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(lr), nil
+	},
+	zipMethodZstd: func(r io.Reader, header *zip.File) (io.ReadCloser, error) {
+		zr, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	},
+	zipMethodXz: func(r io.Reader, header *zip.File) (io.ReadCloser, error) {
+		xr, err := xz.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(xr), nil
+	},
+}
+
+// openZip opens an entry of a zip archive, decrypting and decompressing it if
+// archive/zip can't. The name is the decoded one, given to Password.
+func (e *Extractor) openZip(header *zip.File, name string) (io.ReadCloser, error) {
+	encrypted := header.Flags&zipFlagEncrypted != 0
+	if !encrypted && (header.Method == zip.Store || header.Method == zip.Deflate) {
+		return header.Open()
+	}
+	raw, err := header.OpenRaw()
+	if err != nil {
+		return nil, err
+	}
+	return e.decodeZip(header, name, raw)
+}
+
+// decodeZip decrypts and decompresses the raw data of an entry of a zip archive
+func (e *Extractor) decodeZip(header *zip.File, name string, raw io.Reader) (io.ReadCloser, error) {
+	data, method, checkCRC := raw, header.Method, true
+	if header.Flags&zipFlagEncrypted != 0 {
+		var err error
+		if data, method, checkCRC, err = e.decryptZip(header, name, raw); err != nil {
+			return nil, err
+		}
+	}
+
+	decompressor, ok := zipDecompressors[method]
+	if !ok {
+		return nil, errors.Annotatef(zip.ErrAlgorithm, "Compression method %d", method)
+	}
+	r, err := decompressor(data, header)
+	if err != nil {
+		return nil, errors.Annotatef(err, "Compression method %d", method)
+	}
+	r = &zipSizeReader{ReadCloser: r, left: header.UncompressedSize64}
+	if !checkCRC {
+		return r, nil
+	}
+	return &zipChecksumReader{ReadCloser: r, hash: crc32.NewIEEE(), want: header.CRC32}, nil
+}
+
+// zipSizeReader fails as soon as the data is longer than the declared size, like
+// archive/zip does, so that a bomb isn't written in full before its crc fails
+type zipSizeReader struct {
+	io.ReadCloser
+	left uint64
+}
+
+func (r *zipSizeReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if uint64(n) > r.left {
+		n, r.left = int(r.left), 0
+		return n, zip.ErrFormat
+	}
+	r.left -= uint64(n)
+	return n, err
+}
+
+// zipChecksumReader verifies the crc of the data when the end is reached
+type zipChecksumReader struct {
+	io.ReadCloser
+	hash hash.Hash32
+	want uint32
+}
+
+func (r *zipChecksumReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.hash.Write(p[:n])
+	if err == io.EOF && r.hash.Sum32() != r.want {
+		return n, zip.ErrChecksum
+	}
+	return n, err
+}
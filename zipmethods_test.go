@@ -0,0 +1,289 @@
+package extract_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"context"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/codeclysm/extract/v5"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/require"
+	"github.com/ulikunitz/xz"
+	"github.com/ulikunitz/xz/lzma"
+)
+
+// makeRawZip builds a zip archive with already compressed entries
+func makeRawZip(method uint16, files map[string][2]string) []byte {
+	buf := &bytes.Buffer{}
+	w := zip.NewWriter(buf)
+	for name, file := range files {
+		data, compressed := file[0], file[1]
+		header := &zip.FileHeader{
+			Name:               name,
+			Method:             method,
+			CRC32:              crc32.ChecksumIEEE([]byte(data)),
+			CompressedSize64:   uint64(len(compressed)),
+			UncompressedSize64: uint64(len(data)),
+		}
+		header.SetMode(0644)
+		raw, _ := w.CreateRaw(header)
+		raw.Write([]byte(compressed))
+	}
+	w.Close()
+	return buf.Bytes()
+}
+
+// canonicalCodes returns the canonical huffman codes for the given lengths
+func canonicalCodes(lengths []uint) []uint32 {
+	count := make([]uint32, 16)
+	for _, n := range lengths {
+		count[n]++
+	}
+	count[0] = 0
+	next := make([]uint32, 16)
+	for n := 1; n < 16; n++ {
+		next[n] = (next[n-1] + count[n-1]) << 1
+	}
+	codes := make([]uint32, len(lengths))
+	for symbol, n := range lengths {
+		if n > 0 {
+			codes[symbol] = next[n]
+			next[n]++
+		}
+	}
+	return codes
+}
+
+// deflate64Match encodes data in a single block of deflate64, made of literals
+// followed by a match of length bytes at distance len(data), that needs the
+// bigger window and the longer lengths of deflate64. The block uses the fixed
+// huffman codes, or dynamic ones written in its header.
+func deflate64Match(data []byte, length int, dynamic bool) []byte {
+	out := []byte{}
+	var bits uint32
+	var nbits uint
+	write := func(value uint32, n uint) {
+		bits |= value << nbits
+		nbits += n
+		for nbits >= 8 {
+			out = append(out, byte(bits))
+			bits >>= 8
+			nbits -= 8
+		}
+	}
+	// Huffman codes are written starting from the most significant bit
+	code := func(value uint32, n uint) {
+		reversed := uint32(0)
+		for i := uint(0); i < n; i++ {
+			reversed = reversed<<1 | value>>i&1
+		}
+		write(reversed, n)
+	}
+	literal := func(v int) {
+		switch {
+		case v < 144:
+			code(uint32(0x30+v), 8)
+		case v < 256:
+			code(uint32(0x190+v-144), 9)
+		case v < 280:
+			code(uint32(v-256), 7)
+		default:
+			code(uint32(0xc0+v-280), 8)
+		}
+	}
+
+	write(1, 1) // final
+	if !dynamic {
+		write(1, 2) // fixed huffman codes
+	} else {
+		write(2, 2) // dynamic huffman codes
+		// The literals take 9 bits, the end of block and the longest length 5
+		// bits and the other lengths 6 bits, while all the 32 distances of
+		// deflate64 take 5 bits
+		lengths := make([]uint, 286+32)
+		for i := range lengths {
+			switch {
+			case i < 256:
+				lengths[i] = 9
+			case i == 256 || i == 285:
+				lengths[i] = 5
+			case i < 286:
+				lengths[i] = 6
+			default:
+				lengths[i] = 5
+			}
+		}
+		codes := canonicalCodes(lengths[:286])
+		literal = func(v int) {
+			code(codes[v], lengths[v])
+		}
+
+		// The lengths are written with the codes 5, 6 and 9 of the code
+		// lengths alphabet, which take 1, 2 and 2 bits
+		order := []int{16, 17, 18, 0, 8, 7, 9, 6, 10, 5}
+		clLengths := make([]uint, 19)
+		clLengths[5], clLengths[6], clLengths[9] = 1, 2, 2
+		clCodes := canonicalCodes(clLengths)
+		write(286-257, 5)
+		write(32-1, 5)
+		write(uint32(len(order)-4), 4)
+		for _, symbol := range order {
+			write(uint32(clLengths[symbol]), 3)
+		}
+		for _, n := range lengths {
+			code(clCodes[n], clLengths[n])
+		}
+	}
+	for _, b := range data {
+		literal(int(b))
+	}
+	literal(285)
+	write(uint32(length-3), 16)
+	code(30, 5)
+	write(uint32(len(data)-32769), 14)
+	literal(256)
+	write(0, 7)
+	return out
+}
+
+func TestZipMethods(t *testing.T) {
+	content := strings.Repeat("Compressed ", 500)
+	// testWalk trims the content of the files
+	trimmed := strings.TrimSpace(content)
+
+	t.Run("Fixture", func(t *testing.T) {
+		tmp := mkTempDir(t)
+		f, err := os.Open("testdata/methods.zip")
+		require.NoError(t, err)
+		defer f.Close()
+
+		require.NoError(t, extract.Zip(context.Background(), f, tmp.String(), nil))
+		testWalk(t, tmp.String(), Files{
+			"":           "dir",
+			"/bzip2.txt": trimmed,
+			"/lzma.txt":  trimmed,
+		})
+	})
+
+	t.Run("Deflate64", func(t *testing.T) {
+		data := make([]byte, 40000)
+		for i, seed := 0, uint32(1); i < len(data); i++ {
+			seed = seed*1103515245 + 12345
+			data[i] = byte(seed >> 16)
+		}
+		expected := string(data) + string(data[:1000])
+		archive := makeRawZip(9, map[string][2]string{
+			"fixed.bin":   {expected, string(deflate64Match(data, 1000, false))},
+			"dynamic.bin": {expected, string(deflate64Match(data, 1000, true))},
+		})
+
+		tmp := mkTempDir(t)
+		require.NoError(t, extract.Zip(context.Background(), bytes.NewReader(archive), tmp.String(), nil))
+		testWalk(t, tmp.String(), Files{
+			"":             "dir",
+			"/fixed.bin":   expected,
+			"/dynamic.bin": expected,
+		})
+	})
+
+	t.Run("Deflate64Dynamic", func(t *testing.T) {
+		// Without matches of 258 bytes a deflate stream is a valid deflate64 one
+		lines := &strings.Builder{}
+		for i := 0; i < 5000; i++ {
+			fmt.Fprintf(lines, "line %d\n", i*7919%10007)
+		}
+		buf := &bytes.Buffer{}
+		w, _ := flate.NewWriter(buf, flate.BestCompression)
+		w.Write([]byte(lines.String()))
+		w.Close()
+		archive := makeRawZip(9, map[string][2]string{"file.txt": {lines.String(), buf.String()}})
+
+		tmp := mkTempDir(t)
+		require.NoError(t, extract.Zip(context.Background(), bytes.NewReader(archive), tmp.String(), nil))
+		testWalk(t, tmp.String(), Files{
+			"":          "dir",
+			"/file.txt": strings.TrimSpace(lines.String()),
+		})
+	})
+
+	compress := func(w interface {
+		Write([]byte) (int, error)
+		Close() error
+	}, buf *bytes.Buffer) string {
+		w.Write([]byte(content))
+		w.Close()
+		return buf.String()
+	}
+
+	t.Run("Lzma", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		w, err := lzma.WriterConfig{Size: int64(len(content))}.NewWriter(buf)
+		require.NoError(t, err)
+		classic := compress(w, buf)
+		// The zip format replaces the size in the header with the sdk version
+		compressed := "\x10\x02\x05\x00" + classic[:5] + classic[13:]
+		archive := makeRawZip(14, map[string][2]string{"file.txt": {content, compressed}})
+
+		tmp := mkTempDir(t)
+		require.NoError(t, extract.Zip(context.Background(), bytes.NewReader(archive), tmp.String(), nil))
+		testWalk(t, tmp.String(), Files{
+			"":          "dir",
+			"/file.txt": trimmed,
+		})
+	})
+
+	t.Run("Zstd", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		w, err := zstd.NewWriter(buf)
+		require.NoError(t, err)
+		archive := makeRawZip(93, map[string][2]string{"file.txt": {content, compress(w, buf)}})
+
+		tmp := mkTempDir(t)
+		require.NoError(t, extract.Zip(context.Background(), bytes.NewReader(archive), tmp.String(), nil))
+		testWalk(t, tmp.String(), Files{
+			"":          "dir",
+			"/file.txt": trimmed,
+		})
+	})
+
+	t.Run("Xz", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		w, err := xz.NewWriter(buf)
+		require.NoError(t, err)
+		archive := makeRawZip(95, map[string][2]string{"file.txt": {content, compress(w, buf)}})
+
+		tmp := mkTempDir(t)
+		require.NoError(t, extract.Zip(context.Background(), bytes.NewReader(archive), tmp.String(), nil))
+		testWalk(t, tmp.String(), Files{
+			"":          "dir",
+			"/file.txt": trimmed,
+		})
+	})
+
+	t.Run("Bomb", func(t *testing.T) {
+		// The data is longer than the declared size, it's not written in full
+		buf := &bytes.Buffer{}
+		w, err := zstd.NewWriter(buf)
+		require.NoError(t, err)
+		w.Write(make([]byte, 8<<20))
+		archive := makeRawZip(93, map[string][2]string{"file.txt": {"short", compress(w, buf)}})
+
+		tmp := mkTempDir(t)
+		err = extract.Zip(context.Background(), bytes.NewReader(archive), tmp.String(), nil)
+		require.ErrorContains(t, err, zip.ErrFormat.Error())
+		require.NoFileExists(t, tmp.Join("file.txt").String())
+	})
+
+	t.Run("Unsupported", func(t *testing.T) {
+		archive := makeRawZip(97, map[string][2]string{"file.txt": {content, content}})
+		tmp := mkTempDir(t)
+		err := extract.Zip(context.Background(), bytes.NewReader(archive), tmp.String(), nil)
+		require.ErrorContains(t, err, "method 97")
+	})
+}
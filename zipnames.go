@@ -0,0 +1,123 @@
+package extract
+
+import (
+	"archive/zip"
+	"encoding/binary"
+	"hash/crc32"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/japanese"
+)
+
+const (
+	zipFlagUTF8          = 0x800
+	zipExtraUnicodePath  = 0x7075
+	zipUnicodePathLength = 5
+)
+
+// zipNames decodes the names of the entries of a zip archive. The names are
+// taken from the Info-ZIP Unicode Path extra field if present, and used as they
+// are if they are flagged as UTF-8. The other ones are decoded with the given
+// encoding, or with the guessed one if it's nil.
+func zipNames(files []*zip.File, enc encoding.Encoding) map[*zip.File]string {
+	names := map[*zip.File]string{}
+	legacy := []*zip.File{}
+	for _, header := range files {
+		if name, ok := zipUnicodePath(header); ok {
+			names[header] = name
+		} else if header.Flags&zipFlagUTF8 != 0 || (enc == nil && utf8.ValidString(header.Name)) {
+			names[header] = header.Name
+		} else {
+			legacy = append(legacy, header)
+		}
+	}
+	if len(legacy) == 0 {
+		return names
+	}
+
+	if enc == nil {
+		enc = guessZipEncoding(legacy)
+	}
+	decoder := enc.NewDecoder()
+	for _, header := range legacy {
+		name, err := decoder.String(header.Name)
+		if err != nil {
+			name = header.Name
+		}
+		names[header] = name
+	}
+	return names
+}
+
+// zipUnicodePath returns the name stored in the Unicode Path extra field, if it
+// was written for the current name
+func zipUnicodePath(header *zip.File) (string, bool) {
+	extra := header.Extra
+	for len(extra) >= 4 {
+		id := binary.LittleEndian.Uint16(extra)
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+		extra = extra[4:]
+		if size > len(extra) {
+			break
+		}
+		field := extra[:size]
+		extra = extra[size:]
+		if id != zipExtraUnicodePath || size < zipUnicodePathLength || field[0] != 1 {
+			continue
+		}
+		if binary.LittleEndian.Uint32(field[1:]) != crc32.ChecksumIEEE([]byte(header.Name)) {
+			continue
+		}
+		if name := string(field[zipUnicodePathLength:]); utf8.ValidString(name) {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// guessZipEncoding chooses between Shift-JIS, used by the Japanese versions of
+// Windows, and CP437, the original encoding of zip. CP437 can decode any sequence
+// of bytes, so Shift-JIS is chosen only if all the names are valid in it and they
+// don't look like CP437 text, where the non ASCII characters are accented letters.
+func guessZipEncoding(files []*zip.File) encoding.Encoding {
+	onlyLetters := true
+	for _, header := range files {
+		if !validShiftJIS(header.Name) {
+			return charmap.CodePage437
+		}
+		for i := 0; i < len(header.Name); i++ {
+			if b := header.Name[i]; b > 0xa5 && b != 0xe1 {
+				onlyLetters = false
+			}
+		}
+	}
+	if onlyLetters {
+		return charmap.CodePage437
+	}
+	return japanese.ShiftJIS
+}
+
+// validShiftJIS checks that every byte of name is part of a valid Shift-JIS
+// character
+func validShiftJIS(name string) bool {
+	for i := 0; i < len(name); i++ {
+		b := name[i]
+		switch {
+		case b < 0x80 || (b >= 0xa1 && b <= 0xdf):
+			// ASCII and half-width katakana
+		case (b >= 0x81 && b <= 0x9f) || (b >= 0xe0 && b <= 0xfc):
+			if i+1 >= len(name) {
+				return false
+			}
+			i++
+			if trail := name[i]; trail < 0x40 || trail == 0x7f || trail > 0xfc {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,82 @@
+package extract_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+
+	"github.com/codeclysm/extract/v5"
+	"github.com/codeclysm/extract/v5/extracttest"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/japanese"
+)
+
+// makeLegacyZip builds a zip archive with the names stored as they are, without
+// the UTF-8 flag. If unicode isn't empty the names are also stored in the Unicode
+// Path extra field, together with the checksum of the name they were written for.
+func makeLegacyZip(names []string, unicode [][2]string) []byte {
+	buf := &bytes.Buffer{}
+	w := zip.NewWriter(buf)
+	for i, name := range names {
+		header := &zip.FileHeader{Name: name, Method: zip.Store, NonUTF8: true}
+		if unicode != nil {
+			field := []byte{1}
+			field = binary.LittleEndian.AppendUint32(field, crc32.ChecksumIEEE([]byte(unicode[i][0])))
+			field = append(field, unicode[i][1]...)
+			header.Extra = binary.LittleEndian.AppendUint16(binary.LittleEndian.AppendUint16(nil, 0x7075), uint16(len(field)))
+			header.Extra = append(header.Extra, field...)
+		}
+		header.SetMode(0644)
+		f, _ := w.CreateHeader(header)
+		f.Write([]byte("content"))
+	}
+	w.Close()
+	return buf.Bytes()
+}
+
+func TestZipNames(t *testing.T) {
+	shiftJIS, _ := japanese.ShiftJIS.NewEncoder().String("日本語のファイル.txt")
+	cp437, _ := charmap.CodePage437.NewEncoder().String("Über-größe.txt")
+	mojibake, _ := charmap.CodePage437.NewDecoder().String(shiftJIS)
+
+	for _, test := range []struct {
+		name     string
+		archive  []byte
+		extract  extract.Extractor
+		expected Files
+	}{
+		{"GuessShiftJIS", makeLegacyZip([]string{shiftJIS, "ascii.txt"}, nil), extract.Extractor{}, Files{
+			"":              "dir",
+			"/日本語のファイル.txt": "content",
+			"/ascii.txt":    "content",
+		}},
+		{"GuessCP437", makeLegacyZip([]string{cp437}, nil), extract.Extractor{}, Files{
+			"":                "dir",
+			"/Über-größe.txt": "content",
+		}},
+		{"ChosenEncoding", makeLegacyZip([]string{shiftJIS}, nil), extract.Extractor{ZipEncoding: charmap.CodePage437}, Files{
+			"":             "dir",
+			"/" + mojibake: "content",
+		}},
+		{"UnicodePath", makeLegacyZip([]string{cp437}, [][2]string{{cp437, "Über-größe.txt"}}), extract.Extractor{ZipEncoding: japanese.ShiftJIS}, Files{
+			"":                "dir",
+			"/Über-größe.txt": "content",
+		}},
+		{"StaleUnicodePath", makeLegacyZip([]string{"renamed.txt"}, [][2]string{{"original.txt", "Über-größe.txt"}}), extract.Extractor{}, Files{
+			"":             "dir",
+			"/renamed.txt": "content",
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			tmp := mkTempDir(t)
+			extractor := test.extract
+			extractor.FS = &extracttest.LoggingFS{}
+			require.NoError(t, extractor.Zip(context.Background(), bytes.NewReader(test.archive), tmp.String(), nil))
+			testWalk(t, tmp.String(), test.expected)
+		})
+	}
+}
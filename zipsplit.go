@@ -0,0 +1,301 @@
+package extract
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"sort"
+
+	"github.com/juju/errors"
+)
+
+const (
+	zipDirectoryHeaderSignature = 0x02014b50
+	zipDirectoryEndSignature    = 0x06054b50
+	zip64DirectoryEndSignature  = 0x06064b50
+	zip64LocatorSignature       = 0x07064b50
+	zipExtraZip64               = 0x0001
+)
+
+// ZipSplit extracts a zip archive split in many volumes (data.z01, data.z02, ...,
+// data.zip) in the specified location. The volumes must be given in order, with
+// the .zip one as the last.
+// It accepts a rename function to handle the names of the files (see the example)
+func (e *Extractor) ZipSplit(ctx context.Context, volumes []io.Reader, location string, rename Renamer) error {
+	joined, err := JoinZipVolumes(ctx, volumes)
+	if err != nil {
+		return err
+	}
+	return e.Zip(ctx, joined, location, rename)
+}
+
+// JoinZipVolumes presents the volumes of a split zip archive, given in order with
+// the .zip one as the last, as a single zip archive. The offsets of the central
+// directory, which are relative to the volume where every file starts, are
+// rewritten to point inside the joined archive.
+func JoinZipVolumes(ctx context.Context, volumes []io.Reader) (*io.SectionReader, error) {
+	if len(volumes) == 0 {
+		return nil, errors.New("No volumes")
+	}
+	parts := make([]io.ReaderAt, len(volumes))
+	sizes := make([]int64, len(volumes))
+	for i, volume := range volumes {
+		var err error
+		if parts[i], sizes[i], err = readerAt(ctx, volume); err != nil {
+			return nil, errors.Annotatef(err, "Read volume %d", i+1)
+		}
+	}
+	joined := newMultiReaderAt(parts, sizes)
+	last := len(volumes) - 1
+
+	end, err := readZipDirectoryEnd(parts[last], sizes[last])
+	if err != nil {
+		return nil, err
+	}
+	if int(end.disk) != last {
+		return nil, errors.Errorf("The archive has %d volumes, but %d were given", end.disk+1, len(volumes))
+	}
+	if int(end.directoryDisk) > last {
+		return nil, errors.New("Corrupted end of central directory")
+	}
+
+	// The directory must be inside the volumes before allocating it
+	available := uint64(joined.size - joined.offsets[end.directoryDisk])
+	if end.directoryOffset > available || end.directorySize > available-end.directoryOffset {
+		return nil, errors.New("Central directory outside of the volumes")
+	}
+	start := joined.offsets[end.directoryDisk] + int64(end.directoryOffset)
+	directory := make([]byte, end.directorySize)
+	if _, err := joined.ReadAt(directory, start); err != nil {
+		return nil, errors.Annotatef(err, "Read central directory")
+	}
+
+	// Rewrite every record of the central directory, moving it on the first disk
+	tail := &bytes.Buffer{}
+	for i := uint64(0); i < end.records; i++ {
+		record, size, err := rewriteZipDirectoryRecord(directory, joined.offsets)
+		if err != nil {
+			return nil, err
+		}
+		tail.Write(record)
+		directory = directory[size:]
+	}
+	directorySize := uint64(tail.Len())
+	directoryOffset := uint64(start)
+
+	le := binary.LittleEndian
+	records, size, offset := end.records, directorySize, directoryOffset
+	if records >= 0xffff || size >= 0xffffffff || offset >= 0xffffffff {
+		zip64End := uint64(start) + directorySize
+		record := le.AppendUint32(nil, zip64DirectoryEndSignature)
+		record = le.AppendUint64(record, 44)
+		record = le.AppendUint16(record, 45)
+		record = le.AppendUint16(record, 45)
+		record = le.AppendUint32(record, 0)
+		record = le.AppendUint32(record, 0)
+		record = le.AppendUint64(record, records)
+		record = le.AppendUint64(record, records)
+		record = le.AppendUint64(record, directorySize)
+		record = le.AppendUint64(record, directoryOffset)
+		record = le.AppendUint32(record, zip64LocatorSignature)
+		record = le.AppendUint32(record, 0)
+		record = le.AppendUint64(record, zip64End)
+		record = le.AppendUint32(record, 1)
+		tail.Write(record)
+		records, size, offset = min(records, 0xffff), min(size, 0xffffffff), min(offset, 0xffffffff)
+	}
+	record := le.AppendUint32(nil, zipDirectoryEndSignature)
+	record = le.AppendUint16(record, 0)
+	record = le.AppendUint16(record, 0)
+	record = le.AppendUint16(record, uint16(records))
+	record = le.AppendUint16(record, uint16(records))
+	record = le.AppendUint32(record, uint32(size))
+	record = le.AppendUint32(record, uint32(offset))
+	record = le.AppendUint16(record, uint16(len(end.comment)))
+	record = append(record, end.comment...)
+	tail.Write(record)
+
+	// The data before the central directory is left as it is
+	logical := newMultiReaderAt(
+		[]io.ReaderAt{joined, bytes.NewReader(tail.Bytes())},
+		[]int64{start, int64(tail.Len())},
+	)
+	return io.NewSectionReader(logical, 0, logical.size), nil
+}
+
+type zipDirectoryEnd struct {
+	disk, directoryDisk uint32
+	records             uint64
+	directorySize       uint64
+	directoryOffset     uint64
+	comment             []byte
+}
+
+// readZipDirectoryEnd reads the end of central directory record, and its zip64
+// version if present, from the last volume
+func readZipDirectoryEnd(r io.ReaderAt, size int64) (*zipDirectoryEnd, error) {
+	le := binary.LittleEndian
+	bufSize := min(size, 0xffff+22)
+	buf := make([]byte, bufSize)
+	if _, err := r.ReadAt(buf, size-bufSize); err != nil && err != io.EOF {
+		return nil, errors.Annotatef(err, "Read end of central directory")
+	}
+	pos := -1
+	for i := len(buf) - 22; i >= 0; i-- {
+		if le.Uint32(buf[i:]) == zipDirectoryEndSignature && i+22+int(le.Uint16(buf[i+20:])) <= len(buf) {
+			pos = i
+			break
+		}
+	}
+	if pos < 0 {
+		return nil, errors.New("Not a valid zip file: missing end of central directory")
+	}
+	b := buf[pos:]
+	end := &zipDirectoryEnd{
+		disk:            uint32(le.Uint16(b[4:])),
+		directoryDisk:   uint32(le.Uint16(b[6:])),
+		records:         uint64(le.Uint16(b[10:])),
+		directorySize:   uint64(le.Uint32(b[12:])),
+		directoryOffset: uint64(le.Uint32(b[16:])),
+		comment:         append([]byte{}, b[22:22+int(le.Uint16(b[20:]))]...),
+	}
+
+	// The zip64 locator precedes the record, and points to the zip64 record
+	// on the last disk
+	if pos < 20 || le.Uint32(buf[pos-20:]) != zip64LocatorSignature {
+		return end, nil
+	}
+	locator := buf[pos-20:]
+	offset := int64(le.Uint64(locator[8:]))
+	b = make([]byte, 56)
+	if _, err := r.ReadAt(b, offset); err != nil || le.Uint32(b) != zip64DirectoryEndSignature {
+		return nil, errors.New("Corrupted zip64 end of central directory")
+	}
+	end.disk = le.Uint32(b[16:])
+	end.directoryDisk = le.Uint32(b[20:])
+	end.records = le.Uint64(b[32:])
+	end.directorySize = le.Uint64(b[40:])
+	end.directoryOffset = le.Uint64(b[48:])
+	return end, nil
+}
+
+// rewriteZipDirectoryRecord returns a copy of the first record of the central
+// directory with the offset of the local header relative to the joined volumes.
+// It returns the size of the original record too.
+func rewriteZipDirectoryRecord(directory []byte, diskOffsets []int64) ([]byte, int, error) {
+	le := binary.LittleEndian
+	if len(directory) < 46 || le.Uint32(directory) != zipDirectoryHeaderSignature {
+		return nil, 0, errors.New("Corrupted central directory")
+	}
+	nameLen := int(le.Uint16(directory[28:]))
+	extraLen := int(le.Uint16(directory[30:]))
+	commentLen := int(le.Uint16(directory[32:]))
+	size := 46 + nameLen + extraLen + commentLen
+	if len(directory) < size {
+		return nil, 0, errors.New("Corrupted central directory")
+	}
+	header := append([]byte{}, directory[:46+nameLen]...)
+	extra := directory[46+nameLen : 46+nameLen+extraLen]
+	comment := directory[46+nameLen+extraLen : size]
+
+	disk := uint32(le.Uint16(header[34:]))
+	offset := uint64(le.Uint32(header[42:]))
+
+	// Read the zip64 fields, which are present only if the ones in the header are
+	// saturated, and remove them from the extra fields
+	var sizes []byte
+	otherExtra := []byte{}
+	for len(extra) >= 4 {
+		id := le.Uint16(extra)
+		fieldLen := int(le.Uint16(extra[2:]))
+		if 4+fieldLen > len(extra) {
+			break
+		}
+		field := extra[4 : 4+fieldLen]
+		if id != zipExtraZip64 {
+			otherExtra = append(otherExtra, extra[:4+fieldLen]...)
+			extra = extra[4+fieldLen:]
+			continue
+		}
+		for _, pos := range []int{24, 20} {
+			if le.Uint32(header[pos:]) == 0xffffffff && len(field) >= 8 {
+				sizes = append(sizes, field[:8]...)
+				field = field[8:]
+			}
+		}
+		if offset == 0xffffffff && len(field) >= 8 {
+			offset = le.Uint64(field)
+			field = field[8:]
+		}
+		if disk == 0xffff && len(field) >= 4 {
+			disk = le.Uint32(field)
+		}
+		extra = extra[4+fieldLen:]
+	}
+	if int(disk) >= len(diskOffsets) {
+		return nil, 0, errors.Errorf("Missing volume %d", disk+1)
+	}
+	offset += uint64(diskOffsets[disk])
+
+	zip64 := sizes
+	if offset >= 0xffffffff {
+		zip64 = le.AppendUint64(zip64, offset)
+		offset = 0xffffffff
+	}
+	if len(zip64) > 0 {
+		otherExtra = append(le.AppendUint16(le.AppendUint16(nil, zipExtraZip64), uint16(len(zip64))), append(zip64, otherExtra...)...)
+	}
+	le.PutUint16(header[30:], uint16(len(otherExtra)))
+	le.PutUint16(header[34:], 0)
+	le.PutUint32(header[42:], uint32(offset))
+
+	record := append(header, otherExtra...)
+	record = append(record, comment...)
+	return record, size, nil
+}
+
+// multiReaderAt is the logical concatenation of many io.ReaderAt
+type multiReaderAt struct {
+	parts   []io.ReaderAt
+	offsets []int64
+	size    int64
+}
+
+func newMultiReaderAt(parts []io.ReaderAt, sizes []int64) *multiReaderAt {
+	m := &multiReaderAt{parts: parts}
+	for _, size := range sizes {
+		m.offsets = append(m.offsets, m.size)
+		m.size += size
+	}
+	return m
+}
+
+func (m *multiReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("Negative offset")
+	}
+	read := 0
+	// Find the last part that starts before the offset
+	i := sort.Search(len(m.offsets), func(i int) bool { return m.offsets[i] > off }) - 1
+	for ; i < len(m.parts) && read < len(p); i++ {
+		end := m.size
+		if i+1 < len(m.offsets) {
+			end = m.offsets[i+1]
+		}
+		want := min(int64(len(p)-read), end-off)
+		if want <= 0 {
+			continue
+		}
+		n, err := m.parts[i].ReadAt(p[read:read+int(want)], off-m.offsets[i])
+		read += n
+		off += int64(n)
+		if err != nil && !(err == io.EOF && int64(n) == want) {
+			return read, err
+		}
+	}
+	if read < len(p) {
+		return read, io.EOF
+	}
+	return read, nil
+}
@@ -0,0 +1,73 @@
+package extract_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/codeclysm/extract/v5"
+	"github.com/stretchr/testify/require"
+)
+
+func openVolumes(t *testing.T, paths ...string) []io.Reader {
+	volumes := []io.Reader{}
+	for _, path := range paths {
+		f, err := os.Open(path)
+		require.NoError(t, err)
+		t.Cleanup(func() { f.Close() })
+		volumes = append(volumes, f)
+	}
+	return volumes
+}
+
+func TestZipSplit(t *testing.T) {
+	t.Run("Volumes", func(t *testing.T) {
+		tmp := mkTempDir(t)
+		volumes := openVolumes(t, "testdata/split.z01", "testdata/split.zip")
+		require.NoError(t, extract.ZipSplit(context.Background(), volumes, tmp.String(), nil))
+		testWalk(t, tmp.String(), Files{
+			"":                        "dir",
+			"/split":                  "dir",
+			"/split/big.txt":          strings.Repeat("0123456789", 7000),
+			"/split/folder":           "dir",
+			"/split/folder/file1.txt": "File1",
+		})
+	})
+
+	t.Run("Joined", func(t *testing.T) {
+		tmp := mkTempDir(t)
+		volumes := openVolumes(t, "testdata/split.z01", "testdata/split.zip")
+		joined, err := extract.JoinZipVolumes(context.Background(), volumes)
+		require.NoError(t, err)
+		require.NoError(t, extract.Archive(context.Background(), joined, tmp.String(), nil))
+		require.FileExists(t, tmp.Join("split", "folder", "file1.txt").String())
+	})
+
+	t.Run("SingleVolume", func(t *testing.T) {
+		tmp := mkTempDir(t)
+		volumes := openVolumes(t, "testdata/archive.zip")
+		require.NoError(t, extract.ZipSplit(context.Background(), volumes, tmp.String(), nil))
+		require.FileExists(t, tmp.Join("archive", "folder", "file1.txt").String())
+	})
+
+	t.Run("MissingVolume", func(t *testing.T) {
+		tmp := mkTempDir(t)
+		volumes := openVolumes(t, "testdata/split.zip")
+		require.Error(t, extract.ZipSplit(context.Background(), volumes, tmp.String(), nil))
+	})
+
+	t.Run("HugeDirectory", func(t *testing.T) {
+		tmp := mkTempDir(t)
+		last, err := os.ReadFile("testdata/split.zip")
+		require.NoError(t, err)
+		end := bytes.LastIndex(last, []byte("PK\x05\x06"))
+		binary.LittleEndian.PutUint32(last[end+12:], 0xfffffff0)
+		volumes := append(openVolumes(t, "testdata/split.z01"), bytes.NewReader(last))
+		err = extract.ZipSplit(context.Background(), volumes, tmp.String(), nil)
+		require.ErrorContains(t, err, "Central directory outside of the volumes")
+	})
+}
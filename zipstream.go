@@ -0,0 +1,420 @@
+package extract
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+const (
+	zipLocalHeaderSignature    = 0x04034b50
+	zipDataDescriptorSignature = 0x08074b50
+
+	// zipStreamLinkSize is the maximum size of the entries kept in memory while
+	// streaming, in case the central directory says they're symlinks
+	zipStreamLinkSize = 4096
+	// zipStreamLinkMemory is the maximum memory used to keep them
+	zipStreamLinkMemory = 16 << 20
+)
+
+// zipStreamEntry is an entry read from its local header
+type zipStreamEntry struct {
+	header zip.FileHeader
+	name   string
+	path   string
+	dir    bool
+	data   []byte
+}
+
+// zipStream extracts a zip archive reading the entries from their local headers
+// as the data arrives. The central directory at the end is used to restore the
+// modes of the files and the symlinks, and to verify the entries if needed.
+func (e *Extractor) zipStream(ctx context.Context, body io.Reader, location string, rename Renamer) error {
+	counter := &countingReader{r: body}
+	r := bufio.NewReaderSize(counter, 1<<16)
+	collisions := e.newCollisions(location)
+	writers := e.newWriters(ctx)
+	defer writers.wait()
+
+	entries := []*zipStreamEntry{}
+	kept := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return errors.New("interrupted")
+		default:
+		}
+
+		b, err := r.Peek(4)
+		if err != nil && (err != io.EOF || len(b) > 0) {
+			return errors.Annotatef(unexpectedEOF(err), "Read the zip file")
+		}
+		signature := uint32(0)
+		if len(b) == 4 {
+			signature = binary.LittleEndian.Uint32(b)
+		}
+		switch {
+		case signature == zipLocalHeaderSignature:
+		case signature == zipDataDescriptorSignature && counter.n == int64(r.Buffered()):
+			// The marker of split archives, at the start of the first volume
+			r.Discard(4)
+			continue
+		case signature == zipDirectoryHeaderSignature || signature == zipDirectoryEndSignature || len(b) == 0:
+			if err := writers.wait(); err != nil {
+				return err
+			}
+			return e.zipStreamDirectory(ctx, r, counter.n-int64(r.Buffered()), location, entries)
+		default:
+			return errors.New("Read the zip file: not a valid zip stream")
+		}
+
+		entry, err := readZipLocalHeader(r)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, entry)
+
+		file := &zip.File{FileHeader: entry.header}
+		entry.name = zipNames([]*zip.File{file}, e.ZipEncoding)[file]
+		path, forceDir, ok := zipPath(entry.name, location, rename)
+		entry.dir = forceDir || strings.HasSuffix(entry.header.Name, "/")
+		if ok {
+			if path, ok, err = collisions.add(path); err != nil {
+				return err
+			}
+		}
+		if ok {
+			entry.path = path
+		}
+
+		src, err := e.zipStreamData(r, entry)
+		if err != nil {
+			return errors.Annotatef(err, "Open file %s", entry.header.Name)
+		}
+		// Small files are kept in case they're symlinks
+		keep := &cappedBuffer{max: min(zipStreamLinkSize, zipStreamLinkMemory-kept)}
+		src = io.TeeReader(src, keep)
+
+		switch {
+		case !ok:
+		case entry.dir:
+			if err := e.FS.MkdirAll(path, 0755); err != nil {
+				return errors.Annotatef(err, "Create directory %s", path)
+			}
+		case entry.header.Flags&zipFlagDataDescriptor == 0:
+			if err := writers.write(path, 0666, src, int64(entry.header.UncompressedSize64)); err != nil {
+				return err
+			}
+		default:
+			// The size is known only at the end of the data, so the file can't be
+			// buffered and must be written before reading the next one
+			if err := writers.write(path, 0666, src, -1); err != nil {
+				return err
+			}
+			if err := writers.wait(); err != nil {
+				return err
+			}
+		}
+		// Read what's left of the entry, verifying it, to arrive at the next one
+		if _, err := io.Copy(io.Discard, src); err != nil {
+			return errors.Annotatef(err, "Read file %s", entry.header.Name)
+		}
+		if ok && !entry.dir && !keep.full {
+			entry.data = keep.Bytes()
+			kept += len(entry.data)
+		}
+	}
+}
+
+// zipStreamData returns the decompressed data of an entry, followed by its data
+// descriptor if any
+func (e *Extractor) zipStreamData(r *bufio.Reader, entry *zipStreamEntry) (io.Reader, error) {
+	header := &entry.header
+	if header.Flags&zipFlagDataDescriptor != 0 && header.CompressedSize64 == 0 {
+		// The size is unknown, only deflate can find the end of the data by itself
+		if header.Method != zip.Deflate || header.Flags&zipFlagEncrypted != 0 {
+			return nil, errors.Errorf("The size of the data is unknown, compression method %d can't be streamed", header.Method)
+		}
+		return &zipStreamReader{r: flate.NewReader(r), br: r, entry: entry, hash: crc32.NewIEEE(), check: true}, nil
+	}
+
+	raw := io.LimitReader(r, int64(header.CompressedSize64))
+	data, err := e.decodeZip(&zip.File{FileHeader: *header}, entry.name, raw)
+	if err != nil {
+		return nil, err
+	}
+	if header.Flags&zipFlagDataDescriptor == 0 {
+		return io.MultiReader(data, &drainReader{raw}), nil
+	}
+	// The crc is in the data descriptor, it's verified after reading it
+	checksum, check := data.(*zipChecksumReader)
+	if check {
+		data = checksum.ReadCloser
+	}
+	return &zipStreamReader{r: data, raw: raw, br: r, entry: entry, hash: crc32.NewIEEE(), check: check}, nil
+}
+
+// zipStreamDirectory reads the central directory at offset, restoring the modes
+// and the symlinks of the entries and verifying them if needed
+func (e *Extractor) zipStreamDirectory(ctx context.Context, r io.Reader, offset int64, location string, entries []*zipStreamEntry) error {
+	tail := &bytes.Buffer{}
+	if _, err := copyCancel(ctx, tail, r); err != nil {
+		return errors.Annotatef(err, "Read the central directory")
+	}
+	// The data before the central directory isn't needed to read it
+	archive, err := zip.NewReader(newMultiReaderAt(
+		[]io.ReaderAt{zeroReaderAt{}, bytes.NewReader(tail.Bytes())},
+		[]int64{offset, int64(tail.Len())},
+	), offset+int64(tail.Len()))
+	if err != nil {
+		if e.VerifyZipDirectory {
+			return errors.Annotatef(err, "Read the central directory")
+		}
+		return nil
+	}
+
+	if e.VerifyZipDirectory {
+		if len(archive.File) != len(entries) {
+			return errors.Errorf("The central directory has %d entries, but the archive has %d", len(archive.File), len(entries))
+		}
+		for i, header := range archive.File {
+			local := entries[i].header
+			if header.Name != local.Name || header.CRC32 != local.CRC32 ||
+				header.CompressedSize64 != local.CompressedSize64 || header.UncompressedSize64 != local.UncompressedSize64 {
+				return errors.Errorf("The entry %s doesn't match the central directory", header.Name)
+			}
+		}
+	}
+
+	// The entries are matched by their position, or by their name
+	byName := map[string]*zipStreamEntry{}
+	for _, entry := range entries {
+		byName[entry.header.Name] = entry
+	}
+	links := []*link{}
+	for i, header := range archive.File {
+		entry := byName[header.Name]
+		if i < len(entries) && entries[i].header.Name == header.Name {
+			entry = entries[i]
+		}
+		if entry == nil || entry.path == "" {
+			continue
+		}
+		mode := header.Mode()
+		switch {
+		case entry.dir:
+			if err := e.FS.Chmod(entry.path, e.Modes.apply(mode|os.ModeDir)|0100); err != nil {
+				return errors.Annotatef(err, "Set permissions %s", entry.path)
+			}
+		// We only check for symlinks because hard links aren't possible
+		case mode&os.ModeSymlink != 0:
+			if entry.data == nil {
+				return errors.Errorf("Read address of link %s: the link is too long", entry.path)
+			}
+			links = append(links, &link{Path: entry.path, Name: string(entry.data)})
+		default:
+			if err := e.FS.Chmod(entry.path, e.Modes.perm(mode)); err != nil {
+				return errors.Annotatef(err, "Set permissions %s", entry.path)
+			}
+		}
+	}
+	return e.extractSymlinks(ctx, location, links)
+}
+
+// readZipLocalHeader reads the local header of an entry
+func readZipLocalHeader(r io.Reader) (*zipStreamEntry, error) {
+	le := binary.LittleEndian
+	b := make([]byte, 30)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, errors.Annotatef(unexpectedEOF(err), "Read local header")
+	}
+	nameLen := int(le.Uint16(b[26:]))
+	rest := make([]byte, nameLen+int(le.Uint16(b[28:])))
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return nil, errors.Annotatef(unexpectedEOF(err), "Read local header")
+	}
+
+	header := zip.FileHeader{
+		ReaderVersion:      le.Uint16(b[4:]),
+		Flags:              le.Uint16(b[6:]),
+		Method:             le.Uint16(b[8:]),
+		ModifiedTime:       le.Uint16(b[10:]),
+		ModifiedDate:       le.Uint16(b[12:]),
+		CRC32:              le.Uint32(b[14:]),
+		CompressedSize64:   uint64(le.Uint32(b[18:])),
+		UncompressedSize64: uint64(le.Uint32(b[22:])),
+		Name:               string(rest[:nameLen]),
+		Extra:              rest[nameLen:],
+	}
+	header.Modified = msDosTime(header.ModifiedDate, header.ModifiedTime)
+
+	// The zip64 field stores the sizes that don't fit in the header, the
+	// uncompressed one first
+	if field, ok := zipExtraField(header.Extra, zipExtraZip64); ok {
+		for _, value := range []*uint64{&header.UncompressedSize64, &header.CompressedSize64} {
+			if *value == 0xffffffff && len(field) >= 8 {
+				*value, field = le.Uint64(field), field[8:]
+			}
+		}
+	}
+	return &zipStreamEntry{header: header}, nil
+}
+
+// readZipDataDescriptor reads the data descriptor following the data of an
+// entry, updating its header
+func readZipDataDescriptor(r *bufio.Reader, entry *zipStreamEntry) error {
+	le := binary.LittleEndian
+	if b, err := r.Peek(4); err == nil && le.Uint32(b) == zipDataDescriptorSignature {
+		r.Discard(4)
+	}
+
+	// The sizes take 8 bytes in zip64 archives
+	_, zip64 := zipExtraField(entry.header.Extra, zipExtraZip64)
+	b := make([]byte, 12)
+	if zip64 {
+		b = make([]byte, 20)
+	}
+	if _, err := io.ReadFull(r, b); err != nil {
+		return errors.Annotatef(unexpectedEOF(err), "Read data descriptor")
+	}
+	header := &entry.header
+	crc, compressed, uncompressed := le.Uint32(b), uint64(le.Uint32(b[4:])), uint64(le.Uint32(b[8:]))
+	if zip64 {
+		compressed, uncompressed = le.Uint64(b[4:]), le.Uint64(b[12:])
+	}
+	if header.CompressedSize64 > 0 && compressed != header.CompressedSize64 {
+		return errors.New("The data descriptor doesn't match the local header")
+	}
+	header.CRC32, header.CompressedSize64, header.UncompressedSize64 = crc, compressed, uncompressed
+	return nil
+}
+
+// zipExtraField returns the field of an extra block with the given id
+func zipExtraField(extra []byte, id uint16) ([]byte, bool) {
+	for len(extra) >= 4 {
+		fieldID, size := binary.LittleEndian.Uint16(extra), int(binary.LittleEndian.Uint16(extra[2:]))
+		if 4+size > len(extra) {
+			break
+		}
+		if fieldID == id {
+			return extra[4 : 4+size], true
+		}
+		extra = extra[4+size:]
+	}
+	return nil, false
+}
+
+// zipStreamReader reads the data of an entry followed by a data descriptor,
+// verifying the data against it when the end is reached
+type zipStreamReader struct {
+	r     io.Reader
+	raw   io.Reader
+	br    *bufio.Reader
+	entry *zipStreamEntry
+	hash  hash32
+	check bool
+	size  uint64
+	err   error
+}
+
+type hash32 interface {
+	io.Writer
+	Sum32() uint32
+}
+
+func (z *zipStreamReader) Read(p []byte) (int, error) {
+	if z.err != nil {
+		return 0, z.err
+	}
+	n, err := z.r.Read(p)
+	z.hash.Write(p[:n])
+	z.size += uint64(n)
+	if err == io.EOF {
+		err = z.end()
+	}
+	z.err = err
+	return n, err
+}
+
+func (z *zipStreamReader) end() error {
+	if z.raw != nil {
+		if _, err := io.Copy(io.Discard, z.raw); err != nil {
+			return err
+		}
+	}
+	if err := readZipDataDescriptor(z.br, z.entry); err != nil {
+		return err
+	}
+	header := z.entry.header
+	if header.UncompressedSize64 != z.size || (z.check && header.CRC32 != z.hash.Sum32()) {
+		return zip.ErrChecksum
+	}
+	return io.EOF
+}
+
+// drainReader reads the rest of r when it's read to the end
+type drainReader struct {
+	r io.Reader
+}
+
+func (d *drainReader) Read(p []byte) (int, error) {
+	if _, err := io.Copy(io.Discard, d.r); err != nil {
+		return 0, err
+	}
+	return 0, io.EOF
+}
+
+// cappedBuffer keeps what's written to it until it exceeds max bytes
+type cappedBuffer struct {
+	bytes.Buffer
+	max  int
+	full bool
+}
+
+func (c *cappedBuffer) Write(p []byte) (int, error) {
+	if c.full || c.Len()+len(p) > c.max {
+		c.full = true
+		c.Reset()
+		return len(p), nil
+	}
+	return c.Buffer.Write(p)
+}
+
+// countingReader counts the bytes read
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// zeroReaderAt reads zeros at every position
+type zeroReaderAt struct{}
+
+func (zeroReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// msDosTime converts an MS-DOS date and time
+func msDosTime(date, t uint16) time.Time {
+	return time.Date(
+		int(date>>9+1980), time.Month(date>>5&0xf), int(date&0x1f),
+		int(t>>11), int(t>>5&0x3f), int(t&0x1f*2),
+		0, time.UTC,
+	)
+}
@@ -0,0 +1,111 @@
+package extract_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"hash/crc32"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/codeclysm/extract/v5"
+	"github.com/codeclysm/extract/v5/extracttest"
+	"github.com/stretchr/testify/require"
+)
+
+// makeStreamedZip builds a zip like a streaming writer does, with the sizes and
+// the crc of the deflated entries in data descriptors after their data
+func makeStreamedZip() []byte {
+	buf := &bytes.Buffer{}
+	w := zip.NewWriter(buf)
+	w.CreateHeader(&zip.FileHeader{Name: "dir/", Method: zip.Store})
+	f, _ := w.Create("dir/file.txt")
+	f.Write(bytes.Repeat([]byte("File "), 1000))
+	header := &zip.FileHeader{Name: "dir/run.sh", Method: zip.Deflate}
+	header.SetMode(0755)
+	f, _ = w.CreateHeader(header)
+	f.Write([]byte("#!/bin/sh"))
+	header = &zip.FileHeader{Name: "dir/link.txt", Method: zip.Deflate}
+	header.SetMode(os.ModeSymlink | 0777)
+	f, _ = w.CreateHeader(header)
+	f.Write([]byte("file.txt"))
+	// Stored entries can be streamed only if their size is in the local header
+	stored := []byte("Stored")
+	f, _ = w.CreateRaw(&zip.FileHeader{
+		Name:               "stored.txt",
+		Method:             zip.Store,
+		CRC32:              crc32.ChecksumIEEE(stored),
+		CompressedSize64:   uint64(len(stored)),
+		UncompressedSize64: uint64(len(stored)),
+	})
+	f.Write(stored)
+	w.Close()
+	return buf.Bytes()
+}
+
+func TestZipStream(t *testing.T) {
+	expected := Files{
+		"":              "dir",
+		"/dir":          "dir",
+		"/dir/file.txt": string(bytes.TrimSpace(bytes.Repeat([]byte("File "), 1000))),
+		"/dir/run.sh":   "#!/bin/sh",
+		"/dir/link.txt": "link",
+		"/stored.txt":   "Stored",
+	}
+
+	for _, writers := range []int{0, 4} {
+		tmp := mkTempDir(t)
+		extractor := extract.Extractor{FS: &extracttest.LoggingFS{}, StreamZip: true, VerifyZipDirectory: true, Writers: writers}
+		body := struct{ io.Reader }{bytes.NewReader(makeStreamedZip())}
+		require.NoError(t, extractor.Zip(context.Background(), body, tmp.String(), nil))
+		testWalk(t, tmp.String(), expected)
+
+		info, err := os.Stat(tmp.Join("dir", "run.sh").String())
+		require.NoError(t, err)
+		require.Equal(t, os.FileMode(0755), info.Mode().Perm())
+		link, err := os.Readlink(tmp.Join("dir", "link.txt").String())
+		require.NoError(t, err)
+		require.Equal(t, "file.txt", link)
+	}
+
+	t.Run("NoDirectory", func(t *testing.T) {
+		archive := makeStreamedZip()
+		end := bytes.Index(archive, []byte{0x50, 0x4b, 0x01, 0x02})
+		archive = archive[:end]
+
+		extractor := extract.Extractor{FS: &extracttest.LoggingFS{}, StreamZip: true, VerifyZipDirectory: true}
+		err := extractor.Zip(context.Background(), struct{ io.Reader }{bytes.NewReader(archive)}, mkTempDir(t).String(), nil)
+		require.ErrorContains(t, err, "central directory")
+
+		// Without the central directory the files are extracted anyway
+		tmp := mkTempDir(t)
+		extractor = extract.Extractor{FS: &extracttest.LoggingFS{}, StreamZip: true}
+		require.NoError(t, extractor.Zip(context.Background(), struct{ io.Reader }{bytes.NewReader(archive)}, tmp.String(), nil))
+		expected := Files{
+			"":              "dir",
+			"/dir":          "dir",
+			"/dir/file.txt": expected["/dir/file.txt"],
+			"/dir/run.sh":   "#!/bin/sh",
+			"/dir/link.txt": "file.txt",
+			"/stored.txt":   "Stored",
+		}
+		testWalk(t, tmp.String(), expected)
+	})
+
+	t.Run("Corrupted", func(t *testing.T) {
+		archive := makeStreamedZip()
+		archive[bytes.Index(archive, []byte("Stored"))] = 's'
+		extractor := extract.Extractor{FS: &extracttest.LoggingFS{}, StreamZip: true}
+		err := extractor.Zip(context.Background(), struct{ io.Reader }{bytes.NewReader(archive)}, mkTempDir(t).String(), nil)
+		require.ErrorContains(t, err, zip.ErrChecksum.Error())
+	})
+
+	t.Run("Spill", func(t *testing.T) {
+		tmp := mkTempDir(t)
+		extractor := extract.Extractor{FS: &extracttest.LoggingFS{}, SpillThreshold: 100}
+		body := struct{ io.Reader }{bytes.NewReader(makeStreamedZip())}
+		require.NoError(t, extractor.Zip(context.Background(), body, tmp.String(), nil))
+		testWalk(t, tmp.String(), expected)
+	})
+}